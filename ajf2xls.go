@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// ajf2xls implements the "ajf2xls" command, which converts ajf forms back to xlsforms.
+func ajf2xls(args []string) error {
+	fs := flag.NewFlagSet("ajf2xls", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `formconv ajf2xls converts ajf forms back to xlsforms. Usage:
+formconv ajf2xls form1.json form2.json`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	for _, ajfName := range fs.Args() {
+		data, err := ioutil.ReadFile(ajfName)
+		if err != nil {
+			return err
+		}
+		var ajf formats.AjfForm
+		if err := json.Unmarshal(data, &ajf); err != nil {
+			return fmt.Errorf("Error decoding file %s: %s", ajfName, err)
+		}
+		xls, err := formats.Ajf2xls(&ajf)
+		if err != nil {
+			return fmt.Errorf("%s, %s", ajfName, err)
+		}
+		xlsName := ajfName[0:len(ajfName)-len(filepath.Ext(ajfName))] + ".xlsx"
+		if _, err := os.Stat(xlsName); err == nil {
+			return fmt.Errorf("File %s already exists.", xlsName)
+		}
+		if err := formats.EncXlsxToFile(xlsName, xls); err != nil {
+			return fmt.Errorf("Error encoding file %s: %s", xlsName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// anonymize implements the "anonymize" command, which writes copies of xlsforms
+// without the details of their sensitive questions, as xlsform and as ajf.
+func anonymize(args []string) error {
+	fs := flag.NewFlagSet("anonymize", flag.ExitOnError)
+	var aopts formats.AnonymizeOptions
+	fs.BoolVar(&aopts.Hash, "hash", false,
+		"replace the sensitive questions with hashed placeholders, instead of removing them")
+	fs.StringVar(&aopts.Salt, "salt", "", "secret mixed into the hashes, so that question names can't be guessed")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `formconv anonymize copies xlsforms without the questions flagged in the sensitive column,
+writing form_anonymized.xlsx and form_anonymized.json. Usage:
+formconv anonymize [-hash] [-salt secret] form1.xlsx form2.xlsx`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	for _, xlsName := range fs.Args() {
+		wb, err := openWorkBook(xlsName)
+		if err != nil {
+			return fmt.Errorf("Error opening workbook: %s", err)
+		}
+		xls, err := formats.DecXlsform(wb)
+		if err != nil {
+			return fmt.Errorf("Error decoding file %s: %s", xlsName, err)
+		}
+		if err := formats.LoadExternalChoices(xls, filepath.Dir(xlsName)); err != nil {
+			return fmt.Errorf("%s, %s", xlsName, err)
+		}
+		anon, warnings, err := formats.Anonymize(xls, aopts)
+		if err != nil {
+			return fmt.Errorf("%s, %s", xlsName, err)
+		}
+		for _, w := range warnings {
+			fmt.Fprintf(os.Stderr, "%s, warning: %s\n", xlsName, w)
+		}
+		ajf, _, err := formats.Convert(anon, opts)
+		if err != nil {
+			return fmt.Errorf("%s, error converting the anonymized form: %s", xlsName, err)
+		}
+
+		name := xlsName[0:len(xlsName)-len(filepath.Ext(xlsName))] + "_anonymized"
+		if _, err := os.Stat(name + ".xlsx"); err == nil {
+			return fmt.Errorf("File %s.xlsx already exists.", name)
+		}
+		// The external choices are left in their files, which are not shared.
+		sheetChoices := anon.Choices[:0:0]
+		for _, c := range anon.Choices {
+			if c.File == "" {
+				sheetChoices = append(sheetChoices, c)
+			}
+		}
+		anon.Choices = sheetChoices
+		if err := formats.EncXlsxToFile(name+".xlsx", anon); err != nil {
+			return fmt.Errorf("Error encoding file %s.xlsx: %s", name, err)
+		}
+		if err := formats.EncJsonToFile(name+".json", ajf); err != nil {
+			return fmt.Errorf("Error encoding file %s.json: %s", name, err)
+		}
+	}
+	return nil
+}
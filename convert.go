@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+var (
+	outDir string // when not empty, the output files are written here
+	quiet  bool   // don't print warnings
+)
+
+// errSkipped is the error of the forms not converted because of -fail-fast.
+var errSkipped = errors.New("skipped")
+
+// outputNames reserves the output names of the forms converted by batchConvert.
+// When two forms have the same output name, the first one in the order of the arguments
+// gets it, however long the conversions take: a form can reserve its name only after
+// the preceding ones have reserved theirs, or ended without reaching that point.
+type outputNames struct {
+	mu       sync.Mutex
+	reserved map[string]bool
+	settled  []chan struct{} // closed when the form with the same index has settled
+	once     []sync.Once
+}
+
+func newOutputNames(n int) *outputNames {
+	o := &outputNames{
+		reserved: make(map[string]bool),
+		settled:  make([]chan struct{}, n),
+		once:     make([]sync.Once, n),
+	}
+	for i := range o.settled {
+		o.settled[i] = make(chan struct{})
+	}
+	return o
+}
+
+// reserve records that the output files with the given name are written by the i-th form,
+// returning false if they were already reserved by a preceding one.
+func (o *outputNames) reserve(i int, name string) bool {
+	for _, c := range o.settled[:i] {
+		<-c
+	}
+	o.mu.Lock()
+	ok := !o.reserved[name]
+	o.reserved[name] = true
+	o.mu.Unlock()
+	o.settle(i)
+	return ok
+}
+
+// settle records that the i-th form won't reserve a name, or has already done so.
+func (o *outputNames) settle(i int) {
+	o.once[i].Do(func() { close(o.settled[i]) })
+}
+
+// batchConvert implements the "convert" command, which converts many forms
+// to an output directory. The forms are converted concurrently, each with its
+// own log, and reported in the order given; a failure doesn't stop the others,
+// unless -fail-fast is set. It returns the exit status: 0 if all the forms
+// were converted, 1 if some failed, 2 for usage errors.
+func batchConvert(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `formconv convert converts xlsforms to ajf files named after their form_id. Usage:
+formconv convert [flags] -o outdir form1.xlsx form2.xlsx`)
+		fs.PrintDefaults()
+	}
+	applyFlags := convFlags(fs)
+	fs.StringVar(&outDir, "o", ".", "output directory")
+	failFast := fs.Bool("fail-fast", false, "stop at the first form that can't be converted")
+	fs.BoolVar(&quiet, "quiet", false, "don't print warnings, only errors")
+	jobs := fs.Int("j", runtime.GOMAXPROCS(0), "number of forms converted at the same time")
+	fs.Parse(args)
+	if err := applyFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *jobs < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid value %d for flag -j.\n", *jobs)
+		return 2
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	files := fs.Args()
+	names := newOutputNames(len(files))
+	logs := make([]bytes.Buffer, len(files))
+	var (
+		mu     sync.Mutex
+		failed bool
+	)
+	results := formats.ConvertAllWith(files, *jobs, func(i int, fileName string) formats.Result {
+		defer names.settle(i)
+		mu.Lock()
+		stop := failed && *failFast
+		mu.Unlock()
+		if stop {
+			return formats.Result{Path: fileName, Err: errSkipped}
+		}
+		err := decXlsEncAjf(fileName, &logs[i], func(name string) bool { return names.reserve(i, name) })
+		if err != nil {
+			mu.Lock()
+			failed = true
+			mu.Unlock()
+		}
+		return formats.Result{Path: fileName, Err: err}
+	})
+	return report(results, logs)
+}
+
+// report prints the warnings and errors of the forms converted by batchConvert,
+// followed by a summary, and returns the exit status.
+func report(results []formats.Result, logs []bytes.Buffer) int {
+	var failed, skipped []string
+	for i, res := range results {
+		if res.Err == errSkipped {
+			skipped = append(skipped, res.Path)
+			continue
+		}
+		os.Stderr.Write(logs[i].Bytes())
+		if res.Err != nil {
+			fmt.Fprintln(os.Stderr, res.Err)
+			failed = append(failed, res.Path)
+		}
+	}
+	converted := len(results) - len(failed) - len(skipped)
+	if len(failed) == 0 && len(skipped) == 0 {
+		if len(results) > 1 {
+			fmt.Fprintf(os.Stderr, "%d forms converted.\n", converted)
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%d forms converted, %d failed", converted, len(failed))
+	if len(skipped) > 0 {
+		fmt.Fprintf(os.Stderr, ", %d skipped", len(skipped))
+	}
+	fmt.Fprintln(os.Stderr, ".")
+	for _, f := range failed {
+		fmt.Fprintf(os.Stderr, "failed: %s\n", f)
+	}
+	return 1
+}
+
+// outputName returns the name of the output files of a form:
+// its form_id, if it can be used as a file name, or the name of the input file.
+func outputName(fileName, formId string) string {
+	if formId == "" || formId != filepath.Base(formId) || formId == "." || formId == ".." {
+		return fileName
+	}
+	return formId
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// deps implements the "deps" command, which lists the cells of an xlsform
+// referencing a question, to be updated when the question is renamed or deleted.
+func deps(args []string) error {
+	fs := flag.NewFlagSet("deps", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `formconv deps lists the formulas, labels and types referencing a question,
+directly or through calculations. Usage:
+formconv deps form.xlsx question_name`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	xlsName, name := fs.Arg(0), fs.Arg(1)
+	wb, err := openWorkBook(xlsName)
+	if err != nil {
+		return fmt.Errorf("Error opening workbook: %s", err)
+	}
+	xls, err := formats.DecXlsform(wb)
+	if err != nil {
+		return fmt.Errorf("Error decoding file %s: %s", xlsName, err)
+	}
+	found := false
+	for _, row := range xls.Survey {
+		found = found || row.Name == name
+	}
+	if !found {
+		return fmt.Errorf("Question %q not found in %s.", name, xlsName)
+	}
+	for _, d := range formats.Dependents(xls, name) {
+		fmt.Println(d)
+	}
+	return nil
+}
@@ -5,11 +5,22 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"sort"
 )
 
 type AjfForm struct {
-	ChoicesOrigins []ChoicesOrigin `json:"choicesOrigins,omitempty"`
-	Slides         []Node          `json:"nodes"`
+	Title           string          `json:"title,omitempty"`
+	FormId          string          `json:"formId,omitempty"`
+	Version         string          `json:"version,omitempty"`
+	DefaultLanguage string          `json:"defaultLanguage,omitempty"`
+	ChoicesOrigins  []ChoicesOrigin `json:"choicesOrigins,omitempty"`
+	Slides          []Node          `json:"nodes"`
+	// NameMapping maps the names of the xlsform questions to the names of the ajf nodes,
+	// which may differ as ajf requires names that are valid JavaScript identifiers.
+	NameMapping map[string]string `json:"nameMapping,omitempty"`
+	// Translations can contain the translations of the form (see the Translations function),
+	// making the ajf form self-contained.
+	Translations map[string]map[string]string `json:"translations,omitempty"`
 }
 
 type ChoicesOrigin struct {
@@ -17,19 +28,38 @@ type ChoicesOrigin struct {
 	Name        string     `json:"name"`
 	ChoicesType ChoiceType `json:"choicesType"`
 	Choices     []Choice   `json:"choices"`
+	RepeatRef   string     `json:"repeatRef,omitempty"`
+	FieldRef    string     `json:"fieldRef,omitempty"`
+	// Provenance, if requested, contains the source of each choice, in the same order.
+	Provenance []ChoiceSource `json:"provenance,omitempty"`
+}
+
+// ChoiceSource is the cell of the spreadsheets where a choice is defined.
+type ChoiceSource struct {
+	File  string `json:"file,omitempty"`  // the external file, empty for the xlsform
+	Sheet string `json:"sheet,omitempty"` // empty for csv files and generated choices
+	Line  int    `json:"line,omitempty"`  // zero for the choices generated by the converter
 }
 
 type OriginType string
 
-const OtFixed OriginType = "fixed"
+const (
+	OtFixed OriginType = "fixed"
+	// OtRepeat origins have as choices the answers given to the field FieldRef
+	// in the repetitions of the repeating slide RepeatRef.
+	OtRepeat OriginType = "repeat"
+)
 
 type ChoiceType string
 
 const CtString ChoiceType = "string"
 
 type Choice struct {
-	Value string `json:"value"`
-	Label string `json:"label"`
+	Value      string            `json:"value"`
+	Label      string            `json:"label"`
+	Image      string            `json:"image,omitempty"` // file names or urls, as in the xlsform
+	Audio      string            `json:"audio,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
 }
 
 type Node struct {
@@ -39,11 +69,29 @@ type Node struct {
 	Label    string   `json:"label"`
 	Type     NodeType `json:"nodeType"`
 
+	Hint             string           `json:"hint,omitempty"`
+	Description      string           `json:"description,omitempty"`
 	FieldType        *FieldType       `json:"fieldType,omitempty"`
 	ChoicesOriginRef string           `json:"choicesOriginRef,omitempty"`
+	ChoicesFilter    *Formula         `json:"choicesFilter,omitempty"`
+	ForceExpanded    bool             `json:"forceExpanded,omitempty"`
+	ForceNarrow      bool             `json:"forceNarrow,omitempty"`
+	Ranked           bool             `json:"ranked,omitempty"`
+	RandomizeChoices bool             `json:"randomizeChoices,omitempty"`
+	RandomSeed       *Formula         `json:"randomSeed,omitempty"` // without a seed, the order differs at each rendering
 	HTML             string           `json:"HTML,omitempty"`
+	Collapsible      bool             `json:"collapsible,omitempty"`
 	MaxReps          *int             `json:"maxReps,omitempty"`
+	FormulaReps      *Formula         `json:"formulaReps,omitempty"`
+	Start            *float64         `json:"start,omitempty"`
+	End              *float64         `json:"end,omitempty"`
+	Step             *float64         `json:"step,omitempty"`
+	Decimals         *int             `json:"decimals,omitempty"` // decimal places shown by number fields
+	ThousandsSep     bool             `json:"thousandsSeparator,omitempty"`
+	Unit             string           `json:"unit,omitempty"` // unit of measurement of number fields, like "kg"
 	Formula          *Formula         `json:"formula,omitempty"`
+	DefaultValue     interface{}      `json:"defaultValue,omitempty"`
+	Editable         *bool            `json:"editable,omitempty"` // fields are editable if nil
 	Validation       *FieldValidation `json:"validation,omitempty"`
 	Visibility       *NodeVisibility  `json:"visibility,omitempty"`
 	Nodes            []Node           `json:"nodes,omitempty"`
@@ -63,6 +111,7 @@ type FieldType int
 
 var (
 	FtString         FieldType = 0
+	FtText           FieldType = 1
 	FtNumber         FieldType = 2
 	FtBoolean        FieldType = 3
 	FtSingleChoice   FieldType = 4
@@ -73,6 +122,9 @@ var (
 	FtTime           FieldType = 10
 	FtGeolocation    FieldType = 12
 	FtBarcode        FieldType = 13
+	FtFile           FieldType = 14
+	FtImage          FieldType = 15
+	FtRange          FieldType = 17
 )
 
 type Formula struct {
@@ -81,6 +133,8 @@ type Formula struct {
 
 type FieldValidation struct {
 	NotEmpty   bool                  `json:"notEmpty,omitempty"`
+	MinValue   *float64              `json:"minValue,omitempty"`
+	MaxValue   *float64              `json:"maxValue,omitempty"`
 	Conditions []ValidationCondition `json:"conditions,omitempty"`
 }
 
@@ -94,6 +148,43 @@ type NodeVisibility struct {
 	Condition string `json:"condition"`
 }
 
+// EncodeOptions control the output of EncAjfToWriter.
+// The zero value produces tab-indented json.
+type EncodeOptions struct {
+	// Compact disables the indentation of the output.
+	Compact bool
+}
+
+// EncAjfToWriter writes the ajf form as json. The output is deterministic:
+// the choices origins are sorted by name, the nodes are in document order
+// and the keys of maps are sorted. The form is not modified.
+func EncAjfToWriter(form *AjfForm, w io.Writer, opts EncodeOptions) error {
+	return encJson(w, sortedForm(form), opts)
+}
+
+// EncResultToWriter writes the conversion result as json,
+// encoding the form like EncAjfToWriter.
+func EncResultToWriter(res *ConversionResult, w io.Writer, opts EncodeOptions) error {
+	return encJson(w, &ConversionResult{sortedForm(res.Form), res.Warnings}, opts)
+}
+
+// sortedForm returns a shallow copy of the form with the choices origins sorted by name.
+func sortedForm(form *AjfForm) *AjfForm {
+	sorted := *form
+	sorted.ChoicesOrigins = append([]ChoicesOrigin(nil), form.ChoicesOrigins...)
+	sort.Stable(coSlice(sorted.ChoicesOrigins))
+	return &sorted
+}
+
+func encJson(w io.Writer, e interface{}, opts EncodeOptions) error {
+	enc := json.NewEncoder(w)
+	if !opts.Compact {
+		enc.SetIndent("", "\t")
+	}
+	enc.SetEscapeHTML(false)
+	return enc.Encode(e)
+}
+
 func EncIndentedJson(w io.Writer, e interface{}) error {
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "\t")
@@ -0,0 +1,363 @@
+package formats
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/scanner"
+)
+
+// Ajf2xls converts an ajf form back to an xlsform, which can be written with EncXlsx.
+// Formulas are translated back from JavaScript on a best-effort basis: operators,
+// question references and the functions produced by Convert are supported.
+// Translations are not included in the xlsform.
+func Ajf2xls(ajf *AjfForm) (*XlsForm, error) {
+	var xls XlsForm
+	if ajf.Title != "" || ajf.FormId != "" || ajf.Version != "" || ajf.DefaultLanguage != "" {
+		xls.Settings = []SettingsRow{{
+			FormTitle:       ajf.Title,
+			FormId:          ajf.FormId,
+			Version:         ajf.Version,
+			DefaultLanguage: ajf.DefaultLanguage,
+			LineNum:         2,
+		}}
+	}
+	origins := make(map[string]*ChoicesOrigin, len(ajf.ChoicesOrigins))
+	for i := range ajf.ChoicesOrigins {
+		co := &ajf.ChoicesOrigins[i]
+		origins[co.Name] = co
+		if co.Type != OtFixed {
+			continue
+		}
+		for _, c := range co.Choices {
+			xls.Choices = append(xls.Choices, ChoicesRow{
+				ListName:   co.Name,
+				Name:       c.Value,
+				Label:      c.Label,
+				Image:      c.Image,
+				Audio:      c.Audio,
+				LineNum:    len(xls.Choices) + 2,
+				Attributes: c.Attributes,
+			})
+		}
+	}
+	e := xlsEncoder{origins: origins, names: make(nameSet)}
+	collectNames(ajf.Slides, e.names)
+	for _, slide := range ajf.Slides {
+		if err := e.encNode(&slide); err != nil {
+			return nil, err
+		}
+	}
+	xls.Survey = e.survey
+	return &xls, nil
+}
+
+func collectNames(nodes []Node, names nameSet) {
+	for i := range nodes {
+		names[nodes[i].Name] = true
+		collectNames(nodes[i].Nodes, names)
+	}
+}
+
+type xlsEncoder struct {
+	origins map[string]*ChoicesOrigin
+	names   nameSet // names of the nodes, used to recognize question references
+	survey  []SurveyRow
+}
+
+func (e *xlsEncoder) add(row SurveyRow) {
+	row.LineNum = len(e.survey) + 2
+	e.survey = append(e.survey, row)
+}
+
+func (e *xlsEncoder) encNode(node *Node) error {
+	row := SurveyRow{Name: node.Name, Label: node.Label, Hint: node.Hint}
+	if node.Visibility != nil {
+		row.Relevant = e.formula(node.Visibility.Condition)
+	}
+	switch node.Type {
+	case NtSlide, NtGroup, NtRepeatingSlide:
+		return e.encGroup(node, row)
+	case NtField:
+		return e.encField(node, row)
+	default:
+		return fmt.Errorf("Node %q has unsupported type %d.", node.Name, node.Type)
+	}
+}
+
+func (e *xlsEncoder) encGroup(node *Node, row SurveyRow) error {
+	row.Type = beginGroup
+	end := endGroup
+	if node.Type == NtRepeatingSlide {
+		row.Type, end = beginRepeat, endRepeat
+		switch {
+		case node.MaxReps != nil:
+			row.RepeatCount = strconv.Itoa(*node.MaxReps)
+		case node.FormulaReps != nil:
+			row.RepeatCount = e.formula(node.FormulaReps.Formula)
+		}
+	}
+	if node.Collapsible {
+		row.Appearance = "collapsible"
+	}
+	e.add(row)
+	if node.Description != "" {
+		e.add(SurveyRow{Type: "note", Name: e.names.unique(node.Name + "_description"), Label: node.Description})
+	}
+	for i := range node.Nodes {
+		if err := e.encNode(&node.Nodes[i]); err != nil {
+			return err
+		}
+	}
+	e.add(SurveyRow{Type: end})
+	return nil
+}
+
+func (e *xlsEncoder) encField(node *Node, row SurveyRow) error {
+	fieldType := FtString
+	if node.FieldType != nil {
+		fieldType = *node.FieldType
+	}
+	hidden := node.Visibility != nil && node.Visibility.Condition == "false"
+	if hidden {
+		row.Relevant = ""
+	}
+	if node.Formula != nil && fieldType != FtFormula {
+		row.Calculation = e.formula(node.Formula.Formula)
+	}
+	switch fieldType {
+	case FtString:
+		row.Type = "text"
+		if hidden && node.Label == "" {
+			row.Type = "hidden"
+		}
+	case FtText:
+		row.Type, row.Appearance = "text", "multiline"
+	case FtNumber:
+		row.Type = "decimal"
+		if node.Decimals != nil {
+			row.Parameters = fmt.Sprintf("decimals=%d", *node.Decimals)
+		}
+		if node.ThousandsSep {
+			row.Appearance = "thousands-sep"
+		}
+	case FtBoolean:
+		row.Type = "boolean"
+	case FtSingleChoice, FtMultipleChoice:
+		list := node.ChoicesOriginRef
+		if co := e.origins[list]; co != nil && co.Type == OtRepeat {
+			list = "${" + co.FieldRef + "}"
+		}
+		switch {
+		case fieldType == FtSingleChoice:
+			row.Type = "select_one " + list
+		case node.Ranked:
+			row.Type = "rank " + list
+		default:
+			row.Type = "select_multiple " + list
+		}
+		if node.ForceExpanded {
+			row.Appearance = "quick"
+		} else if node.ForceNarrow {
+			row.Appearance = "minimal"
+		}
+		if node.ChoicesFilter != nil {
+			row.ChoiceFilter = e.formula(node.ChoicesFilter.Formula)
+		}
+	case FtFormula:
+		row.Type = "calculate"
+		if node.Formula != nil {
+			row.Calculation = e.formula(node.Formula.Formula)
+		}
+		if hidden {
+			row.Relevant = ""
+		}
+	case FtNote:
+		row.Type, row.Label = "note", node.HTML
+	case FtDate:
+		row.Type = "date"
+	case FtTime:
+		row.Type = "time"
+	case FtGeolocation:
+		row.Type = "geopoint"
+	case FtBarcode:
+		row.Type = "barcode"
+	case FtFile:
+		row.Type = "file"
+	case FtImage:
+		row.Type = "image"
+	case FtRange:
+		row.Type = "range"
+		if node.Start != nil && node.End != nil && node.Step != nil {
+			row.Parameters = fmt.Sprintf("start=%g end=%g step=%g", *node.Start, *node.End, *node.Step)
+		}
+	default:
+		return fmt.Errorf("Field %q has unsupported field type %d.", node.Name, fieldType)
+	}
+	row.Unit = node.Unit
+	if hidden && row.Type != "hidden" && row.Type != "calculate" {
+		row.Relevant = "false()"
+	}
+	if v := node.Validation; v != nil {
+		if v.NotEmpty {
+			row.Required = "yes"
+		}
+		var constraints []string
+		for _, c := range v.Conditions {
+			if fieldType == FtNumber && c.Condition == "isInt("+node.Name+")" {
+				row.Type = "integer"
+				continue
+			}
+			if fieldType == FtString && c.Condition == dateTimeCondition(node.Name) {
+				row.Type = "datetime"
+				continue
+			}
+			constraints = append(constraints, "("+e.formula(c.Condition)+")")
+			if row.ConstraintMessage == "" {
+				row.ConstraintMessage = c.ErrorMessage
+			}
+		}
+		if len(constraints) == 1 {
+			constraints[0] = strings.TrimSuffix(strings.TrimPrefix(constraints[0], "("), ")")
+		}
+		row.Constraint = strings.Join(constraints, " and ")
+	}
+	row.Default = formatDefault(node.DefaultValue)
+	if node.Editable != nil && !*node.Editable {
+		row.ReadOnly = "yes"
+	}
+	e.add(row)
+	return nil
+}
+
+func formatDefault(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case bool:
+		if v {
+			return "yes"
+		}
+		return "no"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []string:
+		return strings.Join(v, " ")
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i := range v {
+			parts[i] = fmt.Sprint(v[i])
+		}
+		return strings.Join(parts, " ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+var (
+	jsfunc2func     = reverseMap(func2jsfunc)
+	jsoperator2xlsf = map[string]string{
+		"===": "=", "!==": "!=", "&&": "and", "||": "or", "/": "div", "%": "mod",
+		"<": "<", "<=": "<=", ">": ">", ">=": ">=", "*": "*", "+": "+", "-": "-",
+	}
+)
+
+func reverseMap(m map[string]string) map[string]string {
+	r := make(map[string]string, len(m))
+	for k, v := range m {
+		r[v] = k
+	}
+	return r
+}
+
+// formula translates a JavaScript formula back to the xlsform syntax.
+// Constructs that can't be translated are copied unchanged.
+func (e *xlsEncoder) formula(js string) string {
+	var s scanner.Scanner
+	s.Init(strings.NewReader(js))
+	s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats | scanner.ScanStrings
+	s.Error = func(*scanner.Scanner, string) {}
+	var b strings.Builder
+	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
+		text := s.TokenText()
+		switch tok {
+		case scanner.Ident:
+			for s.Peek() == '.' {
+				s.Next()
+				s.Scan()
+				text += "." + s.TokenText()
+			}
+			switch {
+			case text == "true":
+				b.WriteString("True")
+			case text == "false":
+				b.WriteString("False")
+			case text == "Math.PI":
+				b.WriteString("pi()")
+			case jsfunc2func[text] != "" && s.Peek() == '(':
+				b.WriteString(jsfunc2func[text])
+			case e.names[text]:
+				b.WriteString("${" + text + "}")
+			default:
+				b.WriteString(text)
+			}
+		case '$':
+			// $choice.value, $choice.label, $choice.attributes.attr in choice filters.
+			s.Scan()
+			text = s.TokenText()
+			for s.Peek() == '.' {
+				s.Next()
+				s.Scan()
+				text += "." + s.TokenText()
+			}
+			switch {
+			case text == "choice.value":
+				b.WriteString("name")
+			case text == "choice.label":
+				b.WriteString("label")
+			case strings.HasPrefix(text, "choice.attributes."):
+				b.WriteString(text[len("choice.attributes."):])
+			default:
+				b.WriteString("$" + text)
+			}
+		case '\'':
+			b.WriteByte('\'')
+			for ch := s.Next(); ch != scanner.EOF; ch = s.Next() {
+				b.WriteRune(ch)
+				if ch == '\\' {
+					b.WriteRune(s.Next())
+				} else if ch == '\'' {
+					break
+				}
+			}
+		case '=', '!', '&', '|', '<', '>':
+			for s.Peek() == '=' || s.Peek() == '&' || s.Peek() == '|' {
+				text += string(s.Next())
+			}
+			if op, ok := jsoperator2xlsf[text]; ok {
+				writeOperator(&b, op)
+			} else if text == "!" && s.Peek() == '(' {
+				b.WriteString("not")
+			} else {
+				b.WriteString(text)
+			}
+		case '*', '/', '%', '+', '-':
+			writeOperator(&b, jsoperator2xlsf[text])
+		case ',':
+			b.WriteString(", ")
+		case '.':
+			// (arg1).method(arg2) becomes func(arg1, arg2): not supported, copied unchanged.
+			b.WriteByte('.')
+		default:
+			b.WriteString(text)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func writeOperator(b *strings.Builder, op string) {
+	if s := b.String(); s != "" && !strings.HasSuffix(s, " ") && !strings.HasSuffix(s, "(") {
+		b.WriteByte(' ')
+	}
+	b.WriteString(op + " ")
+}
@@ -1,8 +1,18 @@
 package formats
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/kr/pretty"
@@ -44,26 +54,298 @@ func TestDecodeXls(t *testing.T) {
 			t.Errorf("Error decoding %s, unexpected result:", fileName+ext)
 			logFatalDiff(t, xls, expected)
 		}
+
+		data, err := ioutil.ReadFile(fileName + ext)
+		check(t, err)
+		xls, err = DecXlsFromReader(bytes.NewReader(data), int64(len(data)), ext)
+		check(t, err)
+		if !reflect.DeepEqual(xls, expected) {
+			t.Errorf("Error decoding %s from reader, unexpected result:", fileName+ext)
+			logFatalDiff(t, xls, expected)
+		}
+	}
+}
+
+func TestEncXlsx(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{LineNum: 2, Type: "select_one list", Name: "name1", Label: "label1", Hint: "hint1"},
+			{LineNum: 3, Type: "text", Name: "name2", Label: "label2"},
+		},
+		Choices: []ChoicesRow{
+			{LineNum: 2, ListName: "list", Name: "a", Label: "A", Attributes: map[string]string{"x": "1"}},
+			{LineNum: 3, ListName: "list", Name: "b", Label: "B"},
+		},
+		Settings: []SettingsRow{{LineNum: 2, FormTitle: "Title"}},
+	}
+	var buf bytes.Buffer
+	err := EncXlsx(&buf, xls)
+	check(t, err)
+	wb, err := NewWorkBook(bytes.NewReader(buf.Bytes()), ".xlsx", int64(buf.Len()))
+	check(t, err)
+	decoded, err := DecXlsform(wb)
+	check(t, err)
+	if !reflect.DeepEqual(decoded, xls) {
+		t.Error("Error encoding xlsx, unexpected result after decoding:")
+		logFatalDiff(t, decoded, xls)
+	}
+}
+
+func TestEncAjfToWriter(t *testing.T) {
+	form := &AjfForm{
+		ChoicesOrigins: []ChoicesOrigin{{Name: "b"}, {Name: "a"}},
+		Slides:         []Node{{Name: "slide", Label: "<b>Slide</b>"}},
+	}
+	var buf bytes.Buffer
+	check(t, EncAjfToWriter(form, &buf, EncodeOptions{Compact: true}))
+	expected := `{"choicesOrigins":[{"type":"","name":"a","choicesType":"","choices":null},` +
+		`{"type":"","name":"b","choicesType":"","choices":null}],` +
+		`"nodes":[{"parent":0,"id":0,"name":"slide","label":"<b>Slide</b>","nodeType":0}]}` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("Unexpected encoding of ajf form:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+	if form.ChoicesOrigins[0].Name != "b" {
+		t.Fatal("EncAjfToWriter modified the form")
+	}
+
+	buf.Reset()
+	res := &ConversionResult{form, []Warning{{2, "Warning."}}}
+	check(t, EncResultToWriter(res, &buf, EncodeOptions{Compact: true}))
+	expected = `{"form":` + strings.TrimSuffix(expected, "\n") + `,"warnings":[{"line":2,"message":"Warning."}]}` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("Unexpected encoding of conversion result:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestValidateAjf(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: beginGroup, Name: "g", Label: "G", LineNum: 2},
+			{Type: "select_one yn", Name: "ok", Label: "Ok?", LineNum: 3},
+			{Type: "integer", Name: "n", Label: "N", Relevant: "${ok} = 'yes'", ReadOnly: "yes", LineNum: 4},
+			{Type: endGroup, LineNum: 5},
+		},
+		Choices: []ChoicesRow{{ListName: "yn", Name: "yes", Label: "Yes", LineNum: 2}},
+	}
+	newForm := func() *AjfForm {
+		form, _, err := Convert(xls, ConvertOptions{})
+		check(t, err)
+		return form
+	}
+	check(t, ValidateAjf(newForm()))
+
+	cases := []struct {
+		change func(f *AjfForm)
+		err    string
+	}{
+		{func(f *AjfForm) { f.Slides[0].Nodes[1].Id = f.Slides[0].Nodes[0].Id }, "same id"},
+		{func(f *AjfForm) { f.Slides[0].Nodes[1].Name = "ok" }, "Duplicate node name"},
+		{func(f *AjfForm) { f.Slides[0].Nodes[1].Previous = f.Slides[0].Id }, "has parent"},
+		{func(f *AjfForm) { f.Slides[0].Type = NtGroup }, "not a slide"},
+		{func(f *AjfForm) { f.Slides[0].Nodes[0].ChoicesOriginRef = "colors" }, "undefined choices origin"},
+		{func(f *AjfForm) { f.Slides[0].Nodes[0].FieldType = nil }, "no field type"},
+		{func(f *AjfForm) { f.Slides[0].Nodes[0].Type = NodeType(1) }, "nodes[0].nodes[0].nodeType: invalid value 1"},
+		{func(f *AjfForm) { f.Slides[0].Nodes[0].Name = "" }, "string is too short"},
+		{func(f *AjfForm) { f.Slides[0].Nodes[1].Visibility.Condition = "" }, "visibility.condition"},
+		{func(f *AjfForm) { f.Slides[0].Nodes[1].Id = 0 }, "0 is less than 1"},
+		{func(f *AjfForm) { f.Slides[0].Nodes[1].DefaultValue = map[string]int{} }, ""},
+		{func(f *AjfForm) { f.ChoicesOrigins[0].Choices = nil }, "expected array, found null"},
+	}
+	for i, c := range cases {
+		form := newForm()
+		c.change(form)
+		err := ValidateAjf(form)
+		if c.err == "" {
+			check(t, err)
+		} else if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Case %d: expected error containing %q, got: %v", i, c.err, err)
+		} else if _, ok := err.(AjfError); !ok {
+			t.Errorf("Case %d: expected an AjfError, got %T", i, err)
+		}
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	editable := true
+	a := &AjfForm{
+		ChoicesOrigins: []ChoicesOrigin{{Name: "b"}, {Name: "a", Choices: []Choice{{Value: "x", Attributes: map[string]string{}}}}},
+		Slides: []Node{{Name: "s", Id: 1, Nodes: []Node{{
+			Name: "q", Id: 1001, Previous: 1,
+			Visibility: &NodeVisibility{" true "},
+			Validation: &FieldValidation{},
+			Formula:    &Formula{" a + 1\n"},
+			Editable:   &editable,
+		}}}},
+		NameMapping:  map[string]string{"q": "q"},
+		Translations: map[string]map[string]string{"it": {}},
+	}
+	b := &AjfForm{
+		ChoicesOrigins: []ChoicesOrigin{{Name: "a", Choices: []Choice{{Value: "x"}}}, {Name: "b", Choices: []Choice{}}},
+		Slides: []Node{{Name: "s", Id: 1, Nodes: []Node{{
+			Name: "q", Id: 1001, Previous: 1, Formula: &Formula{"a + 1"},
+		}}}},
+	}
+	ja, err := CanonicalJson(a)
+	check(t, err)
+	jb, err := CanonicalJson(b)
+	check(t, err)
+	if !bytes.Equal(ja, jb) {
+		t.Fatalf("Equivalent forms have different canonical encodings:\n%s\n%s", ja, jb)
+	}
+	if a.ChoicesOrigins[0].Name != "b" || a.Slides[0].Nodes[0].Visibility == nil {
+		t.Fatal("CanonicalJson modified the form")
+	}
+
+	Canonicalize(a)
+	if !reflect.DeepEqual(a, b) {
+		t.Error("Unexpected canonical form:")
+		logFatalDiff(t, a, b)
+	}
+
+	b.Slides[0].Nodes[0].Validation = &FieldValidation{NotEmpty: true}
+	jb, err = CanonicalJson(b)
+	check(t, err)
+	if bytes.Equal(ja, jb) {
+		t.Fatal("Different forms have the same canonical encoding")
+	}
+
+	// Whether conditions are validated on the client is data, not a default.
+	b.Slides[0].Nodes[0].Validation = &FieldValidation{Conditions: []ValidationCondition{{Condition: "a > 0"}}}
+	ja, err = CanonicalJson(b)
+	check(t, err)
+	b.Slides[0].Nodes[0].Validation.Conditions[0].ClientValidation = true
+	jb, err = CanonicalJson(b)
+	check(t, err)
+	if bytes.Equal(ja, jb) {
+		t.Fatal("Canonicalize changed the client validation of a condition")
+	}
+}
+
+func TestAjf2xls(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: beginGroup, Name: "g", Label: "Group", Relevant: "True"},
+			{Type: "integer", Name: "n", Label: "N", Required: "yes", Constraint: ". > 0 and . < 10",
+				ConstraintMessage: "Out of range"},
+			{Type: "text", Name: "t", Label: "T", Appearance: "multiline", Hint: "Hint", ReadOnly: "yes"},
+			{Type: "select_one list", Name: "s", Label: "S", Appearance: "minimal",
+				ChoiceFilter: "region = ${t} or name != 'x'", Default: "a"},
+			{Type: "calculate", Name: "c", Calculation: "pow(${n}, 2) div 3 + int(${n} mod 2)"},
+			{Type: "range", Name: "r", Label: "R", Parameters: "start=1 end=5 step=1"},
+			{Type: "decimal", Name: "d", Label: "D", Relevant: "not(${n} = 1) and -${n} < 0"},
+			{Type: endGroup},
+			{Type: beginRepeat, Name: "rep", Label: "Rep", RepeatCount: "${n}"},
+			{Type: "text", Name: "member", Label: "Member"},
+			{Type: endRepeat},
+			{Type: beginGroup, Name: "g2", Label: "Group 2"},
+			{Type: "rank ${member}", Name: "order", Label: "Order"},
+			{Type: "hidden", Name: "h"},
+			{Type: endGroup},
+		},
+		Choices: []ChoicesRow{
+			{ListName: "list", Name: "a", Label: "A", Attributes: map[string]string{"region": "north"}},
+			{ListName: "list", Name: "b", Label: "B"},
+		},
+		Settings: []SettingsRow{{FormTitle: "Title", Version: "1"}},
+	}
+	ajf, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	back, err := Ajf2xls(ajf)
+	check(t, err)
+	ajf2, _, err := Convert(back, ConvertOptions{})
+	check(t, err)
+	if !reflect.DeepEqual(ajf2, ajf) {
+		t.Errorf("Unexpected result converting back to xlsform:\n%# v", pretty.Formatter(back.Survey))
+		logFatalDiff(t, ajf2, ajf)
+	}
+}
+
+func TestSplitForm(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: beginGroup, Name: "first", Label: "First"},
+			{Type: "integer", Name: "n", Label: "N"},
+			{Type: "select_one list", Name: "s", Label: "S"},
+			{Type: endGroup},
+			{Type: beginGroup, Name: "second", Label: "Second"},
+			{Type: "text", Name: "t", Label: "T", Relevant: "${n} > 1"},
+			{Type: endGroup},
+		},
+		Choices: []ChoicesRow{{ListName: "list", Name: "a", Label: "A"}},
+	}
+	ajf, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	forms, manifest, err := SplitForm(ajf, 0)
+	check(t, err)
+	if len(forms) != 2 || len(forms[0].ChoicesOrigins) != 1 || len(forms[1].ChoicesOrigins) != 0 {
+		t.Fatalf("Unexpected split forms: %# v", pretty.Formatter(forms))
+	}
+	if slide := forms[1].Slides[0]; slide.Id != 1 || slide.Nodes[0].Id != 1001 || slide.Nodes[0].Previous != 1 {
+		t.Fatalf("Ids not reassigned in split form: %# v", pretty.Formatter(slide))
+	}
+	if ajf.Slides[1].Id != 2 {
+		t.Fatal("SplitForm modified the original form")
+	}
+	expected := &Manifest{Forms: []ManifestEntry{
+		{Form: "first", Title: "First"},
+		{Form: "second", Title: "Second", References: []string{"first"}},
+	}}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Error("Unexpected manifest:")
+		logFatalDiff(t, manifest, expected)
+	}
+}
+
+func TestAnnotateXlsx(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{LineNum: 2, Type: "text", Name: "name1", Label: "label1"},
+			{LineNum: 3, Type: "foo", Name: "name2", Label: "label2"},
+		},
+		Choices: []ChoicesRow{{LineNum: 2, ListName: "list", Name: "a", Label: "A"}},
+	}
+	_, _, convErr := Convert(xls, ConvertOptions{})
+	if convErr == nil {
+		t.Fatal("Expected conversion error")
+	}
+	warnings := []Warning{{LineNum: 2, Message: "a warning"}}
+
+	var buf bytes.Buffer
+	check(t, EncXlsx(&buf, xls))
+	wb, err := NewWorkBook(bytes.NewReader(buf.Bytes()), ".xlsx", int64(buf.Len()))
+	check(t, err)
+	buf.Reset()
+	check(t, AnnotateXlsx(&buf, wb, Annotations(convErr, warnings)))
+
+	wb, err = NewWorkBook(bytes.NewReader(buf.Bytes()), ".xlsx", int64(buf.Len()))
+	check(t, err)
+	rows := wb.Rows("survey")
+	col := columnIndex(rows[0], messagesColumn)
+	if col < 0 {
+		t.Fatalf("Missing messages column in annotated survey: %v", rows[0])
+	}
+	if rows[1][col] != "a warning" || rows[2][col] != `Invalid type "foo" in survey.` {
+		t.Fatalf("Unexpected messages in annotated survey: %q, %q", rows[1][col], rows[2][col])
 	}
 }
 
 func TestBuildChoicesOrigins(t *testing.T) {
 	choicesSheet := []ChoicesRow{
-		{"list1", "elem1a", "label1a", 0},
-		{"list2", "elem2a", "label2a", 0},
-		{"list1", "elem1b", "label1b", 0},
+		{"list1", "elem1a", "label1a", "", "", 0, nil, ""},
+		{"list2", "elem2a", "label2a", "", "", 0, map[string]string{"color": "red"}, ""},
+		{"list1", "elem1b", "label1b", "", "", 0, nil, ""},
 	}
 	choices, _ := buildChoicesOrigins(choicesSheet)
 	expected := []ChoicesOrigin{{
 		Type:        OtFixed,
 		Name:        "list1",
 		ChoicesType: CtString,
-		Choices:     []Choice{{"elem1a", "label1a"}, {"elem1b", "label1b"}},
+		Choices:     []Choice{{"elem1a", "label1a", "", "", nil}, {"elem1b", "label1b", "", "", nil}},
 	}, {
 		Type:        OtFixed,
 		Name:        "list2",
 		ChoicesType: CtString,
-		Choices:     []Choice{{"elem2a", "label2a"}},
+		Choices:     []Choice{{"elem2a", "label2a", "", "", map[string]string{"color": "red"}}},
 	}}
 	if !reflect.DeepEqual(choices, expected) {
 		t.Errorf("Error building choices origins of\n%# v\nunexpected result:",
@@ -72,6 +354,89 @@ func TestBuildChoicesOrigins(t *testing.T) {
 	}
 }
 
+func TestSanitizeOriginNames(t *testing.T) {
+	co := []ChoicesOrigin{{Name: "a/b"}, {Name: "a_b"}, {Name: "città"}, {Name: "1st list"}, {Name: "ok"}}
+	names := sanitizeOriginNames(co)
+	expectedNames := map[string]string{
+		"a/b": "a_b_1", "a_b": "a_b", "città": "citt_", "1st list": "_1st_list", "ok": "ok",
+	}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Error("Error sanitizing choices origin names, unexpected result:")
+		logFatalDiff(t, names, expectedNames)
+	}
+	for i := 1; i < len(co); i++ {
+		if co[i-1].Name >= co[i].Name {
+			t.Fatalf("Choices origins are not sorted by name: %v", co)
+		}
+	}
+}
+
+func TestSanitizeQuestionNames(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: "integer", Name: "household-size", Label: "Size"},
+		{Type: "integer", Name: "class", Label: "Class", Relevant: "${household-size} > 1"},
+		{Type: "text", Name: "città", Label: "City"},
+	}}
+	ajf, _, err := Convert(xls, ConvertOptions{NameMapping: true})
+	check(t, err)
+	expected := map[string]string{"household-size": "household_size", "class": "class_", "città": "città"}
+	if !reflect.DeepEqual(ajf.NameMapping, expected) {
+		t.Error("Unexpected name mapping:")
+		logFatalDiff(t, ajf.NameMapping, expected)
+	}
+	nodes := ajf.Slides[0].Nodes
+	if nodes[0].Name != "household_size" || nodes[1].Visibility.Condition != "household_size > 1" {
+		t.Fatalf("Names not sanitized: %# v", pretty.Formatter(nodes))
+	}
+
+	xls.Survey[1].Relevant = ""
+	ajf, _, err = Convert(xls, ConvertOptions{})
+	check(t, err)
+	if ajf.NameMapping != nil || ajf.Slides[0].Nodes[0].Name != "household-size" {
+		t.Fatal("Names sanitized without the NameMapping option")
+	}
+}
+
+func TestRepeatOrigins(t *testing.T) {
+	survey := []SurveyRow{
+		{Type: beginRepeat, Name: "members"},
+		{Type: beginGroup, Name: "member"},
+		{Type: "text", Name: "member_name"},
+		{Type: endGroup},
+		{Type: endRepeat},
+		{Type: "select_one ${member_name}", Name: "head"},
+		{Type: "select_multiple ${member_name}", Name: "workers"},
+	}
+	originNames := map[string]string{"member_name_choices": "member_name_choices"}
+	co := []ChoicesOrigin{{Type: OtFixed, Name: "member_name_choices"}}
+	co, err := buildRepeatOrigins(survey, co, originNames)
+	check(t, err)
+	expected := []ChoicesOrigin{
+		{Type: OtFixed, Name: "member_name_choices"},
+		{
+			Type:        OtRepeat,
+			Name:        "member_name_choices_1",
+			ChoicesType: CtString,
+			Choices:     []Choice{},
+			RepeatRef:   "members",
+			FieldRef:    "member_name",
+		},
+	}
+	if !reflect.DeepEqual(co, expected) {
+		t.Error("Error building repeat choices origins, unexpected result:")
+		logFatalDiff(t, co, expected)
+	}
+	if originNames["${member_name}"] != "member_name_choices_1" {
+		t.Fatalf("Unexpected origin names: %v", originNames)
+	}
+
+	survey = append(survey, SurveyRow{Type: "text", Name: "outside"}, SurveyRow{Type: "select_one ${outside}"})
+	_, err = buildRepeatOrigins(survey, nil, map[string]string{})
+	if err == nil {
+		t.Fatal("Expected error for choices referring to a question outside of repeats")
+	}
+}
+
 func TestPreprocessGroups(t *testing.T) {
 	errSurveys := [][]SurveyRow{
 		{{Type: beginGroup}, {Type: beginRepeat}, {Type: endRepeat}, {Type: endGroup}},
@@ -81,14 +446,14 @@ func TestPreprocessGroups(t *testing.T) {
 		{{Type: beginRepeat}, {Type: endRepeat}, {Type: "text"}},
 	}
 	for _, errSurvey := range errSurveys {
-		_, err := preprocessGroups(errSurvey)
+		_, err := preprocessGroups(errSurvey, ConvertOptions{})
 		if err == nil {
 			t.Fatalf("Couldn't find error in erroneus survey:\n%# v", pretty.Formatter(errSurvey))
 		}
 	}
 
 	survey := []SurveyRow{{Type: "text"}}
-	processed, err := preprocessGroups(survey)
+	processed, err := preprocessGroups(survey, ConvertOptions{})
 	check(t, err)
 	expected := []SurveyRow{
 		{Type: beginGroup, Name: "global"},
@@ -101,6 +466,56 @@ func TestPreprocessGroups(t *testing.T) {
 		t.Error(`Error wrapping []SurveyRow{{Type: "text"}}, unexpected result:`)
 		logFatalDiff(t, processed, expected)
 	}
+
+	survey = []SurveyRow{{Type: "text", Name: "form"}, {Type: "text", Name: "global"}, {Type: "text", Name: "form_1"}}
+	processed, err = preprocessGroups(survey, ConvertOptions{})
+	check(t, err)
+	expected = []SurveyRow{
+		{Type: beginGroup, Name: "global_1"},
+		{Type: beginGroup, Name: "form_2", Label: "Form"},
+		{Type: "text", Name: "form"},
+		{Type: "text", Name: "global"},
+		{Type: "text", Name: "form_1"},
+		{Type: endGroup},
+		{Type: endGroup},
+	}
+	if !reflect.DeepEqual(processed, expected) {
+		t.Error("Error wrapping survey with colliding names, unexpected result:")
+		logFatalDiff(t, processed, expected)
+	}
+
+	survey = []SurveyRow{
+		{Type: "text", LineNum: 2},
+		{Type: "text", LineNum: 4},
+		{Type: beginRepeat, LineNum: 5},
+		{Type: "text", LineNum: 6},
+		{Type: endRepeat, LineNum: 7},
+		{Type: "text", LineNum: 8},
+	}
+	_, err = preprocessGroups(survey, ConvertOptions{})
+	if err == nil || !strings.Contains(err.Error(), "(lines 2-4, line 8)") {
+		t.Fatalf("Expected error listing the ungrouped questions, got: %v", err)
+	}
+	processed, err = preprocessGroups(survey, ConvertOptions{WrapUngrouped: true})
+	check(t, err)
+	expected = []SurveyRow{
+		{Type: beginGroup, Name: "global"},
+		{Type: beginGroup, Name: "form", Label: "Form"},
+		{Type: "text", LineNum: 2},
+		{Type: "text", LineNum: 4},
+		{Type: endGroup},
+		{Type: beginRepeat, LineNum: 5},
+		{Type: "text", LineNum: 6},
+		{Type: endRepeat, LineNum: 7},
+		{Type: beginGroup, Name: "form_1", Label: "Form"},
+		{Type: "text", LineNum: 8},
+		{Type: endGroup},
+		{Type: endGroup},
+	}
+	if !reflect.DeepEqual(processed, expected) {
+		t.Error("Error wrapping ungrouped questions around repeats, unexpected result:")
+		logFatalDiff(t, processed, expected)
+	}
 }
 
 func TestNonformulaFeatures(t *testing.T) {
@@ -110,7 +525,7 @@ func TestNonformulaFeatures(t *testing.T) {
 
 	xls, err := DecXlsFromFile(in)
 	check(t, err)
-	ajf, err := Convert(xls)
+	ajf, _, err := Convert(xls, ConvertOptions{})
 	check(t, err)
 	err = EncJsonToFile(out, ajf)
 	check(t, err)
@@ -140,7 +555,11 @@ func TestFormulaParser(t *testing.T) {
 		`regex("s", "re")`:                       `(("s").match("re") !== null)`,
 		`string-length("hello")`:                 `("hello").length`,
 		`exp10(${x})`:                            `Math.pow(10, x)`,
+		`1 + coalesce(${x}, 0)`:                  `1 + ((x) != null && (x) !== "" ? (x) : (0))`,
 		`+(-(+(-5)))`:                            `+(-(+(-5)))`,
+		`decimal-date-time(today())`:             `(new Date(new Date(new Date().setHours(0, 0, 0, 0))).getTime() / 86400000)`,
+		`date(${x})`:                             `(typeof (x) === "number" ? new Date((x) * 86400000) : new Date(x))`,
+		`format-date(${x}, 'on %e/%n')`:          `("on " + String(new Date(x).getDate()) + "/" + String(new Date(x).getMonth() + 1))`,
 		`'hello \n \123 \xab \uabcd \Uabcd1234'`: `'hello \n \123 \xab \uabcd \Uabcd1234'`,
 	}
 	for formula, expected := range formulas {
@@ -155,8 +574,8 @@ func TestFormulaParser(t *testing.T) {
 
 	errFormulas := []string{
 		"5++", "$dollar", "..", "((1)", ")(1)", "1 == 2", "!True", "1 << 2",
-		"True andd False", "plainIdent > 3", "unknownFunc(7)",
-		`'\g'`, `'\12'`, `'\xax'`,
+		"True andd False", "plainIdent > 3", "unknownFunc(7)", "coalesce(1)",
+		`'\g'`, `'\12'`, `'\xax'`, `format-date(now(), ${x})`, `format-date(now(), "%Q")`,
 	}
 	for _, formula := range errFormulas {
 		_, err := p.Parse(formula, "formula", "fieldName")
@@ -166,90 +585,2602 @@ func TestFormulaParser(t *testing.T) {
 	}
 }
 
-func TestFormulaFeatures(t *testing.T) {
-	in := "testdata/formulas.xlsx"
-	out := "testdata/formulas.json"
-	oracle := "testdata/formulas_oracle.json"
+func TestNodeVisibility(t *testing.T) {
+	var b nodeBuilder
+	row := SurveyRow{Type: "text", Name: "name", Relevant: "${age} > 18 and ${gender} = 'f'", LineNum: 7}
+	vis, err := b.nodeVisibility(&row)
+	check(t, err)
+	expected := &NodeVisibility{Condition: "age > 18 && gender === 'f'"}
+	if !reflect.DeepEqual(vis, expected) {
+		t.Fatalf("Error converting relevant %q\nexpected: %v\ngot: %v", row.Relevant, expected, vis)
+	}
 
-	xls, err := DecXlsFromFile(in)
+	row.Relevant = ""
+	vis, err = b.nodeVisibility(&row)
+	if vis != nil || err != nil {
+		t.Fatalf("Empty relevant expected to produce no visibility, got %v, %v", vis, err)
+	}
+
+	row.Relevant = "${age} >"
+	_, err = b.nodeVisibility(&row)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 7: ") {
+		t.Fatalf("Expected error with line number for erroneus relevant, got: %v", err)
+	}
+}
+
+func TestFieldValidation(t *testing.T) {
+	var b nodeBuilder
+	row := SurveyRow{
+		Type:              "decimal",
+		Name:              "age",
+		Constraint:        ". >= 0 and . <= 120",
+		ConstraintMessage: "Invalid age.",
+		Required:          "yes",
+	}
+	v, err := b.fieldValidation(&row)
 	check(t, err)
-	ajf, err := Convert(xls)
+	expected := &FieldValidation{
+		NotEmpty: true,
+		Conditions: []ValidationCondition{{
+			Condition:        "age >= 0 && age <= 120",
+			ClientValidation: true,
+			ErrorMessage:     "Invalid age.",
+		}},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Error("Error converting constraint, unexpected result:")
+		logFatalDiff(t, v, expected)
+	}
+
+	row = SurveyRow{Type: "integer", Name: "children"}
+	v, err = b.fieldValidation(&row)
 	check(t, err)
-	err = EncJsonToFile(out, ajf)
+	expected = &FieldValidation{
+		Conditions: []ValidationCondition{{
+			Condition:        "isInt(children)",
+			ClientValidation: true,
+			ErrorMessage:     "The field value must be an integer.",
+		}},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Error("Error generating integer validation, unexpected result:")
+		logFatalDiff(t, v, expected)
+	}
+}
+
+func TestLongLabels(t *testing.T) {
+	var b nodeBuilder
+	row := SurveyRow{Type: "text", Name: "name", Label: "first half, ", LabelContinued: "second half", LineNum: 3}
+	field, err := b.buildField(&row)
 	check(t, err)
-	result, err := ioutil.ReadFile(out)
+	if field.Label != "first half, second half" {
+		t.Fatalf("Label continuation not applied, got label %q", field.Label)
+	}
+	if len(b.warnings) != 0 {
+		t.Fatalf("Unexpected warnings: %v", b.warnings)
+	}
+
+	row.LabelContinued = strings.Repeat("a", maxLabelLength)
+	_, err = b.buildField(&row)
 	check(t, err)
-	expected, err := ioutil.ReadFile(oracle)
+	if len(b.warnings) != 1 || b.warnings[0].LineNum != 3 {
+		t.Fatalf("Expected a warning about the label length on line 3, got: %v", b.warnings)
+	}
+}
+
+func TestNoteAsDescription(t *testing.T) {
+	survey := []SurveyRow{
+		{Type: beginGroup, Name: "group", Label: "Group"},
+		{Type: "note", Name: "intro", Label: "Introduction"},
+		{Type: "text", Name: "name", Label: "Name"},
+		{Type: endGroup},
+	}
+	b := nodeBuilder{opts: ConvertOptions{NoteAsDescription: true}}
+	group, err := b.buildGroup(survey)
 	check(t, err)
-	if !reflect.DeepEqual(result, expected) {
-		t.Fatalf("Unexpected result. Check the differences between %s and %s", out, oracle)
+	if group.Description != "Introduction" || len(group.Nodes) != 1 {
+		t.Fatalf("Note not promoted to group description: %# v", pretty.Formatter(group))
+	}
+
+	b = nodeBuilder{}
+	group, err = b.buildGroup(survey)
+	check(t, err)
+	if group.Description != "" || len(group.Nodes) != 2 {
+		t.Fatalf("Note unexpectedly promoted to group description: %# v", pretty.Formatter(group))
 	}
 }
 
-func TestListLanguages(t *testing.T) {
-	if l := ListLanguages(nil); l != nil {
-		t.Fatalf("ListLanguages(nil) expected to be nil, found %v", l)
+func TestMalformedGroups(t *testing.T) {
+	// Rows that preprocessing should have rejected make the builder fail with an error, not panic.
+	cases := []struct {
+		survey []SurveyRow
+		line   int
+		code   string
+	}{
+		{[]SurveyRow{{Type: "text", Name: "q", LineNum: 2}}, 2, CodeInvalidType},
+		{[]SurveyRow{{Type: beginGroup, Name: "g", LineNum: 2}}, 2, CodeUnclosedGroup},
+		{[]SurveyRow{
+			{Type: beginGroup, Name: "g", LineNum: 2},
+			{Type: beginGroup, Name: "h", LineNum: 3},
+			{Type: endGroup, LineNum: 4},
+		}, 2, CodeUnclosedGroup},
+		{[]SurveyRow{
+			{Type: beginGroup, Name: "g", LineNum: 2},
+			{Type: endGroup, LineNum: 3},
+			{Type: "text", Name: "q", LineNum: 4},
+			{Type: endGroup, LineNum: 5},
+		}, 3, CodeUnexpectedEnd},
+		{[]SurveyRow{
+			{Type: beginGroup, Name: "g", LineNum: 2},
+			{Type: "txt", Name: "q", LineNum: 3},
+			{Type: endGroup, LineNum: 4},
+		}, 3, CodeInvalidType},
 	}
-	rows := [][]string{
-		{"type", "label", "label::English (en)", "label::French (fr)", "label::Italian (it)"},
+	for i, c := range cases {
+		var b nodeBuilder
+		_, err := b.buildGroup(c.survey)
+		e, ok := err.(SourceError)
+		if !ok || e.LineNum != c.line || e.Code != c.code {
+			t.Errorf("Case %d: expected %s error on line %d, got: %v", i, c.code, c.line, err)
+		}
 	}
-	list := ListLanguages(rows)
-	expected := map[string]bool{"fr": true, "it": true}
-	if !reflect.DeepEqual(list, expected) {
-		t.Fatalf("Error listing languages of\n%v\nexpected: %v\nfound: %v", rows, list, expected)
+}
+
+func TestCollapsibleGroups(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: beginGroup, Name: "slide", Label: "Slide", Appearance: "collapsible", LineNum: 2},
+		{Type: beginGroup, Name: "details", Label: "Details", Appearance: "field-list collapsible", LineNum: 3},
+		{Type: "text", Name: "name", Label: "Name", LineNum: 4},
+		{Type: endGroup, LineNum: 5},
+		{Type: endGroup, LineNum: 6},
+	}}
+	ajf, warnings, err := Convert(xls, ConvertOptions{CollapsibleGroups: true})
+	check(t, err)
+	if !ajf.Slides[0].Nodes[0].Collapsible || ajf.Slides[0].Collapsible {
+		t.Fatalf("Unexpected collapsible flags: %# v", pretty.Formatter(ajf.Slides))
+	}
+	if len(warnings) != 1 || warnings[0].LineNum != 2 {
+		t.Fatalf("Expected a warning for the collapsible slide, got %v", warnings)
+	}
+
+	ajf, _, err = Convert(xls, ConvertOptions{})
+	check(t, err)
+	if ajf.Slides[0].Nodes[0].Collapsible {
+		t.Fatal("Group made collapsible without the CollapsibleGroups option")
 	}
 }
 
-func TestTranslationIndex(t *testing.T) {
-	if i := translationIndex(nil, "foo", "bar"); i != -1 {
-		t.Fatalf("translationIndex(nil, \"foo\", \"bar\") expected to be -1, found %d", i)
+func TestUnrollNestedRepeats(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: beginRepeat, Name: "household", Label: "Household", LineNum: 2},
+		{Type: beginRepeat, Name: "child", Label: "Child", RepeatCount: "2", LineNum: 3},
+		{Type: "text", Name: "child_name", Label: "Name", LineNum: 4},
+		{Type: "integer", Name: "age", Label: "Age of ${child_name}", Relevant: "${child_name} != ''", LineNum: 5},
+		{Type: endRepeat, LineNum: 6},
+		{Type: endRepeat, LineNum: 7},
+	}}
+	if _, _, err := Convert(xls, ConvertOptions{}); err == nil {
+		t.Fatal("Expected error for nested repeats")
 	}
-	row := []string{"type", "label", "label::English (en)", "label::French (fr)", "label::Italian (it)"}
-	if i := translationIndex(row, "label", "fr"); i != 3 {
-		t.Fatalf("translationIndex(%v, \"label\", \"fr\")\nexpected to be 3, found %d", row, i)
+	ajf, _, err := Convert(xls, ConvertOptions{UnrollNestedRepeats: true})
+	check(t, err)
+	repeat := ajf.Slides[0]
+	if repeat.Type != NtRepeatingSlide || len(repeat.Nodes) != 2 {
+		t.Fatalf("Unexpected unrolled repeat: %# v", pretty.Formatter(repeat))
 	}
-	if i := translationIndex(row, "type", "en"); i != -1 {
-		t.Fatalf("translationIndex(%v, \"type\", \"en\")\nexpected to be -1, found %d", row, i)
+	second := repeat.Nodes[1]
+	if second.Type != NtGroup || second.Name != "child__2" ||
+		second.Nodes[0].Name != "child_name__2" || second.Nodes[1].Label != "Age of ${child_name__2}" ||
+		second.Nodes[1].Visibility.Condition != "child_name__2 !== ''" {
+		t.Fatalf("Unexpected unrolled copy: %# v", pretty.Formatter(second))
+	}
+
+	xls.Survey[1].RepeatCount = "${n}"
+	if _, _, err := Convert(xls, ConvertOptions{UnrollNestedRepeats: true}); err == nil {
+		t.Fatal("Expected error for nested repeat with non-constant repeat_count")
 	}
 }
 
-func TestTranslation(t *testing.T) {
-	if tr := Translation(nil, "en"); tr != nil {
-		t.Fatalf("Translation(nil, \"en\") expected to be nil, found %v", tr)
+func TestStyle(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: beginGroup, Name: "a", Label: "A"},
+			{Type: "text", Name: "q1", Label: "Q1"},
+			{Type: endGroup},
+			{Type: beginGroup, Name: "b", Label: "B"},
+			{Type: "text", Name: "q2", Label: "Q2"},
+			{Type: endGroup},
+			{Type: beginRepeat, Name: "r", Label: "R"},
+			{Type: "text", Name: "q3", Label: "Q3"},
+			{Type: endRepeat},
+		},
+		Settings: []SettingsRow{{FormTitle: "Title", Style: "theme-grid", LineNum: 2}},
 	}
-	rows := [][]string{
-		{"", "", ""},
-		{"type", "label", "label::Italian (it)"},
-		{"text", "cheese", "formaggio"},
-		{"number", "bread", "pane"},
+	ajf, warnings, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	slides := ajf.Slides
+	if len(slides) != 2 || slides[0].Type != NtSlide || slides[0].Label != "Title" || len(slides[0].Nodes) != 2 ||
+		slides[0].Nodes[0].Type != NtGroup || slides[0].Nodes[1].Name != "b" || slides[1].Type != NtRepeatingSlide {
+		t.Fatalf("Unexpected slides for single page style: %# v", pretty.Formatter(slides))
 	}
-	tr := Translation(rows, "it")
-	expected := map[string]string{"cheese": "formaggio", "bread": "pane"}
-	if !reflect.DeepEqual(tr, expected) {
-		t.Fatalf("Error translating %v\nexpected: %v\n got: %v", rows, expected, tr)
+	if len(warnings) != 1 {
+		t.Fatalf("Expected a warning for the theme, got %v", warnings)
+	}
+
+	xls.Settings[0].Style = "pages theme-grid"
+	ajf, _, err = Convert(xls, ConvertOptions{})
+	check(t, err)
+	if len(ajf.Slides) != 3 || ajf.Slides[0].Type != NtSlide || ajf.Slides[1].Name != "b" {
+		t.Fatalf("Unexpected slides for pages style: %# v", pretty.Formatter(ajf.Slides))
+	}
+
+	// Without a style, each top-level group is still a slide.
+	for _, settings := range [][]SettingsRow{{{FormTitle: "Title", LineNum: 2}}, nil} {
+		xls.Settings = settings
+		unstyled, _, err := Convert(xls, ConvertOptions{})
+		check(t, err)
+		if !reflect.DeepEqual(unstyled.Slides, ajf.Slides) {
+			t.Error("Unexpected slides without a style:")
+			logFatalDiff(t, unstyled.Slides, ajf.Slides)
+		}
 	}
 }
 
-func BenchmarkDecXls(b *testing.B) {
-	for n := 0; n < b.N; n++ {
-		_, err := DecXlsFromFile("testdata/Picaps_baseline_form.xls")
-		check(b, err)
+func TestRepeatedQuestion(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: "text", Name: "phone", Label: "Phones", Relevant: "${has_phone}", RepeatCount: "3", LineNum: 2},
+		{Type: "text", Name: "phone_repeat", Label: "Name collision", LineNum: 3},
+		{Type: "boolean", Name: "has_phone", Label: "Do you have a phone?", LineNum: 4},
+	}}
+	ajf, _, err := Convert(xls, ConvertOptions{WrapUngrouped: true})
+	check(t, err)
+	repeat := ajf.Slides[0]
+	if repeat.Type != NtRepeatingSlide || repeat.Name != "phone_repeat_1" || repeat.Label != "Phones" ||
+		*repeat.MaxReps != 3 || repeat.Visibility.Condition != "has_phone" ||
+		len(repeat.Nodes) != 1 || repeat.Nodes[0].Name != "phone" || repeat.Nodes[0].Visibility != nil {
+		t.Fatalf("Unexpected repeat for repeated question: %# v", pretty.Formatter(repeat))
 	}
 }
 
-func BenchmarkDecXlsx(b *testing.B) {
-	for n := 0; n < b.N; n++ {
-		_, err := DecXlsFromFile("testdata/Picaps_baseline_form.xlsx")
-		check(b, err)
+func TestRepeatCount(t *testing.T) {
+	survey := []SurveyRow{
+		{Type: beginRepeat, Name: "members", RepeatCount: "5"},
+		{Type: "text", Name: "member_name"},
+		{Type: endRepeat},
+	}
+	var b nodeBuilder
+	repeat, err := b.buildGroup(survey)
+	check(t, err)
+	if repeat.MaxReps == nil || *repeat.MaxReps != 5 || repeat.FormulaReps != nil {
+		t.Fatalf("Unexpected repetitions of repeat with constant count: %# v", pretty.Formatter(repeat))
+	}
+
+	survey[0].RepeatCount = "${household_size} - 1"
+	repeat, err = b.buildGroup(survey)
+	check(t, err)
+	if repeat.MaxReps != nil || repeat.FormulaReps == nil || repeat.FormulaReps.Formula != "household_size - 1" {
+		t.Fatalf("Unexpected repetitions of repeat with formula count: %# v", pretty.Formatter(repeat))
+	}
+
+	survey[0].RepeatCount = "${household_size} +"
+	if _, err = b.buildGroup(survey); err == nil {
+		t.Fatal("Expected error for invalid repeat_count formula")
 	}
 }
 
-func BenchmarkXls2ajf(b *testing.B) {
-	xls, err := DecXlsFromFile("testdata/Picaps_baseline_form.xlsx")
-	check(b, err)
-	b.ResetTimer()
-	for n := 0; n < b.N; n++ {
-		_, err = Convert(xls)
-		check(b, err)
+func TestHiddenFields(t *testing.T) {
+	var b nodeBuilder
+	rows := []SurveyRow{
+		{Type: "hidden", Name: "token", Default: "abc"},
+		{Type: "calculate", Name: "total", Calculation: "${a} + ${b}"},
+	}
+	for _, row := range rows {
+		field, err := b.buildField(&row)
+		check(t, err)
+		if field.Name != row.Name || field.Visibility == nil || field.Visibility.Condition != "false" {
+			t.Fatalf("Question of type %s not converted to hidden field: %# v", row.Type, pretty.Formatter(field))
+		}
+	}
+
+	row := SurveyRow{Type: "calculate", Name: "total", Label: "Total:", Calculation: "${a} + ${b}"}
+	field, err := b.buildField(&row)
+	check(t, err)
+	if field.Visibility != nil {
+		t.Fatalf("Calculation with label converted to hidden field: %# v", pretty.Formatter(field))
+	}
+}
+
+func TestRank(t *testing.T) {
+	b := nodeBuilder{originNames: map[string]string{"colors": "colors"}}
+	row := SurveyRow{Type: "rank colors", Name: "preferred", Default: "red blue"}
+	field, err := b.buildField(&row)
+	check(t, err)
+	if *field.FieldType != FtMultipleChoice || !field.Ranked || field.ChoicesOriginRef != "colors" {
+		t.Fatalf("Unexpected conversion of rank question: %# v", pretty.Formatter(field))
+	}
+}
+
+func TestRandomizeChoices(t *testing.T) {
+	b := nodeBuilder{originNames: map[string]string{"colors": "colors"}}
+	row := SurveyRow{Type: "select_one colors", Name: "color", Parameters: "randomize=true seed=${resp_id}"}
+	field, err := b.buildField(&row)
+	check(t, err)
+	if !field.RandomizeChoices || field.RandomSeed == nil || field.RandomSeed.Formula != "resp_id" {
+		t.Fatalf("Unexpected randomization: %# v", pretty.Formatter(field))
+	}
+
+	b.opts.FixedSeed = "42"
+	field, err = b.buildField(&row)
+	check(t, err)
+	if field.RandomSeed == nil || field.RandomSeed.Formula != "42" {
+		t.Fatalf("Fixed seed not applied: %# v", pretty.Formatter(field))
+	}
+
+	row.Parameters = "seed=${resp_id}"
+	field, err = b.buildField(&row)
+	check(t, err)
+	if field.RandomizeChoices || field.RandomSeed != nil || len(b.warnings) != 1 {
+		t.Fatalf("Seed without randomize not ignored: %# v", pretty.Formatter(field))
+	}
+
+	row.Parameters = "randomize=maybe"
+	if _, err = b.buildField(&row); err == nil {
+		t.Fatal("Expected error for invalid randomize parameter")
+	}
+	if _, _, err = Convert(&XlsForm{}, ConvertOptions{FixedSeed: "abc"}); err == nil {
+		t.Fatal("Expected error for invalid fixed seed")
+	}
+
+	b.warnings = nil
+	row.Parameters = "zeta=1 randomize=yes alpha=2"
+	_, err = b.buildField(&row)
+	check(t, err)
+	if len(b.warnings) != 2 || !strings.Contains(b.warnings[0].Message, `"alpha"`) ||
+		!strings.Contains(b.warnings[1].Message, `"zeta"`) {
+		t.Fatalf("Unsupported parameters not reported in order: %v", b.warnings)
+	}
+}
+
+func TestNumberFormat(t *testing.T) {
+	var b nodeBuilder
+	row := SurveyRow{Type: "decimal", Name: "weight", Parameters: "decimals=2", Appearance: "thousands-sep"}
+	field, err := b.buildField(&row)
+	check(t, err)
+	if field.Decimals == nil || *field.Decimals != 2 || !field.ThousandsSep || len(b.warnings) != 0 {
+		t.Fatalf("Unexpected number format: %# v", pretty.Formatter(field))
+	}
+
+	row.Type = "integer"
+	field, err = b.buildField(&row)
+	check(t, err)
+	if field.Decimals != nil || !field.ThousandsSep || len(b.warnings) != 1 {
+		t.Fatalf("Decimals not ignored for integer: %# v", pretty.Formatter(field))
+	}
+
+	b.warnings = nil
+	row.Parameters = "zeta=1 decimals=2 alpha=2"
+	_, err = b.buildField(&row)
+	check(t, err)
+	if len(b.warnings) != 3 || !strings.Contains(b.warnings[0].Message, `"alpha"`) ||
+		!strings.Contains(b.warnings[1].Message, `"decimals"`) || !strings.Contains(b.warnings[2].Message, `"zeta"`) {
+		t.Fatalf("Unsupported parameters not reported in order: %v", b.warnings)
+	}
+
+	row.Type, row.Parameters = "decimal", "decimals=-1"
+	if _, err = b.buildField(&row); err == nil {
+		t.Fatal("Expected error for invalid decimals parameter")
+	}
+}
+
+func TestUnits(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: "decimal", Name: "weight", Label: "Weight", Unit: "kg", LineNum: 2},
+		{Type: "decimal", Name: "tare", Label: "Tare", Unit: "g", Constraint: ". < ${weight}", LineNum: 3},
+		{Type: "calculate", Name: "net", Calculation: "${weight} - ${tare}", Unit: "kg", LineNum: 4},
+		{Type: "calculate", Name: "ratio", Calculation: "${tare} div ${weight} * 100", Unit: "%", LineNum: 5},
+		{Type: "text", Name: "notes", Label: "Notes", Unit: "kg", LineNum: 6},
+	}}
+	ajf, warnings, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	if ajf.Slides[0].Nodes[0].Unit != "kg" || ajf.Slides[0].Nodes[4].Unit != "" || len(warnings) != 1 {
+		t.Fatalf("Unexpected units: %# v %v", pretty.Formatter(ajf.Slides[0].Nodes), warnings)
+	}
+
+	_, warnings, err = Convert(xls, ConvertOptions{CheckUnits: true})
+	check(t, err)
+	expected := []Warning{
+		{3, "The constraint combines quantities with different units: ${tare} (g), ${weight} (kg)."},
+		{4, "The calculation combines quantities with different units: ${weight} (kg), ${tare} (g), ${net} (kg)."},
+		{6, `Questions of type "text" can't have a unit, ignoring.`},
+	}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Error("Unexpected unit warnings:")
+		logFatalDiff(t, warnings, expected)
+	}
+}
+
+func TestConvertXlsform(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: "text", Name: "name", Label: "Name", Appearance: "wide", LineNum: 2},
+	}}
+	res, err := ConvertXlsform(xls, ConvertOptions{})
+	check(t, err)
+	data, err := json.Marshal(res.Warnings)
+	check(t, err)
+	expected := `[{"line":2,"message":"Appearance \"wide\" is not supported for questions of type \"text\", ignoring."}]`
+	if res.Form == nil || string(data) != expected {
+		t.Fatalf("Unexpected conversion result, warnings: %s", data)
+	}
+
+	xls.Survey[0].Appearance = ""
+	res, err = ConvertXlsform(xls, ConvertOptions{})
+	check(t, err)
+	if res.Warnings == nil || len(res.Warnings) != 0 {
+		t.Fatalf("Expected empty warnings, got %#v", res.Warnings)
+	}
+}
+
+func TestEvalConstant(t *testing.T) {
+	constants := map[string]interface{}{
+		`1 + 2 * 3`:                          7.0,
+		`-(10 - 4) div 4`:                    -1.5,
+		`7 mod 4 = 3 and not(False) != True`: false,
+		`"a" = 'a' or "[x]" = 'y'`:           true,
+		`7 mod 4 = 3 and 2 <= 1`:             false,
+		`concat("v", '1.') + "2"`:            "v1.2",
+		`if(1 > 2, "a", "b")`:                "b",
+		`max(1, int(2.5), abs(-3))`:          3.0,
+		`1 + "2"`:                            nil, // implicit conversions
+		`${x} + 1`:                           nil,
+		`. > 1`:                              nil,
+		`random()`:                           nil,
+		`1 div 0`:                            nil,
+		`"a\tb"`:                             nil,
+	}
+	var p parser
+	for formula, expected := range constants {
+		js, err := p.Parse(formula, "calculation", "q")
+		check(t, err)
+		val, ok := evalConstant(js)
+		if ok != (expected != nil) || val != expected {
+			t.Fatalf("Unexpected value of %q: %v, %v", formula, val, ok)
+		}
+	}
+
+	b := nodeBuilder{opts: ConvertOptions{EvalConstants: true}}
+	row := SurveyRow{Type: "calculate", Name: "version", Calculation: `concat("1.", "2")`}
+	field, err := b.buildField(&row)
+	check(t, err)
+	if field.Formula == nil || field.Formula.Formula != `"1.2"` {
+		t.Fatalf("Unexpected field for constant calculation: %# v", pretty.Formatter(field))
+	}
+	row = SurveyRow{Type: "integer", Name: "score", Calculation: "2 * 5"}
+	field, err = b.buildField(&row)
+	check(t, err)
+	if field.Formula != nil || field.DefaultValue != 10.0 {
+		t.Fatalf("Unexpected field for question with constant calculation: %# v", pretty.Formatter(field))
+	}
+}
+
+func TestDeploymentOptions(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: beginGroup, Name: "g1", Label: "G1", LineNum: 2},
+			{Type: "select_one colors", Name: "color", Label: "Color", LineNum: 3},
+			{Type: "select_one colors", Name: "color2", Label: "Color", Appearance: "quick", LineNum: 4},
+			{Type: endGroup, LineNum: 5},
+			{Type: beginGroup, Name: "g2", Label: "G2", LineNum: 6},
+			{Type: "select_one yn", Name: "ok", Label: "Ok?", LineNum: 7},
+			{Type: endGroup, LineNum: 8},
+		},
+		Choices: []ChoicesRow{
+			{ListName: "colors", Name: "red", Label: "Red", LineNum: 2},
+			{ListName: "colors", Name: "green", Label: "Green", LineNum: 3},
+			{ListName: "colors", Name: "blue", Label: "Blue", LineNum: 4},
+			{ListName: "yn", Name: "yes", Label: "Yes", LineNum: 5},
+			{ListName: "yn", Name: "no", Label: "No", LineNum: 6},
+		},
+	}
+	opts := ConvertOptions{IdStartOffset: 10, DefaultLanguage: "it", MaxChoicesInline: 2}
+	ajf, _, err := Convert(xls, opts)
+	check(t, err)
+	g1, g2 := ajf.Slides[0], ajf.Slides[1]
+	if ajf.DefaultLanguage != "it" || g1.Id != 11 || g1.Previous != 0 || g2.Id != 12 || g2.Previous != 11 ||
+		g1.Nodes[0].Id != 11001 || g1.Nodes[0].Previous != 11 {
+		t.Fatalf("Unexpected ids or language: %# v", pretty.Formatter(ajf))
+	}
+	if !g1.Nodes[0].ForceNarrow || g1.Nodes[1].ForceNarrow || g2.Nodes[0].ForceNarrow {
+		t.Fatalf("Unexpected dropdowns: %# v", pretty.Formatter(ajf.Slides))
+	}
+
+	xls.Settings = []SettingsRow{{DefaultLanguage: "fr", LineNum: 2}}
+	ajf, _, err = Convert(xls, opts)
+	check(t, err)
+	if ajf.DefaultLanguage != "fr" {
+		t.Fatalf("Default language of the settings overridden by option: %s", ajf.DefaultLanguage)
+	}
+}
+
+func TestHtmlLabel(t *testing.T) {
+	labels := map[string]bool{
+		"Your <b>full</b> name":        true,
+		"Line<br/>break":               true,
+		`<img src="x.png">`:            true,
+		"Is 3 < 4 and 5 > 2?":          false,
+		"Weight (<1kg, >10kg ignored)": false,
+	}
+	for label, hasHtml := range labels {
+		var b nodeBuilder
+		_, err := b.buildField(&SurveyRow{Type: "text", Name: "q", Label: label})
+		check(t, err)
+		if (len(b.warnings) == 1) != hasHtml {
+			t.Fatalf("Unexpected warnings for label %q: %v", label, b.warnings)
+		}
+		_, err = b.buildField(&SurveyRow{Type: "note", Name: "n", Label: label})
+		check(t, err)
+		if (len(b.warnings) == 1) != hasHtml {
+			t.Fatalf("Unexpected warnings for note %q: %v", label, b.warnings)
+		}
+	}
+}
+
+func TestNoteMode(t *testing.T) {
+	label := "# Welcome\nPlease read the **terms** at [this page](https://example.com/?a=1&b=2), *carefully* <3"
+	expected := map[NoteMode]string{
+		NoteHtml: label,
+		NoteText: "# Welcome<br>Please read the **terms** at [this page](https://example.com/?a=1&amp;b=2), " +
+			"*carefully* &lt;3",
+		NoteMarkdown: "<h1>Welcome</h1>Please read the <strong>terms</strong> at " +
+			`<a href="https://example.com/?a=1&amp;b=2">this page</a>, <em>carefully</em> &lt;3`,
+	}
+	for mode, html := range expected {
+		b := nodeBuilder{opts: ConvertOptions{Notes: mode}}
+		field, err := b.buildField(&SurveyRow{Type: "note", Name: "n", Label: label})
+		check(t, err)
+		if field.HTML != html {
+			t.Fatalf("Unexpected html for note mode %d:\n%s", mode, field.HTML)
+		}
+	}
+	if html := markdownToHtml("[click](javascript:alert(1))"); strings.Contains(html, "<a") {
+		t.Fatalf("Unsafe link converted: %s", html)
+	}
+
+	rows := [][]string{
+		{"type", "name", "label", "label::Italian (it)"},
+		{"note", "n", "**Hello**", "**Ciao**"},
+	}
+	tr, err := Translations(rowsWorkBook{"survey": rows}, ConvertOptions{Notes: NoteMarkdown})
+	check(t, err)
+	if tr["it"]["<strong>Hello</strong>"] != "<strong>Ciao</strong>" || tr["it"]["**Hello**"] != "**Ciao**" {
+		t.Fatalf("Unexpected translations: %v", tr)
+	}
+}
+
+func TestSanitizeHtml(t *testing.T) {
+	cases := [][2]string{
+		{"<b>bold</b> &amp; <i>it</i><br/>", "<b>bold</b> &amp; <i>it</i><br>"},
+		{"a < b && c > d", "a &lt; b &amp;&amp; c &gt; d"},
+		{`<p onclick="alert(1)" style="color:red">x</p>`, "<p>x</p>"},
+		{`<a href="https://example.com" target=_blank title='T'>l</a>`, `<a href="https://example.com" title="T">l</a>`},
+		{`<a href="javascript:alert(1)">l</a>`, "<a>l</a>"},
+		{`<a href="&#106;avascript:alert(1)">l</a>`, "<a>l</a>"},
+		{"<script>alert('<b>')</script>ok", "ok"},
+		{"<SCRIPT>alert(1)</script >ok<!-- c -->!", "ok!"},
+		{`<img src=x onerror=alert(1)>text<font color=red>red</font>`, "textred"},
+		{"<style>body{}", ""},
+	}
+	for _, c := range cases {
+		if got := sanitizeHtml(c[0]); got != c[1] {
+			t.Errorf("sanitizeHtml(%q) = %q, expected %q", c[0], got, c[1])
+		}
+	}
+
+	b := nodeBuilder{opts: ConvertOptions{Notes: NoteSanitized}}
+	field, err := b.buildField(&SurveyRow{Type: "note", Name: "n",
+		Label: "# Title\n**Read** the <u>terms</u><script>x()</script>"})
+	check(t, err)
+	if expected := "<h1>Title</h1><strong>Read</strong> the <u>terms</u>"; field.HTML != expected {
+		t.Fatalf("Unexpected html for sanitized note:\n%s", field.HTML)
+	}
+}
+
+func TestMarkdownLabels(t *testing.T) {
+	b := nodeBuilder{opts: ConvertOptions{MarkdownLabels: true}}
+	field, err := b.buildField(&SurveyRow{Type: "text", Name: "q", Label: "Your **full** name\n<i>as in the ID</i>"})
+	check(t, err)
+	if expected := "Your <strong>full</strong> name<br>&lt;i&gt;as in the ID&lt;/i&gt;"; field.Label != expected {
+		t.Fatalf("Unexpected markdown label:\n%s", field.Label)
+	}
+	group, err := b.buildGroup([]SurveyRow{
+		{Type: beginGroup, Name: "g", Label: "*Group*"},
+		{Type: "note", Name: "n", Label: "**note**"},
+		{Type: endGroup},
+	})
+	check(t, err)
+	if group.Label != "<em>Group</em>" || group.Nodes[0].HTML != "**note**" {
+		t.Fatalf("Unexpected group: %# v", pretty.Formatter(group))
+	}
+
+	rows := [][]string{
+		{"type", "name", "label", "label::Italian (it)"},
+		{"text", "q", "*Name*", "*Nome*"},
+	}
+	tr, err := Translations(rowsWorkBook{"survey": rows}, ConvertOptions{MarkdownLabels: true})
+	check(t, err)
+	if tr["it"]["<em>Name</em>"] != "<em>Nome</em>" {
+		t.Fatalf("Unexpected translations: %v", tr)
+	}
+}
+
+func TestCalculatedValue(t *testing.T) {
+	var b nodeBuilder
+	row := SurveyRow{Type: "integer", Name: "total", Calculation: "${a} + ${b}"}
+	field, err := b.buildField(&row)
+	check(t, err)
+	if *field.FieldType != FtNumber || field.Formula == nil || field.Formula.Formula != "a + b" {
+		t.Fatalf("Unexpected field for visible question with calculation: %# v", pretty.Formatter(field))
+	}
+
+	row.Default = "3"
+	if _, err = b.buildField(&row); err == nil {
+		t.Fatal("Expected error for question with both default value and calculation")
+	}
+}
+
+func TestRepeatJoinKeys(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: beginGroup, Name: "household", Label: "Household"},
+		{Type: "text", Name: "household_id", Label: "Id"},
+		{Type: endGroup},
+		{Type: beginRepeat, Name: "members", Label: "Members"},
+		{Type: "text", Name: "members_index", Label: "Name collision"},
+		{Type: endRepeat},
+	}}
+	opts := ConvertOptions{RepeatJoinKeys: true, RepeatParentKey: "${household_id}"}
+	ajf, _, err := Convert(xls, opts)
+	check(t, err)
+	nodes := ajf.Slides[1].Nodes
+	if len(nodes) != 3 || nodes[0].Name != "members_index_1" || nodes[0].Formula.Formula != repeatIndexFormula ||
+		nodes[1].Name != "members_parent_key" || nodes[1].Formula.Formula != "household_id" ||
+		nodes[1].Visibility.Condition != "false" {
+		t.Fatalf("Unexpected join keys: %# v", pretty.Formatter(nodes))
+	}
+}
+
+func TestValidValues(t *testing.T) {
+	survey := []SurveyRow{
+		{Type: "text", Name: "a", Required: "yes", Appearance: "multiline"},
+		{Type: "select_one list", Name: "b", Appearance: "minimal quick"},
+		{Type: "text", Name: "c"},
+	}
+	valid := map[string][]string{
+		"required":   {"yes", "no"},
+		"appearance": {"multiline", "minimal", "quick"},
+	}
+	check(t, checkValidValues(survey, valid))
+
+	survey[2].Required = "true"
+	if err := checkValidValues(survey, valid); err == nil {
+		t.Fatal("Expected error for value not allowed")
+	}
+	if err := checkValidValues(survey, map[string][]string{"colour": {"red"}}); err == nil {
+		t.Fatal("Expected error for unknown column")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	survey := []SurveyRow{
+		{Type: "text", Name: "a", LineNum: 2},
+		{Type: "text", Name: "b", Disabled: "yes", LineNum: 3},
+		{Type: beginGroup, Name: "g", Disabled: "yes", LineNum: 4},
+		{Type: "text", Name: "c", LineNum: 5},
+		{Type: endGroup, LineNum: 6},
+		{Type: "text", Name: "d", Disabled: "no", LineNum: 7},
+	}
+	var b nodeBuilder
+	enabled := b.removeDisabled(survey)
+	if len(enabled) != 2 || enabled[0].Name != "a" || enabled[1].Name != "d" {
+		t.Fatalf("Unexpected survey after removing disabled rows: %# v", pretty.Formatter(enabled))
+	}
+	if len(b.warnings) != 2 || b.warnings[0].LineNum != 3 || b.warnings[1].LineNum != 4 {
+		t.Fatalf("Unexpected warnings for disabled rows: %v", b.warnings)
+	}
+
+	// A disabled end row alone doesn't break the structure of the group.
+	survey[2].Disabled, survey[4].Disabled = "", "yes"
+	b = nodeBuilder{}
+	enabled = b.removeDisabled(survey)
+	if len(enabled) != 5 || enabled[3].Type != endGroup || len(b.warnings) != 2 || b.warnings[1].LineNum != 6 {
+		t.Fatalf("Unexpected result disabling an end row: %# v %v", pretty.Formatter(enabled), b.warnings)
+	}
+}
+
+func TestFieldTypes(t *testing.T) {
+	types := map[string]FieldType{
+		"text":        FtString,
+		"geopoint":    FtGeolocation,
+		"geotrace":    FtString,
+		"geoshape":    FtString,
+		"image":       FtImage,
+		"audio":       FtFile,
+		"file":        FtFile,
+		"datetime":    FtString,
+		"acknowledge": FtBoolean,
+		"trigger":     FtBoolean,
+	}
+	var b nodeBuilder
+	for typ, expected := range types {
+		row := SurveyRow{Type: typ, Name: "field"}
+		field, err := b.buildField(&row)
+		check(t, err)
+		if field.FieldType == nil || *field.FieldType != expected {
+			t.Fatalf("Question of type %q converted to field type %v, expected %d", typ, field.FieldType, expected)
+		}
+	}
+}
+
+func TestDateTime(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: beginGroup, Name: "g", Label: "G", LineNum: 2},
+		{Type: "datetime", Name: "visit", Label: "Visit", LineNum: 3},
+		{Type: "start", Name: "started", LineNum: 4},
+		{Type: endGroup, LineNum: 5},
+	}}
+	form, _, err := Convert(xls, ConvertOptions{Metadata: MetadataHidden})
+	check(t, err)
+	// The numeric field types are checked, as ajf has no datetime type (18 is a signature).
+	data, err := json.Marshal(form)
+	check(t, err)
+	var decoded struct {
+		Nodes []struct {
+			Nodes []struct {
+				FieldType  int `json:"fieldType"`
+				Validation *struct {
+					Conditions []struct {
+						Condition string `json:"condition"`
+					} `json:"conditions"`
+				} `json:"validation"`
+			} `json:"nodes"`
+		} `json:"nodes"`
+	}
+	check(t, json.Unmarshal(data, &decoded))
+	fields := decoded.Nodes[0].Nodes
+	if fields[0].FieldType != 0 || fields[1].FieldType != 0 {
+		t.Fatalf("Unexpected field types %d and %d for datetime and start", fields[0].FieldType, fields[1].FieldType)
+	}
+	if fields[0].Validation == nil || len(fields[0].Validation.Conditions) != 1 ||
+		fields[0].Validation.Conditions[0].Condition != dateTimeCondition("visit") {
+		t.Fatalf("Missing datetime validation: %s", data)
+	}
+
+	if errs := Validate(map[string]interface{}{"visit": "2019-05-01T10:30"}, form); len(errs) > 0 {
+		t.Fatalf("Unexpected errors validating a datetime: %v", errs)
+	}
+	if errs := Validate(map[string]interface{}{"visit": "yesterday"}, form); len(errs) != 1 || errs[0].Field != "visit" {
+		t.Fatalf("Expected an error for an invalid datetime, got %v", errs)
+	}
+
+	back, err := Ajf2xls(form)
+	check(t, err)
+	if row := back.Survey[1]; row.Type != "datetime" || row.Constraint != "" {
+		t.Fatalf("Datetime field converted back to %q with constraint %q", row.Type, row.Constraint)
+	}
+}
+
+func TestSkipUnsupportedFields(t *testing.T) {
+	survey := []SurveyRow{{Type: "text", LineNum: 2}, {Type: "xml-external", LineNum: 3}}
+	var b nodeBuilder
+	if _, err := b.checkTypes(survey); err == nil {
+		t.Fatal("Unsupported question type not reported as error")
+	}
+	b.opts.SkipUnsupportedFields = true
+	checked, err := b.checkTypes(survey)
+	check(t, err)
+	if len(checked) != 1 || len(b.warnings) != 1 || b.warnings[0].LineNum != 3 {
+		t.Fatalf("Unsupported question not skipped with warning: %v, %v", checked, b.warnings)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	survey := []SurveyRow{{Type: "text", LineNum: 2}, {Type: "deviceid", Name: "device", LineNum: 3}}
+	b := nodeBuilder{opts: ConvertOptions{Metadata: MetadataSkip}}
+	checked, err := b.checkTypes(survey)
+	check(t, err)
+	if len(checked) != 1 || len(b.warnings) != 1 {
+		t.Fatalf("Metadata question not skipped with warning: %v, %v", checked, b.warnings)
+	}
+
+	b = nodeBuilder{opts: ConvertOptions{Metadata: MetadataHidden}}
+	checked, err = b.checkTypes(survey)
+	check(t, err)
+	if len(checked) != 2 {
+		t.Fatalf("Metadata question unexpectedly skipped: %v", checked)
+	}
+	field, err := b.buildField(&checked[1])
+	check(t, err)
+	if *field.FieldType != FtString || field.Visibility == nil || field.Visibility.Condition != "false" {
+		t.Fatalf("Metadata question not converted to hidden field: %# v", pretty.Formatter(field))
+	}
+	// The timestamps are strings, ajf has no datetime fields.
+	for _, typ := range []string{"start", "end"} {
+		field, err = b.buildField(&SurveyRow{Type: typ, Name: typ})
+		check(t, err)
+		if *field.FieldType != FtString {
+			t.Fatalf("Metadata question %s converted to field type %d", typ, *field.FieldType)
+		}
+	}
+}
+
+func TestAppearance(t *testing.T) {
+	var b nodeBuilder
+	row := SurveyRow{Type: "text", Name: "notes", Appearance: "multiline"}
+	field, err := b.buildField(&row)
+	check(t, err)
+	if *field.FieldType != FtText {
+		t.Fatalf("Multiline text not converted to text field: %# v", pretty.Formatter(field))
+	}
+	row = SurveyRow{Type: "select_one yes_no", Name: "pizza", Appearance: "minimal"}
+	field, err = b.buildField(&row)
+	check(t, err)
+	if !field.ForceNarrow || field.ForceExpanded {
+		t.Fatalf("Minimal appearance not applied: %# v", pretty.Formatter(field))
+	}
+	row.Appearance = "likert"
+	field, err = b.buildField(&row)
+	check(t, err)
+	if !field.ForceExpanded || field.ForceNarrow {
+		t.Fatalf("Likert appearance not applied: %# v", pretty.Formatter(field))
+	}
+	if len(b.warnings) != 0 {
+		t.Fatalf("Unexpected warnings: %v", b.warnings)
+	}
+	row.Appearance = "signature"
+	_, err = b.buildField(&row)
+	check(t, err)
+	if len(b.warnings) != 1 {
+		t.Fatalf("Expected warning for unsupported appearance, got: %v", b.warnings)
+	}
+}
+
+func TestDefaultValue(t *testing.T) {
+	b := nodeBuilder{choices: map[string][]Choice{"colors": {{Value: "red"}, {Value: "blue"}}}}
+	defaults := []struct {
+		typ, def string
+		value    interface{}
+	}{
+		{"decimal", "1.5", 1.5},
+		{"integer", "3", 3},
+		{"boolean", "yes", true},
+		{"acknowledge", "OK", true},
+		{"date", "2019-05-01", "2019-05-01"},
+		{"datetime", "2019-05-01T10:30", "2019-05-01T10:30"},
+		{"text", "hello", "hello"},
+		{"select_one colors", "red", "red"},
+		{"select_multiple colors", "red blue", []string{"red", "blue"}},
+	}
+	for _, d := range defaults {
+		row := SurveyRow{Type: d.typ, Name: "field", Default: d.def}
+		field, err := b.buildField(&row)
+		check(t, err)
+		if !reflect.DeepEqual(field.DefaultValue, d.value) {
+			t.Fatalf("Default %q of %s converted to %#v, expected %#v", d.def, d.typ, field.DefaultValue, d.value)
+		}
+	}
+
+	errDefaults := [][2]string{
+		{"integer", "1.5"}, {"boolean", "maybe"}, {"date", "01/05/2019"},
+		{"select_one colors", "green"}, {"note", "hello"},
+	}
+	for _, d := range errDefaults {
+		row := SurveyRow{Type: d[0], Name: "field", Default: d[1]}
+		if _, err := b.buildField(&row); err == nil {
+			t.Fatalf("Expected error for default %q of %s", d[1], d[0])
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	var b nodeBuilder
+	row := SurveyRow{Type: "text", Name: "center", Default: "Milano", ReadOnly: "yes"}
+	field, err := b.buildField(&row)
+	check(t, err)
+	if field.Editable == nil || *field.Editable {
+		t.Fatalf("Read-only question converted to editable field: %# v", pretty.Formatter(field))
+	}
+	row.ReadOnly = "no"
+	field, err = b.buildField(&row)
+	check(t, err)
+	if field.Editable != nil {
+		t.Fatalf("Question converted to read-only field: %# v", pretty.Formatter(field))
+	}
+	row.ReadOnly = "maybe"
+	field, err = b.buildField(&row)
+	check(t, err)
+	if field.Editable != nil || len(b.warnings) != 1 {
+		t.Fatalf("Expected editable field and warning for unrecognized read_only, got: %v", b.warnings)
+	}
+}
+
+func TestRange(t *testing.T) {
+	var b nodeBuilder
+	row := SurveyRow{Type: "range", Name: "score", Parameters: "start=1;end=5 step=0.5"}
+	field, err := b.buildField(&row)
+	check(t, err)
+	start, end, step := 1.0, 5.0, 0.5
+	expected := Node{
+		Name:       "score",
+		Type:       NtField,
+		FieldType:  &FtRange,
+		Start:      &start,
+		End:        &end,
+		Step:       &step,
+		Validation: &FieldValidation{MinValue: &start, MaxValue: &end},
+	}
+	if !reflect.DeepEqual(field, expected) {
+		t.Error("Error converting range, unexpected result:")
+		logFatalDiff(t, field, expected)
+	}
+
+	for _, params := range []string{"start=a", "begin=1", "start=1 end=5 step=-1", "step"} {
+		row.Parameters = params
+		if _, err := b.buildField(&row); err == nil {
+			t.Fatalf("Expected error for range parameters %q", params)
+		}
+	}
+}
+
+func TestParseYesNo(t *testing.T) {
+	values := map[string]bool{"yes": true, "TRUE": true, " 1 ": true, "Si": true, "": false, "no": false, "false()": false}
+	for cell, expected := range values {
+		if val, ok := parseYesNo(cell); !ok || val != expected {
+			t.Fatalf("parseYesNo(%q) = %v, %v, expected %v, true", cell, val, ok, expected)
+		}
+	}
+	if _, ok := parseYesNo("maybe"); ok {
+		t.Fatal(`parseYesNo("maybe") expected to fail`)
+	}
+
+	var b nodeBuilder
+	row := SurveyRow{Type: "text", Name: "name", Required: "maybe"}
+	v, err := b.fieldValidation(&row)
+	check(t, err)
+	if v != nil || len(b.warnings) != 1 {
+		t.Fatalf("Expected no validation and a warning, got: %v, %v", v, b.warnings)
+	}
+}
+
+func TestAssignIds(t *testing.T) {
+	nodes := []Node{{Nodes: []Node{{}, {}}}, {}}
+	err := assignIds(nodes, 0, 10)
+	check(t, err)
+	if nodes[0].Id != 1 || nodes[1].Id != 2 || nodes[0].Nodes[1].Id != 12 || nodes[0].Nodes[1].Previous != 11 {
+		t.Fatalf("Unexpected ids: %# v", pretty.Formatter(nodes))
+	}
+	if err := assignIds(nodes, 0, 2); err == nil {
+		t.Fatal("Id overflow not detected")
+	}
+	if err := assignIds(nodes, maxId/2, 10); err == nil {
+		t.Fatal("Id overflow not detected")
+	}
+}
+
+func TestIdAssigners(t *testing.T) {
+	newNodes := func() []Node {
+		return []Node{{Name: "a", Nodes: []Node{{Name: "b"}, {Name: "c"}}}, {Name: "d"}}
+	}
+	nodes := newNodes()
+	check(t, SequentialIds{Start: 10}.AssignIds(nodes))
+	if nodes[0].Id != 11 || nodes[0].Nodes[0].Id != 12 || nodes[0].Nodes[1].Id != 13 ||
+		nodes[0].Nodes[1].Previous != 12 || nodes[1].Id != 14 || nodes[1].Previous != 11 {
+		t.Fatalf("Unexpected sequential ids: %# v", pretty.Formatter(nodes))
+	}
+	if err := (SequentialIds{Start: maxId - 2}).AssignIds(nodes); err == nil {
+		t.Fatal("Id overflow not detected")
+	}
+
+	many := []Node{{Name: "g", Nodes: make([]Node, 1500)}}
+	if err := (HierarchicalIds{}).AssignIds(many); err == nil {
+		t.Fatal("Expected error for group with more than 999 children")
+	}
+	check(t, SequentialIds{}.AssignIds(many))
+	if many[0].Nodes[1499].Id != 1501 {
+		t.Fatalf("Unexpected id of last child: %d", many[0].Nodes[1499].Id)
+	}
+
+	nodes = newNodes()
+	check(t, NameHashIds{}.AssignIds(nodes))
+	c := nodes[0].Nodes[1]
+	if c.Id <= 0 || c.Id > maxId || c.Previous != nodes[0].Nodes[0].Id || nodes[0].Previous != 0 {
+		t.Fatalf("Unexpected name hash ids: %# v", pretty.Formatter(nodes))
+	}
+	// Ids don't depend on the position of the nodes.
+	moved := []Node{{Name: "d"}, {Name: "c"}}
+	check(t, NameHashIds{}.AssignIds(moved))
+	if moved[1].Id != c.Id || moved[1].Previous != moved[0].Id {
+		t.Fatalf("Name hash id changed with position: %d, %d", moved[1].Id, c.Id)
+	}
+	check(t, NameHashIds{Salt: "x"}.AssignIds(moved))
+	if moved[1].Id == c.Id {
+		t.Fatal("Salt not used in name hash ids")
+	}
+	if err := (NameHashIds{}).AssignIds([]Node{{Name: "a"}, {Name: "a"}}); err == nil {
+		t.Fatal("Id collision not detected")
+	}
+
+	xls := &XlsForm{Survey: []SurveyRow{{Type: "text", Name: "q", Label: "Q", LineNum: 2}}}
+	ajf, _, err := Convert(xls, ConvertOptions{IdAssigner: SequentialIds{Start: 100}})
+	check(t, err)
+	if ajf.Slides[0].Id != 101 || ajf.Slides[0].Nodes[0].Id != 102 {
+		t.Fatalf("IdAssigner option not applied: %# v", pretty.Formatter(ajf.Slides))
+	}
+}
+
+func TestPreviousIds(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: beginGroup, Name: "g", Label: "G", LineNum: 2},
+		{Type: "text", Name: "a", Label: "A", LineNum: 3},
+		{Type: "text", Name: "b", Label: "B", LineNum: 4},
+		{Type: endGroup, LineNum: 5},
+	}}
+	prev, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+
+	// Question a is removed, c is added before b.
+	xls.Survey = []SurveyRow{
+		xls.Survey[0],
+		{Type: "integer", Name: "c", Label: "C", LineNum: 3},
+		xls.Survey[2],
+		xls.Survey[3],
+	}
+	ajf, _, err := Convert(xls, ConvertOptions{IdAssigner: PreviousIds{prev}})
+	check(t, err)
+	g, pg := ajf.Slides[0], prev.Slides[0]
+	if g.Id != pg.Id || g.Nodes[1].Id != pg.Nodes[1].Id {
+		t.Fatalf("Ids not reused: %# v", pretty.Formatter(ajf.Slides))
+	}
+	if c := g.Nodes[0]; c.Id != pg.Nodes[1].Id+1 || c.Previous != g.Id || g.Nodes[1].Previous != c.Id {
+		t.Fatalf("Unexpected id of new question: %# v", pretty.Formatter(ajf.Slides))
+	}
+
+	if err := (PreviousIds{}).AssignIds(ajf.Slides); err == nil {
+		t.Fatal("Expected error for missing previous form")
+	}
+}
+
+func TestChoiceFilter(t *testing.T) {
+	wb := rowsWorkBook{
+		"survey": {
+			{"type", "name", "label", "choice_filter"},
+			{"begin group", "g", "G", ""},
+			{"select_one countries", "country", "Country", ""},
+			{"select_one regions", "region", "Region", "country = ${country} and name != 'x'"},
+			{"end group", "", "", ""},
+		},
+		"choices": {
+			{"list name", "name", "label", "country", "label::Italian (it)"},
+			{"countries", "it", "Italy", "", "Italia"},
+			{"regions", "lazio", "Lazio", "it", "Lazio"},
+		},
+	}
+	xls, err := DecXlsform(wb)
+	check(t, err)
+	if attrs := xls.Choices[1].Attributes; !reflect.DeepEqual(attrs, map[string]string{"country": "it"}) {
+		t.Fatalf("Unexpected choice attributes: %v", attrs)
+	}
+	ajf, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	filter := ajf.Slides[0].Nodes[1].ChoicesFilter
+	expected := &Formula{"$choice.attributes.country === country && $choice.value !== 'x'"}
+	if !reflect.DeepEqual(filter, expected) {
+		t.Fatalf("Error converting choice filter, expected: %v, got: %v", expected, filter)
+	}
+
+	xls.Survey[2].ChoiceFilter = "province = ${country}"
+	if _, _, err := Convert(xls, ConvertOptions{}); err == nil {
+		t.Fatal("Expected error for choice filter referring to an unknown attribute")
+	}
+}
+
+func TestOrOther(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: beginGroup, Name: "g", LineNum: 2},
+			{Type: "select_one colors or_other", Name: "color", Label: "Color", LineNum: 3},
+			{Type: "select_multiple colors or_other", Name: "colors", Label: "Colors", LineNum: 4},
+			{Type: "text", Name: "colors_other", Label: "Taken", LineNum: 5},
+			{Type: endGroup, LineNum: 6},
+		},
+		Choices: []ChoicesRow{{ListName: "colors", Name: "red", Label: "Red", LineNum: 2}},
+	}
+	if errs := ValidateXls(xls); len(errs) > 0 {
+		t.Fatalf("Unexpected validation errors: %v", errs)
+	}
+	ajf, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	expectedChoices := []Choice{{Value: "red", Label: "Red"}, {Value: "other", Label: "Other"}}
+	if choices := ajf.ChoicesOrigins[0].Choices; !reflect.DeepEqual(choices, expectedChoices) {
+		t.Fatalf("Unexpected choices with or_other: %v", choices)
+	}
+	nodes := ajf.Slides[0].Nodes
+	if len(nodes) != 5 {
+		t.Fatalf("Expected 5 fields, got %d", len(nodes))
+	}
+	expected := []struct{ name, visibility string }{
+		{"color_other", "color === 'other'"},
+		{"colors_other_1", "valueInChoice(colors, 'other')"},
+	}
+	for i, e := range expected {
+		node := nodes[2*i+1]
+		if node.Name != e.name || node.Visibility == nil || node.Visibility.Condition != e.visibility {
+			t.Errorf("Unexpected other field %q, visibility %v", node.Name, node.Visibility)
+		}
+	}
+	if len(xls.Choices) != 1 || xls.Survey[1].Type != "select_one colors or_other" {
+		t.Fatal("The xlsform was modified by the conversion")
+	}
+}
+
+func TestValidateSubmission(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: beginGroup, Name: "g", LineNum: 2},
+			{Type: "integer", Name: "age", Label: "Age", Required: "yes", Constraint: ". < 150",
+				ConstraintMessage: "Too old.", LineNum: 3},
+			{Type: "text", Name: "job", Label: "Job", Required: "yes", Relevant: "${age} >= 18", LineNum: 4},
+			{Type: "select_one colors", Name: "color", Label: "Color", LineNum: 5},
+			{Type: "select_multiple colors", Name: "colors", Label: "Colors", LineNum: 6},
+			{Type: "date", Name: "birth", Label: "Birth", LineNum: 7},
+			{Type: "text", Name: "code", Label: "Code", Constraint: "regex(., '[0-9]+')", LineNum: 8},
+			{Type: endGroup, LineNum: 9},
+			{Type: beginRepeat, Name: "children", LineNum: 10},
+			{Type: "text", Name: "child", Label: "Child", Required: "yes", LineNum: 11},
+			{Type: endRepeat, LineNum: 12},
+		},
+		Choices: []ChoicesRow{
+			{ListName: "colors", Name: "red", Label: "Red", LineNum: 2},
+			{ListName: "colors", Name: "blue", Label: "Blue", LineNum: 3},
+		},
+	}
+	form, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+
+	valid := map[string]interface{}{
+		"age": 30.0, "job": "baker", "color": "red", "colors": []interface{}{"red", "blue"},
+		"birth": "1990-05-01", "code": "A123", "child__0": "Ann", "child__1": "Bob",
+	}
+	if errs := Validate(valid, form); len(errs) > 0 {
+		t.Fatalf("Unexpected errors validating a valid submission: %v", errs)
+	}
+	// The job is hidden for minors.
+	if errs := Validate(map[string]interface{}{"age": 10.0}, form); len(errs) > 0 {
+		t.Fatalf("Unexpected errors validating a submission with hidden questions: %v", errs)
+	}
+
+	invalid := map[string]interface{}{
+		"age": 150.5, "color": "green", "colors": []interface{}{"red", 3.0},
+		"birth": "yesterday", "child__0": "",
+	}
+	expected := []ValidationError{
+		{"age", "The field value must be an integer."},
+		{"age", "Too old."},
+		{"job", "An answer is required."},
+		{"color", `"green" is not a choice of list "colors".`},
+		{"colors", "The answer must be a list of choice values."},
+		{"birth", "Invalid date yesterday."},
+		{"child__0", "An answer is required."},
+	}
+	if errs := Validate(invalid, form); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Unexpected validation errors:")
+		logFatalDiff(t, errs, expected)
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	answers := map[string]interface{}{"a": 2.0, "s": "abc", "m": []interface{}{"x", "y"}}
+	lookup := func(name string) interface{} { return answers[name] }
+	conditions := map[string]interface{}{
+		`a * 3 + 1 === 7 && !(a > 5)`:             true,
+		`Math.max(a, 10) / 4 % 2`:                 0.5,
+		`s.length === 3 ? s.startsWith("ab") : 0`: true,
+		`valueInChoice(m, 'y') || missing`:        true,
+		`notEmpty(missing) || null`:               nil,
+		`round(2.345, 2) >= 2.35 && isInt(a)`:     true,
+		`s + "||" + '!' === "abc||!"`:             true, // operators in strings
+		`("a").concat("b", s)`:                    "ababc",
+		`(s).match("b") !== null`:                 true,
+		`s.match("^[0-9]")`:                       nil,
+	}
+	for js, expected := range conditions {
+		val, ok := evalCondition(js, lookup)
+		if !ok || val != expected {
+			t.Errorf("Condition %s: expected %v, got %v (ok %v)", js, expected, val, ok)
+		}
+	}
+	for _, js := range []string{`a == "2"`, `new Date(s)`, `s.match("(?=b)")`, `a = 1`, `m === m`} {
+		if val, ok := evalCondition(js, lookup); ok {
+			t.Errorf("Condition %s should not be evaluated, got %v", js, val)
+		}
+	}
+}
+
+func TestDecScenarios(t *testing.T) {
+	data := `{
+	"adult": {"age": 34, "name": "O'Brien #1", "colors": ["red", "dark blue"], "consent": true},
+	"child": {"age": 5, "colors": ["red"], "birth": "2015-03-01", "note": null}
+}`
+	scenarios, err := DecScenarios([]byte(data))
+	check(t, err)
+	// The scenarios keep the order of the file.
+	expected := []Scenario{
+		{"adult", map[string]interface{}{
+			"age": 34.0, "name": "O'Brien #1", "colors": []interface{}{"red", "dark blue"}, "consent": true,
+		}},
+		{"child", map[string]interface{}{
+			"age": 5.0, "colors": []interface{}{"red"}, "birth": "2015-03-01", "note": nil,
+		}},
+	}
+	if !reflect.DeepEqual(scenarios, expected) {
+		t.Error("Unexpected scenarios:")
+		logFatalDiff(t, scenarios, expected)
+	}
+
+	for _, bad := range []string{"adult:\n  age: 34\n", `[{"age": 3}]`, `{"a": 1}`, `{"a": null}`,
+		`{"a": {"x": 1}, "a": {"x": 2}}`, `{"a": {"x": [1, 2}}`, `{"a": {}} {}`} {
+		if _, err := DecScenarios([]byte(bad)); err == nil {
+			t.Errorf("Expected error decoding %q", bad)
+		}
+	}
+}
+
+func TestRunScenario(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: beginGroup, Name: "g", LineNum: 2},
+		{Type: "integer", Name: "age", Label: "Age", Constraint: ". < 150", ConstraintMessage: "Too old.", LineNum: 3},
+		{Type: "calculate", Name: "adult", Calculation: "${age} >= 18", LineNum: 4},
+		{Type: "text", Name: "job", Label: "Job", Required: "yes", Relevant: "${adult}", LineNum: 5},
+		{Type: "text", Name: "code", Label: "Code", Relevant: "regex(${job}, 'x')", LineNum: 6},
+		{Type: endGroup, LineNum: 7},
+	}}
+	form, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+
+	res := RunScenario(form, Scenario{"adult", map[string]interface{}{"age": 30.0}})
+	expected := ScenarioResult{"adult", []QuestionResult{
+		{Name: "age", Visibility: "visible"},
+		{Name: "job", Visibility: "visible", Errors: []string{"An answer is required."}},
+		{Name: "code", Visibility: "unknown"},
+	}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Error("Unexpected scenario result:")
+		logFatalDiff(t, res, expected)
+	}
+
+	res = RunScenario(form, Scenario{"old child", map[string]interface{}{"age": 200.0, "adult": false}})
+	expected = ScenarioResult{"old child", []QuestionResult{
+		{Name: "age", Visibility: "visible", Errors: []string{"Too old."}},
+		{Name: "job", Visibility: "hidden"},
+		{Name: "code", Visibility: "unknown"},
+	}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Error("Unexpected scenario result:")
+		logFatalDiff(t, res, expected)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: "text", Name: "name", Label: "Name", LineNum: 2},
+			{Type: "select_one status", Name: "hiv", Label: "HIV status", Hint: "Ask privately",
+				Relevant: "${name} != 'John Doe'", Constraint: ". != 'unknown'", Sensitive: "yes", LineNum: 3},
+			{Type: "text", Name: "treatment", Label: "Treatment for ${hiv}", Relevant: "${hiv} = 'positive'",
+				Sensitive: "no", LineNum: 4},
+			{Type: beginGroup, Name: "income", Label: "Income", Sensitive: "yes", LineNum: 5},
+			{Type: "decimal", Name: "salary", Label: "Salary", LineNum: 6},
+			{Type: "calculate", Name: "tax", Calculation: "${salary} * 0.23", LineNum: 7},
+			{Type: endGroup, LineNum: 8},
+			{Type: "select_one colors", Name: "color", Label: "Color", LineNum: 9},
+		},
+		Choices: []ChoicesRow{
+			{ListName: "status", Name: "positive", Label: "Positive", LineNum: 2},
+			{ListName: "status", Name: "negative", Label: "Negative", LineNum: 3},
+			{ListName: "colors", Name: "red", Label: "Red", LineNum: 4},
+		},
+	}
+
+	anon, warnings, err := Anonymize(xls, AnonymizeOptions{})
+	check(t, err)
+	var names []string
+	for _, row := range anon.Survey {
+		names = append(names, row.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"name", "treatment", "color"}) {
+		t.Fatalf("Unexpected questions after removing the sensitive ones: %v", names)
+	}
+	treatment := anon.Survey[1]
+	if treatment.Relevant != "'' = 'positive'" || treatment.Label != "Treatment for " ||
+		len(warnings) != 2 || warnings[0].LineNum != 4 || warnings[1].LineNum != 4 {
+		t.Fatalf("Unexpected relevant %q, label %q, warnings %v", treatment.Relevant, treatment.Label, warnings)
+	}
+	checkNoSensitiveColumn(t, anon)
+	if len(anon.Choices) != 1 || anon.Choices[0].ListName != "colors" {
+		t.Fatalf("Unexpected choices after removing the sensitive ones: %v", anon.Choices)
+	}
+	_, _, err = Convert(anon, ConvertOptions{})
+	check(t, err)
+
+	anon, _, err = Anonymize(xls, AnonymizeOptions{Hash: true, Salt: "secret"})
+	check(t, err)
+	hiv := anon.Survey[1]
+	if !strings.HasPrefix(hiv.Name, "sensitive_") || hiv.Label != "Sensitive question "+hiv.Name[len("sensitive_"):] ||
+		hiv.Hint != "" || anon.Survey[2].Relevant != "${"+hiv.Name+"} = 'positive'" {
+		t.Fatalf("Unexpected hashed question %v, relevant %q", hiv, anon.Survey[2].Relevant)
+	}
+	if hiv.Relevant != "" || hiv.Constraint != "" {
+		t.Fatalf("The formulas of the sensitive questions should be removed: %v", hiv)
+	}
+	if anon.Survey[4].Name == "salary" || len(anon.Survey) != len(xls.Survey) {
+		t.Fatal("The questions of sensitive groups should be hashed")
+	}
+	if tax := anon.Survey[5]; tax.Calculation != "''" {
+		t.Fatalf("The calculations of the sensitive questions should be replaced: %q", tax.Calculation)
+	}
+	checkNoSensitiveColumn(t, anon)
+	if anon.Choices[0].Label != "Choice 1" || anon.Choices[0].Name != "positive" || anon.Choices[2].Label != "Red" {
+		t.Fatalf("Unexpected choices after hashing: %v", anon.Choices)
+	}
+	other, _, err := Anonymize(xls, AnonymizeOptions{Hash: true})
+	check(t, err)
+	if other.Survey[1].Name == hiv.Name {
+		t.Error("The salt should change the hashes")
+	}
+	_, _, err = Convert(anon, ConvertOptions{})
+	check(t, err)
+	if xls.Survey[1].Name != "hiv" || xls.Choices[0].Label != "Positive" {
+		t.Fatal("The xlsform was modified by Anonymize")
+	}
+
+	xls.Survey[0].Sensitive = "maybe"
+	if _, _, err := Anonymize(xls, AnonymizeOptions{}); err == nil {
+		t.Error("Expected error for unrecognized sensitive value")
+	}
+}
+
+// checkNoSensitiveColumn checks that the xlsx encoding of the form has no "sensitive" column.
+func checkNoSensitiveColumn(t *testing.T, xls *XlsForm) {
+	t.Helper()
+	f, err := newXlsxFile(xls)
+	check(t, err)
+	for _, cell := range f.Sheet["survey"].Rows[0].Cells {
+		if cell.Value == "sensitive" {
+			t.Fatal("The anonymized xlsform should not have the sensitive column")
+		}
+	}
+}
+
+func TestDependents(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: "integer", Name: "age", Label: "Age", LineNum: 2},
+		{Type: "calculate", Name: "adult", Calculation: "${age} >= 18 and ${age} < 150", LineNum: 3},
+		{Type: "calculate", Name: "senior", Calculation: "${adult} and ${age} > 65", LineNum: 4},
+		{Type: "text", Name: "job", Label: "Job of a ${age} years old", Relevant: "${adult}", LineNum: 5},
+		{Type: beginRepeat, Name: "r", RepeatCount: "${age}", LineNum: 6},
+		{Type: "text", Name: "child", Label: "Child", Relevant: "${senior}", LineNum: 7},
+		{Type: endRepeat, LineNum: 8},
+		{Type: "select_one ${child}", Name: "fav", Label: "Favourite", LineNum: 9},
+	}}
+	expected := []Dependency{
+		{"adult", "calculation", 3, ""},
+		{"senior", "calculation", 4, ""},
+		{"senior", "calculation", 4, "adult"},
+		{"job", "label", 5, ""},
+		{"job", "relevant", 5, "adult"},
+		{"r", "repeat_count", 6, ""},
+		{"child", "relevant", 7, "senior"},
+	}
+	if deps := Dependents(xls, "age"); !reflect.DeepEqual(deps, expected) {
+		t.Errorf("Unexpected dependencies of age:")
+		logFatalDiff(t, deps, expected)
+	}
+	expected = []Dependency{{"fav", "type", 9, ""}}
+	if deps := Dependents(xls, "child"); !reflect.DeepEqual(deps, expected) {
+		t.Fatalf("Unexpected dependencies of child: %v", deps)
+	}
+	if deps := Dependents(xls, "fav"); len(deps) != 0 {
+		t.Fatalf("Unexpected dependencies of fav: %v", deps)
+	}
+	if s := (Dependency{"job", "relevant", 5, "adult"}).String(); s != `line 5: relevant of "job", via ${adult}` {
+		t.Errorf("Unexpected string %q", s)
+	}
+}
+
+func TestHeaderMatching(t *testing.T) {
+	wb := rowsWorkBook{
+		"survey": {
+			{" Type", "NAME", "Label ", "Constraint Message", "label::Italian (it)"},
+			{"text", "q", "Question", "Too long", "Domanda"},
+		},
+		"choices": {
+			{"List_Name", "name", "label", "Country", "Media::IMAGE"},
+			{"yn", "y", "Yes", "it", "yes.png"},
+		},
+	}
+	xls, err := DecXlsform(wb)
+	check(t, err)
+	expected := &XlsForm{
+		Survey: []SurveyRow{{Type: "text", Name: "q", Label: "Question", ConstraintMessage: "Too long", LineNum: 2}},
+		Choices: []ChoicesRow{
+			{ListName: "yn", Name: "y", Label: "Yes", Image: "yes.png", LineNum: 2,
+				Attributes: map[string]string{"Country": "it"}},
+		},
+	}
+	if !reflect.DeepEqual(xls, expected) {
+		t.Error("Error decoding headers, unexpected result:")
+		logFatalDiff(t, xls, expected)
+	}
+	tr, err := Translations(wb, ConvertOptions{})
+	check(t, err)
+	if tr["it"]["Question"] != "Domanda" {
+		t.Fatalf("Unexpected translations: %v", tr)
+	}
+
+	_, err = DecXlsformWithOptions(wb, DecodeOptions{StrictHeaders: true})
+	if err == nil {
+		t.Fatal("Expected error for inexact headers in strict mode")
+	}
+	tr, err = TranslationsWithOptions(wb, ConvertOptions{}, DecodeOptions{StrictHeaders: true})
+	check(t, err)
+	if _, ok := tr["it"]["Question"]; ok {
+		t.Fatalf("Unexpected translation of inexact header in strict mode: %v", tr)
+	}
+}
+
+func TestSlideRequiredValidation(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: beginGroup, Name: "g", LineNum: 2},
+		{Type: "text", Name: "a", Required: "yes", LineNum: 3},
+		{Type: "text", Name: "b", LineNum: 4},
+		{Type: beginGroup, Name: "inner", Relevant: "${b} = 'x'", LineNum: 5},
+		{Type: "integer", Name: "c", Required: "yes", Relevant: "${a} != ''", LineNum: 6},
+		{Type: endGroup, LineNum: 7},
+		{Type: endGroup, LineNum: 8},
+		{Type: beginGroup, Name: "optional", LineNum: 9},
+		{Type: "text", Name: "d", LineNum: 10},
+		{Type: endGroup, LineNum: 11},
+	}}
+	ajf, _, err := Convert(xls, ConvertOptions{SlideRequiredValidation: true})
+	check(t, err)
+	expected := &FieldValidation{Conditions: []ValidationCondition{{
+		Condition:        "notEmpty(a) && (!((b === 'x') && (a !== '')) || notEmpty(c))",
+		ClientValidation: true,
+		ErrorMessage:     "All the required questions must be answered.",
+	}}}
+	if v := ajf.Slides[0].Validation; !reflect.DeepEqual(v, expected) {
+		t.Error("Unexpected slide validation:")
+		logFatalDiff(t, v, expected)
+	}
+	if v := ajf.Slides[1].Validation; v != nil {
+		t.Fatalf("Unexpected validation of slide without required fields: %v", v)
+	}
+}
+
+func TestChoicesProvenance(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: beginGroup, Name: "g"},
+			{Type: "select_one colors or_other", Name: "color"},
+			{Type: "select_one_from_file cities.csv", Name: "city"},
+			{Type: "select_one_from_file lists.xlsx", Name: "other_city"},
+			{Type: endGroup},
+		},
+		Choices: []ChoicesRow{
+			{ListName: "colors", Name: "red", Label: "Red", LineNum: 2},
+			{ListName: "cities.csv", Name: "rome", Label: "Rome", LineNum: 2, File: "cities.csv"},
+			{ListName: "lists.xlsx", Name: "milan", Label: "Milan", LineNum: 5, File: "lists.xlsx"},
+		},
+	}
+	ajf, _, err := Convert(xls, ConvertOptions{ChoicesProvenance: true})
+	check(t, err)
+	expected := map[string][]ChoiceSource{
+		"cities_csv": {{File: "cities.csv", Line: 2}},
+		"colors":     {{Sheet: "choices", Line: 2}, {}},
+		"lists_xlsx": {{File: "lists.xlsx", Sheet: "choices", Line: 5}},
+	}
+	provenance := make(map[string][]ChoiceSource)
+	for _, co := range ajf.ChoicesOrigins {
+		provenance[co.Name] = co.Provenance
+	}
+	if !reflect.DeepEqual(provenance, expected) {
+		t.Error("Unexpected choices provenance:")
+		logFatalDiff(t, provenance, expected)
+	}
+
+	ajf, _, err = Convert(xls, ConvertOptions{})
+	check(t, err)
+	if p := ajf.ChoicesOrigins[0].Provenance; p != nil {
+		t.Fatalf("Unexpected provenance without the option: %v", p)
+	}
+}
+
+func TestUnusedColumns(t *testing.T) {
+	wb := csvWorkBook{
+		"survey": {
+			{"type", "name", "label", "label::Italian (it)", "Relevent", "trigger", messagesColumn},
+			{"text", "q", "Q", "D", "${x} = 1", "yes", ""},
+		},
+		"choices":  {{"list_name", "name", "label", "color"}},
+		"settings": {{}, {"form_title", "instance_name"}},
+		"entities": {{"list_name"}},
+	}
+	expected := []Warning{
+		{0, `Sheet "entities" is not used by the converter.`},
+		{1, `Column "Relevent" of sheet "survey" is not used by the converter. Did you mean "relevant"?`},
+		{1, `Column "trigger" of sheet "survey" is not used by the converter.`},
+		{2, `Column "instance_name" of sheet "settings" is not used by the converter.`},
+	}
+	warnings, err := UnusedColumns(wb)
+	check(t, err)
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Error("Unexpected unused columns:")
+		logFatalDiff(t, warnings, expected)
+	}
+}
+
+func TestTruncateLabels(t *testing.T) {
+	long := "How many people, including children, live in your household?"
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: beginGroup, Name: "g", Label: "Household"},
+		{Type: "integer", Name: "a", Label: long},
+		{Type: "integer", Name: "b", Label: long, Hint: "Count yourself"},
+		{Type: "text", Name: "c", Label: "Short label"},
+		{Type: "note", Name: "n", Label: long},
+		{Type: endGroup},
+	}}
+	ajf, _, err := Convert(xls, ConvertOptions{TruncateLabels: 30})
+	check(t, err)
+	nodes := ajf.Slides[0].Nodes
+	short := "How many people, including…"
+	if nodes[0].Label != short || nodes[0].Hint != long {
+		t.Errorf("Unexpected truncation: %q, hint %q", nodes[0].Label, nodes[0].Hint)
+	}
+	if nodes[1].Label != short || nodes[1].Hint != "Count yourself" || nodes[1].Description != long {
+		t.Errorf("Unexpected truncation with hint: %q, description %q", nodes[1].Label, nodes[1].Description)
+	}
+	if nodes[2].Label != "Short label" || nodes[2].Hint != "" || nodes[3].Hint != "" {
+		t.Error("Unexpected truncation of short label or note")
+	}
+
+	wb := rowsWorkBook{"survey": {{"type", "name", "label", "label::Italian (it)"}, {"integer", "a", long, "Quante persone vivono nella tua famiglia, inclusi i bambini?"}}}
+	tr, err := Translations(wb, ConvertOptions{TruncateLabels: 30})
+	check(t, err)
+	if it := tr["it"][short]; it != "Quante persone vivono nella…" {
+		t.Fatalf("Unexpected translation of truncated label: %q", it)
+	}
+
+	// Labels that would be shortened to the same text are kept.
+	other := "How many people, including guests, slept in your household?"
+	xls.Survey = []SurveyRow{
+		{Type: "integer", Name: "a", Label: long, LineNum: 2},
+		{Type: "integer", Name: "b", Label: other, LineNum: 3},
+	}
+	ajf, warnings, err := Convert(xls, ConvertOptions{TruncateLabels: 30})
+	check(t, err)
+	if nodes := ajf.Slides[0].Nodes; nodes[0].Label != long || nodes[1].Label != other || len(warnings) != 2 {
+		t.Fatalf("Unexpected truncation of ambiguous labels: %# v %v", pretty.Formatter(nodes), warnings)
+	}
+	wb["survey"] = append(wb["survey"], []string{"integer", "b", other, "Quante persone, inclusi gli ospiti, hanno dormito da te?"})
+	tr, err = Translations(wb, ConvertOptions{TruncateLabels: 30})
+	check(t, err)
+	if it, ok := tr["it"][short]; ok {
+		t.Fatalf("Unexpected translation of ambiguous truncated label: %q", it)
+	}
+
+	for label, expected := range map[string]string{
+		"Please read <a href=\"https://example.com/terms\">the terms</a>": "Please read…",
+		"Please read [the terms](https://example.com/terms) first":        "Please read…",
+		"Please read <b>all</b> the terms and conditions":                 "Please read <b>all</b> the…",
+	} {
+		if short, _ := shortenLabel(label, 30); short != expected {
+			t.Errorf("Label %q shortened to %q, expected %q", label, short, expected)
+		}
+	}
+}
+
+func TestStreamingWorkBook(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.xlsx")
+	check(t, err)
+	// A workbook written by EncXlsx, with inline strings and empty cells.
+	var encoded bytes.Buffer
+	err = EncXlsx(&encoded, &XlsForm{
+		Survey:  []SurveyRow{{Type: "text", Name: "q", Label: "Q", Hint: " spaced <&> "}, {Type: "integer", Name: "n", Default: "3"}},
+		Choices: []ChoicesRow{{ListName: "l", Name: "a", Label: "A", Attributes: map[string]string{"x": "1"}}},
+	})
+	check(t, err)
+	for _, fileName := range append(files, "") {
+		data := encoded.Bytes()
+		if fileName != "" {
+			data, err = ioutil.ReadFile(fileName)
+			check(t, err)
+		}
+		wb, err := NewWorkBook(bytes.NewReader(data), ".xlsx", int64(len(data)))
+		check(t, err)
+		expected, err := DecXlsform(wb)
+		check(t, err)
+		swb, err := NewStreamingWorkBook(bytes.NewReader(data), int64(len(data)))
+		check(t, err)
+		if _, ok := swb.(RowStreamer); !ok {
+			t.Fatal("The streaming workbook doesn't implement RowStreamer")
+		}
+		xls, err := DecXlsform(swb)
+		check(t, err)
+		if !reflect.DeepEqual(xls, expected) {
+			t.Errorf("Error decoding %s with the streaming workbook, unexpected result:", fileName)
+			logFatalDiff(t, xls, expected)
+		}
+		for _, sheet := range []string{"survey", "choices", "settings"} {
+			if rows := Translation(swb.Rows(sheet), "it"); !reflect.DeepEqual(rows, Translation(wb.Rows(sheet), "it")) {
+				t.Fatalf("Different translations of sheet %s of %s with the streaming workbook", sheet, fileName)
+			}
+		}
+		tr, err := Translations(swb, ConvertOptions{})
+		check(t, err)
+		expectedTr, err := Translations(wb, ConvertOptions{})
+		check(t, err)
+		if !reflect.DeepEqual(tr, expectedTr) {
+			t.Fatalf("Different translations of %s with the streaming workbook", fileName)
+		}
+		unused, err := UnusedColumns(swb)
+		check(t, err)
+		expectedUnused, err := UnusedColumns(wb)
+		check(t, err)
+		if !reflect.DeepEqual(unused, expectedUnused) {
+			t.Fatalf("Different unused columns of %s with the streaming workbook: %v, expected %v",
+				fileName, unused, expectedUnused)
+		}
+	}
+
+	// The errors reading the sheets are reported, not taken for empty sheets.
+	zr, err := zip.NewReader(bytes.NewReader(encoded.Bytes()), int64(encoded.Len()))
+	check(t, err)
+	var broken bytes.Buffer
+	zw := zip.NewWriter(&broken)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		check(t, err)
+		data, err := ioutil.ReadAll(rc)
+		check(t, err)
+		rc.Close()
+		if strings.HasPrefix(f.Name, "xl/worksheets/") {
+			data = data[:len(data)/2]
+		}
+		w, err := zw.Create(f.Name)
+		check(t, err)
+		_, err = w.Write(data)
+		check(t, err)
+	}
+	check(t, zw.Close())
+	swb, err := NewStreamingWorkBook(bytes.NewReader(broken.Bytes()), int64(broken.Len()))
+	check(t, err)
+	if _, err := Translations(swb, ConvertOptions{}); err == nil {
+		t.Fatal("Expected error reading the translations of a broken sheet")
+	}
+	if _, err := UnusedColumns(swb); err == nil {
+		t.Fatal("Expected error reading the columns of a broken sheet")
+	}
+}
+
+func TestConvertAll(t *testing.T) {
+	paths := []string{"testdata/noformulas.xlsx", "testdata/missing.xlsx", "testdata/languages.xlsx",
+		"testdata/skeleton.json", "testdata/repeats.xls"}
+	results := convertAll(paths, ConvertOptions{}, 2)
+	if len(results) != len(paths) {
+		t.Fatalf("Expected %d results, got %d", len(paths), len(results))
+	}
+	for i, res := range results {
+		if res.Path != paths[i] {
+			t.Fatalf("Result %d is for %s, expected %s", i, res.Path, paths[i])
+		}
+		if i == 1 || i == 3 {
+			if res.Err == nil || res.Form != nil {
+				t.Errorf("Expected error converting %s", res.Path)
+			}
+			continue
+		}
+		check(t, res.Err)
+		xls, err := DecXlsFromFile(res.Path)
+		check(t, err)
+		expected, _, err := Convert(xls, ConvertOptions{})
+		check(t, err)
+		if !reflect.DeepEqual(res.Form, expected) {
+			t.Errorf("Unexpected result converting %s:", res.Path)
+			logFatalDiff(t, res.Form, expected)
+		}
+	}
+	if len(results[2].Translations) == 0 {
+		t.Fatal("Missing translations of languages.xlsx")
+	}
+	if ConvertAll(nil, ConvertOptions{}) == nil {
+		t.Fatal("Expected empty results")
+	}
+
+	results = ConvertAllWith(paths, 3, func(i int, path string) Result {
+		if i == 2 {
+			panic("converter bug")
+		}
+		return Result{Path: path}
+	})
+	for i, res := range results {
+		if res.Path != paths[i] || (res.Err != nil) != (i == 2) {
+			t.Fatalf("Unexpected result %d: %v", i, res)
+		}
+	}
+	if !strings.HasPrefix(results[2].Err.Error(), "Internal error converting testdata/languages.xlsx") {
+		t.Fatalf("Unexpected error for panic: %s", results[2].Err)
+	}
+
+	// Less than one worker means the default.
+	for _, workers := range []int{0, -1} {
+		results = ConvertAllWith(paths, workers, func(i int, path string) Result { return Result{Path: path} })
+		if len(results) != len(paths) || results[len(paths)-1].Path != paths[len(paths)-1] {
+			t.Fatalf("Unexpected results with %d workers: %v", workers, results)
+		}
+	}
+}
+
+func TestChoiceMedia(t *testing.T) {
+	wb := rowsWorkBook{
+		"survey": {
+			{"type", "name", "label"},
+			{"select_one animals", "animal", "Animal"},
+		},
+		"choices": {
+			{"list name", "name", "label", "media::image", "media::audio", "audio", "color"},
+			{"animals", "cow", "Cow", "cow.png", "cow.mp3", "moo", "brown"},
+			{"animals", "goat", "Goat", "goat.png", "", "", ""},
+		},
+	}
+	xls, err := DecXlsform(wb)
+	check(t, err)
+	ajf, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	expected := []Choice{
+		{Value: "cow", Label: "Cow", Image: "cow.png", Audio: "cow.mp3",
+			Attributes: map[string]string{"audio": "moo", "color": "brown"}},
+		{Value: "goat", Label: "Goat", Image: "goat.png"},
+	}
+	if choices := ajf.ChoicesOrigins[0].Choices; !reflect.DeepEqual(choices, expected) {
+		t.Error("Error converting choice media, unexpected result:")
+		logFatalDiff(t, choices, expected)
+	}
+
+	back, err := Ajf2xls(ajf)
+	check(t, err)
+	if back.Choices[0].Image != "cow.png" || back.Choices[0].Audio != "cow.mp3" {
+		t.Fatalf("Choice media lost converting back to xlsform: %v", back.Choices[0])
+	}
+}
+
+func TestExternalChoices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formconv")
+	check(t, err)
+	defer os.RemoveAll(dir)
+	csv := "name,label,region\nrome,Rome,lazio\nmilan,Milan\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "cities.csv"), []byte(csv), 0644)
+	check(t, err)
+
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: beginGroup, Name: "g"},
+		{Type: "select_one_from_file cities.csv", Name: "city"},
+		{Type: endGroup},
+	}}
+	err = LoadExternalChoices(xls, dir)
+	check(t, err)
+	expected := []ChoicesRow{
+		{ListName: "cities.csv", Name: "rome", Label: "Rome", LineNum: 2, Attributes: map[string]string{"region": "lazio"},
+			File: "cities.csv"},
+		{ListName: "cities.csv", Name: "milan", Label: "Milan", LineNum: 3, File: "cities.csv"},
+	}
+	if !reflect.DeepEqual(xls.Choices, expected) {
+		t.Error("Error loading external choices, unexpected result:")
+		logFatalDiff(t, xls.Choices, expected)
+	}
+	// Lists already loaded, e.g. by DecXlsFromFile, are skipped.
+	err = LoadExternalChoices(xls, dir)
+	check(t, err)
+	if len(xls.Choices) != len(expected) {
+		t.Fatalf("External choices loaded twice: %v", xls.Choices)
+	}
+	ajf, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	if ref := ajf.Slides[0].Nodes[0].ChoicesOriginRef; ref != "cities_csv" || ajf.ChoicesOrigins[0].Name != ref {
+		t.Fatalf("Unexpected choices origin reference %q", ref)
+	}
+
+	xls.Survey[1].Type = "select_one_from_file ../cities.csv"
+	if err := LoadExternalChoices(xls, dir); err == nil {
+		t.Fatal("Expected error for external choices file outside of the form directory")
+	}
+}
+
+func TestOdsWorkBook(t *testing.T) {
+	content := `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+ xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+ xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:spreadsheet><table:table table:name="survey">
+<table:table-row><table:table-cell><text:p>type</text:p></table:table-cell>` +
+		`<table:table-cell table:number-columns-repeated="2"/><table:table-cell><text:p>name</text:p></table:table-cell></table:table-row>
+<table:table-row table:number-rows-repeated="2"><table:table-cell table:number-columns-repeated="1024"/></table:table-row>
+<table:table-row><table:table-cell><text:p>text</text:p></table:table-cell><table:table-cell>` +
+		`<office:annotation><text:p>comment</text:p></office:annotation><text:p>a<text:s text:c="2"/>b</text:p><text:p>c</text:p>` +
+		`</table:table-cell><table:table-cell office:value-type="float" office:value="3"/></table:table-row>
+<table:table-row table:number-rows-repeated="1048572"><table:table-cell table:number-columns-repeated="1024"/></table:table-row>
+</table:table></office:spreadsheet></office:body></office:document-content>`
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("content.xml")
+	check(t, err)
+	_, err = io.WriteString(w, content)
+	check(t, err)
+	check(t, zw.Close())
+
+	wb, err := NewWorkBook(bytes.NewReader(buf.Bytes()), ".ods", int64(buf.Len()))
+	check(t, err)
+	expected := [][]string{
+		{"type", "", "", "name"},
+		{"", "", "", ""},
+		{"", "", "", ""},
+		{"text", "a  b\nc", "3", ""},
+	}
+	if rows := wb.Rows("survey"); !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("Unexpected ods rows: %q", rows)
+	}
+	if wb.Rows("choices") != nil {
+		t.Fatal("Expected nil rows for missing sheet")
+	}
+
+	// Repetitions expanding a small file into a huge table are rejected.
+	bombs := []string{
+		`<table:table-row table:number-rows-repeated="1000000"><table:table-cell><text:p>x</text:p></table:table-cell></table:table-row>`,
+		`<table:table-row><table:table-cell table:number-columns-repeated="10000"><text:p>x</text:p></table:table-cell></table:table-row>`,
+		`<table:table-row><table:table-cell table:number-columns-repeated="10000"/><table:table-cell><text:p>x</text:p></table:table-cell></table:table-row>`,
+		`<table:table-row table:number-rows-repeated="30000"><table:table-cell table:number-columns-repeated="200"><text:p>x</text:p></table:table-cell></table:table-row>`,
+		`<table:table-row><table:table-cell><text:p><text:s text:c="1000000000"/></text:p></table:table-cell></table:table-row>`,
+	}
+	for i, bomb := range bombs {
+		content := `<table:table xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+ xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0" table:name="survey">` + bomb + `</table:table>`
+		if _, err := decOdsContent(strings.NewReader(content)); err == nil {
+			t.Errorf("Case %d: expected error for oversized sheet", i)
+		}
+	}
+}
+
+func TestDiffXlsForms(t *testing.T) {
+	oldForm := &XlsForm{
+		Survey: []SurveyRow{
+			{LineNum: 2, Type: beginGroup, Name: "g", Label: "G"},
+			{LineNum: 3, Type: "text", Name: "a", Label: "A"},
+			{LineNum: 4, Type: "integer", Name: "b", Label: "B"},
+			{LineNum: 5, Type: "text", Name: "c", Label: "C"},
+			{LineNum: 6, Type: endGroup},
+		},
+		Choices: []ChoicesRow{
+			{LineNum: 2, ListName: "l", Name: "x", Label: "X", Attributes: map[string]string{"k": "1"}},
+		},
+	}
+	newForm := &XlsForm{
+		Survey: []SurveyRow{
+			{LineNum: 2, Type: beginGroup, Name: "g", Label: "G"},
+			{LineNum: 3, Type: "integer", Name: "b", Label: "B", Required: "yes"},
+			{LineNum: 4, Type: "text", Name: "a", Label: "A"},
+			{LineNum: 5, Type: endGroup},
+			{LineNum: 6, Type: "note", Name: "d", Label: "D"},
+		},
+		Choices: []ChoicesRow{
+			{LineNum: 2, ListName: "l", Name: "x", Label: "X", Attributes: map[string]string{"k": "2"}},
+		},
+		Settings: []SettingsRow{{LineNum: 2, FormTitle: "Title"}},
+	}
+	expected := []Difference{
+		{Sheet: "survey", Key: "c", Kind: DiffRemoved, LineNum: 5},
+		{Sheet: "survey", Key: "b", Kind: DiffChanged, Column: "required", Old: "", New: "yes", LineNum: 3},
+		{Sheet: "survey", Key: "a", Kind: DiffMoved, LineNum: 4},
+		{Sheet: "survey", Key: "d", Kind: DiffAdded, LineNum: 6},
+		{Sheet: "choices", Key: "l/x", Kind: DiffChanged, Column: "k", Old: "1", New: "2", LineNum: 2},
+		{Sheet: "settings", Key: "settings", Kind: DiffAdded, LineNum: 2},
+	}
+	diffs := DiffXlsForms(oldForm, newForm)
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Error("Unexpected differences:")
+		logFatalDiff(t, diffs, expected)
+	}
+	if diffs := DiffXlsForms(oldForm, oldForm); len(diffs) != 0 {
+		t.Fatalf("Unexpected differences between equal forms: %v", diffs)
+	}
+}
+
+func TestLongestCommonSubsequence(t *testing.T) {
+	cases := []struct {
+		a, b    string
+		unmoved string
+	}{
+		{"abcde", "abcde", "abcde"},
+		{"abcde", "eabcd", "abcd"},
+		{"abcde", "bcdea", "bcde"},
+		{"abcde", "edcba", "e"},
+		{"abcdef", "badcfe", "bdf"},
+		{"", "", ""},
+	}
+	// Keeps the keys of s that are in the set, in order.
+	filter := func(s string, keys map[string]bool) string {
+		var kept []string
+		for _, k := range strings.Split(s, "") {
+			if keys[k] {
+				kept = append(kept, k)
+			}
+		}
+		return strings.Join(kept, "")
+	}
+	for _, c := range cases {
+		keys := longestCommonSubsequence(strings.Split(c.a, ""), strings.Split(c.b, ""))
+		inA, inB := filter(c.a, keys), filter(c.b, keys)
+		if inA != inB || len(inA) != len(c.unmoved) {
+			t.Errorf("Lcs of %q and %q is %q (%q in the second), expected %q", c.a, c.b, inA, inB, c.unmoved)
+		}
+	}
+
+	// Large sheets are diffed in linear space.
+	n := 200000
+	a, b := make([]string, n), make([]string, n)
+	for i := range a {
+		a[i] = strconv.Itoa(i)
+	}
+	copy(b, a[1:])
+	b[n-1] = a[0]
+	if keys := longestCommonSubsequence(a, b); len(keys) != n-1 || keys[a[0]] {
+		t.Fatalf("Unexpected lcs of %d keys, expected all but the first", len(keys))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	xls := NewXlsForm(
+		[]SurveyRow{
+			{Type: beginGroup, Name: "g", Label: "G"},
+			{Type: "select_one yes_no", Name: "q", Label: "Q"},
+			{Type: endGroup},
+		},
+		[]ChoicesRow{{ListName: "yes_no", Name: "yes", Label: "Yes"}},
+		&SettingsRow{FormTitle: "Title"},
+	)
+	if xls.Survey[2].LineNum != 4 || xls.Choices[0].LineNum != 2 || xls.Settings[0].LineNum != 2 {
+		t.Fatalf("Unexpected line numbers: %# v", pretty.Formatter(xls))
+	}
+	check(t, xls.Validate())
+
+	invalid := map[string]func(xls *XlsForm){
+		"line 3: Undefined single or multiple choice \"colors\".":     func(xls *XlsForm) { xls.Survey[1].Type = "select_one colors" },
+		"line 3: Invalid type \"txt\" in survey.":                     func(xls *XlsForm) { xls.Survey[1].Type = "txt" },
+		"line 3: Missing name for row of type \"select_one yes_no\".": func(xls *XlsForm) { xls.Survey[1].Name = "" },
+		"line 4: Unexpected end of group/repeat.":                     func(xls *XlsForm) { xls.Survey[2].Type = endRepeat },
+		"line 2: Choices must have a list name and a name.":           func(xls *XlsForm) { xls.Choices[0].Name = "" },
+	}
+	for msg, modify := range invalid {
+		broken := NewXlsForm(xls.Survey, xls.Choices, nil)
+		modify(broken)
+		if err := broken.Validate(); err == nil || err.Error() != msg {
+			t.Fatalf("Expected error %q, got %v", msg, err)
+		}
+	}
+}
+
+func TestApplyJsonPatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, expected string
+	}{
+		{`{"a": 1}`, `[{"op": "add", "path": "/b", "value": [1]}]`, `{"a": 1, "b": [1]}`},
+		{`{"a": [1, 3]}`, `[{"op": "add", "path": "/a/1", "value": 2}, {"op": "add", "path": "/a/-", "value": 4}]`,
+			`{"a": [1, 2, 3, 4]}`},
+		{`{"a": [1, 2], "b": 3}`, `[{"op": "remove", "path": "/a/0"}, {"op": "remove", "path": "/b"}]`, `{"a": [2]}`},
+		{`{"a/b": {"~": 1}}`, `[{"op": "replace", "path": "/a~1b/~0", "value": null}]`, `{"a/b": {"~": null}}`},
+		{`{"a": {"x": 1}, "b": {}}`, `[{"op": "move", "from": "/a/x", "path": "/b/y"}]`, `{"a": {}, "b": {"y": 1}}`},
+		{`{"a": [{"x": 1}]}`, `[{"op": "copy", "from": "/a/0", "path": "/a/-"}, {"op": "add", "path": "/a/1/x", "value": 2}]`,
+			`{"a": [{"x": 1}, {"x": 2}]}`},
+		{`{"a": 1.50}`, `[{"op": "test", "path": "/a", "value": 1.50}, {"op": "replace", "path": "", "value": []}]`, `[]`},
+	}
+	for _, test := range tests {
+		doc, err := decJsonValue([]byte(test.doc))
+		check(t, err)
+		patch, err := DecJsonPatch([]byte(test.patch))
+		check(t, err)
+		doc, err = ApplyJsonPatch(doc, patch)
+		check(t, err)
+		expected, _ := decJsonValue([]byte(test.expected))
+		if !reflect.DeepEqual(doc, expected) {
+			t.Fatalf("Patch %s applied to %s gave %v, expected %v", test.patch, test.doc, doc, expected)
+		}
+	}
+
+	errPatches := []string{
+		`[{"op": "remove", "path": "/missing"}]`,
+		`[{"op": "replace", "path": "/a/1", "value": 1}]`,
+		`[{"op": "add", "path": "/a/01", "value": 1}]`,
+		`[{"op": "add", "path": "a", "value": 1}]`,
+		`[{"op": "add", "path": "/b"}]`,
+		`[{"op": "test", "path": "/a/0", "value": 2}]`,
+		`[{"op": "move", "from": "/a", "path": "/a/0"}]`,
+		`[{"op": "increment", "path": "/a"}]`,
+	}
+	for _, p := range errPatches {
+		doc, _ := decJsonValue([]byte(`{"a": [1]}`))
+		patch, err := DecJsonPatch([]byte(p))
+		check(t, err)
+		if _, err := ApplyJsonPatch(doc, patch); err == nil {
+			t.Fatalf("Expected error for patch %s", p)
+		}
+	}
+}
+
+func TestPatchAjf(t *testing.T) {
+	ajf := &AjfForm{Slides: []Node{{Id: 1, Name: "slide", Label: "Slide", Type: NtSlide}}}
+	patch := []PatchOperation{{Op: "add", Path: "/nodes/0/readonly", Value: json.RawMessage("true")}}
+	doc, err := PatchAjf(ajf, patch)
+	check(t, err)
+	data, err := json.Marshal(doc)
+	check(t, err)
+	expected := `{"nodes":[{"id":1,"label":"Slide","name":"slide","nodeType":3,"parent":0,"readonly":true}]}`
+	if string(data) != expected {
+		t.Fatalf("Unexpected patched form %s", data)
+	}
+}
+
+func TestValidateXls(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: beginGroup, Name: "g", LineNum: 2},
+			{Type: "select_one colors", Name: "q", LineNum: 3},
+			{Type: "txt", Name: "q", LineNum: 4},
+			{Type: endRepeat, LineNum: 5},
+			{Type: "text", LineNum: 6},
+		},
+		Choices: []ChoicesRow{
+			{ListName: "yes_no", Name: "yes", LineNum: 2},
+			{ListName: "yes_no", Name: "yes", LineNum: 3},
+			{Name: "no", LineNum: 4},
+		},
+	}
+	expected := []SourceError{
+		{"survey", 3, "type", CodeUndefinedChoices, `Undefined single or multiple choice "colors".`},
+		{"survey", 4, "type", CodeInvalidType, `Invalid type "txt" in survey.`},
+		{"survey", 4, "name", CodeDuplicateName, `Duplicate name "q", already used at line 3.`},
+		{"survey", 5, "type", CodeUnexpectedEnd, "Unexpected end of group/repeat."},
+		{"survey", 6, "name", CodeMissingName, `Missing name for row of type "text".`},
+		{"survey", 2, "type", CodeUnclosedGroup, "Unclosed group/repeat."},
+		{"choices", 3, "name", CodeDuplicateChoice,
+			`Duplicate choice "yes" in list "yes_no", already defined at line 2.`},
+		{"choices", 4, "list name", CodeMissingName, "Choices must have a list name and a name."},
+	}
+	errs := ValidateXls(xls)
+	if !reflect.DeepEqual(errs, expected) {
+		t.Error("Unexpected validation errors:")
+		logFatalDiff(t, errs, expected)
+	}
+}
+
+func TestLintCsvForm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formconv")
+	check(t, err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"survey.csv": "type,name,label\nbegin group,g,G\nselect_one colors,q,Q\ntxt,q\n" +
+			"end repeat\ntext,,T\nselect_one_from_file cities.csv,city,City\n",
+		"choices.csv": "list name,name,label\nyes_no,yes,Yes\nyes_no,yes,Yes\n,no,No\n",
+		"cities.csv":  "name,label\nrome,Rome\nrome,Rome\n",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		check(t, err)
+	}
+	var errs []SourceError
+	err = LintCsvForm(filepath.Join(dir, "survey.csv"), filepath.Join(dir, "choices.csv"),
+		func(e SourceError) { errs = append(errs, e) })
+	check(t, err)
+	expected := []SourceError{
+		{"choices", 3, "name", CodeDuplicateChoice,
+			`Duplicate choice "yes" in list "yes_no", already defined at line 2.`},
+		{"choices", 4, "list name", CodeMissingName, "Choices must have a list name and a name."},
+		{"survey", 3, "type", CodeUndefinedChoices, `Undefined single or multiple choice "colors".`},
+		{"survey", 4, "type", CodeInvalidType, `Invalid type "txt" in survey.`},
+		{"survey", 4, "name", CodeDuplicateName, `Duplicate name "q", already used at line 3.`},
+		{"survey", 5, "type", CodeUnexpectedEnd, "Unexpected end of group/repeat."},
+		{"survey", 6, "name", CodeMissingName, `Missing name for row of type "text".`},
+		{"choices", 3, "name", CodeDuplicateChoice,
+			`Duplicate choice "rome" in list "cities.csv", already defined at line 2.`},
+		{"survey", 2, "type", CodeUnclosedGroup, "Unclosed group/repeat."},
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Error("Unexpected lint errors:")
+		logFatalDiff(t, errs, expected)
+	}
+
+	err = LintCsvForm(filepath.Join(dir, "choices.csv"), "", func(SourceError) {})
+	if err == nil {
+		t.Fatal("Expected error for survey without mandatory columns")
+	}
+}
+
+func TestDecCsvForm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formconv")
+	check(t, err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"survey.csv":   "type,name,label\nselect_one yn,ok,\"Is it ok?\"\n",
+		"choices.csv":  "list name,name,label\nyn,yes,Yes\nyn,no,No\n",
+		"settings.csv": "form_title\nTitle\n",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		check(t, err)
+	}
+	xls, err := DecCsvForm(filepath.Join(dir, "survey.csv"), filepath.Join(dir, "choices.csv"),
+		filepath.Join(dir, "settings.csv"))
+	check(t, err)
+	expected := &XlsForm{
+		Survey: []SurveyRow{{Type: "select_one yn", Name: "ok", Label: "Is it ok?", LineNum: 2}},
+		Choices: []ChoicesRow{
+			{ListName: "yn", Name: "yes", Label: "Yes", LineNum: 2},
+			{ListName: "yn", Name: "no", Label: "No", LineNum: 3},
+		},
+		Settings: []SettingsRow{{FormTitle: "Title", LineNum: 2}},
+	}
+	if !reflect.DeepEqual(xls, expected) {
+		t.Error("Error decoding csv form, unexpected result:")
+		logFatalDiff(t, xls, expected)
+	}
+
+	_, err = DecCsvForm(filepath.Join(dir, "survey.csv"), filepath.Join(dir, "missing.csv"), "")
+	if err == nil {
+		t.Fatal("Expected error for missing choices file")
+	}
+}
+
+func TestCheckFormula(t *testing.T) {
+	names := nameSet{"location": true}
+	safe := []string{
+		"a + b * 2", "(x === 'a;b') && y !== \"[c]\"", "location.length > 0",
+		"$choice.attributes.country === country", "a - -1", "(s).match('\\d+') !== null",
+	}
+	for _, js := range safe {
+		check(t, checkFormula(js, names))
+	}
+	unsafe := []string{
+		"eval('1')", "window.alert", "a = 1", "a += 1", "a++", "(x) => x", "a; b",
+		"`${a}`", "a.constructor", "[1][0]", "{}", "'unterminated",
+	}
+	for _, js := range unsafe {
+		if checkFormula(js, names) == nil {
+			t.Fatalf("Expected formula %q to be rejected", js)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: "note", Name: "n", Label: `<b>Hello</b> <img src=x onerror="alert(1)">`, LineNum: 2},
+	}}
+	_, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	_, _, err = Convert(xls, ConvertOptions{Strict: true})
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2: ") {
+		t.Fatalf("Expected error for script markup in strict mode, got %v", err)
+	}
+	xls.Survey[0].Label = "<b>Hello</b>"
+	_, _, err = Convert(xls, ConvertOptions{Strict: true})
+	check(t, err)
+
+	// Literals can contain characters that are rejected outside of strings.
+	for _, constraint := range []string{"'a[b]{c}'", "'a`b'", "'a;b'", `'a\b'`} {
+		xls := &XlsForm{Survey: []SurveyRow{
+			{Type: "text", Name: "q", Label: "Q", Constraint: ". != " + constraint, LineNum: 2},
+		}}
+		for _, strict := range []bool{false, true} {
+			_, _, err := Convert(xls, ConvertOptions{Strict: strict})
+			if err != nil {
+				t.Fatalf("Constraint with literal %s (strict: %v): %v", constraint, strict, err)
+			}
+		}
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: "integer", Name: "age", Label: "Age", LineNum: 2},
+		{Type: "text", Name: "name", Label: "Name", Relevant: "${age} >", LineNum: 3},
+	}}
+	_, _, err := Convert(xls, ConvertOptions{})
+	srcErr, ok := err.(SourceError)
+	if !ok {
+		t.Fatalf("Expected a SourceError, got %v", err)
+	}
+	if srcErr.Sheet != "survey" || srcErr.LineNum != 3 || srcErr.Column != "relevant" ||
+		srcErr.Code != CodeInvalidFormula || !strings.HasPrefix(err.Error(), "line 3: ") {
+		t.Fatalf("Unexpected source error %#v", srcErr)
+	}
+	notes := Annotations(err, nil)
+	if len(notes) != 1 || notes[0].LineNum != 3 || notes[0].Message != srcErr.Message {
+		t.Fatalf("Unexpected annotations %v", notes)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: "integer", Name: "age", Label: "Age", Relevant: "${consent}", LineNum: 2},
+		{Type: "boolean", Name: "consent", Label: "Consent", LineNum: 3},
+		{Type: "calculate", Name: "adult", Calculation: "${age} >= 18", LineNum: 4},
+	}}
+	_, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+
+	xls.Survey[2].Calculation = "${age} >= ${ majority }"
+	_, _, err = Convert(xls, ConvertOptions{})
+	e, ok := err.(SourceError)
+	if !ok || e.LineNum != 4 || e.Column != "calculation" || e.Code != CodeUndefinedReference ||
+		e.Message != "Reference to undefined question ${majority}." {
+		t.Fatalf("Expected undefined reference error, got %v", err)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: beginGroup, Name: "info", Label: "Info", LineNum: 2},
+			{Type: "select_one yn", Name: "ok", Label: "Ok?", LineNum: 3},
+			{Type: endGroup, Name: "info", LineNum: 4},
+		},
+		Choices: []ChoicesRow{
+			{ListName: "yn", Name: "yes", Label: "Yes", LineNum: 2},
+			{ListName: "yn", Name: "no", Label: "No", LineNum: 3},
+		},
+	}
+	_, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+
+	xls.Survey[1].Name = ""
+	_, _, err = Convert(xls, ConvertOptions{})
+	if e, ok := err.(SourceError); !ok || e.LineNum != 3 || e.Code != CodeMissingName {
+		t.Fatalf("Expected missing name error, got %v", err)
+	}
+
+	xls.Survey[1].Name = "info"
+	_, _, err = Convert(xls, ConvertOptions{})
+	if err == nil || err.Error() != `line 3: Duplicate name "info", already used at line 2.` {
+		t.Fatalf("Expected duplicate name error, got %v", err)
+	}
+	xls.Survey[1].Name = "ok"
+	xls.Choices[1].Name = "yes"
+	_, _, err = Convert(xls, ConvertOptions{})
+	if e, ok := err.(SourceError); !ok || e.Sheet != "choices" || e.Code != CodeDuplicateChoice {
+		t.Fatalf("Expected duplicate choice error, got %v", err)
+	}
+
+	xls.Settings = []SettingsRow{{AllowChoiceDuplicates: "yes", LineNum: 2}}
+	ajf, warnings, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	if len(warnings) != 1 || warnings[0].LineNum != 3 {
+		t.Fatalf("Expected a warning about the duplicate choice on line 3, got: %v", warnings)
+	}
+	if choices := ajf.ChoicesOrigins[0].Choices; len(choices) != 1 || choices[0].Label != "Yes" {
+		t.Fatalf("Duplicate choice not removed: %v", choices)
+	}
+	if errs := ValidateXls(xls); len(errs) != 0 {
+		t.Fatalf("Unexpected validation errors: %v", errs)
+	}
+	xls.Settings[0].AllowChoiceDuplicates = "maybe"
+	_, _, err = Convert(xls, ConvertOptions{})
+	if e, ok := err.(SourceError); !ok || e.Sheet != "settings" || e.Code != CodeInvalidValue {
+		t.Fatalf("Expected invalid setting error, got %v", err)
+	}
+}
+
+func TestFormulaFeatures(t *testing.T) {
+	in := "testdata/formulas.xlsx"
+	out := "testdata/formulas.json"
+	oracle := "testdata/formulas_oracle.json"
+
+	xls, err := DecXlsFromFile(in)
+	check(t, err)
+	ajf, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	err = EncJsonToFile(out, ajf)
+	check(t, err)
+	result, err := ioutil.ReadFile(out)
+	check(t, err)
+	expected, err := ioutil.ReadFile(oracle)
+	check(t, err)
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Unexpected result. Check the differences between %s and %s", out, oracle)
+	}
+}
+
+func TestListLanguages(t *testing.T) {
+	if l := ListLanguages(nil); l != nil {
+		t.Fatalf("ListLanguages(nil) expected to be nil, found %v", l)
+	}
+	rows := [][]string{
+		{"type", "label", "label::English (en)", "label::French (fr)", "label::Italian (it)"},
+	}
+	list := ListLanguages(rows)
+	expected := map[string]bool{"fr": true, "it": true}
+	if !reflect.DeepEqual(list, expected) {
+		t.Fatalf("Error listing languages of\n%v\nexpected: %v\nfound: %v", rows, list, expected)
+	}
+}
+
+func TestTranslationIndex(t *testing.T) {
+	if i := translationIndex(nil, "foo", "bar", false); i != -1 {
+		t.Fatalf("translationIndex(nil, \"foo\", \"bar\") expected to be -1, found %d", i)
+	}
+	row := []string{"type", "label", "label::English (en)", "label::French (fr)", "Label::Italian (IT) "}
+	if i := translationIndex(row, "label", "fr", false); i != 3 {
+		t.Fatalf("translationIndex(%v, \"label\", \"fr\")\nexpected to be 3, found %d", row, i)
+	}
+	if i := translationIndex(row, "type", "en", false); i != -1 {
+		t.Fatalf("translationIndex(%v, \"type\", \"en\")\nexpected to be -1, found %d", row, i)
+	}
+	if i := translationIndex(row, "label", "it", false); i != 4 {
+		t.Fatalf("translationIndex(%v, \"label\", \"it\")\nexpected to be 4, found %d", row, i)
+	}
+	if i := translationIndex(row, "label", "it", true); i != -1 {
+		t.Fatalf("translationIndex(%v, \"label\", \"it\") in strict mode\nexpected to be -1, found %d", row, i)
+	}
+}
+
+func TestTranslation(t *testing.T) {
+	if tr := Translation(nil, "en"); tr != nil {
+		t.Fatalf("Translation(nil, \"en\") expected to be nil, found %v", tr)
+	}
+	rows := [][]string{
+		{"", "", ""},
+		{"type", "label", "label::Italian (it)"},
+		{"text", "cheese", "formaggio"},
+		{"number", "bread", "pane"},
+	}
+	tr := Translation(rows, "it")
+	expected := map[string]string{"cheese": "formaggio", "bread": "pane"}
+	if !reflect.DeepEqual(tr, expected) {
+		t.Fatalf("Error translating %v\nexpected: %v\n got: %v", rows, expected, tr)
+	}
+}
+
+type rowsWorkBook map[string][][]string
+
+func (wb rowsWorkBook) Rows(sheetName string) [][]string { return wb[sheetName] }
+
+func TestDecodeSettings(t *testing.T) {
+	wb := rowsWorkBook{
+		"survey":   {{"type", "name", "label"}},
+		"choices":  {{"list name", "name", "label"}},
+		"settings": {{"form_title", "form_id", "version"}, {"Census", "census", "2"}},
+	}
+	xls, err := DecXlsform(wb)
+	check(t, err)
+	expected := []SettingsRow{{FormTitle: "Census", FormId: "census", Version: "2", LineNum: 2}}
+	if !reflect.DeepEqual(xls.Settings, expected) {
+		t.Error("Error decoding settings, unexpected result:")
+		logFatalDiff(t, xls.Settings, expected)
+	}
+	ajf, _, err := Convert(xls, ConvertOptions{})
+	check(t, err)
+	if ajf.Title != "Census" || ajf.FormId != "census" || ajf.Version != "2" {
+		t.Fatalf("Settings not propagated to ajf: %# v", pretty.Formatter(ajf))
+	}
+}
+
+func TestTranslations(t *testing.T) {
+	wb := rowsWorkBook{
+		"survey": {
+			{"type", "label", "label::Italian (it)", "label::French (fr)"},
+			{"text", "cheese", "formaggio", "fromage"},
+		},
+		"choices": {
+			{"list name", "label", "label::Italian (it)", "label::French (fr)"},
+			{"list", "bread", "pane", "pain"},
+		},
+	}
+	tr, err := Translations(wb, ConvertOptions{Languages: []string{"it", "de"}})
+	check(t, err)
+	expected := map[string]map[string]string{"it": {"cheese": "formaggio", "bread": "pane"}}
+	if !reflect.DeepEqual(tr, expected) {
+		t.Fatalf("Error translating %v\nexpected: %v\n got: %v", wb, expected, tr)
+	}
+	if tr, _ := Translations(wb, ConvertOptions{}); len(tr) != 2 {
+		t.Fatalf("Expected translations for all the languages, got: %v", tr)
+	}
+
+	wb["survey"] = append(wb["survey"], []string{"select_one list or_other", "Bread?", "Pane?", "Pain ?"})
+	wb["choices"] = append(wb["choices"], []string{"list", "Other", "Altro", "Autre"})
+	tr, err = Translations(wb, ConvertOptions{Languages: []string{"it"}})
+	check(t, err)
+	expected = map[string]map[string]string{"it": {
+		"cheese": "formaggio", "bread": "pane", "Bread?": "Pane?", "Other": "Altro", "Specify other.": "Specify other.",
+	}}
+	if !reflect.DeepEqual(tr, expected) {
+		t.Fatalf("Error translating the or_other labels\nexpected: %v\n got: %v", expected, tr)
+	}
+
+	// The converter emits the label with its continuation.
+	wb = rowsWorkBook{"survey": {
+		{"type", "label", "label_continued", "label::Italian (it)", "label_continued::Italian (it)"},
+		{"text", "A long ", "question", "Una lunga ", "domanda"},
+	}}
+	tr, err = Translations(wb, ConvertOptions{TruncateLabels: 8})
+	check(t, err)
+	short, _ := shortenLabel("A long question", 8)
+	shortTr, _ := shortenLabel("Una lunga domanda", 8)
+	if it := tr["it"]; it["A long question"] != "Una lunga domanda" || it[short] != shortTr {
+		t.Fatalf("Error translating the continued label: %v", tr)
+	}
+}
+
+func BenchmarkDecXls(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		_, err := DecXlsFromFile("testdata/Picaps_baseline_form.xls")
+		check(b, err)
+	}
+}
+
+func BenchmarkDecXlsx(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		_, err := DecXlsFromFile("testdata/Picaps_baseline_form.xlsx")
+		check(b, err)
+	}
+}
+
+func BenchmarkXls2ajf(b *testing.B) {
+	xls, err := DecXlsFromFile("testdata/Picaps_baseline_form.xlsx")
+	check(b, err)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, _, err = Convert(xls, ConvertOptions{})
+		check(b, err)
+	}
+}
+
+func ExampleConvert() {
+	xls := &XlsForm{
+		Survey: []SurveyRow{
+			{Type: "begin group", Name: "person", Label: "Person"},
+			{Type: "integer", Name: "age", Label: "Age", Required: "yes"},
+			{Type: "select_one yes_no", Name: "student", Label: "Student?", Relevant: "${age} < 30"},
+			{Type: "end group"},
+		},
+		Choices: []ChoicesRow{
+			{ListName: "yes_no", Name: "yes", Label: "Yes"},
+			{ListName: "yes_no", Name: "no", Label: "No"},
+		},
+	}
+	ajf, warnings, err := Convert(xls, ConvertOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+	slide := ajf.Slides[0]
+	fmt.Println(slide.Id, slide.Name)
+	for _, field := range slide.Nodes {
+		fmt.Println(field.Id, field.Name, field.ChoicesOriginRef, field.Visibility)
+	}
+	// Output:
+	// 1 person
+	// 1001 age  <nil>
+	// 1002 student yes_no &{age < 30}
+}
+
+func ExampleEncAjfToWriter() {
+	ajf := &AjfForm{Slides: []Node{{Id: 1, Name: "slide", Label: "Slide", Type: NtSlide}}}
+	err := EncAjfToWriter(ajf, os.Stdout, EncodeOptions{Compact: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Output:
+	// {"nodes":[{"parent":0,"id":1,"name":"slide","label":"Slide","nodeType":3}]}
+}
+
+func ExampleDecXlsform() {
+	wb := rowsWorkBook{
+		"survey":  {{"type", "name", "label"}, {"text", "name", "Your name"}},
+		"choices": {{"list name", "name", "label"}},
+	}
+	xls, err := DecXlsform(wb)
+	if err != nil {
+		log.Fatal(err)
+	}
+	row := xls.Survey[0]
+	fmt.Println(row.LineNum, row.Type, row.Name, row.Label)
+	// Output:
+	// 2 text name Your name
+}
+
+func ExampleDecXlsFromFile() {
+	xls, err := DecXlsFromFile("testdata/skeleton.xlsx")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, row := range xls.Survey {
+		fmt.Println(row.LineNum, row.Type, row.Name, row.Label)
+	}
+	// Output:
+	// 2 type1 name1 label1
+	// 3 type2 name2 label2
+}
+
+func ExampleTranslations() {
+	wb := rowsWorkBook{
+		"survey": {
+			{"type", "name", "label::English (en)", "label::Italiano (it)"},
+			{"text", "name", "Your name", "Il tuo nome"},
+		},
+		"choices": {{"list name", "name", "label::English (en)", "label::Italiano (it)"}},
+	}
+	translations, err := Translations(wb, ConvertOptions{})
+	if err != nil {
+		fmt.Println(err)
+	}
+	for lang, tr := range translations {
+		fmt.Println(lang, tr)
+	}
+	// Output:
+	// it map[Your name:Il tuo nome]
+}
+
+func ExampleAjf2xls() {
+	ajf := &AjfForm{Slides: []Node{{
+		Name:  "slide",
+		Label: "Slide",
+		Type:  NtSlide,
+		Nodes: []Node{{
+			Name:       "age",
+			Label:      "Age",
+			Type:       NtField,
+			FieldType:  &FtNumber,
+			Visibility: &NodeVisibility{Condition: "consent === true"},
+		}},
+	}}}
+	xls, err := Ajf2xls(ajf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, row := range xls.Survey {
+		fmt.Printf("%s|%s|%s|%s\n", row.Type, row.Name, row.Label, row.Relevant)
+	}
+	// Output:
+	// begin group|slide|Slide|
+	// decimal|age|Age|consent = True
+	// end group|||
+}
+
+func ExampleSplitForm() {
+	xls := &XlsForm{Survey: []SurveyRow{
+		{Type: "begin group", Name: "household", Label: "Household"},
+		{Type: "integer", Name: "size", Label: "Size"},
+		{Type: "end group"},
+		{Type: "begin group", Name: "head", Label: "Head of household"},
+		{Type: "text", Name: "head_name", Label: "Name", Relevant: "${size} > 0"},
+		{Type: "end group"},
+	}}
+	ajf, _, err := Convert(xls, ConvertOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	forms, manifest, err := SplitForm(ajf, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, entry := range manifest.Forms {
+		fmt.Println(entry.Form, forms[i].Slides[0].Id, entry.References)
 	}
+	// Output:
+	// household 1 []
+	// head 1 [household]
 }
@@ -0,0 +1,81 @@
+package formats
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/tealeg/xlsx"
+)
+
+// Annotation is a message concerning a row of a sheet of the xlsform.
+type Annotation struct {
+	Sheet   string
+	LineNum int
+	Message string
+	Warning bool
+}
+
+// messagesColumn is the header of the column added by AnnotateXlsx.
+const messagesColumn = "formconv_messages"
+
+var (
+	errorFill   = xlsx.NewFill("solid", "FFFFC7CE", "FFFFC7CE")
+	warningFill = xlsx.NewFill("solid", "FFFFEB9C", "FFFFEB9C")
+)
+
+// Annotations returns the annotations corresponding to a conversion error
+// and to the warnings. Errors that are not SourceErrors are not included.
+func Annotations(err error, warnings []Warning) []Annotation {
+	var notes []Annotation
+	if e, ok := err.(SourceError); ok {
+		notes = append(notes, Annotation{e.Sheet, e.LineNum, e.Message, false})
+	}
+	for _, w := range warnings {
+		notes = append(notes, Annotation{"survey", w.LineNum, w.Message, true})
+	}
+	return notes
+}
+
+// AnnotateXlsx writes a copy of the workbook to w, in which the rows referenced
+// by the annotations are highlighted (red for errors, yellow for warnings)
+// and their messages are written in an additional column.
+// Only xlsx workbooks can be annotated. The workbook is modified in place.
+func AnnotateXlsx(w io.Writer, wb WorkBook, notes []Annotation) error {
+	xwb, ok := wb.(*xlsxWorkBook)
+	if !ok {
+		return fmt.Errorf("Only xlsx workbooks can be annotated.")
+	}
+	messages := make(map[string]map[int][]string)
+	for _, n := range notes {
+		sheet, ok := xwb.Sheet[n.Sheet]
+		if !ok || n.LineNum < 1 {
+			continue
+		}
+		fill := errorFill
+		if n.Warning {
+			fill = warningFill
+		}
+		row := n.LineNum - 1
+		for col := 0; col < sheet.MaxCol; col++ {
+			cell := sheet.Cell(row, col)
+			style := *cell.GetStyle()
+			style.Fill = *fill
+			style.ApplyFill = true
+			cell.SetStyle(&style)
+		}
+		if messages[n.Sheet] == nil {
+			messages[n.Sheet] = make(map[int][]string)
+		}
+		messages[n.Sheet][row] = append(messages[n.Sheet][row], n.Message)
+	}
+	for sheetName, rows := range messages {
+		sheet := xwb.Sheet[sheetName]
+		col := sheet.MaxCol
+		sheet.Cell(firstNonempty(wb.Rows(sheetName)), col).SetString(messagesColumn)
+		for row, msgs := range rows {
+			sheet.Cell(row, col).SetString(strings.Join(msgs, "\n"))
+		}
+	}
+	return xwb.Write(w)
+}
@@ -0,0 +1,203 @@
+package formats
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// AnonymizeOptions control Anonymize.
+type AnonymizeOptions struct {
+	// Hash keeps the sensitive questions in the form, replacing their names with
+	// hashed placeholders and their texts with generic ones, instead of removing them.
+	Hash bool
+	// Salt is mixed into the hashes, so that common question names
+	// can't be recovered by hashing a list of guesses.
+	Salt string
+}
+
+// Anonymize returns a copy of the xlsform without the details of the questions
+// flagged in the "sensitive" column, for sharing the structure of a form with partners
+// without exposing which personal data it collects. Flagging a group or repeat
+// flags all its content. The sensitive questions are removed and the references to them
+// in the formulas of the other questions replaced with an empty string (reported as warnings);
+// the references in labels and hints are dropped from the text.
+// With opts.Hash, they are instead renamed to sensitive_<hash>, with their label replaced,
+// their hint, constraint message, default, relevant and constraint removed and
+// their calculation emptied, as formulas can contain the sensitive values.
+// The "sensitive" column is cleared, not to tell which questions were flagged.
+// The choice lists used only by sensitive questions are removed as well, or get
+// generic labels (their values are kept, as formulas compare answers with them). The xlsform is not modified.
+func Anonymize(xls *XlsForm, opts AnonymizeOptions) (*XlsForm, []Warning, error) {
+	sensitive, err := sensitiveRows(xls.Survey)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make(map[string]string) // sensitive name -> placeholder (empty when removed)
+	for i, row := range xls.Survey {
+		if sensitive[i] && row.Name != "" {
+			names[row.Name] = ""
+			if opts.Hash {
+				names[row.Name] = "sensitive_" + anonHash(opts.Salt, row.Name)
+			}
+		}
+	}
+	var warnings []Warning
+	survey := make([]SurveyRow, 0, len(xls.Survey))
+	if opts.Hash {
+		for i, row := range xls.Survey {
+			row = renameRefs(row, func(field, name string) (string, bool) {
+				n, ok := names[name]
+				return "${" + n + "}", ok
+			})
+			if sensitive[i] && row.Name != "" {
+				row.Name = names[xls.Survey[i].Name]
+				row.Label = "Sensitive question " + strings.TrimPrefix(row.Name, "sensitive_")
+				row.LabelContinued, row.Hint, row.ConstraintMessage, row.Default = "", "", "", ""
+				row.Relevant, row.Constraint = "", ""
+				if row.Calculation != "" {
+					row.Calculation = "''"
+				}
+			}
+			row.Sensitive = ""
+			survey = append(survey, row)
+		}
+	} else {
+		removeDependentSelects(xls.Survey, sensitive, names)
+		for i, row := range xls.Survey {
+			if sensitive[i] {
+				continue
+			}
+			row = renameRefs(row, func(field, name string) (string, bool) {
+				_, ok := names[name]
+				if !ok {
+					return "", false
+				}
+				if textFields[field] {
+					warnings = append(warnings, Warning{row.LineNum,
+						"Reference to removed sensitive question ${" + name + "} dropped from the text."})
+					return "", true
+				}
+				warnings = append(warnings, Warning{row.LineNum,
+					"Reference to removed sensitive question ${" + name + "} replaced with ''."})
+				return "''", true
+			})
+			row.Sensitive = ""
+			survey = append(survey, row)
+		}
+	}
+
+	// Choice lists.
+	publicLists := make(map[string]bool)
+	for i, row := range xls.Survey {
+		if isSelectOne(row.Type) || isSelectMultiple(row.Type) {
+			if !sensitive[i] {
+				publicLists[strings.TrimSuffix(choiceName(row.Type), orOther)] = true
+			}
+		}
+	}
+	choices := make([]ChoicesRow, 0, len(xls.Choices))
+	counts := make(map[string]int)
+	for _, c := range xls.Choices {
+		if !publicLists[c.ListName] && usesList(xls.Survey, c.ListName) {
+			if !opts.Hash {
+				continue
+			}
+			counts[c.ListName]++
+			c.Label = "Choice " + strconv.Itoa(counts[c.ListName])
+			c.Image, c.Audio = "", ""
+		}
+		choices = append(choices, c)
+	}
+	return &XlsForm{Survey: survey, Choices: choices, Settings: xls.Settings}, warnings, nil
+}
+
+// sensitiveRows returns which rows of the survey are sensitive, either flagged
+// themselves or contained in a flagged group or repeat.
+func sensitiveRows(survey []SurveyRow) ([]bool, error) {
+	sensitive := make([]bool, len(survey))
+	for i := 0; i < len(survey); i++ {
+		row := survey[i]
+		flagged, ok := parseYesNo(row.Sensitive)
+		if !ok {
+			// Guessing could leak the question, so the value must be fixed.
+			return nil, fmtSrcErr(row.LineNum, "sensitive", CodeInvalidValue,
+				`Unrecognized value %q in "sensitive" column.`, row.Sensitive)
+		}
+		if !flagged {
+			continue
+		}
+		sensitive[i] = true
+		if row.Type == beginGroup || row.Type == beginRepeat {
+			if end, ok := findGroupEnd(survey, i); ok {
+				for j := i + 1; j < end; j++ {
+					sensitive[j] = true
+				}
+				i = end - 1
+			}
+		}
+	}
+	return sensitive, nil
+}
+
+// removeDependentSelects flags as sensitive the select questions whose choices are the answers
+// to a removed question (select_one ${question}), adding them to removed.
+func removeDependentSelects(survey []SurveyRow, sensitive []bool, removed map[string]string) {
+	for changed := true; changed; {
+		changed = false
+		for i, row := range survey {
+			if sensitive[i] || !(isSelectOne(row.Type) || isSelectMultiple(row.Type)) {
+				continue
+			}
+			c := strings.TrimSuffix(choiceName(row.Type), orOther)
+			if m := referenceRegexp.FindStringSubmatch(c); m != nil && isRepeatChoice(c) {
+				if _, ok := removed[m[1]]; ok {
+					sensitive[i], changed = true, true
+					removed[row.Name] = ""
+				}
+			}
+		}
+	}
+}
+
+// usesList reports whether a select question of the survey uses the choice list.
+func usesList(survey []SurveyRow, list string) bool {
+	for _, row := range survey {
+		if (isSelectOne(row.Type) || isSelectMultiple(row.Type)) &&
+			strings.TrimSuffix(choiceName(row.Type), orOther) == list {
+			return true
+		}
+	}
+	return false
+}
+
+// textFields are the fields of SurveyRow shown as text, whose references are interpolated
+// instead of evaluated as formulas.
+var textFields = map[string]bool{"Label": true, "LabelContinued": true, "Hint": true, "ConstraintMessage": true}
+
+// renameRefs replaces the ${name} references in the cells of the row (other than its name)
+// for which replace returns true. replace gets the name of the field of the reference too.
+func renameRefs(row SurveyRow, replace func(field, name string) (string, bool)) SurveyRow {
+	rowVal := reflect.ValueOf(&row).Elem()
+	for j := 0; j < rowVal.NumField(); j++ {
+		f, field := rowVal.Field(j), rowVal.Type().Field(j).Name
+		if f.Kind() != reflect.String || field == "Name" {
+			continue
+		}
+		f.SetString(referenceRegexp.ReplaceAllStringFunc(f.String(), func(ref string) string {
+			if s, ok := replace(field, referenceRegexp.FindStringSubmatch(ref)[1]); ok {
+				return s
+			}
+			return ref
+		}))
+	}
+	return row
+}
+
+// anonHash returns a short hash of the name.
+func anonHash(salt, name string) string {
+	sum := sha256.Sum256([]byte(salt + "\x00" + name))
+	return hex.EncodeToString(sum[:4])
+}
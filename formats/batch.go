@@ -0,0 +1,112 @@
+package formats
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// Result is the outcome of the conversion of a file by ConvertAll.
+type Result struct {
+	Path string
+	Form *AjfForm
+	// Translations are the translations of the form, indexed by language (see Translations).
+	Translations map[string]map[string]string
+	Warnings     []Warning
+	Err          error
+}
+
+// ConvertAll converts the xlsforms (xls, xlsx or ods files) at paths concurrently,
+// running at most runtime.GOMAXPROCS(0) conversions at a time, and returns the results
+// in the order of paths. External choices are loaded from the directory of each form.
+// A failure, including an internal error of the converter, only affects its own file.
+func ConvertAll(paths []string, opts ConvertOptions) []Result {
+	return convertAll(paths, opts, runtime.GOMAXPROCS(0))
+}
+
+func convertAll(paths []string, opts ConvertOptions, workers int) []Result {
+	return ConvertAllWith(paths, workers, func(i int, path string) Result { return convertFile(path, opts) })
+}
+
+// ConvertAllWith is like ConvertAll, but each file is converted by calling convert with its index
+// in paths, running at most workers conversions at a time (runtime.GOMAXPROCS(0) if workers
+// is less than 1). The conversions are started in the order of paths. A panic in convert
+// becomes the error of the result of its file.
+func ConvertAllWith(paths []string, workers int, convert func(i int, path string) Result) []Result {
+	results := make([]Result, len(paths))
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = safeConvert(i, paths[i], convert)
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// safeConvert calls convert, recovering from its panics.
+func safeConvert(i int, path string, convert func(i int, path string) Result) (res Result) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = Result{Path: path, Err: fmt.Errorf("Internal error converting %s: %v", path, r)}
+		}
+	}()
+	return convert(i, path)
+}
+
+// convertFile converts the xlsform at path.
+func convertFile(path string, opts ConvertOptions) (res Result) {
+	res.Path = path
+	f, err := os.Open(path)
+	if err != nil {
+		res.Err = fmt.Errorf("Couldn't open file: %s", err)
+		return res
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		res.Err = fmt.Errorf("Couldn't get file stat: %s", err)
+		return res
+	}
+	var wb WorkBook
+	if ext := filepath.Ext(path); ext == ".xlsx" {
+		wb, err = NewStreamingWorkBook(f, stat.Size())
+	} else {
+		wb, err = NewWorkBook(f, ext, stat.Size())
+	}
+	if err != nil {
+		res.Err = fmt.Errorf("Error opening workbook: %s", err)
+		return res
+	}
+	xls, err := DecXlsform(wb)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	if err := LoadExternalChoices(xls, filepath.Dir(path)); err != nil {
+		res.Err = err
+		return res
+	}
+	res.Form, res.Warnings, res.Err = Convert(xls, opts)
+	if res.Err == nil {
+		res.Translations, res.Err = Translations(wb, opts)
+	}
+	return res
+}
@@ -0,0 +1,108 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Canonicalize normalizes the form in place, so that forms with the same meaning
+// have the same encoding: the choices origins are sorted by name, the settings having
+// the default value are removed (empty validations, visibility conditions that are always
+// true, fields marked as editable, names mapped to themselves, empty maps), the empty lists
+// are made non-nil, and the surrounding whitespace of the formulas is trimmed. The order of the nodes
+// and their ids are significant and are kept.
+func Canonicalize(form *AjfForm) {
+	sort.Stable(coSlice(form.ChoicesOrigins))
+	if len(form.ChoicesOrigins) == 0 {
+		form.ChoicesOrigins = nil
+	}
+	for i := range form.ChoicesOrigins {
+		co := &form.ChoicesOrigins[i]
+		if co.Choices == nil {
+			co.Choices = []Choice{}
+		}
+		for j := range co.Choices {
+			if len(co.Choices[j].Attributes) == 0 {
+				co.Choices[j].Attributes = nil
+			}
+		}
+		if len(co.Provenance) == 0 {
+			co.Provenance = nil
+		}
+	}
+	if form.Slides == nil {
+		form.Slides = []Node{}
+	}
+	walkNodes(form.Slides, canonicalizeNode)
+	for name, mapped := range form.NameMapping {
+		if name == mapped {
+			delete(form.NameMapping, name)
+		}
+	}
+	if len(form.NameMapping) == 0 {
+		form.NameMapping = nil
+	}
+	for lang, tr := range form.Translations {
+		if len(tr) == 0 {
+			delete(form.Translations, lang)
+		}
+	}
+	if len(form.Translations) == 0 {
+		form.Translations = nil
+	}
+}
+
+func canonicalizeNode(n *Node) {
+	if len(n.Nodes) == 0 {
+		n.Nodes = nil
+	}
+	if n.Editable != nil && *n.Editable {
+		n.Editable = nil
+	}
+	for _, f := range []*Formula{n.ChoicesFilter, n.RandomSeed, n.FormulaReps, n.Formula} {
+		if f != nil {
+			f.Formula = strings.TrimSpace(f.Formula)
+		}
+	}
+	if v := n.Visibility; v != nil {
+		v.Condition = strings.TrimSpace(v.Condition)
+		if v.Condition == "true" {
+			n.Visibility = nil
+		}
+	}
+	if v := n.Validation; v != nil {
+		for i := range v.Conditions {
+			v.Conditions[i].Condition = strings.TrimSpace(v.Conditions[i].Condition)
+		}
+		if len(v.Conditions) == 0 {
+			v.Conditions = nil
+			if !v.NotEmpty && v.MinValue == nil && v.MaxValue == nil {
+				n.Validation = nil
+			}
+		}
+	}
+}
+
+// CanonicalJson returns the compact json encoding of the canonical version of the form
+// (see Canonicalize), suitable for comparing and hashing forms. The form is not modified.
+func CanonicalJson(form *AjfForm) ([]byte, error) {
+	// The form is copied through its encoding, as Canonicalize works in place.
+	data, err := json.Marshal(form)
+	if err != nil {
+		return nil, err
+	}
+	var c AjfForm
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	Canonicalize(&c)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(&c); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,41 @@
+package formats
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// evalConstant returns the value of the JavaScript translation of a formula, if it doesn't
+// depend on the answers or on the time of evaluation and can be computed at conversion time.
+// It is evaluated by jsEvaluator, the identifiers other than the names of its functions
+// making the formula depend on the answers.
+func evalConstant(js string) (val interface{}, ok bool) {
+	dependent := false
+	val, ok = evalCondition(js, func(string) interface{} {
+		dependent = true
+		return nil
+	})
+	if !ok || dependent {
+		return nil, false
+	}
+	switch x := val.(type) {
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) || math.Abs(x) >= 1e21 {
+			return nil, false // not representable as a plain json number
+		}
+	case string, bool:
+	default:
+		return nil, false
+	}
+	return val, true
+}
+
+// constLiteral returns the JavaScript literal of a constant value.
+func constLiteral(val interface{}) string {
+	if f, ok := val.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	data, _ := json.Marshal(val)
+	return string(data)
+}
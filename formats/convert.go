@@ -2,51 +2,368 @@ package formats
 
 import (
 	"fmt"
+	"html"
 	"math"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-func Convert(xls *XlsForm) (*AjfForm, error) {
-	err := checkTypes(xls.Survey)
+// ConvertOptions control the behavior of Convert.
+// The zero value is the default configuration.
+type ConvertOptions struct {
+	// WrapUngrouped allows forms having both repeats and ungrouped questions:
+	// each sequence of ungrouped questions is wrapped into its own slide.
+	WrapUngrouped bool
+	// NoteAsDescription promotes a note at the start of a group
+	// to the description of the group, instead of converting it to a field.
+	NoteAsDescription bool
+	// Languages restricts the languages for which translations are produced.
+	// When empty, all the languages found in the form are translated.
+	Languages []string
+	// SkipUnsupportedFields makes questions of unsupported types be skipped
+	// with a warning, instead of failing the conversion.
+	SkipUnsupportedFields bool
+	// IdMultiplier determines the ids of the ajf nodes: the children of a node
+	// with id x have ids x*IdMultiplier + 1, x*IdMultiplier + 2 and so on.
+	// It defaults to 1000.
+	IdMultiplier int
+	// IdStartOffset is added to the ids of the top-level slides, which are otherwise
+	// numbered from 1, e.g. to avoid clashes when the nodes of several forms are merged.
+	IdStartOffset int
+	// IdAssigner, if not nil, assigns the ids of the nodes in place of the hierarchical scheme
+	// described above (IdMultiplier and IdStartOffset are then ignored),
+	// e.g. SequentialIds or NameHashIds.
+	IdAssigner IdAssigner
+	// DefaultLanguage is the default language of the form
+	// when the settings sheet doesn't specify one.
+	DefaultLanguage string
+	// MaxChoicesInline, if positive, is the maximum number of choices of a select question
+	// shown as a list of options: questions with more choices are shown as dropdowns,
+	// unless their appearance requires otherwise.
+	MaxChoicesInline int
+	// Metadata determines how metadata questions (start, end, deviceid...) are handled.
+	Metadata MetadataMode
+	// Notes determines how the labels of notes are converted to the HTML of the fields.
+	Notes NoteMode
+	// UnrollNestedRepeats allows repeats nested inside groups or other repeats,
+	// which ajf doesn't support: they are unrolled into repeat_count copies
+	// of their content, so repeat_count must be a constant.
+	UnrollNestedRepeats bool
+	// NameMapping renames the questions whose names aren't valid JavaScript identifiers,
+	// together with the references to them, and includes in the ajf form the mapping
+	// from the names of the questions to the names of the nodes.
+	NameMapping bool
+	// RepeatJoinKeys adds to each repeating slide hidden fields identifying
+	// the repetition, so that exported repeat data can be joined with the parent record:
+	// <repeat>_index, the 1-based index of the repetition, and <repeat>_parent_key,
+	// computed by the RepeatParentKey formula (if not empty, e.g. "${household_id}").
+	RepeatJoinKeys  bool
+	RepeatParentKey string
+	// ValidValues restricts the values allowed in the columns of the survey sheet,
+	// e.g. {"required": {"yes", "no"}}. Empty cells are always allowed; in cells
+	// containing multiple words, like appearance, each word must be allowed.
+	ValidValues map[string][]string
+	// CollapsibleGroups converts groups with the "collapsible" appearance
+	// into collapsible ajf groups, which are initially shown collapsed.
+	CollapsibleGroups bool
+	// Strict rejects the forms whose labels, hints, constraint messages or choice labels
+	// contain markup that can run JavaScript when rendered as html (script elements,
+	// event handler attributes, javascript: urls). It is meant for services converting
+	// forms from untrusted sources. Translations are not checked.
+	// The generated formulas are also checked to be plain expressions (see checkFormula).
+	Strict bool
+	// FixedSeed, if not empty, is the seed used by all the questions with randomized choices
+	// in place of their seed parameter, so that every respondent sees the choices
+	// in the same order. It is meant for previews and tests and must be an integer.
+	FixedSeed string
+	// EvalConstants evaluates at conversion time the calculations that depend only on constants,
+	// like "1.0 + 0.5" or concat("v", "2"): calculate fields get the resulting literal
+	// as formula and the other questions get it as default value.
+	EvalConstants bool
+	// CheckUnits reports as warnings the formulas adding, subtracting or comparing
+	// questions with different units (see the unit column).
+	CheckUnits bool
+	// SlideRequiredValidation adds to each slide a validation condition satisfied when
+	// all its visible required fields are answered, so that navigation doesn't proceed
+	// until they are, as in the pages mode of ODK. Repeating slides are not affected.
+	SlideRequiredValidation bool
+	// ChoicesProvenance records in the choices origins where each choice comes from
+	// (see ChoicesOrigin.Provenance), so that the options of the deployed form
+	// can be traced back to the spreadsheets.
+	ChoicesProvenance bool
+	// TruncateLabels, if positive, is the maximum length of the labels of questions and groups
+	// (notes excluded): longer labels are shortened, and their full text is moved to the hint,
+	// or to the description for the nodes that already have a hint.
+	TruncateLabels int
+	// MarkdownLabels converts the labels of questions and groups (notes excluded, see Notes)
+	// from markdown to html, like NoteMarkdown, so that they can contain emphasis, links
+	// and line breaks. Labels shortened by TruncateLabels are converted after truncation.
+	MarkdownLabels bool
+}
+
+// MetadataMode determines how metadata questions are converted.
+type MetadataMode int
+
+const (
+	MetadataError  MetadataMode = iota // metadata questions are not supported
+	MetadataSkip                       // metadata questions are skipped with a warning
+	MetadataHidden                     // metadata questions become hidden fields
+)
+
+// NoteMode determines how the labels of notes are converted.
+type NoteMode int
+
+const (
+	NoteHtml      NoteMode = iota // labels are html, emitted verbatim
+	NoteText                      // labels are plain text, html special characters are escaped
+	NoteMarkdown                  // labels are markdown, converted to html
+	NoteSanitized                 // labels are markdown mixed with html, converted to html and sanitized
+)
+
+// renderNote converts the label of a note to html, according to mode.
+func renderNote(label string, mode NoteMode) string {
+	switch mode {
+	case NoteText:
+		return strings.Replace(html.EscapeString(label), "\n", "<br>", -1)
+	case NoteMarkdown:
+		return markdownToHtml(label)
+	case NoteSanitized:
+		return sanitizedMarkdownToHtml(label)
+	default:
+		return label
+	}
+}
+
+// Warning describes a problem in the xlsform that doesn't prevent the conversion.
+type Warning struct {
+	LineNum int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string { return fmt.Sprintf("line %d: %s", w.LineNum, w.Message) }
+
+// ConversionResult is the result of a successful conversion:
+// the ajf form and the non-fatal problems found in the xlsform.
+type ConversionResult struct {
+	Form     *AjfForm  `json:"form"`
+	Warnings []Warning `json:"warnings"`
+}
+
+// ConvertXlsform is like Convert, but returns the form and the warnings together,
+// e.g. to be encoded as a single json document.
+func ConvertXlsform(xls *XlsForm, opts ConvertOptions) (*ConversionResult, error) {
+	ajf, warnings, err := Convert(xls, opts)
 	if err != nil {
 		return nil, err
 	}
+	if warnings == nil {
+		warnings = []Warning{}
+	}
+	return &ConversionResult{ajf, warnings}, nil
+}
+
+// Convert converts the xlsform to ajf.
+// Non-fatal problems found in the xlsform are returned as warnings.
+func Convert(xls *XlsForm, opts ConvertOptions) (*AjfForm, []Warning, error) {
+	b := nodeBuilder{opts: opts}
+	if opts.FixedSeed != "" {
+		if _, err := strconv.Atoi(opts.FixedSeed); err != nil {
+			return nil, nil, fmt.Errorf("Invalid fixed seed %q, expected an integer.", opts.FixedSeed)
+		}
+	}
+	if err := checkValidValues(xls.Survey, opts.ValidValues); err != nil {
+		return nil, nil, err
+	}
+	if opts.TruncateLabels > 0 {
+		labels := make([]string, len(xls.Survey))
+		for i := range xls.Survey {
+			labels[i] = xls.Survey[i].Label
+		}
+		b.ambiguous = ambiguousShortLabels(labels, opts.TruncateLabels)
+	}
+	survey, choices := expandOrOther(b.removeDisabled(xls.Survey), xls.Choices)
+	survey, err := b.checkTypes(survey)
+	if err != nil {
+		return nil, nil, err
+	}
+	allowDups, err := choiceDuplicatesAllowed(xls.Settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	if allowDups {
+		var dups []ChoicesRow
+		choices, dups = dedupeChoices(choices)
+		for _, c := range dups {
+			b.warn(c.LineNum, "Duplicate choice %q in list %q of the choices sheet, ignoring.", c.Name, c.ListName)
+		}
+	}
+	if err := checkDuplicates(survey, choices); err != nil {
+		return nil, nil, err
+	}
+	if err := checkReferences(survey); err != nil {
+		return nil, nil, err
+	}
+	if opts.CheckUnits {
+		b.checkUnits(survey)
+	}
+	if opts.Strict {
+		if err := checkMarkup(survey, choices); err != nil {
+			return nil, nil, err
+		}
+	}
+	var nameMapping map[string]string
+	if opts.NameMapping {
+		survey, nameMapping = sanitizeQuestionNames(survey)
+	}
+	survey = expandRepeatedQuestions(survey)
+	if opts.UnrollNestedRepeats {
+		survey, err = unrollNestedRepeats(survey, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
 	var ajf AjfForm
+	paged := true
+	if len(xls.Settings) > 0 {
+		settings := xls.Settings[0]
+		if len(xls.Settings) > 1 {
+			b.warn(xls.Settings[1].LineNum, "Only the first row of the settings sheet is considered.")
+		}
+		ajf.Title = settings.FormTitle
+		ajf.FormId = settings.FormId
+		ajf.Version = settings.Version
+		ajf.DefaultLanguage = settings.DefaultLanguage
+		paged = b.parseStyle(&settings)
+	}
+	if ajf.DefaultLanguage == "" {
+		ajf.DefaultLanguage = opts.DefaultLanguage
+	}
 	var choicesMap map[string][]Choice
-	ajf.ChoicesOrigins, choicesMap = buildChoicesOrigins(xls.Choices)
-	err = checkChoicesRef(xls.Survey, choicesMap)
+	ajf.ChoicesOrigins, choicesMap = buildChoicesOrigins(choices)
+	err = checkChoicesRef(survey, choicesMap)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	b.originNames = sanitizeOriginNames(ajf.ChoicesOrigins)
+	b.choiceAttrs = choiceAttributes(choicesMap)
+	b.choices = choicesMap
+	ajf.ChoicesOrigins, err = buildRepeatOrigins(survey, ajf.ChoicesOrigins, b.originNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Stable(coSlice(ajf.ChoicesOrigins))
+	if opts.ChoicesProvenance {
+		addChoicesProvenance(ajf.ChoicesOrigins, choices, b.originNames)
 	}
 
-	survey, err := preprocessGroups(xls.Survey)
+	survey, err = preprocessGroups(survey, opts)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	var b nodeBuilder
+	b.names = newNameSet(survey)
 	global, err := b.buildGroup(survey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	ajf.Slides = global.Nodes
-	for i := range ajf.Slides {
-		if ajf.Slides[i].Type == NtGroup {
-			ajf.Slides[i].Type = NtSlide
+	if paged {
+		for i := range ajf.Slides {
+			if ajf.Slides[i].Type == NtGroup {
+				ajf.Slides[i].Type = NtSlide
+			}
+		}
+	} else {
+		ajf.Slides = b.singlePage(ajf.Slides, ajf.Title)
+	}
+	if opts.SlideRequiredValidation {
+		for i := range ajf.Slides {
+			if ajf.Slides[i].Type == NtSlide {
+				addRequiredValidation(&ajf.Slides[i])
+			}
+		}
+	}
+	ids := opts.IdAssigner
+	if ids == nil {
+		ids = HierarchicalIds{opts.IdMultiplier, opts.IdStartOffset}
+	}
+	err = ids.AssignIds(ajf.Slides)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Strict {
+		// The formulas are translated from a safe subset of xlsform, this is a further check.
+		if err := checkNodeFormulas(ajf.Slides); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.NameMapping {
+		ajf.NameMapping = nameMapping
+	}
+	if err := ValidateAjf(&ajf); err != nil {
+		return nil, nil, AjfError{"Internal error, the converted form is not valid ajf: " + err.Error()}
+	}
+	return &ajf, b.warnings, nil
+}
+
+// parseStyle checks the style setting, which can contain "pages" and theme names.
+// It returns whether each top-level group should be shown on its own page,
+// which is the default when the style is empty.
+func (b *nodeBuilder) parseStyle(settings *SettingsRow) (paged bool) {
+	if strings.TrimSpace(settings.Style) == "" {
+		return true
+	}
+	for _, style := range strings.Fields(settings.Style) {
+		switch {
+		case style == "pages":
+			paged = true
+		case strings.HasPrefix(style, "theme-"):
+			b.warn(settings.LineNum, "Style %q has no equivalent in ajf, ignoring.", style)
+		default:
+			b.warn(settings.LineNum, "Unknown style %q, ignoring.", style)
 		}
 	}
-	assignIds(ajf.Slides, 0)
-	return &ajf, nil
+	return paged
+}
+
+// singlePage merges the consecutive top-level groups into a single slide,
+// in which they become nested groups, for forms whose style is not "pages".
+// Repeating slides can't be nested and remain separate.
+func (b *nodeBuilder) singlePage(nodes []Node, title string) []Node {
+	if title == "" {
+		title = "Form"
+	}
+	var slides []Node
+	for _, n := range nodes {
+		if n.Type != NtGroup {
+			slides = append(slides, n)
+			continue
+		}
+		if len(slides) == 0 || slides[len(slides)-1].Type != NtSlide {
+			slides = append(slides, Node{Name: b.names.unique("form"), Label: title, Type: NtSlide})
+		}
+		last := &slides[len(slides)-1]
+		last.Nodes = append(last.Nodes, n)
+	}
+	return slides
 }
 
 func buildChoicesOrigins(rows []ChoicesRow) ([]ChoicesOrigin, map[string][]Choice) {
 	choicesMap := make(map[string][]Choice)
 	for _, row := range rows {
 		choicesMap[row.ListName] = append(choicesMap[row.ListName], Choice{
-			Value: row.Name,
-			Label: row.Label,
+			Value:      row.Name,
+			Label:      row.Label,
+			Image:      row.Image,
+			Audio:      row.Audio,
+			Attributes: row.Attributes,
 		})
 	}
 	co := make(coSlice, 0, len(choicesMap))
@@ -62,6 +379,159 @@ func buildChoicesOrigins(rows []ChoicesRow) ([]ChoicesOrigin, map[string][]Choic
 	return co, choicesMap
 }
 
+// addChoicesProvenance sets the provenance of the fixed choices origins, built from rows.
+// originNames maps the list names to the names of the origins.
+func addChoicesProvenance(co []ChoicesOrigin, rows []ChoicesRow, originNames map[string]string) {
+	sources := make(map[string][]ChoiceSource)
+	for _, row := range rows {
+		src := ChoiceSource{File: row.File, Sheet: "choices", Line: row.LineNum}
+		if strings.ToLower(filepath.Ext(row.File)) == ".csv" {
+			src.Sheet = ""
+		}
+		if row.LineNum == 0 {
+			src.Sheet = "" // generated by the converter
+		}
+		name := originNames[row.ListName]
+		sources[name] = append(sources[name], src)
+	}
+	for i := range co {
+		if co[i].Type == OtFixed {
+			co[i].Provenance = sources[co[i].Name]
+		}
+	}
+}
+
+// sanitizeOriginNames renames the choices origins so that their names
+// are valid identifiers, returning a map from the original to the new names.
+func sanitizeOriginNames(co []ChoicesOrigin) map[string]string {
+	names := make(map[string]string, len(co))
+	used := make(nameSet, len(co))
+	for i := range co {
+		if isIdentifier(co[i].Name) {
+			used[co[i].Name] = true
+		}
+	}
+	for i := range co {
+		name := co[i].Name
+		if !isIdentifier(name) {
+			co[i].Name = used.unique(toIdentifier(name))
+		}
+		names[name] = co[i].Name
+	}
+	sort.Sort(coSlice(co))
+	return names
+}
+
+// sanitizeQuestionNames renames the questions whose names aren't valid JavaScript identifiers,
+// updating the references to them. It returns the new survey and a map from the original
+// to the new names.
+func sanitizeQuestionNames(survey []SurveyRow) ([]SurveyRow, map[string]string) {
+	names := make(map[string]string)
+	used := make(nameSet)
+	for _, row := range survey {
+		if isJsIdentifier(row.Name) {
+			used[row.Name] = true
+		}
+	}
+	var replacements []string
+	for _, row := range survey {
+		name := row.Name
+		if _, ok := names[name]; ok || name == "" {
+			continue
+		}
+		names[name] = name
+		if !isJsIdentifier(name) {
+			base := toIdentifier(name)
+			if jsReserved[base] {
+				base += "_"
+			}
+			names[name] = used.unique(base)
+			replacements = append(replacements, "${"+name+"}", "${"+names[name]+"}")
+		}
+	}
+	if len(replacements) == 0 {
+		return survey, names
+	}
+	replacer := strings.NewReplacer(replacements...)
+	sanitized := make([]SurveyRow, len(survey))
+	for i, row := range survey {
+		rowVal := reflect.ValueOf(&row).Elem()
+		for j := 0; j < rowVal.NumField(); j++ {
+			if f := rowVal.Field(j); f.Kind() == reflect.String {
+				f.SetString(replacer.Replace(f.String()))
+			}
+		}
+		if row.Name != "" {
+			row.Name = names[survey[i].Name]
+		}
+		sanitized[i] = row
+	}
+	return sanitized, names
+}
+
+// isJsIdentifier reports whether s can be used as a JavaScript variable name.
+func isJsIdentifier(s string) bool {
+	if s == "" || jsReserved[s] {
+		return false
+	}
+	for i, r := range s {
+		if !(r == '_' || r == '$' || unicode.IsLetter(r) || i > 0 && unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+var jsReserved = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true, "const": true, "continue": true,
+	"debugger": true, "default": true, "delete": true, "do": true, "else": true, "enum": true,
+	"export": true, "extends": true, "false": true, "finally": true, "for": true, "function": true,
+	"if": true, "import": true, "in": true, "instanceof": true, "new": true, "null": true,
+	"return": true, "super": true, "switch": true, "this": true, "throw": true, "true": true,
+	"try": true, "typeof": true, "var": true, "void": true, "while": true, "with": true,
+	"yield": true, "let": true, "static": true, "await": true, "implements": true,
+	"interface": true, "package": true, "private": true, "protected": true, "public": true,
+	"arguments": true, "eval": true, "undefined": true, "NaN": true, "Infinity": true,
+}
+
+func isIdentifier(s string) bool { return s != "" && toIdentifier(s) == s }
+
+// toIdentifier replaces the characters of s that are not allowed in identifiers with underscores.
+func toIdentifier(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z':
+			b.WriteRune(r)
+		case '0' <= r && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// choiceAttributes returns the names of the attributes used by the choices of each list.
+func choiceAttributes(choicesMap map[string][]Choice) map[string]map[string]bool {
+	attrs := make(map[string]map[string]bool, len(choicesMap))
+	for list, choices := range choicesMap {
+		attrs[list] = make(map[string]bool)
+		for _, c := range choices {
+			for attr := range c.Attributes {
+				attrs[list][attr] = true
+			}
+		}
+	}
+	return attrs
+}
+
 type coSlice []ChoicesOrigin
 
 func (co coSlice) Len() int           { return len(co) }
@@ -72,8 +542,123 @@ func checkChoicesRef(survey []SurveyRow, choicesMap map[string][]Choice) error {
 	for _, row := range survey {
 		if isSelectOne(row.Type) || isSelectMultiple(row.Type) {
 			c := choiceName(row.Type)
+			if isRepeatChoice(c) {
+				continue // checked by buildRepeatOrigins
+			}
 			if _, ok := choicesMap[c]; !ok {
-				return fmtSrcErr(row.LineNum, "Undefined single or multiple choice %q.", c)
+				return fmtSrcErr(row.LineNum, "type", CodeUndefinedChoices,
+					"Undefined single or multiple choice %q.", c)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDuplicates checks that the questions, groups and repeats have unique names
+// and that the lists of choices don't contain the same value twice, as either would
+// make the ajf form ambiguous. The names of end group/repeat rows are ignored,
+// as some forms repeat the name of the group there.
+func checkDuplicates(survey []SurveyRow, choices []ChoicesRow) error {
+	names := make(map[string]int)
+	for i := range survey {
+		row := &survey[i]
+		if row.Type == endGroup || row.Type == endRepeat {
+			continue
+		}
+		if err := checkName(row, names); err != nil {
+			return err
+		}
+	}
+	choiceLines := make(map[[2]string]int)
+	for _, c := range choices {
+		if err := checkChoiceName(c, choiceLines); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkName checks that the row has a name not already in names,
+// which maps the names found so far to the line of their first use.
+func checkName(row *SurveyRow, names map[string]int) error {
+	if row.Name == "" {
+		return fmtSrcErr(row.LineNum, "name", CodeMissingName, "Missing name for row of type %q.", row.Type)
+	}
+	if line, ok := names[row.Name]; ok {
+		return fmtSrcErr(row.LineNum, "name", CodeDuplicateName,
+			"Duplicate name %q, already used at line %d.", row.Name, line)
+	}
+	names[row.Name] = row.LineNum
+	return nil
+}
+
+// checkChoiceName checks that the choice is not already in lines, which maps
+// the list names and names found so far to the line of their first definition.
+func checkChoiceName(c ChoicesRow, lines map[[2]string]int) error {
+	key := [2]string{c.ListName, c.Name}
+	if line, ok := lines[key]; ok {
+		return SourceError{"choices", c.LineNum, "name", CodeDuplicateChoice,
+			fmt.Sprintf("Duplicate choice %q in list %q, already defined at line %d.",
+				c.Name, c.ListName, line)}
+	}
+	lines[key] = c.LineNum
+	return nil
+}
+
+// choiceDuplicatesAllowed parses the allow_choice_duplicates setting.
+func choiceDuplicatesAllowed(settings []SettingsRow) (bool, error) {
+	if len(settings) == 0 {
+		return false, nil
+	}
+	s := settings[0]
+	allowed, ok := parseYesNo(s.AllowChoiceDuplicates)
+	if !ok {
+		return false, SourceError{"settings", s.LineNum, "allow_choice_duplicates", CodeInvalidValue,
+			fmt.Sprintf(`Unrecognized value %q in "allow_choice_duplicates" setting.`, s.AllowChoiceDuplicates)}
+	}
+	return allowed, nil
+}
+
+// dedupeChoices returns the choices without the repetitions of a value in the same list,
+// keeping the first occurrence, and the removed repetitions.
+func dedupeChoices(choices []ChoicesRow) (unique, dups []ChoicesRow) {
+	seen := make(map[[2]string]bool)
+	unique = make([]ChoicesRow, 0, len(choices))
+	for _, c := range choices {
+		key := [2]string{c.ListName, c.Name}
+		if seen[key] {
+			dups = append(dups, c)
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, c)
+	}
+	return unique, dups
+}
+
+var referenceRegexp = regexp.MustCompile(`\$\{\s*([^}\s]*)\s*\}`)
+
+// checkReferences checks that the ${name} references in the formulas of the survey
+// refer to questions of the form. References to questions defined later in the survey
+// are allowed, as formulas are reevaluated when the answers change.
+func checkReferences(survey []SurveyRow) error {
+	names := make(nameSet)
+	for _, row := range survey {
+		if row.Name != "" {
+			names[row.Name] = true
+		}
+	}
+	for _, row := range survey {
+		formulas := [][2]string{
+			{"relevant", row.Relevant}, {"constraint", row.Constraint}, {"calculation", row.Calculation},
+			{"repeat_count", row.RepeatCount}, {"choice_filter", row.ChoiceFilter}, {"parameters", row.Parameters},
+		}
+		for _, f := range formulas {
+			for _, m := range referenceRegexp.FindAllStringSubmatch(f[1], -1) {
+				if !names[m[1]] {
+					return fmtSrcErr(row.LineNum, f[0], CodeUndefinedReference,
+						"Reference to undefined question ${%s}.", m[1])
+				}
 			}
 		}
 	}
@@ -82,118 +667,663 @@ func checkChoicesRef(survey []SurveyRow, choicesMap map[string][]Choice) error {
 
 func choiceName(rowType string) string { return rowType[strings.Index(rowType, " ")+1:] }
 
-func fmtSrcErr(lineNum int, format string, a ...interface{}) error {
-	return fmt.Errorf("line %d: "+format, append([]interface{}{lineNum}, a...)...)
+// isRepeatChoice reports whether the choices of a select question are the answers
+// given to another question inside a repeat, as in "select_one ${question}".
+func isRepeatChoice(c string) bool { return strings.HasPrefix(c, "${") && strings.HasSuffix(c, "}") }
+
+// buildRepeatOrigins adds to co the choices origins of the select questions
+// whose choices come from a question inside a repeat, updating originNames accordingly.
+func buildRepeatOrigins(survey []SurveyRow, co []ChoicesOrigin, originNames map[string]string) ([]ChoicesOrigin, error) {
+	fieldRepeat := make(map[string]string) // the repeat containing each field
+	var repeats []string
+	for _, row := range survey {
+		switch row.Type {
+		case beginRepeat:
+			repeats = append(repeats, row.Name)
+		case beginGroup:
+			if len(repeats) > 0 {
+				repeats = append(repeats, repeats[len(repeats)-1])
+			} else {
+				repeats = append(repeats, "")
+			}
+		case endRepeat, endGroup:
+			if len(repeats) > 0 {
+				repeats = repeats[:len(repeats)-1]
+			}
+		default:
+			if len(repeats) > 0 && repeats[len(repeats)-1] != "" {
+				fieldRepeat[row.Name] = repeats[len(repeats)-1]
+			}
+		}
+	}
+	used := make(nameSet, len(co))
+	for _, origin := range co {
+		used[origin.Name] = true
+	}
+	for _, row := range survey {
+		if !isSelectOne(row.Type) && !isSelectMultiple(row.Type) {
+			continue
+		}
+		c := choiceName(row.Type)
+		if !isRepeatChoice(c) {
+			continue
+		}
+		if _, ok := originNames[c]; ok {
+			continue // origin already built
+		}
+		field := c[len("${") : len(c)-len("}")]
+		repeat, ok := fieldRepeat[field]
+		if !ok {
+			return nil, fmtSrcErr(row.LineNum, "type", CodeUndefinedChoices,
+				"Choices %q must refer to a question inside a repeat.", c)
+		}
+		name := used.unique(toIdentifier(field + "_choices"))
+		co = append(co, ChoicesOrigin{
+			Type:        OtRepeat,
+			Name:        name,
+			ChoicesType: CtString,
+			Choices:     []Choice{},
+			RepeatRef:   repeat,
+			FieldRef:    field,
+		})
+		originNames[c] = name
+	}
+	sort.Sort(coSlice(co))
+	return co, nil
+}
+
+// fmtSrcErr returns a SourceError concerning a cell of the survey sheet.
+func fmtSrcErr(lineNum int, column, code, format string, a ...interface{}) error {
+	return SourceError{"survey", lineNum, column, code, fmt.Sprintf(format, a...)}
+}
+
+// formulaErr returns the error for a formula of the survey sheet that couldn't be parsed.
+func formulaErr(lineNum int, column string, err error) error {
+	return fmtSrcErr(lineNum, column, CodeInvalidFormula, "%s", err)
+}
+
+// removeDisabled removes the rows flagged in the disabled column,
+// reporting them as warnings. Disabling a group or repeat removes all its content;
+// end group/repeat rows are kept, as they are removed together with their begin rows.
+func (b *nodeBuilder) removeDisabled(survey []SurveyRow) []SurveyRow {
+	enabled := make([]SurveyRow, 0, len(survey))
+	for i := 0; i < len(survey); i++ {
+		row := survey[i]
+		disabled, ok := parseYesNo(row.Disabled)
+		if !ok {
+			b.warn(row.LineNum, `Unrecognized value %q in "disabled" column, the question won't be disabled.`,
+				row.Disabled)
+		}
+		if disabled && (row.Type == endGroup || row.Type == endRepeat) {
+			b.warn(row.LineNum, "Ignoring the disabled column of %s, disable the begin row instead.", row.Type)
+			disabled = false
+		}
+		if !disabled {
+			enabled = append(enabled, row)
+			continue
+		}
+		if row.Type == beginGroup || row.Type == beginRepeat {
+			if end, ok := findGroupEnd(survey, i); ok {
+				b.warn(row.LineNum, "Skipping disabled %s (lines %d-%d).",
+					row.Type[len("begin "):], row.LineNum, survey[end-1].LineNum)
+				i = end - 1
+				continue
+			}
+		}
+		b.warn(row.LineNum, "Skipping disabled question.")
+	}
+	return enabled
+}
+
+// checkValidValues checks that the survey columns contain only the values
+// allowed by valid, which maps column names to lists of values.
+func checkValidValues(survey []SurveyRow, valid map[string][]string) error {
+	columns := sheetInfos[0].columns
+	cols := make([]string, 0, len(valid))
+	for col := range valid {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	for _, col := range cols {
+		values := valid[col]
+		j := -1
+		for i := range columns {
+			if columns[i].name == col {
+				j = i
+			}
+		}
+		if j < 0 {
+			return fmt.Errorf("Unknown survey column %q in valid values.", col)
+		}
+		allowed := make(map[string]bool, len(values))
+		for _, v := range values {
+			allowed[v] = true
+		}
+		for _, row := range survey {
+			val := reflect.ValueOf(row).Field(j).String()
+			if val == "" || allowed[val] {
+				continue
+			}
+			for _, word := range strings.Fields(val) {
+				if !allowed[word] {
+					return fmtSrcErr(row.LineNum, col, CodeInvalidValue,
+						"Value %q is not allowed in column %s, allowed values are: %s.",
+						word, col, strings.Join(values, ", "))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkTypes checks the types of the survey rows. If opts.SkipUnsupportedFields is set,
+// rows of unsupported types are reported as warnings and removed from the returned survey.
+func (b *nodeBuilder) checkTypes(survey []SurveyRow) ([]SurveyRow, error) {
+	checked := make([]SurveyRow, 0, len(survey))
+	for _, row := range survey {
+		switch {
+		case isSupportedField(row.Type):
+		case isMetadata(row.Type) && b.opts.Metadata == MetadataSkip:
+			b.warn(row.LineNum, "Skipping metadata question of type %q.", row.Type)
+			continue
+		case isMetadata(row.Type) && b.opts.Metadata == MetadataHidden:
+		case isUnsupportedField(row.Type) && b.opts.SkipUnsupportedFields:
+			b.warn(row.LineNum, "Questions of type %q are not supported, skipping.", row.Type)
+			continue
+		case isUnsupportedField(row.Type):
+			return nil, fmtSrcErr(row.LineNum, "type", CodeUnsupportedType,
+				"Questions of type %q are not supported.", row.Type)
+		case row.Type == beginGroup || row.Type == endGroup:
+		case row.Type == beginRepeat || row.Type == endRepeat:
+		case row.Type == "":
+			return nil, fmtSrcErr(row.LineNum, "type", CodeInvalidType,
+				"Empty type in non-empty survey row.")
+		default:
+			return nil, fmtSrcErr(row.LineNum, "type", CodeInvalidType,
+				"Invalid type %q in survey.", row.Type)
+		}
+		checked = append(checked, row)
+	}
+	return checked, nil
+}
+
+func preprocessGroups(survey []SurveyRow, opts ConvertOptions) ([]SurveyRow, error) {
+	var stack []*SurveyRow
+	var ungrouped []lineRange
+	repeatLine := -1
+	for i := range survey {
+		row := &survey[i]
+		switch row.Type {
+		case beginRepeat:
+			if len(stack) > 0 {
+				return nil, fmtSrcErr(row.LineNum, "type", CodeNestedRepeat,
+					"Repeats can't be nested inside groups or repeats, unless they are unrolled.")
+			}
+			repeatLine = row.LineNum
+			fallthrough
+		case beginGroup:
+			stack = append(stack, row)
+		case endRepeat, endGroup:
+			if len(stack) == 0 || stack[len(stack)-1].Type[len("begin"):] != row.Type[len("end"):] {
+				return nil, fmtSrcErr(row.LineNum, "type", CodeUnexpectedEnd,
+					"Unexpected end of group/repeat.")
+			}
+			stack = stack[0 : len(stack)-1]
+		default:
+			if len(stack) > 0 {
+				break
+			}
+			if len(ungrouped) > 0 && ungrouped[len(ungrouped)-1].endIndex == i-1 {
+				ungrouped[len(ungrouped)-1].endIndex = i
+				ungrouped[len(ungrouped)-1].end = row.LineNum
+			} else {
+				ungrouped = append(ungrouped, lineRange{row.LineNum, row.LineNum, i, i})
+			}
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmtSrcErr(stack[len(stack)-1].LineNum, "type", CodeUnclosedGroup, "Unclosed group/repeat.")
+	}
+	names := newNameSet(survey)
+	switch {
+	case len(ungrouped) > 0 && repeatLine != -1 && !opts.WrapUngrouped:
+		return nil, fmt.Errorf(
+			"Can't have ungrouped questions (%s) and repeats (line %d) in the same file. "+
+				"Put the ungrouped questions inside groups or enable the automatic wrapping of "+
+				"ungrouped questions into slides.",
+			formatLineRanges(ungrouped), repeatLine,
+		)
+	case len(ungrouped) > 0 && repeatLine != -1:
+		// Wrap each sequence of ungrouped questions into its own slide.
+		wrapped := make([]SurveyRow, 0, len(survey)+2*len(ungrouped))
+		prev := 0
+		for _, r := range ungrouped {
+			wrapped = append(wrapped, survey[prev:r.startIndex]...)
+			wrapped = append(wrapped, SurveyRow{Type: beginGroup, Name: names.unique("form"), Label: "Form"})
+			wrapped = append(wrapped, survey[r.startIndex:r.endIndex+1]...)
+			wrapped = append(wrapped, SurveyRow{Type: endGroup})
+			prev = r.endIndex + 1
+		}
+		survey = append(wrapped, survey[prev:]...)
+	case len(ungrouped) > 0:
+		// Wrap everything into a slide.
+		survey = append([]SurveyRow{{Type: beginGroup, Name: names.unique("form"), Label: "Form"}}, survey...)
+		survey = append(survey, SurveyRow{Type: endGroup})
+	}
+	// Wrap everything into a global group,
+	// it allows building the form with a single call to buildGroup.
+	survey = append([]SurveyRow{{Type: beginGroup, Name: names.unique("global")}}, survey...)
+	survey = append(survey, SurveyRow{Type: endGroup})
+	return survey, nil
+}
+
+// orOther is the suffix of the select types allowing answers not in the choice list,
+// as in "select_one colors or_other".
+const orOther = " or_other"
+
+// The labels of the choice and the question added for "or_other" questions.
+// They are in English, see Translations for the other languages.
+const (
+	otherLabel        = "Other"
+	specifyOtherLabel = "Specify other."
+)
+
+// expandOrOther replaces the "or_other" suffix of select questions with an "other" choice,
+// added to their choice lists, and a text question asking to specify it, named after
+// the select question with the suffix "_other" and relevant only when "other" is selected.
+// The arguments are not modified.
+func expandOrOther(survey []SurveyRow, choices []ChoicesRow) ([]SurveyRow, []ChoicesRow) {
+	var names nameSet
+	var expanded []SurveyRow
+	hasOther := make(map[string]bool)
+	for _, c := range choices {
+		if c.Name == "other" {
+			hasOther[c.ListName] = true
+		}
+	}
+	for i, row := range survey {
+		if !strings.HasSuffix(row.Type, orOther) || !(isSelectOne(row.Type) || isSelectMultiple(row.Type)) {
+			if expanded != nil {
+				expanded = append(expanded, row)
+			}
+			continue
+		}
+		if expanded == nil {
+			expanded = append(make([]SurveyRow, 0, len(survey)+1), survey[:i]...)
+			choices = append([]ChoicesRow(nil), choices...)
+			names = newNameSet(survey)
+		}
+		row.Type = strings.TrimSuffix(row.Type, orOther)
+		list := choiceName(row.Type)
+		if !hasOther[list] {
+			hasOther[list] = true
+			choices = append(choices, ChoicesRow{ListName: list, Name: "other", Label: otherLabel})
+		}
+		relevant := "${" + row.Name + "} = 'other'"
+		if isSelectMultiple(row.Type) {
+			relevant = "selected(${" + row.Name + "}, 'other')"
+		}
+		other := SurveyRow{
+			Type:     "text",
+			Name:     names.unique(row.Name + "_other"),
+			Label:    specifyOtherLabel,
+			Relevant: relevant,
+			LineNum:  row.LineNum,
+		}
+		expanded = append(expanded, row, other)
+	}
+	if expanded == nil {
+		return survey, choices
+	}
+	return expanded, choices
+}
+
+// expandRepeatedQuestions wraps each question having a repeat_count into its own repeat,
+// named after the question with the suffix "_repeat". The label, relevant and
+// repeat_count of the question are moved to the repeat.
+func expandRepeatedQuestions(survey []SurveyRow) []SurveyRow {
+	var names nameSet
+	expanded := make([]SurveyRow, 0, len(survey))
+	for _, row := range survey {
+		switch row.Type {
+		case beginGroup, endGroup, beginRepeat, endRepeat:
+			expanded = append(expanded, row)
+			continue
+		}
+		if row.RepeatCount == "" {
+			expanded = append(expanded, row)
+			continue
+		}
+		if names == nil {
+			names = newNameSet(survey)
+		}
+		repeat := SurveyRow{
+			Type:           beginRepeat,
+			Name:           names.unique(row.Name + "_repeat"),
+			Label:          row.Label,
+			LabelContinued: row.LabelContinued,
+			Relevant:       row.Relevant,
+			RepeatCount:    row.RepeatCount,
+			LineNum:        row.LineNum,
+		}
+		row.Relevant, row.RepeatCount = "", ""
+		expanded = append(expanded, repeat, row, SurveyRow{Type: endRepeat, LineNum: row.LineNum})
+	}
+	return expanded
+}
+
+// unrollNestedRepeats replaces the repeats nested inside groups or other repeats
+// with repeat_count copies of their content, each wrapped in a group.
+// The questions of the i-th copy get the suffix "__i" appended to their names,
+// and the references to them inside the copy are updated accordingly.
+func unrollNestedRepeats(survey []SurveyRow, depth int) ([]SurveyRow, error) {
+	unrolled := make([]SurveyRow, 0, len(survey))
+	for i := 0; i < len(survey); i++ {
+		row := survey[i]
+		switch row.Type {
+		case beginRepeat:
+			end, ok := findGroupEnd(survey, i)
+			if depth == 0 || !ok || survey[end-1].Type != endRepeat {
+				// Unclosed repeats are reported by preprocessGroups.
+				depth++
+				break
+			}
+			copies, err := unrollRepeat(survey[i:end])
+			if err != nil {
+				return nil, err
+			}
+			unrolled = append(unrolled, copies...)
+			i = end - 1
+			continue
+		case beginGroup:
+			depth++
+		case endGroup, endRepeat:
+			depth--
+		}
+		unrolled = append(unrolled, row)
+	}
+	return unrolled, nil
+}
+
+func unrollRepeat(repeat []SurveyRow) ([]SurveyRow, error) {
+	begin := repeat[0]
+	count, ok := parseExcelUint(begin.RepeatCount)
+	if !ok {
+		return nil, fmtSrcErr(begin.LineNum, "repeat_count", CodeNestedRepeat,
+			"Nested repeats can be unrolled only if repeat_count is a constant.")
+	}
+	content, err := unrollNestedRepeats(repeat[1:len(repeat)-1], 1)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, row := range content {
+		if row.Name != "" {
+			names = append(names, row.Name)
+		}
+	}
+	unrolled := make([]SurveyRow, 0, count*(len(content)+2))
+	for i := 1; i <= count; i++ {
+		suffix := "__" + strconv.Itoa(i)
+		var replacements []string
+		for _, name := range names {
+			replacements = append(replacements, "${"+name+"}", "${"+name+suffix+"}")
+		}
+		replacer := strings.NewReplacer(replacements...)
+
+		group := begin
+		group.Type = beginGroup
+		group.Name = begin.Name + suffix
+		group.RepeatCount = ""
+		unrolled = append(unrolled, group)
+		for _, row := range content {
+			rowVal := reflect.ValueOf(&row).Elem()
+			for j := 0; j < rowVal.NumField(); j++ {
+				if f := rowVal.Field(j); f.Kind() == reflect.String {
+					f.SetString(replacer.Replace(f.String()))
+				}
+			}
+			if row.Name != "" {
+				row.Name += suffix
+			}
+			unrolled = append(unrolled, row)
+		}
+		unrolled = append(unrolled, SurveyRow{Type: endGroup, LineNum: repeat[len(repeat)-1].LineNum})
+	}
+	return unrolled, nil
+}
+
+// lineRange is a sequence of consecutive survey rows.
+type lineRange struct {
+	start, end           int // line numbers
+	startIndex, endIndex int // indices in the survey
+}
+
+func formatLineRanges(ranges []lineRange) string {
+	var parts []string
+	for _, r := range ranges {
+		if r.start == r.end {
+			parts = append(parts, "line "+strconv.Itoa(r.start))
+		} else {
+			parts = append(parts, fmt.Sprintf("lines %d-%d", r.start, r.end))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// nameSet is used to generate names for the groups created by the converter,
+// making sure they don't collide with the names of the survey rows.
+type nameSet map[string]bool
+
+func newNameSet(survey []SurveyRow) nameSet {
+	names := make(nameSet)
+	for _, row := range survey {
+		names[row.Name] = true
+	}
+	return names
+}
+
+func (names nameSet) unique(base string) string {
+	name := base
+	for i := 1; names[name]; i++ {
+		name = base + "_" + strconv.Itoa(i)
+	}
+	names[name] = true
+	return name
+}
+
+type nodeBuilder struct {
+	opts        ConvertOptions
+	parser      parser                     // for formulas
+	originNames map[string]string          // sanitized names of the choices origins
+	choiceAttrs map[string]map[string]bool // attribute names of the choices of each list
+	choices     map[string][]Choice        // choice lists by name
+	depth       int                        // nesting level of the group being built
+	names       nameSet                    // for the names of the nodes created by the converter
+	ambiguous   map[string]bool            // short labels shared by different labels, see truncateLabel
+	warnings    []Warning
+}
+
+func (b *nodeBuilder) warn(lineNum int, format string, a ...interface{}) {
+	b.warnings = append(b.warnings, Warning{lineNum, fmt.Sprintf(format, a...)})
+}
+
+// maxLabelLength is the length above which labels may be truncated by ajf.
+const maxLabelLength = 2048
+
+// htmlTag matches opening, closing and self-closing html tags, like <b>, </b> and <br/>.
+var htmlTag = regexp.MustCompile(`<\s*/?\s*[a-zA-Z][a-zA-Z0-9-]*(\s[^<>]*)?/?\s*>`)
+
+func (b *nodeBuilder) checkLabel(row *SurveyRow) {
+	if n := utf8.RuneCountInString(row.FullLabel()); n > maxLabelLength {
+		b.warn(row.LineNum, "Label is %d characters long, it may be truncated to %d characters.",
+			n, maxLabelLength)
+	}
+	// The labels of notes are converted to the HTML of the field, other labels are plain text.
+	if m := htmlTag.FindString(row.FullLabel()); m != "" && row.Type != "note" {
+		b.warn(row.LineNum, "Label contains html markup %q, which is meant to be used only in notes.", m)
+	}
+}
+
+// renderLabel converts the label of the node from markdown to html, with opts.MarkdownLabels.
+func (b *nodeBuilder) renderLabel(n *Node) {
+	if b.opts.MarkdownLabels {
+		n.Label = markdownToHtml(n.Label)
+	}
 }
 
-func checkTypes(survey []SurveyRow) error {
-	for _, row := range survey {
-		switch {
-		case isSupportedField(row.Type):
-			continue
-		case isUnsupportedField(row.Type):
-			return fmtSrcErr(row.LineNum, "Questions of type %q are not supported.", row.Type)
-		case row.Type == beginGroup || row.Type == endGroup:
-			continue
-		case row.Type == beginRepeat || row.Type == endRepeat:
-			continue
-		case row.Type == "":
-			return fmtSrcErr(row.LineNum, "Empty type in non-empty survey row.", row.Type)
-		default:
-			return fmtSrcErr(row.LineNum, "Invalid type %q in survey.", row.Type)
-		}
+// truncateLabel shortens the label of the node according to opts.TruncateLabels,
+// moving its full text to the hint or the description. Nodes having both keep their label,
+// as do the nodes whose short label would be the same as that of a different label
+// (its translation would be ambiguous).
+func (b *nodeBuilder) truncateLabel(n *Node, lineNum int) {
+	short, ok := shortenLabel(n.Label, b.opts.TruncateLabels)
+	if !ok {
+		return
 	}
-	return nil
+	if b.ambiguous[short] {
+		b.warn(lineNum, "Label not truncated, as it would be the same as another truncated label: %q.", short)
+		return
+	}
+	switch {
+	case n.Hint == "":
+		n.Hint = n.Label
+	case n.Description == "":
+		n.Description = n.Label
+	default:
+		return
+	}
+	n.Label = short
 }
 
-func preprocessGroups(survey []SurveyRow) ([]SurveyRow, error) {
-	var stack []*SurveyRow
-	ungroupedQLine := -1
-	repeatLine := -1
-	for i := range survey {
-		row := &survey[i]
-		switch row.Type {
-		case beginRepeat:
-			if len(stack) > 0 {
-				return nil, fmtSrcErr(row.LineNum, "Repeats can't be nested.")
-			}
-			repeatLine = row.LineNum
-			fallthrough
-		case beginGroup:
-			stack = append(stack, row)
-		case endRepeat, endGroup:
-			if len(stack) == 0 || stack[len(stack)-1].Type[len("begin"):] != row.Type[len("end"):] {
-				return nil, fmtSrcErr(row.LineNum, "Unexpected end of group/repeat.")
-			}
-			stack = stack[0 : len(stack)-1]
-		default:
-			if len(stack) == 0 {
-				ungroupedQLine = row.LineNum
-			}
+// shortenLabel returns the label shortened to at most max characters, cut at the last
+// word boundary when possible and ending with an ellipsis. The label is not cut inside
+// html tags or markdown links. ok is false if the label is not longer than max
+// (or max is not positive).
+func shortenLabel(label string, max int) (short string, ok bool) {
+	runes := []rune(label)
+	if max <= 0 || len(runes) <= max {
+		return label, false
+	}
+	cut := runes[:max-1] // room for the ellipsis
+	for i := len(cut) - 1; i > len(cut)/2; i-- {
+		if unicode.IsSpace(cut[i]) {
+			cut = cut[:i]
+			break
 		}
 	}
-	if len(stack) > 0 {
-		return nil, fmtSrcErr(stack[len(stack)-1].LineNum, "Unclosed group/repeat.")
+	if i := lastRune(cut, '<'); i > lastRune(cut, '>') {
+		cut = cut[:i]
 	}
-	if ungroupedQLine != -1 && repeatLine != -1 {
-		return nil, fmt.Errorf(
-			"Can't have ungrouped questions (line %d) and repeats (line %d) in the same file.",
-			ungroupedQLine, repeatLine,
-		)
+	if i := lastRune(cut, '['); i != -1 && lastRune(cut, ')') < i && strings.Contains(string(runes[i:]), "](") {
+		cut = cut[:i]
 	}
-	if ungroupedQLine != -1 {
-		// Wrap everything into a slide.
-		survey = append([]SurveyRow{{Type: beginGroup, Name: "form", Label: "Form"}}, survey...)
-		survey = append(survey, SurveyRow{Type: endGroup})
+	return strings.TrimRightFunc(string(cut), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}) + "…", true
+}
+
+// lastRune returns the index of the last occurrence of r in runes, or -1.
+func lastRune(runes []rune, r rune) int {
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] == r {
+			return i
+		}
 	}
-	// Wrap everything into a global group,
-	// it allows building the form with a single call to buildGroup.
-	survey = append([]SurveyRow{{Type: beginGroup, Name: "global"}}, survey...)
-	survey = append(survey, SurveyRow{Type: endGroup})
-	return survey, nil
+	return -1
 }
 
-type nodeBuilder struct {
-	parser parser // for formulas
+// ambiguousShortLabels returns the short labels (see shortenLabel)
+// that different labels would be shortened to.
+func ambiguousShortLabels(labels []string, max int) map[string]bool {
+	full := make(map[string]string)
+	ambiguous := make(map[string]bool)
+	for _, label := range labels {
+		short, ok := shortenLabel(label, max)
+		if !ok {
+			continue
+		}
+		if l, seen := full[short]; seen && l != label {
+			ambiguous[short] = true
+		}
+		full[short] = label
+	}
+	return ambiguous
 }
 
 func (b *nodeBuilder) buildGroup(survey []SurveyRow) (Node, error) {
 	row := survey[0]
 	if row.Type != beginGroup && row.Type != beginRepeat {
-		panic("not a group")
+		return Node{}, fmtSrcErr(row.LineNum, "type", CodeInvalidType,
+			"Expected begin of group/repeat, found %q.", row.Type)
+	}
+	if _, err := groupEnd(survey, 0); err != nil {
+		return Node{}, err
 	}
 	group := Node{
 		Name:  row.Name,
-		Label: row.Label,
+		Label: row.FullLabel(),
 		Type:  NtGroup,
+		Hint:  row.Hint,
 		Nodes: make([]Node, 0, 8),
 	}
+	b.checkLabel(&row)
 	var err error
 	group.Visibility, err = b.nodeVisibility(&row)
 	if err != nil {
 		return Node{}, err
 	}
+	b.depth++
+	defer func() { b.depth-- }()
+	if b.opts.CollapsibleGroups && hasAppearance(&row, "collapsible") {
+		// depth 1 is the global group, depth 2 are the slides.
+		if row.Type == beginGroup && b.depth > 2 {
+			group.Collapsible = true
+		} else {
+			b.warn(row.LineNum, "Only groups nested in other groups can be collapsible, ignoring appearance.")
+		}
+	}
 	if row.Type == beginRepeat {
 		group.Type = NtRepeatingSlide
 		if row.RepeatCount != "" {
-			reps, ok := parseExcelUint(row.RepeatCount)
-			if !ok {
-				return Node{}, fmtSrcErr(row.LineNum, "repeat_count is not an unsigned integer.")
+			if reps, ok := parseExcelUint(row.RepeatCount); ok {
+				group.MaxReps = &reps
+			} else {
+				// Not a constant, the number of repetitions is computed by a formula.
+				js, err := b.parser.Parse(row.RepeatCount, "repeat_count", row.Name)
+				if err != nil {
+					return Node{}, formulaErr(row.LineNum, "repeat_count", err)
+				}
+				group.FormulaReps = &Formula{js}
+			}
+		}
+		if b.opts.RepeatJoinKeys {
+			keys, err := b.joinKeys(&row)
+			if err != nil {
+				return Node{}, err
 			}
-			group.MaxReps = &reps
+			group.Nodes = append(group.Nodes, keys...)
 		}
 	}
-	for i := 1; i < len(survey); i++ {
+	start := 1
+	if first := survey[1]; b.opts.NoteAsDescription && first.Type == "note" && first.Relevant == "" {
+		group.Description = first.FullLabel()
+		start = 2
+	}
+	for i := start; i < len(survey); i++ {
 		row := survey[i]
 		switch {
-		case isSupportedField(row.Type):
+		case isSupportedField(row.Type) || isMetadata(row.Type):
 			field, err := b.buildField(&row)
 			if err != nil {
 				return Node{}, err
 			}
 			group.Nodes = append(group.Nodes, field)
 		case row.Type == beginGroup || row.Type == beginRepeat:
-			end := groupEnd(survey, i)
+			end, err := groupEnd(survey, i)
+			if err != nil {
+				return Node{}, err
+			}
 			child, err := b.buildGroup(survey[i:end])
 			if err != nil {
 				return Node{}, err
@@ -202,15 +1332,47 @@ func (b *nodeBuilder) buildGroup(survey []SurveyRow) (Node, error) {
 			i = end - 1
 		case row.Type == endGroup || row.Type == endRepeat:
 			if i != len(survey)-1 {
-				panic("unexpected end of group")
+				return Node{}, fmtSrcErr(row.LineNum, "type", CodeUnexpectedEnd, "Unexpected end of group/repeat.")
 			}
 		default:
-			panic("unexpected row type")
+			return Node{}, fmtSrcErr(row.LineNum, "type", CodeInvalidType, "Invalid type %q in survey.", row.Type)
 		}
 	}
+	b.truncateLabel(&group, row.LineNum)
+	b.renderLabel(&group)
 	return group, nil
 }
 
+// repeatIndexFormula evaluates to the 1-based index of the current repetition
+// in a repeating slide.
+const repeatIndexFormula = "$index + 1"
+
+// joinKeys returns the hidden fields identifying the repetitions of a repeat.
+func (b *nodeBuilder) joinKeys(row *SurveyRow) ([]Node, error) {
+	hidden := hiddenVisibility()
+	keys := []Node{{
+		Name:       b.names.unique(row.Name + "_index"),
+		Type:       NtField,
+		FieldType:  &FtFormula,
+		Formula:    &Formula{repeatIndexFormula},
+		Visibility: hidden,
+	}}
+	if b.opts.RepeatParentKey != "" {
+		js, err := b.parser.Parse(b.opts.RepeatParentKey, "repeat_parent_key", row.Name)
+		if err != nil {
+			return nil, formulaErr(row.LineNum, "name", err)
+		}
+		keys = append(keys, Node{
+			Name:       b.names.unique(row.Name + "_parent_key"),
+			Type:       NtField,
+			FieldType:  &FtFormula,
+			Formula:    &Formula{js},
+			Visibility: hidden,
+		})
+	}
+	return keys, nil
+}
+
 func parseExcelUint(s string) (i int, ok bool) {
 	// xlsx files from google sheets may contain ints like 1.23e2
 	f, err := strconv.ParseFloat(s, 64)
@@ -220,7 +1382,16 @@ func parseExcelUint(s string) (i int, ok bool) {
 	return int(f), true
 }
 
-func groupEnd(survey []SurveyRow, groupStart int) int {
+// groupEnd returns the index following the end of the group beginning at groupStart.
+func groupEnd(survey []SurveyRow, groupStart int) (int, error) {
+	end, ok := findGroupEnd(survey, groupStart)
+	if !ok {
+		return -1, fmtSrcErr(survey[groupStart].LineNum, "type", CodeUnclosedGroup, "Unclosed group/repeat.")
+	}
+	return end, nil
+}
+
+func findGroupEnd(survey []SurveyRow, groupStart int) (int, bool) {
 	groupDepth := 1
 	for i := groupStart + 1; i < len(survey); i++ {
 		switch survey[i].Type {
@@ -229,19 +1400,21 @@ func groupEnd(survey []SurveyRow, groupStart int) int {
 		case endGroup, endRepeat:
 			groupDepth--
 			if groupDepth == 0 {
-				return i + 1
+				return i + 1, true
 			}
 		}
 	}
-	panic("group end not found")
+	return -1, false
 }
 
 func (b *nodeBuilder) buildField(row *SurveyRow) (Node, error) {
 	field := Node{
 		Name:  row.Name,
-		Label: row.Label,
+		Label: row.FullLabel(),
 		Type:  NtField,
+		Hint:  row.Hint,
 	}
+	b.checkLabel(row)
 	var err error
 	field.Visibility, err = b.nodeVisibility(row)
 	if err != nil {
@@ -254,76 +1427,460 @@ func (b *nodeBuilder) buildField(row *SurveyRow) (Node, error) {
 	switch {
 	case row.Type == "decimal" || row.Type == "integer":
 		field.FieldType = &FtNumber
+		err = b.numberFormat(&field, row)
+		if err != nil {
+			return Node{}, err
+		}
 	case row.Type == "text":
 		field.FieldType = &FtString
 	case row.Type == "boolean":
 		field.FieldType = &FtBoolean
-	case isSelectOne(row.Type):
+	case row.Type == "acknowledge" || row.Type == "trigger":
+		// A confirmation, checking the box means "OK".
+		field.FieldType = &FtBoolean
+	case isSelectOne(row.Type) || isSelectMultiple(row.Type):
 		field.FieldType = &FtSingleChoice
-		field.ChoicesOriginRef = choiceName(row.Type)
-	case isSelectMultiple(row.Type):
-		field.FieldType = &FtMultipleChoice
-		field.ChoicesOriginRef = choiceName(row.Type)
+		if isSelectMultiple(row.Type) {
+			field.FieldType = &FtMultipleChoice
+			field.Ranked = isRank(row.Type)
+		}
+		field.ChoicesOriginRef = b.originNames[choiceName(row.Type)]
+		if row.ChoiceFilter != "" {
+			attrs := b.choiceAttrs[choiceName(row.Type)]
+			js, err := b.parser.ParseChoiceFilter(row.ChoiceFilter, row.Name, attrs)
+			if err != nil {
+				return Node{}, formulaErr(row.LineNum, "choice_filter", err)
+			}
+			field.ChoicesFilter = &Formula{js}
+		}
+		err = b.randomizeChoices(&field, row)
+		if err != nil {
+			return Node{}, err
+		}
 	case row.Type == "note":
 		field.Label = ""
 		field.FieldType = &FtNote
-		field.HTML = row.Label
+		field.HTML = renderNote(row.FullLabel(), b.opts.Notes)
 	case row.Type == "date":
 		field.FieldType = &FtDate
 	case row.Type == "time":
 		field.FieldType = &FtTime
+	case row.Type == "datetime":
+		// ajf has no datetime fields, the answer is a string validated by dateTimeCondition.
+		field.FieldType = &FtString
 	case row.Type == "calculate":
 		field.FieldType = &FtFormula
 		js, err := b.parser.Parse(row.Calculation, "calculation", row.Name)
 		if err != nil {
-			return Node{}, fmtSrcErr(row.LineNum, "%s", err)
+			return Node{}, formulaErr(row.LineNum, "calculation", err)
+		}
+		if val, ok := b.evalConstant(js); ok {
+			js = constLiteral(val)
 		}
 		field.Formula = &Formula{js}
+		if row.FullLabel() == "" {
+			// Calculations without a label are only used by other formulas.
+			field.Visibility = hiddenVisibility()
+		}
+	case row.Type == "hidden":
+		field.FieldType = &FtString
+		if row.Relevant != "" {
+			b.warn(row.LineNum, "Hidden questions are never visible, ignoring relevant.")
+		}
+		field.Visibility = hiddenVisibility()
 	case row.Type == "barcode":
 		field.FieldType = &FtBarcode
+	case row.Type == "geopoint":
+		field.FieldType = &FtGeolocation
+	case row.Type == "geotrace" || row.Type == "geoshape":
+		// ajf has no field for lines or polygons,
+		// the points are collected as a string of "lat lon" pairs separated by semicolons.
+		field.FieldType = &FtString
+		if field.Hint == "" {
+			field.Hint = geoHint[row.Type]
+		}
+	case row.Type == "image":
+		field.FieldType = &FtImage
+	case row.Type == "audio" || row.Type == "video" || row.Type == "file":
+		field.FieldType = &FtFile
+	case isMetadata(row.Type):
+		// The value is meant to be filled by the application, not by the user.
+		field.FieldType = metadataField[row.Type]
+		field.Visibility = hiddenVisibility()
+	case row.Type == "range":
+		field.FieldType = &FtRange
+		err := setRange(&field, row)
+		if err != nil {
+			return Node{}, err
+		}
 	default:
-		panic("unexpected row type")
+		return Node{}, fmtSrcErr(row.LineNum, "type", CodeInvalidType, "Invalid type %q in survey.", row.Type)
+	}
+	b.applyAppearance(&field, row)
+	if max := b.opts.MaxChoicesInline; max > 0 && (isSelectOne(row.Type) || isSelectMultiple(row.Type)) &&
+		!field.ForceExpanded && len(b.choices[choiceName(row.Type)]) > max {
+		field.ForceNarrow = true
+	}
+	readOnly, ok := parseYesNo(row.ReadOnly)
+	if !ok {
+		b.warn(row.LineNum, `Unrecognized value %q in "read_only" column, the question will be editable.`,
+			row.ReadOnly)
+	}
+	if readOnly {
+		editable := false
+		field.Editable = &editable
+	}
+	if row.Unit != "" {
+		if ft := *field.FieldType; ft == FtNumber || ft == FtRange || ft == FtFormula {
+			field.Unit = row.Unit
+		} else {
+			b.warn(row.LineNum, "Questions of type %q can't have a unit, ignoring.", row.Type)
+		}
+	}
+	if row.Default != "" {
+		field.DefaultValue, err = b.defaultValue(row)
+		if err != nil {
+			return Node{}, err
+		}
+	}
+	if row.Calculation != "" && row.Type != "calculate" {
+		err = b.calculatedValue(&field, row)
+		if err != nil {
+			return Node{}, err
+		}
+	}
+	if row.Type != "note" {
+		b.truncateLabel(&field, row.LineNum)
+		b.renderLabel(&field)
 	}
 	return field, nil
 }
 
+// calculatedValue sets the formula of a visible question with a calculation,
+// whose value is computed from the formula (and can still be modified by the user).
+func (b *nodeBuilder) calculatedValue(field *Node, row *SurveyRow) error {
+	switch {
+	case row.Type == "note":
+		b.warn(row.LineNum, "Calculations on notes are not supported, ignoring.")
+		return nil
+	case row.Default != "":
+		return fmtSrcErr(row.LineNum, "default", CodeInvalidDefault,
+			"Questions can't have both a default value and a calculation.")
+	}
+	js, err := b.parser.Parse(row.Calculation, "calculation", row.Name)
+	if err != nil {
+		return formulaErr(row.LineNum, "calculation", err)
+	}
+	if val, ok := b.evalConstant(js); ok {
+		field.DefaultValue = val
+		return nil
+	}
+	field.Formula = &Formula{js}
+	return nil
+}
+
+// evalConstant evaluates the translation of a calculation at conversion time,
+// if it depends only on constants and the EvalConstants option is set.
+func (b *nodeBuilder) evalConstant(js string) (interface{}, bool) {
+	if !b.opts.EvalConstants {
+		return nil, false
+	}
+	return evalConstant(js)
+}
+
+// defaultValue converts the default value of a question to the type of the field.
+func (b *nodeBuilder) defaultValue(row *SurveyRow) (interface{}, error) {
+	def := strings.TrimSpace(row.Default)
+	invalid := func() (interface{}, error) {
+		return nil, fmtSrcErr(row.LineNum, "default", CodeInvalidDefault,
+			"Default value %q is not valid for questions of type %q.",
+			row.Default, row.Type)
+	}
+	switch {
+	case row.Type == "decimal" || row.Type == "range":
+		f, err := strconv.ParseFloat(def, 64)
+		if err != nil {
+			return invalid()
+		}
+		return f, nil
+	case row.Type == "integer":
+		i, err := strconv.Atoi(def)
+		if err != nil {
+			return invalid()
+		}
+		return i, nil
+	case row.Type == "acknowledge" || row.Type == "trigger":
+		if strings.EqualFold(def, "OK") {
+			return true, nil
+		}
+		fallthrough
+	case row.Type == "boolean":
+		val, ok := parseYesNo(def)
+		if !ok {
+			return invalid()
+		}
+		return val, nil
+	case row.Type == "date" || row.Type == "time" || row.Type == "datetime":
+		for _, layout := range timeLayouts[row.Type] {
+			if _, err := time.Parse(layout, def); err == nil {
+				return def, nil
+			}
+		}
+		return invalid()
+	case isSelectOne(row.Type) || isSelectMultiple(row.Type):
+		values := []string{def}
+		if isSelectMultiple(row.Type) {
+			values = strings.Fields(def)
+		}
+		if choices, ok := b.choices[choiceName(row.Type)]; ok {
+			for _, val := range values {
+				if !containsChoice(choices, val) {
+					return nil, fmtSrcErr(row.LineNum, "default", CodeInvalidDefault,
+						"Default value %q is not one of the choices of %q.",
+						val, choiceName(row.Type))
+				}
+			}
+		}
+		if isSelectMultiple(row.Type) {
+			return values, nil
+		}
+		return def, nil
+	case row.Type == "text" || row.Type == "barcode" || row.Type == "hidden":
+		return row.Default, nil
+	default:
+		return nil, fmtSrcErr(row.LineNum, "default", CodeInvalidDefault,
+			"Questions of type %q can't have a default value.", row.Type)
+	}
+}
+
+var timeLayouts = map[string][]string{
+	"date":     {"2006-01-02"},
+	"time":     {"15:04", "15:04:05"},
+	"datetime": {time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04"},
+}
+
+func containsChoice(choices []Choice, value string) bool {
+	for _, c := range choices {
+		if c.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAppearance reports whether the appearance column of the row contains the given appearance.
+func hasAppearance(row *SurveyRow, appearance string) bool {
+	for _, app := range strings.Fields(row.Appearance) {
+		if app == appearance {
+			return true
+		}
+	}
+	return false
+}
+
+// applyAppearance translates the appearance of a question to the ajf widget attributes.
+func (b *nodeBuilder) applyAppearance(field *Node, row *SurveyRow) {
+	isSelect := isSelectOne(row.Type) || isSelectMultiple(row.Type)
+	for _, app := range strings.Fields(row.Appearance) {
+		switch {
+		case app == "multiline" && row.Type == "text":
+			field.FieldType = &FtText
+		case app == "minimal" && isSelect:
+			field.ForceNarrow = true
+		case (app == "quick" || app == "horizontal" || app == "horizontal-compact" || app == "likert") && isSelect:
+			field.ForceExpanded = true
+		case app == "thousands-sep" && (row.Type == "integer" || row.Type == "decimal"):
+			field.ThousandsSep = true
+		default:
+			b.warn(row.LineNum, "Appearance %q is not supported for questions of type %q, ignoring.",
+				app, row.Type)
+		}
+	}
+}
+
+// setRange sets the start, end and step of a range field,
+// as specified in the parameters column.
+func setRange(field *Node, row *SurveyRow) error {
+	params, err := parseParameters(row.Parameters)
+	if err != nil {
+		return fmtSrcErr(row.LineNum, "parameters", CodeInvalidParameters, "%s", err)
+	}
+	values := map[string]float64{"start": 0, "end": 10, "step": 1} // xlsform defaults
+	for key, val := range params {
+		if _, ok := values[key]; !ok {
+			return fmtSrcErr(row.LineNum, "parameters", CodeInvalidParameters,
+				"Invalid range parameter %q.", key)
+		}
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return fmtSrcErr(row.LineNum, "parameters", CodeInvalidParameters,
+				"Range parameter %q is not a number.", key)
+		}
+		values[key] = f
+	}
+	start, end, step := values["start"], values["end"], values["step"]
+	if step == 0 || (end-start)/step < 0 {
+		return fmtSrcErr(row.LineNum, "parameters", CodeInvalidParameters,
+			"Invalid range, start=%g end=%g step=%g.", start, end, step)
+	}
+	field.Start, field.End, field.Step = &start, &end, &step
+	if field.Validation == nil {
+		field.Validation = new(FieldValidation)
+	}
+	min, max := math.Min(start, end), math.Max(start, end)
+	field.Validation.MinValue, field.Validation.MaxValue = &min, &max
+	return nil
+}
+
+// maxDecimals is the maximum number of decimal places of a number field.
+const maxDecimals = 20
+
+// numberFormat sets the number of decimal places shown by a decimal field,
+// as specified by the decimals parameter.
+func (b *nodeBuilder) numberFormat(field *Node, row *SurveyRow) error {
+	params, err := parseParameters(row.Parameters)
+	if err != nil {
+		return fmtSrcErr(row.LineNum, "parameters", CodeInvalidParameters, "%s", err)
+	}
+	for _, key := range paramNames(params) {
+		val := params[key]
+		if key != "decimals" || row.Type != "decimal" {
+			b.warn(row.LineNum, "Parameter %q is not supported for questions of type %q, ignoring.",
+				key, row.Type)
+			continue
+		}
+		d, err := strconv.Atoi(val)
+		if err != nil || d < 0 || d > maxDecimals {
+			return fmtSrcErr(row.LineNum, "parameters", CodeInvalidParameters,
+				"Invalid value %q for parameter decimals, expected an integer from 0 to %d.", val, maxDecimals)
+		}
+		field.Decimals = &d
+	}
+	return nil
+}
+
+// parseParameters parses the content of the parameters column,
+// a list of key=value pairs separated by spaces or semicolons.
+func parseParameters(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ';' || unicode.IsSpace(r) })
+	for _, f := range fields {
+		eq := strings.IndexByte(f, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("Invalid parameter %q, expected key=value.", f)
+		}
+		params[f[:eq]] = f[eq+1:]
+	}
+	return params, nil
+}
+
+// paramNames returns the names of the parameters in alphabetical order,
+// so that the problems are reported in the same order on each conversion.
+func paramNames(params map[string]string) []string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// randomizeChoices sets the randomization of the choices of a select question,
+// as specified by the randomize and seed parameters.
+func (b *nodeBuilder) randomizeChoices(field *Node, row *SurveyRow) error {
+	params, err := parseParameters(row.Parameters)
+	if err != nil {
+		return fmtSrcErr(row.LineNum, "parameters", CodeInvalidParameters, "%s", err)
+	}
+	randomize, seed := false, ""
+	for _, key := range paramNames(params) {
+		val := params[key]
+		switch key {
+		case "randomize":
+			var ok bool
+			randomize, ok = parseYesNo(val)
+			if !ok {
+				return fmtSrcErr(row.LineNum, "parameters", CodeInvalidParameters,
+					"Invalid value %q for parameter randomize.", val)
+			}
+		case "seed":
+			seed = val
+		default:
+			b.warn(row.LineNum, "Parameter %q is not supported for questions of type %q, ignoring.",
+				key, row.Type)
+		}
+	}
+	if !randomize {
+		if seed != "" {
+			b.warn(row.LineNum, "Parameter seed has no effect without randomize=true, ignoring.")
+		}
+		return nil
+	}
+	field.RandomizeChoices = true
+	switch {
+	case b.opts.FixedSeed != "":
+		field.RandomSeed = &Formula{b.opts.FixedSeed}
+	case seed != "":
+		js, err := b.parser.Parse(seed, "seed", row.Name)
+		if err != nil {
+			return formulaErr(row.LineNum, "parameters", err)
+		}
+		field.RandomSeed = &Formula{js}
+	}
+	return nil
+}
+
 func (b *nodeBuilder) nodeVisibility(row *SurveyRow) (*NodeVisibility, error) {
 	if row.Relevant == "" {
 		return nil, nil
 	}
 	js, err := b.parser.Parse(row.Relevant, "relevant", row.Name)
 	if err != nil {
-		return nil, fmtSrcErr(row.LineNum, "%s", err)
+		return nil, formulaErr(row.LineNum, "relevant", err)
 	}
 	return &NodeVisibility{Condition: js}, nil
 }
 
-func (b *nodeBuilder) fieldValidation(row *SurveyRow) (*FieldValidation, error) {
-	if row.Required == "" && row.Constraint == "" && row.Type != "integer" {
-		return nil, nil
-	}
-	v := new(FieldValidation)
+// dateTimeCondition is the validation condition of the string fields
+// the datetime questions are converted to: the answer must start like an ISO 8601 timestamp.
+func dateTimeCondition(name string) string {
+	return name + " == null || " + name + ".match('^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}') !== null"
+}
 
-	if row.Required != "" && row.Required != "yes" {
-		return nil, fmtSrcErr(row.LineNum, `Invalid value %q in "required" column.`, row.Required)
+// hiddenVisibility is the visibility of the nodes that are never shown.
+func hiddenVisibility() *NodeVisibility { return &NodeVisibility{Condition: "false"} }
+
+func (b *nodeBuilder) fieldValidation(row *SurveyRow) (*FieldValidation, error) {
+	required, ok := parseYesNo(row.Required)
+	if !ok {
+		b.warn(row.LineNum, `Unrecognized value %q in "required" column, the question won't be required.`,
+			row.Required)
 	}
-	if row.Required == "yes" {
-		v.NotEmpty = true
+	if !required && row.Constraint == "" && row.Type != "integer" && row.Type != "datetime" {
+		return nil, nil
 	}
+	v := &FieldValidation{NotEmpty: required}
 
-	if row.Type == "integer" {
+	switch row.Type {
+	case "integer":
 		v.Conditions = []ValidationCondition{{
 			Condition:        "isInt(" + row.Name + ")", // ajf function
 			ClientValidation: true,
 			ErrorMessage:     "The field value must be an integer.",
 		}}
+	case "datetime":
+		v.Conditions = []ValidationCondition{{
+			Condition:        dateTimeCondition(row.Name),
+			ClientValidation: true,
+			ErrorMessage:     "The field value must be a date and time (YYYY-MM-DDTHH:MM).",
+		}}
 	}
 	if row.Constraint == "" {
 		return v, nil
 	}
 	js, err := b.parser.Parse(row.Constraint, "constraint", row.Name)
 	if err != nil {
-		return nil, fmtSrcErr(row.LineNum, "%s", err)
+		return nil, formulaErr(row.LineNum, "constraint", err)
 	}
 	v.Conditions = append(v.Conditions, ValidationCondition{
 		Condition:        js,
@@ -333,20 +1890,118 @@ func (b *nodeBuilder) fieldValidation(row *SurveyRow) (*FieldValidation, error)
 	return v, nil
 }
 
-const idMultiplier = 1000
+// addRequiredValidation adds to the slide a validation condition requiring the answers
+// to its visible required fields, see ConvertOptions.SlideRequiredValidation.
+func addRequiredValidation(slide *Node) {
+	conds := requiredConditions(slide.Nodes, nil)
+	if len(conds) == 0 {
+		return
+	}
+	slide.Validation = &FieldValidation{Conditions: []ValidationCondition{{
+		Condition:        strings.Join(conds, " && "),
+		ClientValidation: true,
+		ErrorMessage:     "All the required questions must be answered.",
+	}}}
+}
+
+// requiredConditions returns, for each required field among nodes and their descendants,
+// a condition satisfied when the field is answered or hidden. visible contains
+// the visibility conditions of the groups containing nodes.
+func requiredConditions(nodes []Node, visible []string) []string {
+	var conds []string
+	for _, n := range nodes {
+		vis := visible
+		if n.Visibility != nil {
+			vis = append(vis[:len(vis):len(vis)], "("+n.Visibility.Condition+")")
+		}
+		switch {
+		case n.Type == NtGroup:
+			conds = append(conds, requiredConditions(n.Nodes, vis)...)
+		case n.Type == NtField && n.Validation != nil && n.Validation.NotEmpty:
+			cond := "notEmpty(" + n.Name + ")" // ajf function
+			if len(vis) > 0 {
+				cond = "(!(" + strings.Join(vis, " && ") + ") || " + cond + ")"
+			}
+			conds = append(conds, cond)
+		}
+	}
+	return conds
+}
+
+// parseYesNo interprets the boolean value of a cell, like the one of the "required" column.
+// An empty cell means false; ok is false if the value is not recognized.
+func parseYesNo(cell string) (value, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(cell)) {
+	case "yes", "y", "true", "true()", "1", "si", "sì", "oui", "ja":
+		return true, true
+	case "", "no", "n", "false", "false()", "0", "non", "nein":
+		return false, true
+	}
+	return false, false
+}
+
+const defaultIdMultiplier = 1000
+
+// maxId is the largest integer that can be represented exactly in JavaScript.
+const maxId = 1<<53 - 1
 
-func assignIds(nodes []Node, parent int) {
+// assignIds gives to the children of a node with id parent the ids
+// parent*idMultiplier + 1, parent*idMultiplier + 2, ...
+// An error is returned if the ids would overflow into the range of another node.
+func assignIds(nodes []Node, parent, idMultiplier int) error {
 	if len(nodes) == 0 {
-		return
+		return nil
+	}
+	if len(nodes) >= idMultiplier {
+		return fmt.Errorf("%s has %d children, the id multiplier (%d) must be greater than that.",
+			describeNode(parent), len(nodes), idMultiplier)
+	}
+	if int64(parent)*int64(idMultiplier)+int64(len(nodes)) > maxId {
+		return fmt.Errorf("%s is nested too deeply, the ids of its children would overflow.",
+			describeNode(parent))
 	}
 	nodes[0].Previous = parent
 	nodes[0].Id = parent*idMultiplier + 1
-	assignIds(nodes[0].Nodes, nodes[0].Id)
 	for i := 1; i < len(nodes); i++ {
 		nodes[i].Previous = nodes[i-1].Id
 		nodes[i].Id = nodes[i-1].Id + 1
-		assignIds(nodes[i].Nodes, nodes[i].Id)
 	}
+	for i := range nodes {
+		err := assignIds(nodes[i].Nodes, nodes[i].Id, idMultiplier)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignSlideIds is like assignIds for the top-level nodes,
+// but their ids start from offset+1 instead of 1.
+func assignSlideIds(slides []Node, offset, idMultiplier int) error {
+	if offset == 0 {
+		return assignIds(slides, 0, idMultiplier)
+	}
+	if int64(offset)+int64(len(slides)) > maxId/int64(idMultiplier) {
+		return fmt.Errorf("The id start offset %d is too large, the ids would overflow.", offset)
+	}
+	for i := range slides {
+		slides[i].Id = offset + i + 1
+		if i > 0 {
+			slides[i].Previous = slides[i-1].Id
+		}
+		err := assignIds(slides[i].Nodes, slides[i].Id, idMultiplier)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func describeNode(id int) string {
+	if id == 0 {
+		return "The form"
+	}
+	return fmt.Sprintf("The node with id %d", id)
 }
 
 const (
@@ -358,24 +2013,46 @@ const (
 
 var supportedField = map[string]bool{
 	"decimal": true, "integer": true, "text": true, "boolean": true,
-	"note": true, "date": true, "time": true, "calculate": true,
-	"barcode": true,
+	"note": true, "date": true, "time": true, "datetime": true, "calculate": true,
+	"barcode": true, "range": true, "geopoint": true, "geotrace": true, "geoshape": true,
+	"image": true, "audio": true, "video": true, "file": true,
+	"acknowledge": true, "trigger": true, "hidden": true,
+}
+
+var geoHint = map[string]string{
+	"geotrace": "List of points of the line, as latitude and longitude pairs separated by semicolons.",
+	"geoshape": "List of points of the polygon, as latitude and longitude pairs separated by semicolons.",
 }
 
 func isSupportedField(typ string) bool {
 	return supportedField[typ] || isSelectOne(typ) || isSelectMultiple(typ)
 }
-func isSelectOne(typ string) bool      { return strings.HasPrefix(typ, "select_one ") }
-func isSelectMultiple(typ string) bool { return strings.HasPrefix(typ, "select_multiple ") }
+func isSelectOne(typ string) bool {
+	return strings.HasPrefix(typ, "select_one ") || strings.HasPrefix(typ, "select_one_from_file ")
+}
+func isSelectMultiple(typ string) bool {
+	return strings.HasPrefix(typ, "select_multiple ") || strings.HasPrefix(typ, "select_multiple_from_file ") ||
+		isRank(typ)
+}
 
 var unsupportedField = map[string]bool{
-	"range": true, "geopoint": true, "geotrace": true, "geoshape": true,
-	"datetime": true, "image": true, "audio": true, "video": true, "file": true,
-	"acknowledge": true, "hidden": true, "xml-external": true,
-	// metadata:
-	"start": true, "end": true, "today": true, "deviceid": true, "subscriberid": true,
-	"simserial": true, "phonenumber": true, "username": true, "email": true,
+	"xml-external": true,
+}
+
+// metadataField maps the metadata question types to the ajf field types
+// used when they are converted to hidden fields.
+var metadataField = map[string]*FieldType{
+	"start": &FtString, "end": &FtString, "today": &FtDate,
+	"deviceid": &FtString, "subscriberid": &FtString, "simserial": &FtString,
+	"phonenumber": &FtString, "username": &FtString, "email": &FtString,
+}
+
+func isMetadata(typ string) bool { return metadataField[typ] != nil }
+
+func isUnsupportedField(typ string) bool {
+	return unsupportedField[typ] || isMetadata(typ)
 }
 
-func isUnsupportedField(typ string) bool { return unsupportedField[typ] || isRank(typ) }
-func isRank(typ string) bool             { return strings.HasPrefix(typ, "rank ") }
+// isRank reports whether typ is a rank question, which is converted
+// to a multiple choice field whose answers are ordered.
+func isRank(typ string) bool { return strings.HasPrefix(typ, "rank ") }
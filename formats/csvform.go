@@ -0,0 +1,130 @@
+package formats
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// DecCsvForm decodes an xlsform whose sheets are stored in separate csv files,
+// as exported by Google Sheets or kept under version control.
+// settingsPath can be empty, as the settings sheet is optional.
+func DecCsvForm(surveyPath, choicesPath, settingsPath string) (*XlsForm, error) {
+	wb, err := NewCsvWorkBook(surveyPath, choicesPath, settingsPath)
+	if err != nil {
+		return nil, err
+	}
+	xls, err := DecXlsform(wb)
+	if err != nil {
+		return nil, err
+	}
+	err = LoadExternalChoices(xls, filepath.Dir(surveyPath))
+	if err != nil {
+		return nil, err
+	}
+	return xls, nil
+}
+
+// NewCsvWorkBook reads the sheets of an xlsform from csv files.
+// Empty paths are skipped.
+func NewCsvWorkBook(surveyPath, choicesPath, settingsPath string) (WorkBook, error) {
+	wb := make(csvWorkBook)
+	paths := [][2]string{{"survey", surveyPath}, {"choices", choicesPath}, {"settings", settingsPath}}
+	for _, p := range paths {
+		if p[1] == "" {
+			continue
+		}
+		f, err := os.Open(p[1])
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't open file: %s", err)
+		}
+		rows, err := readCsv(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", p[1], err)
+		}
+		wb[p[0]] = rows
+	}
+	return wb, nil
+}
+
+type csvWorkBook map[string][][]string
+
+func (wb csvWorkBook) Rows(sheetName string) [][]string { return wb[sheetName] }
+
+// LintCsvForm checks an xlsform stored as csv files (see DecCsvForm) like ValidateXls,
+// calling report for each problem found. The survey is read one row at a time,
+// so that huge generated surveys can be checked before attempting their conversion,
+// without loading them into memory. External choices are searched in the directory
+// of the survey and, like the choices sheet, are read entirely.
+// The returned error reports the problems preventing the check, like unreadable files.
+func LintCsvForm(surveyPath, choicesPath string, report func(SourceError)) error {
+	var choices []ChoicesRow
+	if choicesPath != "" {
+		wb, err := NewCsvWorkBook("", choicesPath, "")
+		if err != nil {
+			return err
+		}
+		err = decSheet(wb.Rows("choices"), &sheetInfos[1], reflect.ValueOf(&choices).Elem(), false)
+		if err != nil {
+			return err
+		}
+		lintChoices(choices, report)
+	}
+
+	f, err := os.Open(surveyPath)
+	if err != nil {
+		return fmt.Errorf("Couldn't open file: %s", err)
+	}
+	defer f.Close()
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	lint := NewSurveyLinter(choices, report)
+	external := make(map[string]bool)
+	var head []string
+	var colIndices []int
+	for lineNum := 1; ; lineNum++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %s", surveyPath, err)
+		}
+		if isEmpty(record) {
+			continue
+		}
+		if head == nil {
+			head = append([]string(nil), record...)
+			colIndices, _, err = sheetColumns(&sheetInfos[0], head, false)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if len(record) < len(head) {
+			record = append(record, make([]string, len(head)-len(record))...)
+		}
+		var row SurveyRow
+		decRow(reflect.ValueOf(&row).Elem(), head, record, colIndices, nil, lineNum)
+		if name := choiceName(row.Type); isSelectFromFile(row.Type) && !external[name] {
+			external[name] = true
+			list, err := loadExternalList(filepath.Dir(surveyPath), name, lineNum)
+			if err != nil {
+				report(err.(SourceError))
+			}
+			lintChoices(list, report)
+			lint.lists[name] = true // not reported as undefined if it couldn't be loaded
+		}
+		lint.Row(&row)
+	}
+	if head == nil {
+		return fmt.Errorf("Empty sheet %q.", "survey")
+	}
+	lint.Finish()
+	return nil
+}
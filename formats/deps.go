@@ -0,0 +1,107 @@
+package formats
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Dependency is a cell of the survey referencing a question, as found by Dependents.
+type Dependency struct {
+	Question string // the name of the row containing the reference (its type for rows without a name)
+	Column   string
+	LineNum  int
+	// Via is empty for the references to the question itself. Otherwise, it is
+	// the calculation, depending on the question, which is referenced instead.
+	Via string
+}
+
+func (d Dependency) String() string {
+	if d.Via != "" {
+		return fmt.Sprintf("line %d: %s of %q, via ${%s}", d.LineNum, d.Column, d.Question, d.Via)
+	}
+	return fmt.Sprintf("line %d: %s of %q", d.LineNum, d.Column, d.Question)
+}
+
+// Dependents returns the cells of the survey that reference the question with the given
+// name, as ${name}: formulas (relevant, constraint, calculation, repeat_count, choice_filter...),
+// texts (labels, hints) and the types of the selects taking their choices from the question.
+// These must be updated when the question is renamed or deleted. The references to the
+// calculations whose value depends on the question, directly or through other calculations,
+// are reported too, with Via set to the referenced calculation. Translation columns
+// are not searched. The dependencies are sorted by line and column.
+func Dependents(xls *XlsForm, name string) []Dependency {
+	columns := sheetInfos[0].columns
+	// The references of each row, with Via set to the referenced name.
+	refs := make([][]Dependency, len(xls.Survey))
+	for i, row := range xls.Survey {
+		rowVal := reflect.ValueOf(row)
+		for j := range columns {
+			if columns[j].name == "name" {
+				continue
+			}
+			for _, m := range referenceRegexp.FindAllStringSubmatch(rowVal.Field(j).String(), -1) {
+				refs[i] = append(refs[i], Dependency{rowKey(row), columns[j].name, row.LineNum, m[1]})
+			}
+		}
+	}
+
+	var deps []Dependency
+	seen := map[string]bool{name: true}
+	queue := []string{name}
+	for len(queue) > 0 {
+		target := queue[0]
+		queue = queue[1:]
+		for i := range refs {
+			for _, ref := range refs[i] {
+				if ref.Via != target {
+					continue
+				}
+				d := ref
+				if target == name {
+					d.Via = ""
+				}
+				deps = append(deps, d)
+				if row := xls.Survey[i]; d.Column == "calculation" && row.Name != "" && !seen[row.Name] {
+					seen[row.Name] = true
+					queue = append(queue, row.Name)
+				}
+			}
+		}
+	}
+	return sortDependencies(deps, columns)
+}
+
+// rowKey identifies a row of the survey, as in Difference.
+func rowKey(row SurveyRow) string {
+	if row.Name != "" {
+		return row.Name
+	}
+	return row.Type
+}
+
+// sortDependencies sorts the dependencies by line and column, removing the duplicates
+// (cells referencing the question more than once).
+func sortDependencies(deps []Dependency, columns []columnInfo) []Dependency {
+	colIndex := make(map[string]int)
+	for j, col := range columns {
+		colIndex[col.name] = j
+	}
+	sort.Slice(deps, func(i, j int) bool {
+		a, b := deps[i], deps[j]
+		if a.LineNum != b.LineNum {
+			return a.LineNum < b.LineNum
+		}
+		if a.Column != b.Column {
+			return colIndex[a.Column] < colIndex[b.Column]
+		}
+		return a.Via < b.Via
+	})
+	unique := deps[:0]
+	for _, d := range deps {
+		if len(unique) == 0 || d != unique[len(unique)-1] {
+			unique = append(unique, d)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,179 @@
+package formats
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadExternalChoices reads the choice lists referenced by the select_one_from_file and
+// select_multiple_from_file questions of the form, and appends them to xls.Choices.
+// The files (csv, xls or xlsx) are searched in dir. The name of a list is the name of its file.
+// csv files must have "name" and "label" columns, xls and xlsx files must have them
+// in a sheet called "choices", and can have media::image and media::audio columns.
+// Other columns are read as choice attributes. The lists already in xls.Choices,
+// like those loaded by DecXlsFromFile, are not loaded again.
+func LoadExternalChoices(xls *XlsForm, dir string) error {
+	return loadExternalChoices(xls, func(name string) ([][]string, error) {
+		return readChoicesFile(filepath.Join(dir, name))
+	})
+}
+
+// loadExternalChoices is LoadExternalChoices, with read returning the rows of the file name.
+func loadExternalChoices(xls *XlsForm, read func(name string) ([][]string, error)) error {
+	loaded := make(map[string]bool)
+	for _, c := range xls.Choices {
+		if c.File != "" {
+			loaded[c.File] = true
+		}
+	}
+	for _, row := range xls.Survey {
+		if !isSelectFromFile(row.Type) {
+			continue
+		}
+		name := choiceName(row.Type)
+		if loaded[name] {
+			continue
+		}
+		loaded[name] = true
+		choices, err := loadList(read, name, row.LineNum)
+		if err != nil {
+			return err
+		}
+		xls.Choices = append(xls.Choices, choices...)
+	}
+	return nil
+}
+
+// loadExternalList reads the external choice list name from dir,
+// for the question at line lineNum.
+func loadExternalList(dir, name string, lineNum int) ([]ChoicesRow, error) {
+	return loadList(func(name string) ([][]string, error) {
+		return readChoicesFile(filepath.Join(dir, name))
+	}, name, lineNum)
+}
+
+// loadList is loadExternalList, with read returning the rows of the file name.
+func loadList(read func(name string) ([][]string, error), name string, lineNum int) ([]ChoicesRow, error) {
+	if name != filepath.Base(name) || name == ".." {
+		return nil, fmtSrcErr(lineNum, "type", CodeExternalChoices,
+			"Invalid external choices file %q.", name)
+	}
+	rows, err := read(name)
+	if err != nil {
+		return nil, fmtSrcErr(lineNum, "type", CodeExternalChoices,
+			"Error reading external choices: %s", err)
+	}
+	choices, err := decExternalChoices(rows, name)
+	if err != nil {
+		return nil, fmtSrcErr(lineNum, "type", CodeExternalChoices,
+			"Error decoding external choices %q: %s", name, err)
+	}
+	return choices, nil
+}
+
+func isSelectFromFile(typ string) bool {
+	return strings.HasPrefix(typ, "select_one_from_file ") || strings.HasPrefix(typ, "select_multiple_from_file ")
+}
+
+func readChoicesFile(fileName string) ([][]string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return decChoicesFile(f, stat.Size(), filepath.Base(fileName))
+}
+
+// decChoicesFile returns the rows of the external choices file name, read from f.
+func decChoicesFile(f File, size int64, name string) ([][]string, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".csv" {
+		return readCsv(f)
+	}
+	wb, err := NewWorkBook(f, ext, size)
+	if err != nil {
+		return nil, err
+	}
+	rows := wb.Rows("choices")
+	if rows == nil {
+		return nil, fmt.Errorf("Missing sheet \"choices\" in %s.", name)
+	}
+	return rows, nil
+}
+
+// readCsv reads a csv file, making all the rows of the same length.
+func readCsv(r io.Reader) ([][]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	return padRows(rows), nil
+}
+
+// padRows makes all the rows as long as the longest one.
+func padRows(rows [][]string) [][]string {
+	numCols := 0
+	for _, row := range rows {
+		if len(row) > numCols {
+			numCols = len(row)
+		}
+	}
+	for i, row := range rows {
+		if len(row) < numCols {
+			rows[i] = append(row, make([]string, numCols-len(row))...)
+		}
+	}
+	return rows
+}
+
+// decExternalChoices decodes the rows of an external choices file into a choice list.
+func decExternalChoices(rows [][]string, listName string) ([]ChoicesRow, error) {
+	headIndex := firstNonempty(rows)
+	if headIndex == -1 {
+		return nil, fmt.Errorf("Empty file.")
+	}
+	head := rows[headIndex]
+	nameIndex, labelIndex := columnIndex(head, "name"), columnIndex(head, "label")
+	if nameIndex == -1 || labelIndex == -1 {
+		return nil, fmt.Errorf("Columns \"name\" and \"label\" are mandatory.")
+	}
+	imageIndex, audioIndex := columnIndex(head, "media::image"), columnIndex(head, "media::audio")
+	extraIndices := extraColumns(head, []int{nameIndex, labelIndex, imageIndex, audioIndex})
+	var choices []ChoicesRow
+	for i := headIndex + 1; i < len(rows); i++ {
+		row := rows[i]
+		if isEmpty(row) {
+			continue
+		}
+		choice := ChoicesRow{ListName: listName, Name: row[nameIndex], Label: row[labelIndex], LineNum: i + 1,
+			File: listName}
+		if imageIndex != -1 {
+			choice.Image = row[imageIndex]
+		}
+		if audioIndex != -1 {
+			choice.Audio = row[audioIndex]
+		}
+		for _, j := range extraIndices {
+			if row[j] == "" {
+				continue
+			}
+			if choice.Attributes == nil {
+				choice.Attributes = make(map[string]string)
+			}
+			choice.Attributes[head[j]] = row[j]
+		}
+		choices = append(choices, choice)
+	}
+	return choices, nil
+}
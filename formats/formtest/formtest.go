@@ -0,0 +1,131 @@
+// Package formtest is a golden file test harness for the converter: it converts
+// the xlsforms of a testdata directory and compares the results with the expected
+// ajf files checked in beside them. A test using it looks like:
+//
+//	func TestForms(t *testing.T) {
+//		formtest.Run(t, "testdata", formats.ConvertOptions{})
+//	}
+//
+// When the output changes on purpose, the expected files are regenerated with
+// FORMTEST_UPDATE=1 go test, and the differences reviewed with git diff.
+package formtest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// UpdateEnv is the environment variable that, when not empty, makes Run rewrite
+// the expected ajf files with the current output. An environment variable is used
+// instead of a flag, which would clash with the flags of the test packages importing formtest.
+const UpdateEnv = "FORMTEST_UPDATE"
+
+// OracleSuffix is appended to the name of a workbook, without its extension,
+// to get the name of its expected ajf file (form.xlsx is compared with form_oracle.json).
+const OracleSuffix = "_oracle.json"
+
+// OraclePath returns the path of the expected ajf file of the workbook at path.
+func OraclePath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + OracleSuffix
+}
+
+// Workbooks returns the sorted paths of the xlsforms (xls, xlsx and ods files) in dir.
+// Subdirectories are not visited.
+func Workbooks(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, info := range infos {
+		switch filepath.Ext(info.Name()) {
+		case ".xls", ".xlsx", ".ods":
+			if !info.IsDir() {
+				paths = append(paths, filepath.Join(dir, info.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Run converts all the workbooks in dir with the given options and compares
+// each form with its expected ajf file (see OraclePath), in a subtest named after
+// the workbook. Forms that can't be converted, and missing expected files, make
+// the subtest fail. If UpdateEnv is set, the expected files are written instead.
+func Run(t *testing.T, dir string, opts formats.ConvertOptions) {
+	t.Helper()
+	paths, err := Workbooks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("No workbooks found in %s.", dir)
+	}
+	update := os.Getenv(UpdateEnv) != ""
+	for _, res := range formats.ConvertAll(paths, opts) {
+		res := res
+		t.Run(filepath.Base(res.Path), func(t *testing.T) {
+			if err := checkResult(res, update); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// checkResult compares the form of res with its expected ajf file,
+// or writes the latter if update is true.
+func checkResult(res formats.Result, update bool) error {
+	if res.Err != nil {
+		return fmt.Errorf("Error converting %s: %s", res.Path, res.Err)
+	}
+	var buf bytes.Buffer
+	if err := formats.EncIndentedJson(&buf, res.Form); err != nil {
+		return err
+	}
+	oracle := OraclePath(res.Path)
+	if update {
+		return ioutil.WriteFile(oracle, buf.Bytes(), 0644)
+	}
+	expected, err := ioutil.ReadFile(oracle)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s not found, run the tests with %s=1 to create it.", oracle, UpdateEnv)
+	}
+	if err != nil {
+		return err
+	}
+	// The app consumes the exact bytes, so the comparison is not done on the canonical forms.
+	if line, got, want, differ := firstDifference(buf.Bytes(), expected); differ {
+		return fmt.Errorf("Output of %s differs from %s at line %d:\n got: %s\nwant: %s\n"+
+			"Run the tests with %s=1 if the change is intended.", res.Path, oracle, line, got, want, UpdateEnv)
+	}
+	return nil
+}
+
+// firstDifference returns the number and the contents of the first line
+// that differs between a and b.
+func firstDifference(a, b []byte) (line int, lineA, lineB string, differ bool) {
+	linesA := strings.Split(string(a), "\n")
+	linesB := strings.Split(string(b), "\n")
+	for i := 0; i < len(linesA) || i < len(linesB); i++ {
+		var la, lb string
+		if i < len(linesA) {
+			la = linesA[i]
+		}
+		if i < len(linesB) {
+			lb = linesB[i]
+		}
+		if la != lb || i >= len(linesA) || i >= len(linesB) {
+			return i + 1, strings.TrimSpace(la), strings.TrimSpace(lb), true
+		}
+	}
+	return 0, "", "", false
+}
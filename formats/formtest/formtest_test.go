@@ -0,0 +1,67 @@
+package formtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+func TestRun(t *testing.T) {
+	Run(t, "../testdata/golden", formats.ConvertOptions{})
+}
+
+func TestCheckResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "form.xlsx")
+	res := formats.Result{Path: path, Form: &formats.AjfForm{}}
+
+	err = checkResult(res, false)
+	if err == nil || !strings.Contains(err.Error(), UpdateEnv) {
+		t.Fatalf("Expected error for missing oracle, got %v", err)
+	}
+	if err := checkResult(res, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "form_oracle.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkResult(res, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Even the differences not affecting the meaning of the form are reported.
+	res.Form.NameMapping = map[string]string{"q": "q"}
+	err = checkResult(res, false)
+	if err == nil || !strings.Contains(err.Error(), "differs") {
+		t.Fatalf("Expected error reporting the identity name mapping, got %v", err)
+	}
+	res.Form.NameMapping = nil
+	res.Form.FormId = "changed"
+	err = checkResult(res, false)
+	if err == nil || !strings.Contains(err.Error(), `"changed"`) {
+		t.Fatalf("Expected error reporting the changed line, got %v", err)
+	}
+}
+
+func TestWorkbooks(t *testing.T) {
+	paths, err := Workbooks("../testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		if ext := filepath.Ext(p); ext != ".xls" && ext != ".xlsx" && ext != ".ods" {
+			t.Errorf("Unexpected file %s", p)
+		}
+	}
+	if len(paths) == 0 || paths[0] != filepath.Join("../testdata", "Picaps_baseline_form.xls") {
+		t.Errorf("Unexpected workbooks %v", paths)
+	}
+}
@@ -2,6 +2,7 @@ package formats
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"text/scanner"
 )
@@ -12,7 +13,22 @@ type parser struct {
 	scanner.Scanner
 	strings.Builder
 	fieldName string // in formulas, "." will be equivalent to "${fieldName}"
-	err       error
+	// In choice filters, identifiers refer to the properties of the choice being filtered.
+	// choiceAttrs maps the identifiers to their JavaScript translation.
+	choiceAttrs map[string]string
+	err         error
+}
+
+// ParseChoiceFilter parses a choice_filter formula. Identifiers that are not
+// question references are translated to $choice.value ("name"), $choice.label ("label")
+// and $choice.attributes.attr (any other attribute in attrs).
+func (p *parser) ParseChoiceFilter(formula, fieldName string, attrs map[string]bool) (js string, err error) {
+	p.choiceAttrs = map[string]string{"name": "$choice.value", "label": "$choice.label"}
+	for attr := range attrs {
+		p.choiceAttrs[attr] = "$choice.attributes." + attr
+	}
+	defer func() { p.choiceAttrs = nil }()
+	return p.Parse(formula, "choice_filter", fieldName)
 }
 
 func (p *parser) Parse(formula, formulaName, fieldName string) (js string, err error) {
@@ -251,7 +267,7 @@ func (p *parser) parseOperatorIdent() {
 // parseExpressionIdent parses an expression that starts with an identifier (already scanned).
 // It has to deal with the following function names that contain a minus:
 // count-selected, starts-with, ends-with, substring-before,
-// substring-after, string-length, boolean-from-string.
+// substring-after, string-length, boolean-from-string, decimal-date-time, format-date.
 func (p *parser) parseExpressionIdent(expectedEnd rune) {
 	if p.Peek() == '(' {
 		p.parseFuncCall()
@@ -262,9 +278,13 @@ func (p *parser) parseExpressionIdent(expectedEnd rune) {
 		p.WriteString("true")
 	case "False":
 		p.WriteString("false")
-	case "count", "starts", "ends", "substring", "string", "boolean":
+	case "count", "starts", "ends", "substring", "string", "boolean", "decimal", "format":
 		p.parseFuncCall()
 	default:
+		if js, ok := p.choiceAttrs[p.TokenText()]; ok {
+			p.WriteString(js)
+			return
+		}
 		p.error(fmt.Sprintf("Unknown identifier %q.", p.TokenText()))
 	}
 }
@@ -333,6 +353,40 @@ func (p *parser) parseFuncCall() {
 		p.parseExpression(')')
 		p.copy(')')
 		p.WriteString(".length")
+	case "coalesce":
+		// coalesce(a, b) becomes (a != null && a !== "" ? a : b)
+		p.consume('(')
+		a := p.captureExpression(',')
+		p.consume(',')
+		b := p.captureExpression(')')
+		p.consume(')')
+		fmt.Fprintf(p, "((%s) != null && (%s) !== \"\" ? (%s) : (%s))", a, a, a, b)
+	case "date":
+		// date(x) becomes a Date, x being either a string or a number of days since 1970-01-01
+		p.consume('(')
+		x := p.captureExpression(')')
+		p.consume(')')
+		fmt.Fprintf(p, "(typeof (%s) === \"number\" ? new Date((%s) * %d) : new Date(%s))", x, x, msPerDay, x)
+	case "decimal-date-time":
+		// decimal-date-time(d) becomes the number of days since 1970-01-01
+		p.consume('(')
+		p.WriteString("(new Date(")
+		p.parseExpression(')')
+		p.consume(')')
+		fmt.Fprintf(p, ").getTime() / %d)", msPerDay)
+	case "format-date", "format-date-time":
+		// format-date(d, "%Y-%m-%d") becomes the concatenation of the parts of the date
+		p.consume('(')
+		d := p.captureExpression(',')
+		p.consume(',')
+		format := p.captureExpression(')')
+		p.consume(')')
+		js, err := formatDate(d, format)
+		if err != nil {
+			p.error(err.Error())
+			return
+		}
+		p.WriteString(js)
 	case "exp10":
 		// exp10(x) becomes Math.pow(10, x)
 		p.consume('(')
@@ -344,11 +398,75 @@ func (p *parser) parseFuncCall() {
 	}
 }
 
+const msPerDay = 24 * 60 * 60 * 1000
+
+// dateFormatParts are the JavaScript expressions computing the parts of a date
+// corresponding to the specifiers of format-date, %s being the date.
+var dateFormatParts = map[byte]string{
+	'Y': "String(new Date(%s).getFullYear())",
+	'y': "String(new Date(%s).getFullYear() %% 100).padStart(2, \"0\")",
+	'm': "String(new Date(%s).getMonth() + 1).padStart(2, \"0\")",
+	'n': "String(new Date(%s).getMonth() + 1)",
+	'd': "String(new Date(%s).getDate()).padStart(2, \"0\")",
+	'e': "String(new Date(%s).getDate())",
+	'H': "String(new Date(%s).getHours()).padStart(2, \"0\")",
+	'h': "String(new Date(%s).getHours())",
+	'M': "String(new Date(%s).getMinutes()).padStart(2, \"0\")",
+	'S': "String(new Date(%s).getSeconds()).padStart(2, \"0\")",
+}
+
+// formatDate translates format-date(date, format), where format is a string literal.
+func formatDate(date, format string) (string, error) {
+	n := len(format)
+	if n < 2 || (format[0] != '"' && format[0] != '\'') || format[n-1] != format[0] ||
+		strings.ContainsAny(format[1:n-1], "\\\"'") {
+		return "", fmt.Errorf("The format of format-date must be a string constant.")
+	}
+	format = format[1 : n-1]
+	var parts []string
+	text := ""
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			text += format[i : i+1]
+			continue
+		}
+		if i+1 == len(format) {
+			return "", fmt.Errorf("Incomplete specifier at the end of date format %q.", format)
+		}
+		i++
+		part, ok := dateFormatParts[format[i]]
+		if !ok {
+			return "", fmt.Errorf("Unsupported specifier %%%c in date format %q.", format[i], format)
+		}
+		if text != "" {
+			parts = append(parts, strconv.Quote(text))
+			text = ""
+		}
+		parts = append(parts, fmt.Sprintf(part, date))
+	}
+	if text != "" || len(parts) == 0 {
+		parts = append(parts, strconv.Quote(text))
+	}
+	return "(" + strings.Join(parts, " + ") + ")", nil
+}
+
+// captureExpression parses an expression and returns its translation
+// instead of appending it to the output, so that it can be used more than once.
+func (p *parser) captureExpression(expectedEnd rune) string {
+	prefix := p.Builder.String()
+	p.Builder.Reset()
+	p.parseExpression(expectedEnd)
+	expr := p.Builder.String()
+	p.Builder.Reset()
+	p.WriteString(prefix)
+	return expr
+}
+
 func (p *parser) parseFuncArgs() {
 	if p.peekNonspace() == ')' { // empty argument list
 		return
 	}
-	for {
+	for p.err == nil { // after an error, the end of the arguments may never be found
 		p.parseExpression(',') // argument
 		if p.peekNonspace() == ')' {
 			return
@@ -400,4 +518,6 @@ var func2jsconstant = map[string]string{
 	"pi":    "Math.PI",
 	"true":  "true",
 	"false": "false",
+	"today": "new Date(new Date().setHours(0, 0, 0, 0))",
+	"now":   "new Date()",
 }
@@ -0,0 +1,62 @@
+//go:build go1.16
+// +build go1.16
+
+package formats
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// DecXlsFromFS is like DecXlsFromFile, but reads the xlsform and its external choices
+// from fsys, e.g. an embed.FS or a zip.Reader. name is a slash-separated path, as required by fs.FS.
+func DecXlsFromFS(fsys fs.FS, name string) (*XlsForm, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open file: %s", err)
+	}
+	defer f.Close()
+	r, size, err := fsReader(f)
+	if err != nil {
+		return nil, err
+	}
+	xls, err := DecXlsFromReader(r, size, path.Ext(name))
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Dir(name)
+	err = loadExternalChoices(xls, func(list string) ([][]string, error) {
+		f, err := fsys.Open(path.Join(dir, list))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r, size, err := fsReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return decChoicesFile(r, size, list)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return xls, nil
+}
+
+// fsReader returns a reader for the content of f, with its size.
+// The files not supporting random access are read into memory.
+func fsReader(f fs.File) (File, int64, error) {
+	if r, ok := f.(File); ok {
+		if stat, err := f.Stat(); err == nil {
+			return r, stat.Size(), nil
+		}
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
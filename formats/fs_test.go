@@ -0,0 +1,50 @@
+//go:build go1.16
+// +build go1.16
+
+package formats
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDecXlsFromFS(t *testing.T) {
+	expected, err := DecXlsFromFile("testdata/noformulas.xlsx")
+	check(t, err)
+	xls, err := DecXlsFromFS(os.DirFS("testdata"), "noformulas.xlsx")
+	check(t, err)
+	if !reflect.DeepEqual(xls, expected) {
+		t.Error("Unexpected result decoding from fs:")
+		logFatalDiff(t, xls, expected)
+	}
+
+	var buf bytes.Buffer
+	err = EncXlsx(&buf, &XlsForm{Survey: []SurveyRow{
+		{Type: beginGroup, Name: "g", Label: "G"},
+		{Type: "select_one_from_file cities.csv", Name: "city", Label: "City"},
+		{Type: endGroup},
+	}})
+	check(t, err)
+	fsys := fstest.MapFS{
+		"forms/form.xlsx":  {Data: buf.Bytes()},
+		"forms/cities.csv": {Data: []byte("name,label\nrome,Rome\n")},
+	}
+	xls, err = DecXlsFromFS(fsys, "forms/form.xlsx")
+	check(t, err)
+	if len(xls.Choices) != 1 || xls.Choices[0].Name != "rome" || xls.Choices[0].File != "cities.csv" {
+		t.Fatalf("External choices not loaded from fs: %v", xls.Choices)
+	}
+	_, _, err = Convert(xls, ConvertOptions{})
+	check(t, err)
+
+	if _, err := DecXlsFromFS(fsys, "forms/missing.xlsx"); err == nil {
+		t.Fatal("Expected error for missing file")
+	}
+	delete(fsys, "forms/cities.csv")
+	if _, err := DecXlsFromFS(fsys, "forms/form.xlsx"); err == nil {
+		t.Fatal("Expected error for missing external choices")
+	}
+}
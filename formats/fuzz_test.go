@@ -0,0 +1,82 @@
+//go:build go1.18
+// +build go1.18
+
+package formats
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The fuzz targets check that malformed input makes the decoder and the converter
+// fail with an error, never panic. Run them with, e.g.:
+//
+//	go test ./formats -run '^$' -fuzz FuzzXls2ajf
+
+func FuzzDecXls(f *testing.F) {
+	for _, pattern := range []string{"testdata/*.xls", "testdata/*.xlsx", "testdata/golden/*.xls*"} {
+		files, _ := filepath.Glob(pattern)
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(data, filepath.Ext(file))
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte, ext string) {
+		if ext != ".xls" && ext != ".xlsx" && ext != ".ods" {
+			return
+		}
+		xls, err := DecXlsFromReader(bytes.NewReader(data), int64(len(data)), ext)
+		if err != nil {
+			return
+		}
+		Convert(xls, ConvertOptions{})
+	})
+}
+
+// FuzzXls2ajf converts forms whose sheets are given as text,
+// with rows separated by newlines and cells by tabs.
+func FuzzXls2ajf(f *testing.F) {
+	seeds := [][2]string{
+		{"type\tname\tlabel\ntext\tq\tQuestion", "list name\tname\tlabel"},
+		{"type\tname\tlabel\trelevant\nbegin group\tg\tGroup\t\ninteger\tn\tN\t${n} > 1\nend group",
+			"list name\tname\tlabel"},
+		{"type\tname\tlabel\tcalculation\trepeat_count\nbegin repeat\tr\tR\t\t3\n" +
+			"select_one c or_other\ts\tS\t\t\ncalculate\tx\t\tconcat(${s}, 'a')\t\nend repeat",
+			"list name\tname\tlabel\nc\ta\tA\nc\tb\tB"},
+		{"type\tname\tlabel\nend group\t\t\nbegin group\tg\tG", "list name\tname\tlabel"},
+		{"type\tname\tlabel\tconstraint\tchoice_filter\nselect_multiple c\tm\tM\tcount-selected(.) < 2\tx = 1\n" +
+			"range\tr\tR\t. > 0\t", "list name\tname\tlabel\tx\nc\ta\tA\t1"},
+	}
+	for _, s := range seeds {
+		f.Add(s[0], s[1])
+	}
+	f.Fuzz(func(t *testing.T, survey, choices string) {
+		wb := rowsWorkBook{"survey": textRows(survey), "choices": textRows(choices)}
+		xls, err := DecXlsform(wb)
+		if err != nil {
+			return
+		}
+		for _, opts := range []ConvertOptions{{}, {WrapUngrouped: true, UnrollNestedRepeats: true, EvalConstants: true}} {
+			// The converted forms are checked by ValidateAjf, invalid ones are bugs of the converter.
+			if _, _, err := Convert(xls, opts); err != nil {
+				if _, invalid := err.(AjfError); invalid {
+					t.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func textRows(text string) [][]string {
+	var rows [][]string
+	for _, line := range strings.Split(text, "\n") {
+		rows = append(rows, strings.Split(line, "\t"))
+	}
+	return padRows(rows)
+}
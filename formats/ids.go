@@ -0,0 +1,157 @@
+package formats
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// IdAssigner assigns the ids of the ajf nodes, setting the Id and Previous fields
+// of the slides and of all their descendants. Previous is the id of the previous sibling,
+// or of the parent node for the first child (0 for the first slide).
+type IdAssigner interface {
+	AssignIds(slides []Node) error
+}
+
+// HierarchicalIds is the default id assignment: the children of a node with id x
+// have ids x*Multiplier + 1, x*Multiplier + 2 and so on, while the slides have ids
+// StartOffset + 1, StartOffset + 2... A Multiplier of 0 means the default, 1000.
+type HierarchicalIds struct {
+	Multiplier  int
+	StartOffset int
+}
+
+func (h HierarchicalIds) AssignIds(slides []Node) error {
+	idMultiplier := h.Multiplier
+	if idMultiplier == 0 {
+		idMultiplier = defaultIdMultiplier
+	}
+	if idMultiplier < 2 {
+		return fmt.Errorf("Invalid id multiplier %d.", idMultiplier)
+	}
+	if h.StartOffset < 0 {
+		return fmt.Errorf("Invalid id start offset %d.", h.StartOffset)
+	}
+	return assignSlideIds(slides, h.StartOffset, idMultiplier)
+}
+
+// SequentialIds numbers the nodes Start + 1, Start + 2... in depth-first order,
+// without limits on the number of children of a node.
+type SequentialIds struct {
+	Start int
+}
+
+func (s SequentialIds) AssignIds(slides []Node) error {
+	if s.Start < 0 {
+		return fmt.Errorf("Invalid id start %d.", s.Start)
+	}
+	count := 0
+	walkNodes(slides, func(*Node) { count++ })
+	if int64(s.Start)+int64(count) > maxId {
+		return fmt.Errorf("The id start %d is too large, the ids of the %d nodes would overflow.", s.Start, count)
+	}
+	next := s.Start
+	var assign func(nodes []Node, parent int)
+	assign = func(nodes []Node, parent int) {
+		previous := parent
+		for i := range nodes {
+			next++
+			nodes[i].Id, nodes[i].Previous = next, previous
+			previous = nodes[i].Id
+			assign(nodes[i].Nodes, nodes[i].Id)
+		}
+	}
+	assign(slides, 0)
+	return nil
+}
+
+// NameHashIds derives the id of each node from a hash of its name (and of Salt),
+// so that a node keeps its id when the form is edited, and the nodes of forms
+// converted separately can be merged. The ids are in the range of the integers
+// representable exactly in JavaScript; an error is returned in the unlikely case
+// of two names having the same hash, which can be solved by changing Salt.
+type NameHashIds struct {
+	Salt string
+}
+
+func (n NameHashIds) AssignIds(slides []Node) error {
+	owners := make(map[int]string)
+	var assign func(nodes []Node, parent int) error
+	assign = func(nodes []Node, parent int) error {
+		previous := parent
+		for i := range nodes {
+			node := &nodes[i]
+			if node.Name == "" {
+				return fmt.Errorf("Can't derive the id of a node without name.")
+			}
+			id := nameHashId(n.Salt, node.Name)
+			if owner, ok := owners[id]; ok {
+				return fmt.Errorf("Nodes %q and %q have the same id %d, change the salt or rename one of them.",
+					owner, node.Name, id)
+			}
+			owners[id] = node.Name
+			node.Id, node.Previous = id, previous
+			previous = id
+			if err := assign(node.Nodes, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return assign(slides, 0)
+}
+
+// nameHashId returns an id in [1, maxId] derived from the name.
+func nameHashId(salt, name string) int {
+	sum := sha256.Sum256([]byte(salt + "\x00" + name))
+	return int(binary.BigEndian.Uint64(sum[:8])%maxId) + 1
+}
+
+// PreviousIds reuses the ids of a previous version of the form: each node gets the id
+// of the node of Previous with the same name, so that the data collected with
+// the previous version stays associated with the right questions after the form
+// is edited and converted again. The other nodes get new ids, larger than
+// all the ids of Previous.
+type PreviousIds struct {
+	Previous *AjfForm
+}
+
+func (p PreviousIds) AssignIds(slides []Node) error {
+	if p.Previous == nil {
+		return fmt.Errorf("Missing previous form to take the ids from.")
+	}
+	ids := make(map[string]int)
+	next := 0
+	walkNodes(p.Previous.Slides, func(n *Node) {
+		if n.Name != "" && n.Id > 0 {
+			ids[n.Name] = n.Id
+		}
+		if n.Id > next {
+			next = n.Id
+		}
+	})
+	used := make(map[int]bool)
+	var assign func(nodes []Node, parent int) error
+	assign = func(nodes []Node, parent int) error {
+		previous := parent
+		for i := range nodes {
+			node := &nodes[i]
+			id, ok := ids[node.Name]
+			if !ok || used[id] {
+				if next >= maxId {
+					return fmt.Errorf("The ids of the previous form are too large, the new ids would overflow.")
+				}
+				next++
+				id = next
+			}
+			used[id] = true
+			node.Id, node.Previous = id, previous
+			previous = id
+			if err := assign(node.Nodes, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return assign(slides, 0)
+}
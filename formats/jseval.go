@@ -0,0 +1,522 @@
+package formats
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/scanner"
+)
+
+// truthy converts a value to boolean, as JavaScript does.
+func truthy(val interface{}) bool {
+	switch x := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case float64:
+		return x != 0 && !math.IsNaN(x)
+	case string:
+		return x != ""
+	}
+	return true
+}
+
+// jsEvaluator evaluates the JavaScript formulas produced by the converter, like the
+// conditions of the nodes on the answers of a submission (see Validate) or the calculations
+// made only of constants (see evalConstant). It supports the operators and functions that
+// the converter emits for the common formulas; the other constructs, and the operations mixing
+// types that JavaScript resolves with implicit conversions, make the evaluation fail.
+// Values are nil, float64, string, bool or []interface{} (multiple choice answers).
+type jsEvaluator struct {
+	toks   []jsToken
+	ok     bool
+	lookup func(name string) interface{} // the values of the identifiers, like the names of the fields
+}
+
+type jsToken struct {
+	kind rune // a scanner token, or the operator characters
+	text string
+}
+
+// mathObject is the value of the Math identifier, whose functions can be called.
+type mathObject struct{}
+
+// evalCondition evaluates a JavaScript condition, resolving the names of the fields
+// with lookup. ok is false if the condition is not supported by jsEvaluator.
+func evalCondition(js string, lookup func(name string) interface{}) (val interface{}, ok bool) {
+	e := jsEvaluator{ok: true, lookup: lookup}
+	var s scanner.Scanner
+	s.Init(strings.NewReader(js))
+	s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats | scanner.ScanStrings
+	s.Error = func(*scanner.Scanner, string) { e.ok = false }
+	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
+		text := s.TokenText()
+		switch tok {
+		case scanner.String:
+			if strings.ContainsRune(text, '\\') {
+				return nil, false
+			}
+			str, err := strconv.Unquote(text)
+			if err != nil {
+				return nil, false
+			}
+			e.toks = append(e.toks, jsToken{scanner.String, str})
+			continue
+		case '\'':
+			var b strings.Builder
+			for ch := s.Next(); ch != '\''; ch = s.Next() {
+				if ch == '\\' || ch == '\n' || ch == scanner.EOF {
+					return nil, false
+				}
+				b.WriteRune(ch)
+			}
+			e.toks = append(e.toks, jsToken{scanner.String, b.String()})
+			continue
+		case '=', '!', '<', '>':
+			for s.Peek() == '=' {
+				text += string(s.Next())
+			}
+		case '&', '|':
+			if s.Peek() == tok {
+				text += string(s.Next())
+			}
+		}
+		e.toks = append(e.toks, jsToken{tok, text})
+	}
+	val = e.evalConditional()
+	if len(e.toks) > 0 || !e.ok {
+		return nil, false
+	}
+	return val, true
+}
+
+func (e *jsEvaluator) fail() interface{} {
+	e.ok = false
+	return nil
+}
+
+func (e *jsEvaluator) peekOp(op string) bool {
+	return e.ok && len(e.toks) > 0 && e.toks[0].kind != scanner.String && e.toks[0].text == op
+}
+
+func (e *jsEvaluator) next() jsToken {
+	if len(e.toks) == 0 {
+		e.ok = false
+		return jsToken{scanner.EOF, ""}
+	}
+	tok := e.toks[0]
+	e.toks = e.toks[1:]
+	return tok
+}
+
+func (e *jsEvaluator) expect(op string) {
+	if !e.peekOp(op) {
+		e.ok = false
+		return
+	}
+	e.next()
+}
+
+func (e *jsEvaluator) evalConditional() interface{} {
+	cond := e.evalOr()
+	if !e.peekOp("?") {
+		return cond
+	}
+	e.next()
+	a := e.evalConditional()
+	e.expect(":")
+	b := e.evalConditional()
+	if truthy(cond) {
+		return a
+	}
+	return b
+}
+
+func (e *jsEvaluator) evalOr() interface{} {
+	a := e.evalAnd()
+	for e.peekOp("||") {
+		e.next()
+		b := e.evalAnd()
+		if !truthy(a) {
+			a = b
+		}
+	}
+	return a
+}
+
+func (e *jsEvaluator) evalAnd() interface{} {
+	a := e.evalEquality()
+	for e.peekOp("&&") {
+		e.next()
+		b := e.evalEquality()
+		if truthy(a) {
+			a = b
+		}
+	}
+	return a
+}
+
+func (e *jsEvaluator) evalEquality() interface{} {
+	a := e.evalRelational()
+	for e.peekOp("===") || e.peekOp("!==") || e.peekOp("==") || e.peekOp("!=") {
+		op := e.next().text
+		b := e.evalRelational()
+		_, listA := a.([]interface{})
+		_, listB := b.([]interface{})
+		if listA || listB {
+			return e.fail() // compared by reference
+		}
+		strict := len(op) == 3
+		if !strict && a != nil && b != nil && !sameType(a, b) {
+			return e.fail()
+		}
+		a = (a == b) != (op[0] == '!')
+	}
+	return a
+}
+
+func (e *jsEvaluator) evalRelational() interface{} {
+	a := e.evalAdditive()
+	for e.peekOp("<") || e.peekOp("<=") || e.peekOp(">") || e.peekOp(">=") {
+		op := e.next().text
+		b := e.evalAdditive()
+		var cmp int
+		switch x := a.(type) {
+		case float64:
+			y, ok := b.(float64)
+			if !ok {
+				return e.fail()
+			}
+			if math.IsNaN(x) || math.IsNaN(y) {
+				a = false
+				continue
+			}
+			cmp = compareFloats(x, y)
+		case string:
+			y, ok := b.(string)
+			if !ok {
+				return e.fail()
+			}
+			cmp = strings.Compare(x, y)
+		default:
+			return e.fail()
+		}
+		switch op {
+		case "<":
+			a = cmp < 0
+		case "<=":
+			a = cmp <= 0
+		case ">":
+			a = cmp > 0
+		case ">=":
+			a = cmp >= 0
+		}
+	}
+	return a
+}
+
+func (e *jsEvaluator) evalAdditive() interface{} {
+	a := e.evalMultiplicative()
+	for e.peekOp("+") || e.peekOp("-") {
+		op := e.next().text
+		b := e.evalMultiplicative()
+		if x, ok := a.(string); ok && op == "+" {
+			y, ok := b.(string)
+			if !ok {
+				return e.fail()
+			}
+			a = x + y
+			continue
+		}
+		x, ok1 := a.(float64)
+		y, ok2 := b.(float64)
+		if !ok1 || !ok2 {
+			return e.fail()
+		}
+		if op == "+" {
+			a = x + y
+		} else {
+			a = x - y
+		}
+	}
+	return a
+}
+
+func (e *jsEvaluator) evalMultiplicative() interface{} {
+	a := e.evalUnary()
+	for e.peekOp("*") || e.peekOp("/") || e.peekOp("%") {
+		op := e.next().text
+		b := e.evalUnary()
+		x, ok1 := a.(float64)
+		y, ok2 := b.(float64)
+		if !ok1 || !ok2 {
+			return e.fail()
+		}
+		switch op {
+		case "*":
+			a = x * y
+		case "/":
+			a = x / y
+		case "%":
+			a = math.Mod(x, y)
+		}
+	}
+	return a
+}
+
+func (e *jsEvaluator) evalUnary() interface{} {
+	switch {
+	case e.peekOp("!"):
+		e.next()
+		return !truthy(e.evalUnary())
+	case e.peekOp("-") || e.peekOp("+"):
+		op := e.next().text
+		x, ok := e.evalUnary().(float64)
+		if !ok {
+			return e.fail()
+		}
+		if op == "-" {
+			return -x
+		}
+		return x
+	}
+	return e.evalPostfix()
+}
+
+// evalPostfix evaluates the accesses to properties and the calls to methods.
+func (e *jsEvaluator) evalPostfix() interface{} {
+	val := e.evalPrimary()
+	for e.peekOp(".") {
+		e.next()
+		prop := e.next()
+		if prop.kind != scanner.Ident {
+			return e.fail()
+		}
+		if !e.peekOp("(") {
+			val = e.property(val, prop.text)
+			continue
+		}
+		args := e.evalArgs()
+		if _, isMath := val.(mathObject); isMath {
+			val = e.mathCall(prop.text, args)
+		} else {
+			val = e.methodCall(val, prop.text, args)
+		}
+	}
+	if _, isMath := val.(mathObject); isMath {
+		return e.fail()
+	}
+	return val
+}
+
+func (e *jsEvaluator) evalPrimary() interface{} {
+	if !e.ok {
+		return nil
+	}
+	switch tok := e.next(); tok.kind {
+	case scanner.Int, scanner.Float:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return e.fail()
+		}
+		return f
+	case scanner.String:
+		return tok.text
+	case '(':
+		val := e.evalConditional()
+		e.expect(")")
+		return val
+	case scanner.Ident:
+		switch tok.text {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null", "undefined":
+			return nil
+		case "Math":
+			return mathObject{}
+		}
+		if e.peekOp("(") {
+			return e.call(tok.text, e.evalArgs())
+		}
+		return e.lookup(tok.text)
+	}
+	return e.fail()
+}
+
+// evalArgs evaluates the arguments of a call, starting from the open parenthesis.
+func (e *jsEvaluator) evalArgs() []interface{} {
+	e.expect("(")
+	var args []interface{}
+	for e.ok && !e.peekOp(")") {
+		args = append(args, e.evalConditional())
+		if !e.peekOp(")") {
+			e.expect(",")
+		}
+	}
+	e.expect(")")
+	return args
+}
+
+// call evaluates the calls to the functions of ajf.
+func (e *jsEvaluator) call(name string, args []interface{}) interface{} {
+	switch {
+	case name == "notEmpty" && len(args) == 1:
+		return answered(args[0])
+	case name == "isInt" && len(args) == 1:
+		x, ok := args[0].(float64)
+		return ok && x == math.Trunc(x) && !math.IsInf(x, 0)
+	case name == "valueInChoice" && len(args) == 2:
+		switch x := args[0].(type) {
+		case []interface{}:
+			for _, item := range x {
+				if item == args[1] {
+					return true
+				}
+			}
+			return false
+		case string, nil:
+			return x == args[1]
+		}
+	case name == "round" && (len(args) == 1 || len(args) == 2):
+		nums, ok := floatArgs(args)
+		if !ok {
+			return e.fail()
+		}
+		digits := 0.0
+		if len(nums) == 2 {
+			digits = nums[1]
+		}
+		p := math.Pow(10, digits)
+		return math.Floor(nums[0]*p+0.5) / p
+	}
+	return e.fail()
+}
+
+// mathCall evaluates the calls to the functions of the Math object.
+func (e *jsEvaluator) mathCall(name string, args []interface{}) interface{} {
+	nums, ok := floatArgs(args)
+	if !ok {
+		return e.fail()
+	}
+	switch {
+	case name == "abs" && len(nums) == 1:
+		return math.Abs(nums[0])
+	case name == "floor" && len(nums) == 1:
+		return math.Floor(nums[0])
+	case name == "ceil" && len(nums) == 1:
+		return math.Ceil(nums[0])
+	case name == "sqrt" && len(nums) == 1:
+		return math.Sqrt(nums[0])
+	case name == "pow" && len(nums) == 2:
+		return math.Pow(nums[0], nums[1])
+	case (name == "max" || name == "min") && len(nums) > 0:
+		res := nums[0]
+		for _, n := range nums[1:] {
+			if name == "max" {
+				res = math.Max(res, n)
+			} else {
+				res = math.Min(res, n)
+			}
+		}
+		return res
+	}
+	return e.fail()
+}
+
+func (e *jsEvaluator) property(val interface{}, name string) interface{} {
+	if _, isMath := val.(mathObject); isMath && name == "PI" {
+		return math.Pi
+	}
+	if name == "length" {
+		switch x := val.(type) {
+		case string:
+			return float64(len([]rune(x)))
+		case []interface{}:
+			return float64(len(x))
+		}
+	}
+	return e.fail()
+}
+
+// methodCall evaluates the calls to the string methods emitted by the converter.
+func (e *jsEvaluator) methodCall(val interface{}, name string, args []interface{}) interface{} {
+	s, ok := val.(string)
+	if ok && name == "concat" {
+		for _, a := range args {
+			arg, ok := a.(string)
+			if !ok {
+				return e.fail()
+			}
+			s += arg
+		}
+		return s
+	}
+	if !ok || len(args) != 1 {
+		return e.fail()
+	}
+	arg, ok := args[0].(string)
+	if !ok {
+		return e.fail()
+	}
+	switch name {
+	case "includes":
+		return strings.Contains(s, arg)
+	case "startsWith":
+		return strings.HasPrefix(s, arg)
+	case "endsWith":
+		return strings.HasSuffix(s, arg)
+	case "match":
+		// The matched text stands for the array returned by JavaScript,
+		// as the converter only compares the result with null.
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return e.fail()
+		}
+		if loc := re.FindStringIndex(s); loc != nil {
+			return s[loc[0]:loc[1]]
+		}
+		return nil
+	}
+	return e.fail()
+}
+
+func floatArgs(args []interface{}) ([]float64, bool) {
+	nums := make([]float64, len(args))
+	for i, a := range args {
+		x, ok := a.(float64)
+		if !ok {
+			return nil, false
+		}
+		nums[i] = x
+	}
+	return nums, true
+}
+
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func sameType(a, b interface{}) bool {
+	switch a.(type) {
+	case float64:
+		_, ok := b.(float64)
+		return ok
+	case string:
+		_, ok := b.(string)
+		return ok
+	case bool:
+		_, ok := b.(bool)
+		return ok
+	}
+	return false
+}
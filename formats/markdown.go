@@ -0,0 +1,169 @@
+package formats
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	mdLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdStrong  = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	mdEm      = regexp.MustCompile(`\*(.+?)\*`)
+)
+
+// markdownToHtml converts the subset of markdown used in xlsform labels to html:
+// headings (# to ######), links, **strong** (or __strong__) and *emphasized* text.
+// Html in the text is escaped and lines are separated by <br>.
+func markdownToHtml(md string) string {
+	return renderMarkdown(md, html.EscapeString)
+}
+
+// sanitizedMarkdownToHtml is like markdownToHtml, but the html in the text is kept
+// and sanitized (see sanitizeHtml) instead of escaped.
+func sanitizedMarkdownToHtml(md string) string {
+	return sanitizeHtml(renderMarkdown(md, func(line string) string { return line }))
+}
+
+func renderMarkdown(md string, escape func(string) string) string {
+	lines := strings.Split(strings.Replace(md, "\r\n", "\n", -1), "\n")
+	var b strings.Builder
+	for i, line := range lines {
+		line = mdInline(escape(line))
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			n := string('0' + rune(len(m[1])))
+			b.WriteString("<h" + n + ">" + m[2] + "</h" + n + ">")
+			continue
+		}
+		b.WriteString(line)
+		if i < len(lines)-1 && !mdHeading.MatchString(lines[i+1]) {
+			b.WriteString("<br>")
+		}
+	}
+	return b.String()
+}
+
+// mdInline converts the inline markdown of an escaped line.
+func mdInline(line string) string {
+	line = mdLink.ReplaceAllStringFunc(line, func(link string) string {
+		m := mdLink.FindStringSubmatch(link)
+		if !isSafeUrl(html.UnescapeString(m[2])) {
+			return link
+		}
+		return `<a href="` + m[2] + `">` + m[1] + "</a>"
+	})
+	line = mdStrong.ReplaceAllString(line, "<strong>$1$2</strong>")
+	return mdEm.ReplaceAllString(line, "<em>$1</em>")
+}
+
+// isSafeUrl reports whether the url is relative or uses a scheme that can't run code.
+func isSafeUrl(url string) bool {
+	i := strings.IndexAny(url, ":/?#")
+	if i == -1 || url[i] != ':' {
+		return true // relative
+	}
+	switch strings.ToLower(url[:i]) {
+	case "http", "https", "mailto", "tel":
+		return true
+	}
+	return false
+}
+
+// allowedTags are the html elements kept by sanitizeHtml, which only affect formatting.
+var allowedTags = map[string]bool{
+	"a": true, "b": true, "strong": true, "i": true, "em": true, "u": true, "s": true,
+	"small": true, "sub": true, "sup": true, "br": true, "hr": true, "p": true, "div": true, "span": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "li": true, "blockquote": true, "code": true, "pre": true,
+}
+
+// droppedContentTags are the elements whose content is removed by sanitizeHtml with them,
+// mapped to the pattern of their end tag.
+var droppedContentTags = func() map[string]*regexp.Regexp {
+	tags := make(map[string]*regexp.Regexp)
+	for _, tag := range []string{"script", "style", "iframe", "object", "embed",
+		"template", "noscript", "textarea", "title"} {
+		tags[tag] = regexp.MustCompile(`(?i)</` + tag + `\s*>`)
+	}
+	return tags
+}()
+
+var (
+	sanitizerTag  = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[^\s"'>/=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*)\s*/?>`)
+	sanitizerAttr = regexp.MustCompile(`([^\s"'>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+	htmlEntity    = regexp.MustCompile(`^&(#[0-9]+|#[xX][0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`)
+)
+
+// sanitizeHtml removes from the html the elements and attributes that can run JavaScript
+// or alter the page: only the formatting elements in allowedTags are kept, without attributes
+// except the href and title of links, whose url must be safe (see isSafeUrl). Comments and
+// the content of elements like script and style are removed, the other elements are
+// replaced with their content, and the special characters not part of markup are escaped.
+func sanitizeHtml(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '<':
+			if strings.HasPrefix(s[i:], "<!--") {
+				end := strings.Index(s[i+4:], "-->")
+				if end == -1 {
+					return b.String()
+				}
+				i += 4 + end + 3
+				continue
+			}
+			m := sanitizerTag.FindStringSubmatch(s[i:])
+			if m == nil {
+				b.WriteString("&lt;")
+				i++
+				continue
+			}
+			i += len(m[0])
+			closing, tag := m[1] == "/", strings.ToLower(m[2])
+			switch {
+			case droppedContentTags[tag] != nil && !closing:
+				end := droppedContentTags[tag].FindStringIndex(s[i:])
+				if end == nil {
+					return b.String()
+				}
+				i += end[1]
+			case allowedTags[tag] && closing:
+				b.WriteString("</" + tag + ">")
+			case allowedTags[tag]:
+				b.WriteString("<" + tag + sanitizeAttrs(tag, m[3]) + ">")
+			}
+		case '&':
+			if m := htmlEntity.FindString(s[i:]); m != "" {
+				b.WriteString(m)
+				i += len(m)
+				continue
+			}
+			b.WriteString("&amp;")
+			i++
+		case '>':
+			b.WriteString("&gt;")
+			i++
+		default:
+			b.WriteByte(s[i])
+			i++
+		}
+	}
+	return b.String()
+}
+
+// sanitizeAttrs returns the allowed attributes of an element, see sanitizeHtml.
+func sanitizeAttrs(tag, attrs string) string {
+	if tag != "a" {
+		return ""
+	}
+	var b strings.Builder
+	for _, m := range sanitizerAttr.FindAllStringSubmatch(attrs, -1) {
+		name, val := strings.ToLower(m[1]), html.UnescapeString(m[2]+m[3]+m[4])
+		if name == "href" && !isSafeUrl(strings.TrimSpace(val)) || name != "href" && name != "title" {
+			continue
+		}
+		b.WriteString(" " + name + `="` + html.EscapeString(val) + `"`)
+	}
+	return b.String()
+}
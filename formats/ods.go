@@ -0,0 +1,209 @@
+package formats
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// odsWorkBook holds the rows of the sheets of an OpenDocument spreadsheet,
+// as created by LibreOffice Calc.
+type odsWorkBook map[string][][]string
+
+func (wb odsWorkBook) Rows(sheetName string) [][]string { return wb[sheetName] }
+
+func readOds(r io.ReaderAt, size int64) (odsWorkBook, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if f.Name != "content.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return decOdsContent(rc)
+	}
+	return nil, fmt.Errorf("Invalid ods file, content.xml not found.")
+}
+
+// The limits on the size of the sheets of ods files, whose repeated rows and cells
+// could otherwise expand a small file into a huge table. The limits on rows and columns
+// are the ones of the xls format.
+const (
+	odsMaxRows    = 1 << 16
+	odsMaxColumns = 1 << 8
+	odsMaxCells   = 1 << 22
+	// odsMaxCellLength is the maximum length of the text of a cell, as in Excel.
+	odsMaxCellLength = 32767
+)
+
+// decOdsContent decodes the tables of the content.xml file of an ods archive.
+// Repeated rows and cells are expanded, except when they are empty and at the end
+// of the table or row: spreadsheets often repeat empty rows up to the maximum size.
+// Sheets exceeding the limits on their size are reported as errors.
+func decOdsContent(r io.Reader) (odsWorkBook, error) {
+	wb := make(odsWorkBook)
+	d := xml.NewDecoder(r)
+	var (
+		sheet                 string
+		rows                  [][]string
+		row                   []string
+		rowRepeat             int
+		emptyRows, emptyCells int
+		cells, width          int
+	)
+	tooLarge := func() error {
+		return fmt.Errorf("Sheet %q is too large, the maximum is %d rows, %d columns and %d cells.",
+			sheet, odsMaxRows, odsMaxColumns, odsMaxCells)
+	}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "table":
+				sheet, rows, emptyRows, cells, width = odsAttr(t, "name"), nil, 0, 0, 0
+			case "table-row":
+				row, emptyCells = nil, 0
+				rowRepeat = odsRepeat(t, "number-rows-repeated")
+			case "table-cell", "covered-table-cell":
+				text, err := odsCellText(d)
+				if err != nil {
+					return nil, err
+				}
+				if text == "" {
+					text = odsAttr(t, "value")
+				}
+				n := odsRepeat(t, "number-columns-repeated")
+				if text == "" {
+					emptyCells += n
+					continue
+				}
+				if len(row)+emptyCells+n > odsMaxColumns {
+					return nil, tooLarge()
+				}
+				for ; emptyCells > 0; emptyCells-- {
+					row = append(row, "")
+				}
+				for i := 0; i < n; i++ {
+					row = append(row, text)
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "table":
+				wb[sheet] = padRows(rows)
+			case "table-row":
+				if len(row) == 0 {
+					emptyRows += rowRepeat
+					continue
+				}
+				if len(row) > width {
+					width = len(row)
+				}
+				cells += rowRepeat * len(row)
+				if len(rows)+emptyRows+rowRepeat > odsMaxRows || cells > odsMaxCells ||
+					(len(rows)+emptyRows+rowRepeat)*width > odsMaxCells {
+					return nil, tooLarge()
+				}
+				for ; emptyRows > 0; emptyRows-- {
+					rows = append(rows, nil)
+				}
+				for i := 0; i < rowRepeat; i++ {
+					rows = append(rows, append([]string(nil), row...))
+				}
+			}
+		}
+	}
+	return wb, nil
+}
+
+// odsCellText reads the content of a cell, whose start element has just been read.
+// Paragraphs are separated by newlines; annotations are skipped.
+func odsCellText(d *xml.Decoder) (string, error) {
+	var b strings.Builder
+	paragraphs, inParagraph := 0, 0
+	for depth := 1; depth > 0; {
+		tok, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch t.Name.Local {
+			case "annotation":
+				if err := d.Skip(); err != nil {
+					return "", err
+				}
+				depth--
+			case "p":
+				if paragraphs > 0 {
+					b.WriteByte('\n')
+				}
+				paragraphs++
+				inParagraph++
+			case "s":
+				n := odsRepeat(t, "c")
+				if b.Len()+n > odsMaxCellLength {
+					return "", fmt.Errorf("Cell text longer than %d characters.", odsMaxCellLength)
+				}
+				b.WriteString(strings.Repeat(" ", n))
+			case "tab":
+				b.WriteByte('\t')
+			case "line-break":
+				b.WriteByte('\n')
+			}
+		case xml.EndElement:
+			depth--
+			if t.Name.Local == "p" {
+				inParagraph--
+			}
+		case xml.CharData:
+			if inParagraph > 0 {
+				b.Write(t)
+			}
+			if b.Len() > odsMaxCellLength {
+				return "", fmt.Errorf("Cell text longer than %d characters.", odsMaxCellLength)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+func odsAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// odsRepeat returns the value of a repetition attribute, which defaults to 1.
+// Values exceeding odsMaxCells are clamped to odsMaxCells+1, which is still
+// over the limits, so that the counts of repeated rows and cells can't overflow.
+func odsRepeat(e xml.StartElement, name string) int {
+	n, err := strconv.Atoi(odsAttr(e, name))
+	if err != nil || n < 1 {
+		return 1
+	}
+	if n > odsMaxCells {
+		return odsMaxCells + 1
+	}
+	return n
+}
@@ -0,0 +1,258 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// PatchOperation is an operation of a JSON Patch (RFC 6902).
+type PatchOperation struct {
+	Op    string          `json:"op"` // add, remove, replace, move, copy or test
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`  // for move and copy
+	Value json.RawMessage `json:"value,omitempty"` // for add, replace and test
+}
+
+// DecJsonPatch decodes a JSON Patch, an array of operations.
+func DecJsonPatch(data []byte) ([]PatchOperation, error) {
+	var patch []PatchOperation
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// PatchAjf applies the patch to the json encoding of the ajf form, returning the
+// patched json document. The result is not decoded back into an AjfForm,
+// so that the patch can add properties that AjfForm doesn't know about.
+func PatchAjf(ajf *AjfForm, patch []PatchOperation) (interface{}, error) {
+	var buf bytes.Buffer
+	if err := EncAjfToWriter(ajf, &buf, EncodeOptions{Compact: true}); err != nil {
+		return nil, err
+	}
+	doc, err := decJsonValue(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return ApplyJsonPatch(doc, patch)
+}
+
+// ApplyJsonPatch applies the patch to a json document, decoded into maps, slices
+// and basic values. The operations are applied in order and the first failing one
+// stops the application. The document may be modified even in case of error.
+func ApplyJsonPatch(doc interface{}, patch []PatchOperation) (interface{}, error) {
+	for i, op := range patch {
+		var err error
+		doc, err = applyPatchOp(doc, op)
+		if err != nil {
+			return nil, fmt.Errorf("Patch operation %d (%s %s): %s", i+1, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyPatchOp(doc interface{}, op PatchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("Missing value.")
+		}
+		if value, err = decJsonValue(op.Value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = getPointer(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			// The copy must not share maps and slices with the original.
+			data, _ := json.Marshal(value)
+			value, _ = decJsonValue(data)
+			break
+		}
+		if op.Path == op.From {
+			return doc, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("Can't move a value into one of its children.")
+		}
+		if doc, err = removePointer(doc, from); err != nil {
+			return nil, err
+		}
+	case "remove":
+		return removePointer(doc, path)
+	default:
+		return nil, fmt.Errorf("Unknown operation.")
+	}
+	switch op.Op {
+	case "test":
+		current, err := getPointer(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, fmt.Errorf("Test failed.")
+		}
+		return doc, nil
+	case "replace":
+		if _, err := getPointer(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, err = removePointer(doc, path); err != nil {
+			return nil, err
+		}
+	}
+	return addPointer(doc, path, value)
+}
+
+// decJsonValue decodes a json value, preserving the exact representation of numbers.
+func decJsonValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("Invalid path %q, it must start with /.", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses the index of an array element; "-" (the end of the array)
+// is accepted only if allowEnd is true.
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("Invalid array index %q.", token)
+	}
+	if i > length || (i == length && !allowEnd) {
+		return 0, fmt.Errorf("Array index %d out of range.", i)
+	}
+	return i, nil
+}
+
+func getPointer(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			child, ok := v[token]
+			if !ok {
+				return nil, fmt.Errorf("Property %q not found.", token)
+			}
+			doc = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[i]
+		default:
+			return nil, fmt.Errorf("Can't access %q in a value that isn't an object or an array.", token)
+		}
+	}
+	return doc, nil
+}
+
+// updatePointer replaces the parent of the location referenced by path
+// with the result of f, which receives the parent and the last token of the path.
+func updatePointer(doc interface{}, path []string, f func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+	child, err := getPointer(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = updatePointer(child, path[1:], f)
+	if err != nil {
+		return nil, err
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		v[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(v), false)
+		v[i] = child
+	}
+	return doc, nil
+}
+
+func addPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updatePointer(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			v[token] = value
+			return v, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(v), true)
+			if err != nil {
+				return nil, err
+			}
+			v = append(v, nil)
+			copy(v[i+1:], v[i:])
+			v[i] = value
+			return v, nil
+		default:
+			return nil, fmt.Errorf("Can't add %q to a value that isn't an object or an array.", token)
+		}
+	})
+}
+
+func removePointer(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("Can't remove the whole document.")
+	}
+	return updatePointer(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := v[token]; !ok {
+				return nil, fmt.Errorf("Property %q not found.", token)
+			}
+			delete(v, token)
+			return v, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(v[:i], v[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("Can't remove %q from a value that isn't an object or an array.", token)
+		}
+	})
+}
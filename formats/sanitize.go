@@ -0,0 +1,125 @@
+package formats
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/scanner"
+)
+
+// unsafeIdents are the global identifiers that give formulas access to the environment
+// they run in, or to code evaluation. They are allowed when they are the names of
+// nodes, as the values of the nodes shadow the globals.
+var unsafeIdents = map[string]bool{
+	"eval": true, "Function": true, "this": true, "import": true, "require": true,
+	"window": true, "document": true, "globalThis": true, "self": true, "top": true,
+	"parent": true, "frames": true, "location": true, "navigator": true,
+	"localStorage": true, "sessionStorage": true, "indexedDB": true, "fetch": true,
+	"XMLHttpRequest": true, "WebSocket": true, "setTimeout": true, "setInterval": true,
+}
+
+// unsafeProps are the properties that give access to constructors or to function invocation.
+var unsafeProps = map[string]bool{
+	"constructor": true, "prototype": true, "__proto__": true,
+	"call": true, "apply": true, "bind": true,
+}
+
+// checkFormula checks that a JavaScript formula produced by the converter is a plain
+// expression: it must not reference unsafe identifiers (other than the names of the nodes)
+// or properties, assign values or contain statements, blocks, template literals
+// or array literals.
+func checkFormula(js string, names nameSet) error {
+	var s scanner.Scanner
+	s.Init(strings.NewReader(js))
+	s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats | scanner.ScanStrings
+	var scanErr string
+	s.Error = func(_ *scanner.Scanner, msg string) { scanErr = msg }
+	prev := rune(0)
+	for tok := s.Scan(); tok != scanner.EOF; prev, tok = tok, s.Scan() {
+		switch tok {
+		case scanner.Ident:
+			ident := s.TokenText()
+			if prev == '.' && unsafeProps[ident] {
+				return fmt.Errorf("Property %q is not allowed.", ident)
+			}
+			if prev != '.' && unsafeIdents[ident] && !names[ident] {
+				return fmt.Errorf("Identifier %q is not allowed.", ident)
+			}
+		case '\'':
+			for ch := s.Next(); ch != '\''; ch = s.Next() {
+				if ch == '\\' {
+					s.Next()
+				} else if ch == scanner.EOF || ch == '\n' {
+					return fmt.Errorf("String literal not terminated.")
+				}
+			}
+		case '=':
+			if s.Peek() != '=' {
+				return fmt.Errorf("Assignments and arrow functions are not allowed.")
+			}
+			for s.Peek() == '=' {
+				s.Next()
+			}
+		case '!', '<', '>':
+			for s.Peek() == '=' {
+				s.Next()
+			}
+		case '+', '-':
+			if s.Peek() == tok {
+				return fmt.Errorf("Operator %q is not allowed.", string(tok)+string(tok))
+			}
+			if s.Peek() == '=' {
+				return fmt.Errorf("Assignments are not allowed.")
+			}
+		case '`', ';', '{', '}', '[', ']', '\\':
+			return fmt.Errorf("Character %q is not allowed.", tok)
+		}
+		if scanErr != "" {
+			return fmt.Errorf("%s", scanErr)
+		}
+	}
+	return nil
+}
+
+// checkNodeFormulas checks the formulas of the nodes (see checkFormula).
+func checkNodeFormulas(nodes []Node) error {
+	names := make(nameSet)
+	collectNames(nodes, names)
+	var err error
+	walkNodes(nodes, func(n *Node) {
+		for _, f := range nodeFormulas(n) {
+			if e := checkFormula(f, names); e != nil && err == nil {
+				err = fmt.Errorf("Unsafe formula %q in node %q: %s", f, n.Name, e)
+			}
+		}
+	})
+	return err
+}
+
+// scriptMarkup matches the html constructs that can run JavaScript when rendered:
+// script-like elements, event handler attributes and javascript: urls.
+var scriptMarkup = regexp.MustCompile(
+	`(?i)<\s*(script|iframe|object|embed|link|meta|base|form)\b|\bon[a-z]+\s*=|(javascript|vbscript)\s*:|data\s*:\s*text/html`)
+
+// checkMarkup reports the texts of the form, which ajf can render as html,
+// containing markup that can run JavaScript. It is used in strict mode.
+func checkMarkup(survey []SurveyRow, choices []ChoicesRow) error {
+	for _, row := range survey {
+		texts := [][2]string{
+			{"label", row.FullLabel()}, {"hint", row.Hint}, {"constraint_message", row.ConstraintMessage},
+		}
+		for _, text := range texts {
+			if m := scriptMarkup.FindString(text[1]); m != "" {
+				return fmtSrcErr(row.LineNum, text[0], CodeUnsafeMarkup,
+					"Markup %q is not allowed in strict mode.", m)
+			}
+		}
+	}
+	for _, c := range choices {
+		if m := scriptMarkup.FindString(c.Label); m != "" {
+			return SourceError{"choices", c.LineNum, "label", CodeUnsafeMarkup,
+				fmt.Sprintf("Markup %q is not allowed in strict mode (choices sheet).", m)}
+		}
+	}
+	return nil
+}
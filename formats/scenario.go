@@ -0,0 +1,120 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Scenario is a named set of answers to the questions of a form,
+// in the format of the submissions checked by Validate.
+type Scenario struct {
+	Name    string
+	Answers map[string]interface{}
+}
+
+// ScenarioResult describes how a form behaves on the answers of a scenario.
+type ScenarioResult struct {
+	Scenario  string           `json:"scenario"`
+	Questions []QuestionResult `json:"questions"`
+}
+
+// QuestionResult is the state of a field of the form in a scenario.
+type QuestionResult struct {
+	Name string `json:"name"` // with the "__i" suffix in repeating slides, as in ValidationError
+	// Visibility is "visible", "hidden", or "unknown" when the visibility condition
+	// of the field or of a group containing it can't be evaluated.
+	Visibility string `json:"visibility"`
+	// Errors are the problems of the answer, as reported by Validate;
+	// the answer is valid if there are none.
+	Errors []string `json:"errors,omitempty"`
+}
+
+var visibilityNames = map[visibility]string{shown: "visible", hidden: "hidden", maybeShown: "unknown"}
+
+// RunScenario evaluates the visibility conditions and the constraints of the form
+// on the answers of the scenario, reporting for each field (calculations excluded)
+// whether it would be visible and whether its answer would be accepted. The formulas
+// of the calculations not answered by the scenario are evaluated first, in the order
+// of the form, so that conditions using them can be evaluated. The same limits of Validate
+// apply to the supported conditions. The scenario is not modified.
+func RunScenario(form *AjfForm, s Scenario) ScenarioResult {
+	data := make(map[string]interface{}, len(s.Answers))
+	for name, val := range s.Answers {
+		data[name] = val
+	}
+	walkNodes(form.Slides, func(n *Node) {
+		if _, ok := data[n.Name]; ok || n.FieldType == nil || *n.FieldType != FtFormula || n.Formula == nil {
+			return
+		}
+		if val, ok := evalCondition(n.Formula.Formula, func(name string) interface{} {
+			return submissionValue(data[name])
+		}); ok {
+			data[n.Name] = val
+		}
+	})
+
+	res := ScenarioResult{Scenario: s.Name, Questions: []QuestionResult{}}
+	index := make(map[string]int)
+	v := newSubmissionValidator(data, form)
+	v.visit = func(n *Node, suffix string, vis visibility) {
+		if n.FieldType != nil && *n.FieldType == FtFormula {
+			return
+		}
+		index[n.Name+suffix] = len(res.Questions)
+		res.Questions = append(res.Questions, QuestionResult{Name: n.Name + suffix, Visibility: visibilityNames[vis]})
+	}
+	v.run(form)
+	for _, e := range v.errs {
+		if i, ok := index[e.Field]; ok {
+			res.Questions[i].Errors = append(res.Questions[i].Errors, e.Message)
+		}
+	}
+	return res
+}
+
+// DecScenarios decodes a json scenarios file: an object mapping the names of the scenarios
+// to their answers, in turn objects mapping the names of the questions to their values,
+// as in the submissions checked by Validate. The scenarios are returned in the order of the file.
+//
+//	{
+//		"adult": {"age": 34, "colors": ["red", "green"], "consent": true},
+//		"child": {"age": 5}
+//	}
+func DecScenarios(data []byte) ([]Scenario, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("The scenarios must be a json object.")
+	}
+	var scenarios []Scenario
+	names := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		name := tok.(string) // the keys of objects are strings
+		if names[name] {
+			return nil, fmt.Errorf("Duplicate scenario %q.", name)
+		}
+		names[name] = true
+		var answers map[string]interface{}
+		if err := dec.Decode(&answers); err != nil {
+			return nil, fmt.Errorf("Scenario %q: %s", name, err)
+		}
+		if answers == nil {
+			return nil, fmt.Errorf("Scenario %q: the answers must be a json object.", name)
+		}
+		scenarios = append(scenarios, Scenario{name, answers})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("Unexpected content after the scenarios.")
+	}
+	return scenarios, nil
+}
@@ -0,0 +1,345 @@
+package formats
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// AjfSchema is the JSON Schema (draft 7) of the ajf forms produced by the converter.
+// It describes the structure of the json documents; the rules relating different parts
+// of a form, like the uniqueness of the ids, are checked by ValidateAjf.
+const AjfSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "ajf form",
+	"type": "object",
+	"required": ["nodes"],
+	"additionalProperties": false,
+	"properties": {
+		"title": {"type": "string"},
+		"formId": {"type": "string"},
+		"version": {"type": "string"},
+		"defaultLanguage": {"type": "string"},
+		"choicesOrigins": {"type": "array", "items": {"$ref": "#/definitions/choicesOrigin"}},
+		"nodes": {"type": "array", "items": {"$ref": "#/definitions/node"}},
+		"nameMapping": {"type": "object", "additionalProperties": {"type": "string"}},
+		"translations": {
+			"type": "object",
+			"additionalProperties": {"type": "object", "additionalProperties": {"type": "string"}}
+		}
+	},
+	"definitions": {
+		"choicesOrigin": {
+			"type": "object",
+			"required": ["type", "name", "choicesType", "choices"],
+			"additionalProperties": false,
+			"properties": {
+				"type": {"enum": ["fixed", "repeat"]},
+				"name": {"type": "string", "minLength": 1},
+				"choicesType": {"enum": ["string"]},
+				"choices": {"type": "array", "items": {"$ref": "#/definitions/choice"}},
+				"repeatRef": {"type": "string"},
+				"fieldRef": {"type": "string"},
+				"provenance": {
+					"type": "array",
+					"items": {
+						"type": "object",
+						"additionalProperties": false,
+						"properties": {
+							"file": {"type": "string"},
+							"sheet": {"type": "string"},
+							"line": {"type": "integer", "minimum": 0}
+						}
+					}
+				}
+			}
+		},
+		"choice": {
+			"type": "object",
+			"required": ["value", "label"],
+			"additionalProperties": false,
+			"properties": {
+				"value": {"type": "string"},
+				"label": {"type": "string"},
+				"image": {"type": "string"},
+				"audio": {"type": "string"},
+				"attributes": {"type": "object", "additionalProperties": {"type": "string"}}
+			}
+		},
+		"formula": {
+			"type": "object",
+			"required": ["formula"],
+			"additionalProperties": false,
+			"properties": {"formula": {"type": "string"}}
+		},
+		"node": {
+			"type": "object",
+			"required": ["parent", "id", "name", "label", "nodeType"],
+			"additionalProperties": false,
+			"properties": {
+				"parent": {"type": "integer", "minimum": 0},
+				"id": {"type": "integer", "minimum": 1},
+				"name": {"type": "string", "minLength": 1},
+				"label": {"type": "string"},
+				"nodeType": {"enum": [0, 2, 3, 4]},
+				"hint": {"type": "string"},
+				"description": {"type": "string"},
+				"fieldType": {"enum": [0, 1, 2, 3, 4, 5, 6, 7, 9, 10, 12, 13, 14, 15, 17]},
+				"choicesOriginRef": {"type": "string"},
+				"choicesFilter": {"$ref": "#/definitions/formula"},
+				"forceExpanded": {"type": "boolean"},
+				"forceNarrow": {"type": "boolean"},
+				"ranked": {"type": "boolean"},
+				"randomizeChoices": {"type": "boolean"},
+				"randomSeed": {"$ref": "#/definitions/formula"},
+				"HTML": {"type": "string"},
+				"collapsible": {"type": "boolean"},
+				"maxReps": {"type": "integer", "minimum": 0},
+				"formulaReps": {"$ref": "#/definitions/formula"},
+				"start": {"type": "number"},
+				"end": {"type": "number"},
+				"step": {"type": "number"},
+				"decimals": {"type": "integer", "minimum": 0},
+				"thousandsSeparator": {"type": "boolean"},
+				"unit": {"type": "string"},
+				"formula": {"$ref": "#/definitions/formula"},
+				"defaultValue": {},
+				"editable": {"type": "boolean"},
+				"validation": {
+					"type": "object",
+					"additionalProperties": false,
+					"properties": {
+						"notEmpty": {"type": "boolean"},
+						"minValue": {"type": "number"},
+						"maxValue": {"type": "number"},
+						"conditions": {
+							"type": "array",
+							"items": {
+								"type": "object",
+								"required": ["condition", "clientValidation"],
+								"additionalProperties": false,
+								"properties": {
+									"condition": {"type": "string", "minLength": 1},
+									"clientValidation": {"type": "boolean"},
+									"errorMessage": {"type": "string"}
+								}
+							}
+						}
+					}
+				},
+				"visibility": {
+					"type": "object",
+					"required": ["condition"],
+					"additionalProperties": false,
+					"properties": {"condition": {"type": "string", "minLength": 1}}
+				},
+				"nodes": {"type": "array", "items": {"$ref": "#/definitions/node"}}
+			}
+		}
+	}
+}`
+
+var ajfSchema map[string]interface{}
+
+func init() {
+	if err := json.Unmarshal([]byte(AjfSchema), &ajfSchema); err != nil {
+		panic("invalid ajf schema: " + err.Error())
+	}
+}
+
+// ValidateAjf checks that the form is a structurally valid ajf form: that its json
+// encoding conforms to AjfSchema, that the ids and the names of the nodes are unique,
+// that the parent of each node is the previous sibling (or the containing node for the
+// first child), that the top-level nodes are slides, that slides are not nested and
+// fields have no children, and that the fields reference existing choices origins.
+// Convert checks its output with it, so that the problems of the converter
+// are reported instead of producing forms that can't be loaded.
+// The problems found are reported as an AjfError.
+func ValidateAjf(form *AjfForm) error {
+	if err := validateAjf(form); err != nil {
+		return AjfError{err.Error()}
+	}
+	return nil
+}
+
+// AjfError is the error of a form that is not valid ajf, see ValidateAjf.
+// Convert returns it when its output is not valid, which is a bug of the converter.
+type AjfError struct {
+	Message string
+}
+
+func (e AjfError) Error() string { return e.Message }
+
+func validateAjf(form *AjfForm) error {
+	data, err := json.Marshal(form)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if err := checkSchema(ajfSchema, doc, "form"); err != nil {
+		return err
+	}
+
+	origins := make(map[string]bool)
+	for _, co := range form.ChoicesOrigins {
+		if origins[co.Name] {
+			return fmt.Errorf("Duplicate choices origin %q.", co.Name)
+		}
+		origins[co.Name] = true
+	}
+	ids := make(map[int]string)
+	names := make(map[string]bool)
+	var check func(nodes []Node, parent int, depth int) error
+	check = func(nodes []Node, parent int, depth int) error {
+		previous := parent
+		for i := range nodes {
+			n := &nodes[i]
+			if other, ok := ids[n.Id]; ok {
+				return fmt.Errorf("Nodes %q and %q have the same id %d.", other, n.Name, n.Id)
+			}
+			ids[n.Id] = n.Name
+			if names[n.Name] {
+				return fmt.Errorf("Duplicate node name %q.", n.Name)
+			}
+			names[n.Name] = true
+			if n.Previous != previous {
+				return fmt.Errorf("Node %q has parent %d, expected %d.", n.Name, n.Previous, previous)
+			}
+			previous = n.Id
+			isSlide := n.Type == NtSlide || n.Type == NtRepeatingSlide
+			switch {
+			case depth == 0 && !isSlide:
+				return fmt.Errorf("Top-level node %q is not a slide.", n.Name)
+			case depth > 0 && isSlide:
+				return fmt.Errorf("Slide %q is nested in another node.", n.Name)
+			case n.Type == NtField && n.FieldType == nil:
+				return fmt.Errorf("Field %q has no field type.", n.Name)
+			case n.Type == NtField && len(n.Nodes) > 0:
+				return fmt.Errorf("Field %q has child nodes.", n.Name)
+			case n.ChoicesOriginRef != "" && !origins[n.ChoicesOriginRef]:
+				return fmt.Errorf("Node %q references undefined choices origin %q.", n.Name, n.ChoicesOriginRef)
+			case n.Type == NtField && (*n.FieldType == FtSingleChoice || *n.FieldType == FtMultipleChoice) &&
+				n.ChoicesOriginRef == "":
+				return fmt.Errorf("Choice field %q has no choices origin.", n.Name)
+			}
+			if err := check(n.Nodes, n.Id, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return check(form.Slides, 0, 0)
+}
+
+// checkSchema validates a decoded json value against a schema, supporting the keywords
+// used by AjfSchema: type, enum, properties, required, additionalProperties, items,
+// minimum, minLength and local $refs. path locates the value in the error messages.
+func checkSchema(schema map[string]interface{}, val interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		def := strings.TrimPrefix(ref, "#/definitions/")
+		schema, ok = ajfSchema["definitions"].(map[string]interface{})[def].(map[string]interface{})
+		if !ok {
+			panic("undefined schema reference " + ref)
+		}
+	}
+	if typ, ok := schema["type"].(string); ok && !hasJsonType(val, typ) {
+		return fmt.Errorf("%s: expected %s, found %s.", path, typ, jsonType(val))
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == val
+		}
+		if !found {
+			return fmt.Errorf("%s: invalid value %v.", path, val)
+		}
+	}
+	if min, ok := schema["minimum"].(float64); ok {
+		if x, isNum := val.(float64); isNum && x < min {
+			return fmt.Errorf("%s: %v is less than %v.", path, x, min)
+		}
+	}
+	if min, ok := schema["minLength"].(float64); ok {
+		if s, isStr := val.(string); isStr && float64(len(s)) < min {
+			return fmt.Errorf("%s: string is too short.", path)
+		}
+	}
+	switch v := val.(type) {
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := checkSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if _, ok := v[r.(string)]; !ok {
+				return fmt.Errorf("%s: missing property %q.", path, r)
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			propSchema, ok := props[k].(map[string]interface{})
+			if !ok {
+				switch extra := schema["additionalProperties"].(type) {
+				case bool:
+					if !extra {
+						return fmt.Errorf("%s: unexpected property %q.", path, k)
+					}
+					continue
+				case map[string]interface{}:
+					propSchema = extra
+				default:
+					continue
+				}
+			}
+			if err := checkSchema(propSchema, v[k], path+"."+k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasJsonType(val interface{}, typ string) bool {
+	if typ == "integer" {
+		x, ok := val.(float64)
+		return ok && x == math.Trunc(x)
+	}
+	return jsonType(val) == typ || typ == "number" && jsonType(val) == "integer"
+}
+
+// jsonType returns the json type of a decoded value.
+func jsonType(val interface{}) string {
+	switch x := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if x == math.Trunc(x) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", val)
+}
@@ -0,0 +1,152 @@
+package formats
+
+import (
+	"sort"
+	"strings"
+	"text/scanner"
+)
+
+// Manifest links the forms produced by SplitForm, in the order
+// in which they are meant to be filled.
+type Manifest struct {
+	Title string          `json:"title,omitempty"`
+	Forms []ManifestEntry `json:"forms"`
+}
+
+type ManifestEntry struct {
+	// Form is the name of the slide the form was made of.
+	Form  string `json:"form"`
+	Title string `json:"title,omitempty"`
+	// File is left empty by SplitForm, it can be set by the caller
+	// to the name of the file containing the form.
+	File string `json:"file,omitempty"`
+	// References lists the forms containing questions
+	// that are referenced by the formulas of this form.
+	References []string `json:"references,omitempty"`
+}
+
+// SplitForm splits the form into multiple forms, one for each slide.
+// Each form includes the choices origins it uses, and its ids are reassigned
+// with the given multiplier (0 means the default, 1000).
+// The original form is not modified.
+func SplitForm(ajf *AjfForm, idMultiplier int) ([]*AjfForm, *Manifest, error) {
+	if idMultiplier == 0 {
+		idMultiplier = defaultIdMultiplier
+	}
+	origins := make(map[string]ChoicesOrigin, len(ajf.ChoicesOrigins))
+	for _, co := range ajf.ChoicesOrigins {
+		origins[co.Name] = co
+	}
+	// The slide containing each node, for resolving references.
+	slideOf := make(map[string]string)
+	for i := range ajf.Slides {
+		slide := ajf.Slides[i].Name
+		walkNodes(ajf.Slides[i:i+1], func(n *Node) { slideOf[n.Name] = slide })
+	}
+
+	forms := make([]*AjfForm, 0, len(ajf.Slides))
+	manifest := &Manifest{Title: ajf.Title, Forms: make([]ManifestEntry, 0, len(ajf.Slides))}
+	for i := range ajf.Slides {
+		slide := copyNode(&ajf.Slides[i])
+		form := &AjfForm{
+			Title:           slide.Label,
+			Version:         ajf.Version,
+			DefaultLanguage: ajf.DefaultLanguage,
+			Slides:          []Node{slide},
+			Translations:    ajf.Translations,
+		}
+		if ajf.FormId != "" {
+			form.FormId = ajf.FormId + "_" + slide.Name
+		}
+		used := make(map[string]bool)
+		refs := make(map[string]bool)
+		walkNodes(form.Slides, func(n *Node) {
+			if n.ChoicesOriginRef != "" {
+				used[n.ChoicesOriginRef] = true
+				if co := origins[n.ChoicesOriginRef]; co.Type == OtRepeat {
+					refs[slideOf[co.RepeatRef]] = true
+				}
+			}
+			for _, f := range nodeFormulas(n) {
+				for _, ident := range identifiers(f) {
+					if s, ok := slideOf[ident]; ok {
+						refs[s] = true
+					}
+				}
+			}
+		})
+		for _, co := range ajf.ChoicesOrigins {
+			if used[co.Name] {
+				form.ChoicesOrigins = append(form.ChoicesOrigins, co)
+			}
+		}
+		err := assignIds(form.Slides, 0, idMultiplier)
+		if err != nil {
+			return nil, nil, err
+		}
+		delete(refs, slide.Name)
+		entry := ManifestEntry{Form: slide.Name, Title: slide.Label}
+		for s := range refs {
+			entry.References = append(entry.References, s)
+		}
+		sort.Strings(entry.References)
+		forms = append(forms, form)
+		manifest.Forms = append(manifest.Forms, entry)
+	}
+	return forms, manifest, nil
+}
+
+func copyNode(n *Node) Node {
+	c := *n
+	if n.Nodes != nil {
+		c.Nodes = make([]Node, len(n.Nodes))
+		for i := range n.Nodes {
+			c.Nodes[i] = copyNode(&n.Nodes[i])
+		}
+	}
+	return c
+}
+
+func walkNodes(nodes []Node, f func(*Node)) {
+	for i := range nodes {
+		f(&nodes[i])
+		walkNodes(nodes[i].Nodes, f)
+	}
+}
+
+// nodeFormulas returns the JavaScript formulas of the node.
+func nodeFormulas(n *Node) []string {
+	var formulas []string
+	for _, f := range []*Formula{n.Formula, n.FormulaReps, n.ChoicesFilter, n.RandomSeed} {
+		if f != nil {
+			formulas = append(formulas, f.Formula)
+		}
+	}
+	if n.Visibility != nil {
+		formulas = append(formulas, n.Visibility.Condition)
+	}
+	if n.Validation != nil {
+		for _, c := range n.Validation.Conditions {
+			formulas = append(formulas, c.Condition)
+		}
+	}
+	return formulas
+}
+
+// identifiers returns the identifiers appearing in a JavaScript formula,
+// excluding the properties accessed with ".".
+func identifiers(js string) []string {
+	var s scanner.Scanner
+	s.Init(strings.NewReader(js))
+	s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats | scanner.ScanStrings
+	s.Error = func(*scanner.Scanner, string) {}
+	var idents []string
+	prev := rune(0)
+	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
+		if tok == scanner.Ident && prev != '.' {
+			idents = append(idents, s.TokenText())
+		}
+		prev = tok
+	}
+	return idents
+}
@@ -0,0 +1,289 @@
+package formats
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ValidationError is a problem of a submission, found by Validate.
+type ValidationError struct {
+	Field   string `json:"field"` // the name of the answer, with the "__i" suffix in repeating slides
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("field %s: %s", e.Field, e.Message)
+}
+
+// Validate checks a submission of the form, as decoded from json, against the types,
+// required flags, ranges, choices and constraints of its fields, so that backends apply
+// the same rules as the rendered form. The answers of the i-th repetition of a repeating
+// slide are named after the fields with the "__i" suffix (starting from 0).
+// The answers to hidden questions are not checked.
+// Constraint and visibility conditions are evaluated when they only use operators,
+// answers and the common functions (like isInt, notEmpty, valueInChoice and Math.max);
+// the others, like date computations or regular expressions, are left to the form
+// and are not checked. Required questions whose visibility can't be evaluated are
+// not required. The form is not modified.
+func Validate(data map[string]interface{}, form *AjfForm) []ValidationError {
+	v := newSubmissionValidator(data, form)
+	v.run(form)
+	return v.errs
+}
+
+// visibility is the state of a node during validation: maybeShown is used
+// when a visibility condition can't be evaluated.
+type visibility int
+
+const (
+	shown visibility = iota
+	hidden
+	maybeShown
+)
+
+type submissionValidator struct {
+	data    map[string]interface{}
+	origins map[string]*ChoicesOrigin
+	errs    []ValidationError
+	// visit, if not nil, is called for each field of the form, including the hidden ones.
+	visit func(n *Node, suffix string, vis visibility)
+}
+
+func newSubmissionValidator(data map[string]interface{}, form *AjfForm) *submissionValidator {
+	v := &submissionValidator{data: data, origins: make(map[string]*ChoicesOrigin)}
+	for i := range form.ChoicesOrigins {
+		v.origins[form.ChoicesOrigins[i].Name] = &form.ChoicesOrigins[i]
+	}
+	return v
+}
+
+func (v *submissionValidator) run(form *AjfForm) {
+	for i := range form.Slides {
+		v.node(&form.Slides[i], "", shown)
+	}
+}
+
+func (v *submissionValidator) errorf(field, format string, a ...interface{}) {
+	v.errs = append(v.errs, ValidationError{field, fmt.Sprintf(format, a...)})
+}
+
+// lookup returns the answer to a question, preferring the one of the current
+// repetition (identified by suffix) when inside a repeating slide.
+func (v *submissionValidator) lookup(name, suffix string) interface{} {
+	if suffix != "" {
+		if val, ok := v.data[name+suffix]; ok {
+			return submissionValue(val)
+		}
+	}
+	return submissionValue(v.data[name])
+}
+
+func (v *submissionValidator) node(n *Node, suffix string, vis visibility) {
+	if n.Visibility != nil && vis != hidden {
+		switch val, ok := evalCondition(n.Visibility.Condition, func(name string) interface{} {
+			return v.lookup(name, suffix)
+		}); {
+		case !ok:
+			vis = maybeShown
+		case !truthy(val):
+			vis = hidden
+		}
+	}
+	if vis == hidden && v.visit == nil {
+		return
+	}
+	switch n.Type {
+	case NtField:
+		if v.visit != nil {
+			v.visit(n, suffix, vis)
+		}
+		if vis != hidden {
+			v.field(n, suffix, vis)
+		}
+	case NtRepeatingSlide:
+		for i := 0; v.hasRepetition(n.Nodes, "__"+strconv.Itoa(i)); i++ {
+			for j := range n.Nodes {
+				v.node(&n.Nodes[j], "__"+strconv.Itoa(i), vis)
+			}
+		}
+	default:
+		for i := range n.Nodes {
+			v.node(&n.Nodes[i], suffix, vis)
+		}
+	}
+}
+
+// hasRepetition reports whether the submission contains answers to the fields
+// of the repetition with the given suffix.
+func (v *submissionValidator) hasRepetition(nodes []Node, suffix string) bool {
+	found := false
+	walkNodes(nodes, func(n *Node) {
+		if _, ok := v.data[n.Name+suffix]; ok && n.Type == NtField {
+			found = true
+		}
+	})
+	return found
+}
+
+func (v *submissionValidator) field(n *Node, suffix string, vis visibility) {
+	if n.FieldType == nil || *n.FieldType == FtFormula || *n.FieldType == FtNote {
+		return
+	}
+	name := n.Name + suffix
+	val := submissionValue(v.data[name])
+	if !answered(val) {
+		if vis == shown && n.Validation != nil && n.Validation.NotEmpty {
+			v.errorf(name, "An answer is required.")
+		}
+		return
+	}
+	if msg := v.checkAnswer(n, val); msg != "" {
+		v.errorf(name, "%s", msg)
+		return
+	}
+	if vis != shown || n.Validation == nil {
+		return
+	}
+	for _, c := range n.Validation.Conditions {
+		res, ok := evalCondition(c.Condition, func(ident string) interface{} {
+			return v.lookup(ident, suffix)
+		})
+		if ok && !truthy(res) {
+			if c.ErrorMessage != "" {
+				v.errorf(name, "%s", c.ErrorMessage)
+			} else {
+				v.errorf(name, "The answer doesn't satisfy the condition %q.", c.Condition)
+			}
+		}
+	}
+}
+
+// checkAnswer checks the type, the range and the choices of an answer,
+// returning the description of the problem found, if any.
+func (v *submissionValidator) checkAnswer(n *Node, val interface{}) string {
+	switch *n.FieldType {
+	case FtString, FtText, FtBarcode, FtFile, FtImage:
+		if _, ok := val.(string); !ok {
+			return "The answer must be a string."
+		}
+	case FtBoolean:
+		if _, ok := val.(bool); !ok {
+			return "The answer must be a boolean."
+		}
+	case FtNumber, FtRange:
+		x, ok := val.(float64)
+		if !ok {
+			return "The answer must be a number."
+		}
+		if n.Start != nil && x < *n.Start || n.End != nil && x > *n.End {
+			return fmt.Sprintf("The answer must be between %v and %v.", fmtNum(n.Start), fmtNum(n.End))
+		}
+		if n.Validation != nil && n.Validation.MinValue != nil && x < *n.Validation.MinValue {
+			return fmt.Sprintf("The answer must be at least %v.", fmtNum(n.Validation.MinValue))
+		}
+		if n.Validation != nil && n.Validation.MaxValue != nil && x > *n.Validation.MaxValue {
+			return fmt.Sprintf("The answer must be at most %v.", fmtNum(n.Validation.MaxValue))
+		}
+	case FtDate, FtTime:
+		s, ok := val.(string)
+		if !ok || !validTime(*n.FieldType, s) {
+			return fmt.Sprintf("Invalid %s %v.", timeTypes[*n.FieldType], val)
+		}
+	case FtSingleChoice:
+		s, ok := val.(string)
+		if !ok {
+			return "The answer must be the value of a choice."
+		}
+		return v.checkChoice(n, s)
+	case FtMultipleChoice:
+		list, ok := val.([]interface{})
+		if !ok {
+			return "The answer must be a list of choice values."
+		}
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return "The answer must be a list of choice values."
+			}
+			if msg := v.checkChoice(n, s); msg != "" {
+				return msg
+			}
+		}
+	}
+	return ""
+}
+
+// checkChoice checks that value is one of the choices of the field. The choices
+// taken from repeats are only known when the form is filled and are not checked.
+func (v *submissionValidator) checkChoice(n *Node, value string) string {
+	origin := v.origins[n.ChoicesOriginRef]
+	if origin == nil || origin.Type != OtFixed {
+		return ""
+	}
+	if containsChoice(origin.Choices, value) {
+		return ""
+	}
+	return fmt.Sprintf("%q is not a choice of list %q.", value, origin.Name)
+}
+
+func fmtNum(x *float64) string {
+	if x == nil {
+		return "-"
+	}
+	return strconv.FormatFloat(*x, 'f', -1, 64)
+}
+
+// timeTypes are the xlsform types of the date and time fields, see timeLayouts.
+var timeTypes = map[FieldType]string{FtDate: "date", FtTime: "time"}
+
+// validTime reports whether s is a valid answer to a date or time field. Dates can also
+// be full timestamps, as produced by JavaScript's Date.toJSON.
+func validTime(ft FieldType, s string) bool {
+	layouts := timeLayouts[timeTypes[ft]]
+	if ft == FtDate {
+		layouts = append(layouts[:len(layouts):len(layouts)], time.RFC3339)
+	}
+	for _, layout := range layouts {
+		if _, err := time.Parse(layout, s); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// submissionValue converts the numbers and lists of a submission decoded
+// with other means than encoding/json to float64 and []interface{}.
+func submissionValue(val interface{}) interface{} {
+	switch x := val.(type) {
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case json.Number:
+		if f, err := x.Float64(); err == nil {
+			return f
+		}
+	case []string:
+		list := make([]interface{}, len(x))
+		for i, s := range x {
+			list[i] = s
+		}
+		return list
+	}
+	return val
+}
+
+// answered reports whether a value is an answer, as the notEmpty function of ajf.
+func answered(val interface{}) bool {
+	switch x := val.(type) {
+	case nil:
+		return false
+	case string:
+		return x != ""
+	case []interface{}:
+		return len(x) > 0
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package formats
+
+import (
+	"strings"
+	"text/scanner"
+)
+
+// checkUnits warns about the formulas adding, subtracting or comparing questions
+// with different units. Only the operands consisting of a single reference
+// (or of ".") are considered, as the unit of other expressions is not known.
+// In calculations, the unit of the question itself must match the ones of the operands.
+func (b *nodeBuilder) checkUnits(survey []SurveyRow) {
+	units := make(map[string]string)
+	for _, row := range survey {
+		if row.Unit != "" {
+			units[row.Name] = row.Unit
+		}
+	}
+	if len(units) == 0 {
+		return
+	}
+	for _, row := range survey {
+		formulas := [][2]string{
+			{"relevant", row.Relevant}, {"constraint", row.Constraint}, {"calculation", row.Calculation},
+		}
+		for _, f := range formulas {
+			for _, operands := range unitOperands(f[1], row.Name) {
+				if f[0] == "calculation" && row.Unit != "" {
+					operands = append(operands, row.Name)
+				}
+				var first string
+				var desc []string
+				mismatch := false
+				for _, name := range operands {
+					unit, ok := units[name]
+					if !ok {
+						continue
+					}
+					if first == "" {
+						first = unit
+					} else if unit != first {
+						mismatch = true
+					}
+					desc = append(desc, "${"+name+"} ("+unit+")")
+				}
+				if mismatch {
+					b.warn(row.LineNum, "The %s combines quantities with different units: %s.",
+						f[0], strings.Join(desc, ", "))
+				}
+			}
+		}
+	}
+}
+
+// unitOperands splits the formula into clauses separated by "and" and "or",
+// returning for each clause the names referenced by its operands, the operands being
+// the parts of the clause separated by +, - and comparison operators.
+// "." is returned as fieldName. Operands that are not a single reference are omitted.
+func unitOperands(formula, fieldName string) [][]string {
+	var s scanner.Scanner
+	s.Init(strings.NewReader(formula))
+	s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats | scanner.ScanStrings
+	s.Error = func(*scanner.Scanner, string) {}
+
+	var clauses [][]string
+	var operands []string
+	ref, other := "", false // the reference in the current operand, other tokens
+	endOperand := func() {
+		if ref != "" && !other {
+			operands = append(operands, ref)
+		}
+		ref, other = "", false
+	}
+	endClause := func() {
+		endOperand()
+		if len(operands) > 0 {
+			clauses = append(clauses, operands)
+		}
+		operands = nil
+	}
+	depth := 0
+	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
+		switch {
+		case tok == '(':
+			depth++
+			other = true
+		case tok == ')':
+			depth--
+		case depth > 0:
+			// Part of a parenthesized expression or of function arguments.
+		case tok == '$' && s.Peek() == '{':
+			s.Scan()
+			name := ""
+			if s.Scan() == scanner.Ident {
+				name = s.TokenText()
+			}
+			if s.Scan() != '}' || ref != "" {
+				other = true
+			}
+			ref = name
+		case tok == '.':
+			if ref != "" {
+				other = true
+			}
+			ref = fieldName
+		case tok == '+' || tok == '-' || tok == '=' || tok == '!' || tok == '<' || tok == '>':
+			endOperand()
+		case tok == scanner.Ident && (s.TokenText() == "and" || s.TokenText() == "or"):
+			endClause()
+		default:
+			// Numbers, strings, functions, *, div, mod...
+			other = true
+		}
+	}
+	endClause()
+	return clauses
+}
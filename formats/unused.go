@@ -0,0 +1,147 @@
+package formats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SheetLister is implemented by the workbooks that can list the names of their sheets.
+type SheetLister interface {
+	SheetNames() []string
+}
+
+func (wb *xlsxWorkBook) SheetNames() []string {
+	names := make([]string, len(wb.Sheets))
+	for i, sheet := range wb.Sheets {
+		names[i] = sheet.Name
+	}
+	return names
+}
+
+func (wb *xlsWorkBook) SheetNames() []string {
+	names := make([]string, wb.NumSheets())
+	for i := range names {
+		names[i] = wb.GetSheet(i).Name
+	}
+	return names
+}
+
+func (wb odsWorkBook) SheetNames() []string { return sortedKeys(wb) }
+func (wb csvWorkBook) SheetNames() []string { return sortedKeys(wb) }
+
+func sortedKeys(sheets map[string][][]string) []string {
+	names := make([]string, 0, len(sheets))
+	for name := range sheets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UnusedColumns returns a warning for each column of the survey and settings sheets
+// that is not read by the converter, like a misspelled "relevent" column, which would
+// silently disable the logic of the form. The columns of the choices sheet are all used,
+// the additional ones as choice attributes. If the workbook implements SheetLister,
+// the sheets other than survey, choices and settings are also reported, with line 0.
+func UnusedColumns(wb WorkBook) ([]Warning, error) {
+	var warnings []Warning
+	if lister, ok := wb.(SheetLister); ok {
+		for _, name := range lister.SheetNames() {
+			if !isKnownSheet(name) {
+				warnings = append(warnings, Warning{0, fmt.Sprintf("Sheet %q is not used by the converter.", name)})
+			}
+		}
+	}
+	for i := range sheetInfos {
+		info := &sheetInfos[i]
+		if info.extraColumns {
+			continue
+		}
+		err := streamRows(wb, info.name, func(lineNum int, head []string) error {
+			for _, cell := range head {
+				if cell == "" || cell == messagesColumn || isKnownColumn(info, cell) {
+					continue
+				}
+				msg := fmt.Sprintf("Column %q of sheet %q is not used by the converter.", cell, info.name)
+				if similar := similarColumn(info, cell); similar != "" {
+					msg += fmt.Sprintf(" Did you mean %q?", similar)
+				}
+				warnings = append(warnings, Warning{lineNum, msg})
+			}
+			return errStopRows
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return warnings, nil
+}
+
+func isKnownSheet(name string) bool {
+	for _, info := range sheetInfos {
+		if info.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isKnownColumn reports whether the header is a column of the sheet (or its alias),
+// or one of its translations (like "label::Italian (it)").
+func isKnownColumn(info *sheetInfo, header string) bool {
+	h := normalizeHeader(header)
+	for _, col := range info.columns {
+		for _, name := range []string{col.name, columnAliases[col.name]} {
+			if name != "" && (h == normalizeHeader(name) || strings.HasPrefix(h, normalizeHeader(name)+"::")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// similarColumn returns the column of the sheet whose name is closest to the header,
+// if at most two edits away.
+func similarColumn(info *sheetInfo, header string) string {
+	h := normalizeHeader(header)
+	similar, best := "", 3
+	for _, col := range info.columns {
+		if d := editDistance(h, normalizeHeader(col.name)); d < best {
+			similar, best = col.name, d
+		}
+	}
+	return similar
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,177 @@
+package formats
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NewXlsForm creates an xlsform from rows built programmatically, e.g. by tools
+// importing questions from other sources. Rows without a line number are numbered
+// as if they followed a header row, so that errors and warnings can refer to them.
+// settings can be nil, as the settings sheet is optional.
+func NewXlsForm(survey []SurveyRow, choices []ChoicesRow, settings *SettingsRow) *XlsForm {
+	xls := &XlsForm{
+		Survey:  append([]SurveyRow(nil), survey...),
+		Choices: append([]ChoicesRow(nil), choices...),
+	}
+	for i := range xls.Survey {
+		if xls.Survey[i].LineNum == 0 {
+			xls.Survey[i].LineNum = i + 2
+		}
+	}
+	for i := range xls.Choices {
+		if xls.Choices[i].LineNum == 0 {
+			xls.Choices[i].LineNum = i + 2
+		}
+	}
+	if settings != nil {
+		s := *settings
+		if s.LineNum == 0 {
+			s.LineNum = 2
+		}
+		xls.Settings = []SettingsRow{s}
+	}
+	return xls
+}
+
+// SourceError is a problem found in a cell of the xlsform.
+// Code identifies the kind of problem (see the Code constants),
+// so that tools can localize the message or handle some problems specially.
+type SourceError struct {
+	Sheet   string
+	LineNum int
+	Column  string
+	Code    string
+	Message string
+}
+
+// Codes of the source errors.
+const (
+	CodeInvalidType        = "invalid_type"
+	CodeUnsupportedType    = "unsupported_type"
+	CodeInvalidValue       = "invalid_value"
+	CodeUndefinedChoices   = "undefined_choices"
+	CodeExternalChoices    = "external_choices"
+	CodeUnexpectedEnd      = "unexpected_end"
+	CodeUnclosedGroup      = "unclosed_group"
+	CodeNestedRepeat       = "nested_repeat"
+	CodeMissingName        = "missing_name"
+	CodeDuplicateName      = "duplicate_name"
+	CodeDuplicateChoice    = "duplicate_choice"
+	CodeInvalidFormula     = "invalid_formula"
+	CodeUndefinedReference = "undefined_reference"
+	CodeInvalidDefault     = "invalid_default"
+	CodeInvalidParameters  = "invalid_parameters"
+	CodeUnsafeMarkup       = "unsafe_markup"
+)
+
+func (e SourceError) Error() string { return fmt.Sprintf("line %d: %s", e.LineNum, e.Message) }
+
+// Validate checks the structure of the xlsform and returns the first problem found,
+// see ValidateXls.
+func (xls *XlsForm) Validate() error {
+	if errs := ValidateXls(xls); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// ValidateXls checks the structure of the xlsform: the types of the questions,
+// the presence and uniqueness of the names, the nesting of groups and repeats,
+// and the references to the choice lists. External choices must have been loaded
+// (see LoadExternalChoices). Unlike Convert, it doesn't stop at the first problem,
+// so that all of them can be fixed at once. Formulas and the rules depending
+// on the conversion options are checked only by Convert.
+func ValidateXls(xls *XlsForm) []SourceError {
+	var errs []SourceError
+	lint := NewSurveyLinter(xls.Choices, func(e SourceError) { errs = append(errs, e) })
+	for i := range xls.Survey {
+		lint.Row(&xls.Survey[i])
+	}
+	lint.Finish()
+
+	choices := xls.Choices
+	if allowDups, err := choiceDuplicatesAllowed(xls.Settings); err != nil {
+		errs = append(errs, err.(SourceError))
+	} else if allowDups {
+		choices, _ = dedupeChoices(choices)
+	}
+	lintChoices(choices, func(e SourceError) { errs = append(errs, e) })
+	return errs
+}
+
+// lintChoices reports the choices without list name or name and the duplicate ones.
+func lintChoices(choices []ChoicesRow, report func(SourceError)) {
+	choiceLines := make(map[[2]string]int)
+	for _, c := range choices {
+		if c.ListName == "" || c.Name == "" {
+			column := "list name"
+			if c.ListName != "" {
+				column = "name"
+			}
+			report(SourceError{"choices", c.LineNum, column, CodeMissingName,
+				"Choices must have a list name and a name."})
+		} else if err := checkChoiceName(c, choiceLines); err != nil {
+			report(err.(SourceError))
+		}
+	}
+}
+
+// SurveyLinter checks the rows of the survey sheet one at a time, reporting the same problems
+// as ValidateXls. It allows validating huge surveys while they are read, without holding them
+// in memory: only the names of the questions and the open groups are kept.
+type SurveyLinter struct {
+	report func(SourceError)
+	lists  map[string]bool
+	stack  []SurveyRow    // open groups and repeats
+	names  map[string]int // line of the first question with each name
+}
+
+// NewSurveyLinter creates a linter checking the select questions against the lists in choices.
+// report is called for each problem found.
+func NewSurveyLinter(choices []ChoicesRow, report func(SourceError)) *SurveyLinter {
+	l := &SurveyLinter{report: report, lists: make(map[string]bool), names: make(map[string]int)}
+	for _, c := range choices {
+		l.lists[c.ListName] = true
+	}
+	return l
+}
+
+func (l *SurveyLinter) errorf(lineNum int, column, code, format string, a ...interface{}) {
+	l.report(SourceError{"survey", lineNum, column, code, fmt.Sprintf(format, a...)})
+}
+
+// Row checks the next row of the survey.
+func (l *SurveyLinter) Row(row *SurveyRow) {
+	switch {
+	case row.Type == "":
+		l.errorf(row.LineNum, "type", CodeInvalidType, "Empty type in non-empty survey row.")
+	case row.Type == beginGroup || row.Type == beginRepeat:
+		l.stack = append(l.stack, *row)
+	case row.Type == endGroup || row.Type == endRepeat:
+		if len(l.stack) == 0 || l.stack[len(l.stack)-1].Type[len("begin"):] != row.Type[len("end"):] {
+			l.errorf(row.LineNum, "type", CodeUnexpectedEnd, "Unexpected end of group/repeat.")
+		} else {
+			l.stack = l.stack[0 : len(l.stack)-1]
+		}
+		return
+	case !isSupportedField(row.Type) && !isUnsupportedField(row.Type):
+		l.errorf(row.LineNum, "type", CodeInvalidType, "Invalid type %q in survey.", row.Type)
+	case isSelectOne(row.Type) || isSelectMultiple(row.Type):
+		if c := strings.TrimSuffix(choiceName(row.Type), orOther); !isRepeatChoice(c) && !l.lists[c] {
+			l.errorf(row.LineNum, "type", CodeUndefinedChoices,
+				"Undefined single or multiple choice %q.", c)
+		}
+	}
+	if err := checkName(row, l.names); err != nil {
+		l.report(err.(SourceError))
+	}
+}
+
+// Finish reports the groups and repeats left open. It must be called after the last row.
+func (l *SurveyLinter) Finish() {
+	for _, row := range l.stack {
+		l.errorf(row.LineNum, "type", CodeUnclosedGroup, "Unclosed group/repeat.")
+	}
+	l.stack = nil
+}
@@ -0,0 +1,76 @@
+package formats
+
+import (
+	"runtime/debug"
+	"sort"
+)
+
+// version can be set at build time with:
+// go build -ldflags "-X github.com/gnucoop/formconv/formats.version=v1.2.3"
+var version string
+
+// Version returns the version of the converter. If it wasn't set at build time,
+// it is taken from the module and vcs information embedded in the binary.
+func Version() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := "devel"
+	for _, dep := range append([]*debug.Module{&info.Main}, info.Deps...) {
+		if dep.Path == "github.com/gnucoop/formconv" && dep.Version != "" && dep.Version != "(devel)" {
+			v = dep.Version
+		}
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			v += " (" + setting.Value + ")"
+		}
+	}
+	return v
+}
+
+// Capabilities describes what the converter supports, so that clients
+// (like form builders) can adapt to the deployed version.
+type Capabilities struct {
+	Version string              `json:"version"`
+	Types   []string            `json:"types"`   // question types
+	Columns map[string][]string `json:"columns"` // the columns of each sheet
+}
+
+// GetCapabilities returns the capabilities of the converter. Types are sorted,
+// columns are in the order of the sheets.
+func GetCapabilities() Capabilities {
+	c := Capabilities{Version: Version(), Columns: make(map[string][]string)}
+	for typ := range supportedField {
+		c.Types = append(c.Types, typ)
+	}
+	c.Types = append(c.Types, "select_one", "select_multiple", "rank", beginGroup, beginRepeat)
+	sort.Strings(c.Types)
+	for _, sheet := range sheetInfos {
+		for _, col := range sheet.columns {
+			c.Columns[sheet.name] = append(c.Columns[sheet.name], col.name)
+		}
+	}
+	return c
+}
+
+// Features returns the list of features supported by the converter,
+// in the form "type:<question type>" and "column:<sheet>/<column>".
+func Features() []string {
+	c := GetCapabilities()
+	var features []string
+	for _, typ := range c.Types {
+		features = append(features, "type:"+typ)
+	}
+	for sheet, cols := range c.Columns {
+		for _, col := range cols {
+			features = append(features, "column:"+sheet+"/"+col)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
@@ -0,0 +1,198 @@
+package formats
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Difference is a change between two versions of an xlsform, as found by DiffXlsForms.
+type Difference struct {
+	Sheet string
+	// Key identifies the row: the name of the question (its type for rows without a name,
+	// like "end group"), "list/name" for choices. Repeated keys get a "#n" suffix.
+	Key  string
+	Kind DiffKind
+	// Column, Old and New describe the change of a cell, for differences of kind DiffChanged.
+	Column   string
+	Old, New string
+	// LineNum is the line of the row in the new form, or in the old one for removed rows.
+	LineNum int
+}
+
+type DiffKind int
+
+const (
+	DiffAdded   DiffKind = iota // the row was added
+	DiffRemoved                 // the row was removed
+	DiffMoved                   // the row changed position with respect to the other rows
+	DiffChanged                 // the content of a cell changed
+)
+
+func (d Difference) String() string {
+	switch d.Kind {
+	case DiffAdded:
+		return fmt.Sprintf("%s: added %q (line %d)", d.Sheet, d.Key, d.LineNum)
+	case DiffRemoved:
+		return fmt.Sprintf("%s: removed %q (line %d of the old form)", d.Sheet, d.Key, d.LineNum)
+	case DiffMoved:
+		return fmt.Sprintf("%s: moved %q (line %d)", d.Sheet, d.Key, d.LineNum)
+	default:
+		return fmt.Sprintf("%s: %q, %s changed from %q to %q (line %d)",
+			d.Sheet, d.Key, d.Column, d.Old, d.New, d.LineNum)
+	}
+}
+
+// DiffXlsForms compares two versions of an xlsform row by row, matching the rows
+// by key (see Difference) rather than by position. Since the forms are compared
+// after decoding, formatting, column order and empty rows are not relevant.
+// Translation columns are not compared.
+func DiffXlsForms(oldForm, newForm *XlsForm) []Difference {
+	var diffs []Difference
+	oldVal, newVal := reflect.ValueOf(oldForm).Elem(), reflect.ValueOf(newForm).Elem()
+	for s := range sheetInfos {
+		a, b := diffRows(s, oldVal.Field(s)), diffRows(s, newVal.Field(s))
+		diffs = append(diffs, diffSheet(sheetInfos[s], a, b)...)
+	}
+	return diffs
+}
+
+type diffRow struct {
+	key     string
+	lineNum int
+	cells   map[string]string // by column name
+}
+
+func diffRows(s int, rows reflect.Value) []diffRow {
+	info := sheetInfos[s]
+	seen := make(map[string]int)
+	out := make([]diffRow, rows.Len())
+	for i := range out {
+		row := rows.Index(i)
+		cells := make(map[string]string)
+		for j, col := range info.columns {
+			cells[col.name] = row.Field(j).String()
+		}
+		if info.extraColumns {
+			for attr, val := range row.FieldByName("Attributes").Interface().(map[string]string) {
+				cells[attr] = val
+			}
+		}
+		var key string
+		switch {
+		case info.name == "choices":
+			key = cells["list name"] + "/" + cells["name"]
+		case info.name == "survey" && cells["name"] != "":
+			key = cells["name"]
+		case info.name == "survey":
+			key = cells["type"]
+		default:
+			key = info.name
+		}
+		seen[key]++
+		if seen[key] > 1 {
+			key += fmt.Sprintf("#%d", seen[key])
+		}
+		out[i] = diffRow{key, int(row.FieldByName("LineNum").Int()), cells}
+	}
+	return out
+}
+
+func diffSheet(info sheetInfo, a, b []diffRow) []Difference {
+	var diffs []Difference
+	inA, inB := make(map[string]*diffRow), make(map[string]*diffRow)
+	for i := range a {
+		inA[a[i].key] = &a[i]
+	}
+	for i := range b {
+		inB[b[i].key] = &b[i]
+	}
+	var seqA, seqB []string // keys in both forms, in their respective order
+	for _, row := range a {
+		if inB[row.key] == nil {
+			diffs = append(diffs, Difference{Sheet: info.name, Key: row.key, Kind: DiffRemoved, LineNum: row.lineNum})
+		} else {
+			seqA = append(seqA, row.key)
+		}
+	}
+	for _, row := range b {
+		if inA[row.key] != nil {
+			seqB = append(seqB, row.key)
+		}
+	}
+	unmoved := longestCommonSubsequence(seqA, seqB)
+	for _, row := range b {
+		oldRow := inA[row.key]
+		if oldRow == nil {
+			diffs = append(diffs, Difference{Sheet: info.name, Key: row.key, Kind: DiffAdded, LineNum: row.lineNum})
+			continue
+		}
+		if !unmoved[row.key] {
+			diffs = append(diffs, Difference{Sheet: info.name, Key: row.key, Kind: DiffMoved, LineNum: row.lineNum})
+		}
+		for _, col := range diffColumns(info, oldRow.cells, row.cells) {
+			if oldRow.cells[col] != row.cells[col] {
+				diffs = append(diffs, Difference{Sheet: info.name, Key: row.key, Kind: DiffChanged,
+					Column: col, Old: oldRow.cells[col], New: row.cells[col], LineNum: row.lineNum})
+			}
+		}
+	}
+	return diffs
+}
+
+// diffColumns returns the columns of the sheet followed by the attributes
+// of the two rows, sorted by name.
+func diffColumns(info sheetInfo, a, b map[string]string) []string {
+	var cols []string
+	known := make(map[string]bool)
+	for _, col := range info.columns {
+		cols = append(cols, col.name)
+		known[col.name] = true
+	}
+	var attrs []string
+	for _, cells := range []map[string]string{a, b} {
+		for col := range cells {
+			if !known[col] {
+				attrs = append(attrs, col)
+				known[col] = true
+			}
+		}
+	}
+	sort.Strings(attrs)
+	return append(cols, attrs...)
+}
+
+// longestCommonSubsequence returns the set of keys in a longest common subsequence
+// of a and b, which contain the same keys, without repetitions. For such sequences
+// it is the longest increasing subsequence of the positions in b of the keys of a,
+// found in O(n log n) time and linear space.
+func longestCommonSubsequence(a, b []string) map[string]bool {
+	posB := make(map[string]int, len(b))
+	for j, key := range b {
+		posB[key] = j
+	}
+	// tails[k] is the index in a of the smallest tail of the increasing subsequences
+	// of length k+1 found so far; prev links each element to its predecessor.
+	var tails []int
+	prev := make([]int, len(a))
+	for i, key := range a {
+		pos := posB[key]
+		k := sort.Search(len(tails), func(k int) bool { return posB[a[tails[k]]] >= pos })
+		prev[i] = -1
+		if k > 0 {
+			prev[i] = tails[k-1]
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+	keys := make(map[string]bool, len(tails))
+	if len(tails) > 0 {
+		for i := tails[len(tails)-1]; i >= 0; i = prev[i] {
+			keys[a[i]] = true
+		}
+	}
+	return keys
+}
@@ -1,30 +1,52 @@
 package formats
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"unicode"
 
 	"github.com/extrame/xls"
 	"github.com/tealeg/xlsx"
 )
 
 type XlsForm struct {
-	Survey  []SurveyRow
-	Choices []ChoicesRow
+	Survey   []SurveyRow
+	Choices  []ChoicesRow
+	Settings []SettingsRow // at most one row is meaningful
 }
 type SurveyRow struct {
 	Type, Name, Label,
-	Relevant, Constraint, ConstraintMessage, Calculation, Required, RepeatCount string
+	Relevant, Constraint, ConstraintMessage, Calculation, Required, RepeatCount,
+	LabelContinued, Hint, Parameters, ChoiceFilter, Appearance, Default, ReadOnly, Disabled, Unit, Sensitive string
 	LineNum int
 }
 type ChoicesRow struct {
 	ListName, Name, Label string
+	Image, Audio          string // media files shown with the choice
 	LineNum               int
+	// Attributes contains the values of the additional columns of the choices sheet,
+	// like the ones used in choice filters.
+	Attributes map[string]string
+	// File is the name of the external file the choice was read from (see LoadExternalChoices),
+	// empty for the choices sheet.
+	File string
 }
+type SettingsRow struct {
+	FormTitle, FormId, Version, DefaultLanguage, Style string
+	// AllowChoiceDuplicates, as in pyxform, allows lists containing the same choice
+	// more than once: only the first occurrence is kept, with a warning.
+	AllowChoiceDuplicates string
+	LineNum               int
+}
+
+// FullLabel returns the label of the row,
+// including its continuation when the label is split across two cells.
+func (row *SurveyRow) FullLabel() string { return row.Label + row.LabelContinued }
 
 // Defines which sheets/columns to read from an excel file.
 // Names must appear in the same order as the fields of XlsForm.
@@ -42,22 +64,55 @@ var sheetInfos = []sheetInfo{
 			{name: "calculation"},
 			{name: "required"},
 			{name: "repeat_count"},
+			{name: "label_continued"},
+			{name: "hint"},
+			{name: "parameters"},
+			{name: "choice_filter"},
+			{name: "appearance"},
+			{name: "default"},
+			{name: "read_only"},
+			{name: "disabled"},
+			{name: "unit"},
+			{name: "sensitive"},
 		},
 	}, {
-		name:      "choices",
-		mandatory: true,
+		name:         "choices",
+		mandatory:    true,
+		extraColumns: true,
 		columns: []columnInfo{
 			{name: "list name", mandatory: true},
 			{name: "name", mandatory: true},
 			{name: "label", mandatory: true},
+			{name: "media::image"},
+			{name: "media::audio"},
+		},
+	}, {
+		name: "settings",
+		columns: []columnInfo{
+			{name: "form_title"},
+			{name: "form_id"},
+			{name: "version"},
+			{name: "default_language"},
+			{name: "style"},
+			{name: "allow_choice_duplicates"},
 		},
 	},
 }
 
+// columnAliases are the alternative names of some columns.
+var columnAliases = map[string]string{
+	// According to the docs, the column should be called "list name",
+	// but it appears as "list_name" in files generated by the Kobo Toolbox.
+	"list name": "list_name",
+}
+
 type sheetInfo struct {
 	name      string
 	mandatory bool
 	columns   []columnInfo
+	// If extraColumns is true, the columns not listed in columns are read
+	// into the Attributes map of the row.
+	extraColumns bool
 }
 type columnInfo struct {
 	name      string
@@ -70,10 +125,33 @@ type File interface {
 	io.Seeker
 }
 
+// DecodeOptions control the decoding of xlsforms by DecXlsformWithOptions.
+type DecodeOptions struct {
+	// StrictHeaders requires the column headers to match exactly, instead of ignoring case,
+	// surrounding whitespace and the difference between spaces and underscores.
+	StrictHeaders bool
+}
+
+// DecXlsform decodes the xlsform in the workbook, with the default DecodeOptions.
 func DecXlsform(wb WorkBook) (*XlsForm, error) {
+	return DecXlsformWithOptions(wb, DecodeOptions{})
+}
+
+// DecXlsformWithOptions decodes the xlsform in the workbook.
+func DecXlsformWithOptions(wb WorkBook, opts DecodeOptions) (*XlsForm, error) {
 	var form XlsForm
 	formVal := reflect.ValueOf(&form).Elem()
 	for s, sheetInfo := range sheetInfos {
+		if rs, ok := wb.(RowStreamer); ok {
+			found, err := streamSheet(rs, &sheetInfo, formVal.Field(s), opts.StrictHeaders)
+			if err != nil {
+				return nil, err
+			}
+			if !found && sheetInfo.mandatory {
+				return nil, fmt.Errorf("Missing mandatory sheet %q.", sheetInfo.name)
+			}
+			continue
+		}
 		rows := wb.Rows(sheetInfo.name)
 		if rows == nil && sheetInfo.mandatory {
 			return nil, fmt.Errorf("Missing mandatory sheet %q.", sheetInfo.name)
@@ -81,40 +159,125 @@ func DecXlsform(wb WorkBook) (*XlsForm, error) {
 		if rows == nil {
 			continue // not mandatory, skip
 		}
-		headIndex := firstNonempty(rows)
-		if headIndex == -1 {
-			return nil, fmt.Errorf("Empty sheet %q.", sheetInfo.name)
-		}
-		head := rows[headIndex]
-		colIndices := make([]int, len(sheetInfo.columns))
-		for j, colInfo := range sheetInfo.columns {
-			colIndices[j] = columnIndex(head, colInfo.name)
-			if colInfo.name == "list name" && colIndices[j] == -1 {
-				// According to the docs, the column should be called "list name",
-				// but it appears as "list_name" in files generated by the Kobo Toolbox.
-				colIndices[j] = columnIndex(head, "list_name")
-			}
-			if colIndices[j] == -1 && colInfo.mandatory {
-				return nil, fmt.Errorf("Column %q in sheet %q is mandatory.", colInfo.name, sheetInfo.name)
-			}
+		if err := decSheet(rows, &sheetInfo, formVal.Field(s), opts.StrictHeaders); err != nil {
+			return nil, err
 		}
-		destSlice := formVal.Field(s)
-		for i := headIndex + 1; i < len(rows); i++ {
-			row := rows[i]
-			if isEmpty(row) {
-				continue
-			}
-			destRow := reflect.New(destSlice.Type().Elem()).Elem()
-			destRow.FieldByName("LineNum").Set(reflect.ValueOf(i + 1))
-			for j := range sheetInfo.columns {
-				if colIndices[j] != -1 {
-					destRow.Field(j).Set(reflect.ValueOf(row[colIndices[j]]))
-				}
+	}
+	return &form, nil
+}
+
+// decSheet decodes the rows of a sheet, appending them to destSlice.
+// If strict, the headers must match the names of the columns exactly.
+func decSheet(rows [][]string, info *sheetInfo, destSlice reflect.Value, strict bool) error {
+	headIndex := firstNonempty(rows)
+	if headIndex == -1 {
+		return fmt.Errorf("Empty sheet %q.", info.name)
+	}
+	head := rows[headIndex]
+	colIndices, extraIndices, err := sheetColumns(info, head, strict)
+	if err != nil {
+		return err
+	}
+	for i := headIndex + 1; i < len(rows); i++ {
+		row := rows[i]
+		if isEmpty(row) {
+			continue
+		}
+		destRow := reflect.New(destSlice.Type().Elem()).Elem()
+		decRow(destRow, head, row, colIndices, extraIndices, i+1)
+		destSlice.Set(reflect.Append(destSlice, destRow))
+	}
+	return nil
+}
+
+// streamSheet is like decSheet, but reads the rows one at a time from rs.
+// found is false if the sheet doesn't exist.
+func streamSheet(rs RowStreamer, info *sheetInfo, destSlice reflect.Value, strict bool) (found bool, err error) {
+	var head []string
+	var colIndices, extraIndices []int
+	found, err = rs.StreamRows(info.name, func(lineNum int, row []string) error {
+		if head == nil {
+			head = append([]string(nil), row...)
+			var err error
+			colIndices, extraIndices, err = sheetColumns(info, head, strict)
+			return err
+		}
+		if len(row) < len(head) {
+			row = append(row, make([]string, len(head)-len(row))...)
+		}
+		destRow := reflect.New(destSlice.Type().Elem()).Elem()
+		decRow(destRow, head, row, colIndices, extraIndices, lineNum)
+		destSlice.Set(reflect.Append(destSlice, destRow))
+		return nil
+	})
+	if err != nil || !found {
+		return found, err
+	}
+	if head == nil {
+		return true, fmt.Errorf("Empty sheet %q.", info.name)
+	}
+	return true, nil
+}
+
+// sheetColumns returns the indices in head of the columns of the sheet (-1 for the missing ones)
+// and the indices of its extra columns. If strict, the headers must match the names exactly.
+func sheetColumns(info *sheetInfo, head []string, strict bool) (colIndices, extraIndices []int, err error) {
+	index := columnIndex
+	if strict {
+		index = strictColumnIndex
+	}
+	colIndices = make([]int, len(info.columns))
+	for j, colInfo := range info.columns {
+		colIndices[j] = index(head, colInfo.name)
+		if alias, ok := columnAliases[colInfo.name]; ok && colIndices[j] == -1 {
+			colIndices[j] = index(head, alias)
+		}
+		if colIndices[j] == -1 && colInfo.mandatory {
+			return nil, nil, fmt.Errorf("Column %q in sheet %q is mandatory.", colInfo.name, info.name)
+		}
+	}
+	if info.extraColumns {
+		extraIndices = extraColumns(head, colIndices)
+	}
+	return colIndices, extraIndices, nil
+}
+
+// decRow decodes a row into destRow, a SurveyRow, ChoicesRow or SettingsRow value,
+// given the indices returned by sheetColumns.
+func decRow(destRow reflect.Value, head, row []string, colIndices, extraIndices []int, lineNum int) {
+	destRow.FieldByName("LineNum").Set(reflect.ValueOf(lineNum))
+	for j, col := range colIndices {
+		if col != -1 {
+			destRow.Field(j).Set(reflect.ValueOf(row[col]))
+		}
+	}
+	if len(extraIndices) > 0 {
+		attrs := make(map[string]string)
+		for _, j := range extraIndices {
+			if row[j] != "" {
+				attrs[head[j]] = row[j]
 			}
-			destSlice.Set(reflect.Append(destSlice, destRow))
+		}
+		if len(attrs) > 0 {
+			destRow.FieldByName("Attributes").Set(reflect.ValueOf(attrs))
 		}
 	}
-	return &form, nil
+}
+
+// extraColumns returns the indices of the columns of head that are not in used.
+// Empty columns and translation columns (like "label::Italian (it)") are ignored.
+func extraColumns(head []string, used []int) []int {
+	isUsed := make(map[int]bool)
+	for _, j := range used {
+		isUsed[j] = true
+	}
+	var extra []int
+	for j, cell := range head {
+		if cell != "" && !isUsed[j] && !strings.Contains(cell, "::") {
+			extra = append(extra, j)
+		}
+	}
+	return extra
 }
 
 func DecXlsFromFile(fileName string) (*XlsForm, error) {
@@ -128,7 +291,29 @@ func DecXlsFromFile(fileName string) (*XlsForm, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't get file stat: %s", err)
 	}
-	wb, err := NewWorkBook(f, filepath.Ext(fileName), stat.Size())
+	xls, err := DecXlsFromReader(f, stat.Size(), filepath.Ext(fileName))
+	if err != nil {
+		return nil, err
+	}
+	err = LoadExternalChoices(xls, filepath.Dir(fileName))
+	if err != nil {
+		return nil, err
+	}
+	return xls, nil
+}
+
+// DecXlsFromReader decodes an xlsform of the given size from r, e.g. an uploaded file.
+// ext is the extension of the file (".xls", ".xlsx" or ".ods") and determines its format.
+// External choices are not loaded, as there is no directory to read them from
+// (see LoadExternalChoices). xlsx files are read with NewStreamingWorkBook.
+func DecXlsFromReader(r io.ReaderAt, size int64, ext string) (*XlsForm, error) {
+	var wb WorkBook
+	var err error
+	if ext == ".xlsx" {
+		wb, err = NewStreamingWorkBook(r, size)
+	} else {
+		wb, err = NewWorkBook(io.NewSectionReader(r, 0, size), ext, size)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -197,10 +382,16 @@ func (wb *xlsWorkBook) Rows(sheetName string) [][]string {
 func NewWorkBook(f File, ext string, size int64) (WorkBook, error) {
 	switch ext {
 	case ".xls":
+		if err := checkOleHeader(f, size); err != nil {
+			return nil, err
+		}
 		wb, err := xls.OpenReader(f, "utf-8")
 		if err != nil {
 			return nil, err
 		}
+		if wb == nil {
+			return nil, fmt.Errorf("Invalid xls file, workbook stream not found.")
+		}
 		return &xlsWorkBook{*wb}, nil
 	case ".xlsx":
 		wb, err := xlsx.OpenReaderAt(f, size)
@@ -208,11 +399,48 @@ func NewWorkBook(f File, ext string, size int64) (WorkBook, error) {
 			return nil, err
 		}
 		return &xlsxWorkBook{*wb}, nil
+	case ".ods":
+		wb, err := readOds(f, size)
+		if err != nil {
+			return nil, err
+		}
+		return wb, nil
 	default:
 		return nil, fmt.Errorf("Unsupported excel file type %s.", ext)
 	}
 }
 
+// checkOleHeader checks that the sector counts in the header of an xls file
+// are consistent with its size, as the xls decoder allocates and reads sectors
+// according to them, and a corrupted header would make it exhaust the memory.
+func checkOleHeader(f io.ReaderAt, size int64) error {
+	header := make([]byte, 512)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("Invalid xls file: %s", err)
+	}
+	sectors := uint64(size / 512)
+	for _, off := range []int{0x2C, 0x40, 0x48} { // FAT, short FAT and MSAT sector counts
+		if uint64(binary.LittleEndian.Uint32(header[off:])) > sectors {
+			return fmt.Errorf("Invalid xls file, corrupted header.")
+		}
+	}
+	// The chain of the MSAT sectors, which the decoder follows until its end.
+	const endOfChain = 0xFFFFFFFE
+	sid := binary.LittleEndian.Uint32(header[0x44:])
+	next := make([]byte, 4)
+	for n := binary.LittleEndian.Uint32(header[0x48:]); sid != endOfChain; n-- {
+		if n == 0 || uint64(sid)+1 >= sectors {
+			return fmt.Errorf("Invalid xls file, corrupted header.")
+		}
+		// The next sector id is at the end of the sector.
+		if _, err := f.ReadAt(next, int64(sid+2)*512-4); err != nil {
+			return fmt.Errorf("Invalid xls file: %s", err)
+		}
+		sid = binary.LittleEndian.Uint32(next)
+	}
+	return nil
+}
+
 func isEmpty(row []string) bool {
 	for _, cell := range row {
 		if cell != "" {
@@ -231,28 +459,58 @@ func firstNonempty(rows [][]string) int {
 	return -1
 }
 
-func columnIndex(row []string, name string) int {
+// columnIndex returns the index of the column called name in the header row, or -1.
+// Headers are compared with sameHeader. The English version of the column
+// (like "label::English (en)") is also accepted.
+func columnIndex(row []string, name string) int { return findColumn(row, name, sameHeader) }
+
+// strictColumnIndex is like columnIndex, but the headers must match exactly.
+func strictColumnIndex(row []string, name string) int {
+	return findColumn(row, name, func(header, name string) bool { return header == name })
+}
+
+func findColumn(row []string, name string, match func(header, name string) bool) int {
 	for i, cell := range row {
-		if cell == name {
+		if match(cell, name) {
 			return i
 		}
 	}
 	name = name + "::English (en)"
 	for i, cell := range row {
-		if cell == name {
+		if match(cell, name) {
 			return i
 		}
 	}
 	return -1
 }
 
+// sameHeader reports whether header matches the column name, ignoring case,
+// surrounding whitespace and the difference between spaces and underscores:
+// "List Name " matches "list_name". The part after "::" (like the language of translation columns)
+// is compared ignoring case and surrounding whitespace.
+func sameHeader(header, name string) bool { return normalizeHeader(header) == normalizeHeader(name) }
+
+func normalizeHeader(h string) string {
+	col, lang := h, ""
+	if i := strings.Index(h, "::"); i != -1 {
+		col, lang = h[:i], "::"+strings.ToLower(strings.TrimSpace(h[i+2:]))
+	}
+	words := strings.FieldsFunc(strings.ToLower(col), func(r rune) bool { return r == '_' || unicode.IsSpace(r) })
+	return strings.Join(words, "_") + lang
+}
+
 func ListLanguages(rows [][]string) map[string]bool {
 	headIndex := firstNonempty(rows)
 	if headIndex == -1 {
 		return nil
 	}
+	return headLanguages(rows[headIndex])
+}
+
+// headLanguages returns the languages of the translation columns of the header row.
+func headLanguages(head []string) map[string]bool {
 	langs := make(map[string]bool)
-	for _, cell := range rows[headIndex] {
+	for _, cell := range head {
 		_, lang := splitLang(cell)
 		if lang != "en" {
 			langs[lang] = true
@@ -284,38 +542,208 @@ func Translation(rows [][]string, targetLang string) map[string]string {
 	if headIndex == -1 {
 		return nil
 	}
-	head := rows[headIndex]
 	translation := make(map[string]string)
+	columns := translationColumns(rows[headIndex], targetLang, false)
+	for _, row := range rows[headIndex+1:] {
+		translateRow(translation, row, columns)
+	}
+	return translation
+}
+
+// translationColumns returns the pairs of indices in head of the columns in English
+// and of their translations into lang. If strict, the headers must match exactly.
+func translationColumns(head []string, lang string, strict bool) [][2]int {
+	var columns [][2]int
 	for en, cell := range head {
 		name, sourceLang := splitLang(cell)
 		if name == "" || sourceLang != "en" {
 			continue
 		}
-		tr := translationIndex(head, name, targetLang)
-		if tr == -1 {
+		if tr := translationIndex(head, name, lang, strict); tr != -1 {
+			columns = append(columns, [2]int{en, tr})
+		}
+	}
+	return columns
+}
+
+// translateRow adds the translations of the cells of the row to translation.
+// Rows may be shorter than the header.
+func translateRow(translation map[string]string, row []string, columns [][2]int) {
+	for _, c := range columns {
+		if c[0] >= len(row) || row[c[0]] == "" {
 			continue
 		}
-		for j := headIndex + 1; j < len(rows); j++ {
-			row := rows[j]
-			if row[en] != "" {
-				translation[row[en]] = row[tr]
-			}
+		tr := ""
+		if c[1] < len(row) {
+			tr = row[c[1]]
 		}
+		translation[row[c[0]]] = tr
 	}
-	return translation
 }
 
-func translationIndex(head []string, name, lang string) int {
-	prefix := name + "::"
+// cellAt returns the cell of the row at index i, empty if the row is shorter or i is -1.
+func cellAt(row []string, i int) string {
+	if i < 0 || i >= len(row) {
+		return ""
+	}
+	return row[i]
+}
+
+// translationIndex returns the index of the column translating the column called name
+// into lang, or -1. If strict, the headers must match exactly.
+func translationIndex(head []string, name, lang string, strict bool) int {
 	suffix := "(" + lang + ")"
 	for i, cell := range head {
-		if strings.HasPrefix(cell, prefix) && strings.HasSuffix(cell, suffix) {
+		j := strings.Index(cell, "::")
+		if j == -1 {
+			continue
+		}
+		if strict {
+			if cell[:j] == name && strings.HasSuffix(cell, suffix) {
+				return i
+			}
+		} else if sameHeader(cell[:j], name) &&
+			strings.HasSuffix(strings.ToLower(strings.TrimSpace(cell)), strings.ToLower(suffix)) {
 			return i
 		}
 	}
 	return -1
 }
 
+// sheetTranslations reads the translations of the sheet into the languages returned by langs,
+// which is called with the header row. rowFn, if not nil, is called for each following row.
+// The sheet is streamed if the workbook implements RowStreamer.
+func sheetTranslations(wb WorkBook, sheetName string, strict bool,
+	langs func(head []string) []string, rowFn func(row []string)) (map[string]map[string]string, error) {
+
+	translations := make(map[string]map[string]string)
+	columns := make(map[string][][2]int)
+	head := true
+	err := streamRows(wb, sheetName, func(lineNum int, row []string) error {
+		if head {
+			head = false
+			for _, lang := range langs(row) {
+				translations[lang] = make(map[string]string)
+				columns[lang] = translationColumns(row, lang, strict)
+			}
+			return nil
+		}
+		for lang, tr := range translations {
+			translateRow(tr, row, columns[lang])
+		}
+		if rowFn != nil {
+			rowFn(row)
+		}
+		return nil
+	})
+	return translations, err
+}
+
+// Translations returns the translations of the survey and choices sheets
+// of the workbook, indexed by language. Only opts.Languages are considered, if specified.
+func Translations(wb WorkBook, opts ConvertOptions) (map[string]map[string]string, error) {
+	return TranslationsWithOptions(wb, opts, DecodeOptions{})
+}
+
+// TranslationsWithOptions is like Translations, matching the headers as specified by decOpts.
+func TranslationsWithOptions(wb WorkBook, opts ConvertOptions, decOpts DecodeOptions) (map[string]map[string]string, error) {
+	var langs []string
+	var labels []string // for the truncated labels
+	labelIndex, contIndex, typeIndex := -1, -1, -1
+	// The converter emits the label and its continuation as a single text, whose translation
+	// is made of the translations of the two cells.
+	contColumns := make(map[string][2]int)          // language -> translations of label and label_continued
+	continued := make(map[string]map[string]string) // language -> full label -> translation
+	hasOrOther := false
+	surveyTrs, err := sheetTranslations(wb, "survey", decOpts.StrictHeaders, func(head []string) []string {
+		all := headLanguages(head)
+		for lang := range all {
+			if len(opts.Languages) == 0 {
+				langs = append(langs, lang)
+			}
+		}
+		for _, lang := range opts.Languages {
+			if all[lang] {
+				langs = append(langs, lang)
+			}
+		}
+		labelIndex, contIndex, typeIndex = columnIndex(head, "label"), columnIndex(head, "label_continued"),
+			columnIndex(head, "type")
+		for _, lang := range langs {
+			contColumns[lang] = [2]int{translationIndex(head, "label", lang, decOpts.StrictHeaders),
+				translationIndex(head, "label_continued", lang, decOpts.StrictHeaders)}
+			continued[lang] = make(map[string]string)
+		}
+		return langs
+	}, func(row []string) {
+		label := cellAt(row, labelIndex)
+		if cont := cellAt(row, contIndex); cont != "" {
+			for lang, cols := range contColumns {
+				continued[lang][label+cont] = cellAt(row, cols[0]) + cellAt(row, cols[1])
+			}
+			label += cont
+		}
+		if label != "" && opts.TruncateLabels > 0 {
+			labels = append(labels, label)
+		}
+		if typeIndex != -1 && typeIndex < len(row) && strings.HasSuffix(strings.TrimSpace(row[typeIndex]), orOther) {
+			hasOrOther = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for lang, tr := range continued {
+		for label, labelTr := range tr {
+			surveyTrs[lang][label] = labelTr
+		}
+	}
+	choicesTrs, err := sheetTranslations(wb, "choices", decOpts.StrictHeaders,
+		func([]string) []string { return langs }, nil)
+	if err != nil {
+		return nil, err
+	}
+	ambiguous := ambiguousShortLabels(labels, opts.TruncateLabels)
+	translations := make(map[string]map[string]string)
+	for lang, surveyTr := range surveyTrs {
+		translations[lang] = MergeMaps(surveyTr, choicesTrs[lang])
+		if hasOrOther {
+			// The labels added for or_other questions appear untranslated, ready to be translated,
+			// unless the choices sheet translates them.
+			for _, label := range []string{otherLabel, specifyOtherLabel} {
+				if _, ok := translations[lang][label]; !ok {
+					translations[lang][label] = label
+				}
+			}
+		}
+		if opts.Notes != NoteHtml {
+			// The html of the notes is translated too.
+			for text, tr := range surveyTr {
+				if note := renderNote(text, opts.Notes); note != text {
+					translations[lang][note] = renderNote(tr, opts.Notes)
+				}
+			}
+		}
+		// Truncated labels are translated too, except those not truncated by the converter
+		// as their short version is shared by different labels.
+		for text, tr := range surveyTr {
+			if short, ok := shortenLabel(text, opts.TruncateLabels); ok && !ambiguous[short] {
+				shortTr, _ := shortenLabel(tr, opts.TruncateLabels)
+				translations[lang][short] = shortTr
+				if opts.MarkdownLabels {
+					translations[lang][markdownToHtml(short)] = markdownToHtml(shortTr)
+				}
+			}
+			if opts.MarkdownLabels {
+				if label := markdownToHtml(text); label != text {
+					translations[lang][label] = markdownToHtml(tr)
+				}
+			}
+		}
+	}
+	return translations, nil
+}
+
 func MergeMaps(a, b map[string]string) map[string]string {
 	res := make(map[string]string)
 	for k, v := range a {
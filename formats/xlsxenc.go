@@ -0,0 +1,112 @@
+package formats
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/tealeg/xlsx"
+)
+
+// EncXlsx writes the xlsform as an xlsx workbook. Optional columns are written
+// only if they are used by at least one row, attributes of choices are written
+// as additional columns of the choices sheet.
+func EncXlsx(w io.Writer, xls *XlsForm) error {
+	f, err := newXlsxFile(xls)
+	if err != nil {
+		return err
+	}
+	return f.Write(w)
+}
+
+func EncXlsxToFile(fileName string, xls *XlsForm) (err error) {
+	f, err := newXlsxFile(xls)
+	if err != nil {
+		return err
+	}
+	err = f.Save(fileName)
+	if err != nil {
+		os.Remove(fileName)
+	}
+	return err
+}
+
+func newXlsxFile(xls *XlsForm) (*xlsx.File, error) {
+	f := xlsx.NewFile()
+	formVal := reflect.ValueOf(xls).Elem()
+	for s, sheetInfo := range sheetInfos {
+		rows := formVal.Field(s)
+		if rows.Len() == 0 && !sheetInfo.mandatory {
+			continue
+		}
+		var cols []int
+		var head []string
+		for j, colInfo := range sheetInfo.columns {
+			if colInfo.mandatory || columnUsed(rows, j) {
+				cols = append(cols, j)
+				head = append(head, colInfo.name)
+			}
+		}
+		var attrs []string
+		if sheetInfo.extraColumns {
+			attrs = attributeNames(rows)
+			head = append(head, attrs...)
+		}
+
+		sheet, err := f.AddSheet(sheetInfo.name)
+		if err != nil {
+			return nil, err
+		}
+		addXlsxRow(sheet, head)
+		for i := 0; i < rows.Len(); i++ {
+			row := rows.Index(i)
+			cells := make([]string, 0, len(head))
+			for _, j := range cols {
+				cells = append(cells, row.Field(j).String())
+			}
+			for _, attr := range attrs {
+				val := row.FieldByName("Attributes").MapIndex(reflect.ValueOf(attr))
+				if val.IsValid() {
+					cells = append(cells, val.String())
+				} else {
+					cells = append(cells, "")
+				}
+			}
+			addXlsxRow(sheet, cells)
+		}
+	}
+	return f, nil
+}
+
+func addXlsxRow(sheet *xlsx.Sheet, cells []string) {
+	row := sheet.AddRow()
+	for _, c := range cells {
+		row.AddCell().SetString(c)
+	}
+}
+
+func columnUsed(rows reflect.Value, col int) bool {
+	for i := 0; i < rows.Len(); i++ {
+		if rows.Index(i).Field(col).String() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// attributeNames returns the sorted names of the attributes of the rows.
+func attributeNames(rows reflect.Value) []string {
+	set := make(map[string]bool)
+	for i := 0; i < rows.Len(); i++ {
+		for _, key := range rows.Index(i).FieldByName("Attributes").MapKeys() {
+			set[key.String()] = true
+		}
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,327 @@
+package formats
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// RowStreamer is implemented by the workbooks that can read the rows of a sheet
+// one at a time. DecXlsform, Translations and UnusedColumns use it, so that huge sheets
+// are never held in memory as a whole.
+type RowStreamer interface {
+	// StreamRows calls fn for each non-empty row of the sheet, with its line number
+	// (starting from 1). The row is only valid during the call. found is false
+	// if the workbook has no sheet with the given name.
+	StreamRows(sheetName string, fn func(lineNum int, row []string) error) (found bool, err error)
+}
+
+// errStopRows can be returned by the function passed to streamRows to stop reading the sheet.
+var errStopRows = errors.New("stop reading rows")
+
+// streamRows calls fn for each non-empty row of the sheet, like RowStreamer.StreamRows,
+// streaming the sheet if the workbook implements RowStreamer. Missing sheets have no rows.
+func streamRows(wb WorkBook, sheetName string, fn func(lineNum int, row []string) error) error {
+	var err error
+	if rs, ok := wb.(RowStreamer); ok {
+		_, err = rs.StreamRows(sheetName, fn)
+	} else {
+		for i, row := range wb.Rows(sheetName) {
+			if isEmpty(row) {
+				continue
+			}
+			if err = fn(i+1, row); err != nil {
+				break
+			}
+		}
+	}
+	if err == errStopRows {
+		return nil
+	}
+	return err
+}
+
+// xlsxStreamWorkBook reads the sheets of an xlsx file decoding their xml as the rows
+// are consumed, instead of building the whole sheets in memory like xlsxWorkBook.
+// Only the table of the shared strings is loaded.
+type xlsxStreamWorkBook struct {
+	names   []string             // in workbook order
+	sheets  map[string]*zip.File // by name
+	strings []string             // shared strings
+}
+
+// NewStreamingWorkBook opens an xlsx file, whose sheets are read one row at a time
+// by DecXlsform (see RowStreamer). It is meant for workbooks with very large
+// sheets, like choice lists with tens of thousands of rows.
+func NewStreamingWorkBook(r io.ReaderAt, size int64) (WorkBook, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			Id   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := decZipXml(files, "xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+	var rels struct {
+		Relationships []struct {
+			Id     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := decZipXml(files, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	targets := make(map[string]string)
+	for _, rel := range rels.Relationships {
+		if strings.HasPrefix(rel.Target, "/") {
+			targets[rel.Id] = strings.TrimPrefix(rel.Target, "/")
+		} else {
+			targets[rel.Id] = path.Join("xl", rel.Target)
+		}
+	}
+	wb := &xlsxStreamWorkBook{sheets: make(map[string]*zip.File)}
+	for _, s := range workbook.Sheets {
+		f, ok := files[targets[s.Id]]
+		if !ok {
+			return nil, fmt.Errorf("Invalid xlsx file, missing sheet %q.", s.Name)
+		}
+		wb.names = append(wb.names, s.Name)
+		wb.sheets[s.Name] = f
+	}
+	if f, ok := files["xl/sharedStrings.xml"]; ok {
+		wb.strings, err = decSharedStrings(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wb, nil
+}
+
+// decZipXml decodes the xml file with the given name of an xlsx archive into v.
+func decZipXml(files map[string]*zip.File, name string, v interface{}) error {
+	f, ok := files[name]
+	if !ok {
+		return fmt.Errorf("Invalid xlsx file, %s not found.", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// decSharedStrings decodes the table of the shared strings. The text of rich strings
+// is the concatenation of their runs; phonetic hints are skipped.
+func decSharedStrings(f *zip.File) ([]string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	d := xml.NewDecoder(rc)
+	var table []string
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return table, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := tok.(xml.StartElement); ok && t.Name.Local == "si" {
+			text, err := xlsxText(d)
+			if err != nil {
+				return nil, err
+			}
+			table = append(table, text)
+		}
+	}
+}
+
+// xlsxText reads the text of a string item (si or is element), whose start element
+// has just been read.
+func xlsxText(d *xml.Decoder) (string, error) {
+	var b strings.Builder
+	inText := false
+	for depth := 1; depth > 0; {
+		tok, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch t.Name.Local {
+			case "rPh":
+				if err := d.Skip(); err != nil {
+					return "", err
+				}
+				depth--
+			case "t":
+				inText = true
+			}
+		case xml.EndElement:
+			depth--
+			if t.Name.Local == "t" {
+				inText = false
+			}
+		case xml.CharData:
+			if inText {
+				b.Write(t)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+func (wb *xlsxStreamWorkBook) SheetNames() []string { return append([]string(nil), wb.names...) }
+
+func (wb *xlsxStreamWorkBook) Rows(sheetName string) [][]string {
+	var rows [][]string
+	found, err := wb.StreamRows(sheetName, func(lineNum int, row []string) error {
+		for len(rows) < lineNum-1 {
+			rows = append(rows, nil)
+		}
+		rows = append(rows, append([]string(nil), row...))
+		return nil
+	})
+	if !found || err != nil {
+		return nil
+	}
+	return padRows(rows)
+}
+
+func (wb *xlsxStreamWorkBook) StreamRows(sheetName string, fn func(lineNum int, row []string) error) (bool, error) {
+	f, ok := wb.sheets[sheetName]
+	if !ok {
+		return false, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return true, err
+	}
+	defer rc.Close()
+	d := xml.NewDecoder(rc)
+	var row []string
+	lineNum := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return true, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "row":
+				lineNum++
+				if r, err := strconv.Atoi(odsAttr(t, "r")); err == nil && r > 0 {
+					lineNum = r
+				}
+				row = row[:0]
+			case "c":
+				col := len(row)
+				if j, ok := xlsxColumn(odsAttr(t, "r")); ok {
+					col = j
+				}
+				if col >= maxXlsxColumns {
+					return true, fmt.Errorf("Invalid cell reference %q.", odsAttr(t, "r"))
+				}
+				value, err := wb.cellValue(d, odsAttr(t, "t"))
+				if err != nil {
+					return true, err
+				}
+				if value == "" {
+					continue
+				}
+				for len(row) <= col {
+					row = append(row, "")
+				}
+				row[col] = value
+			}
+		case xml.EndElement:
+			if t.Name.Local == "row" && !isEmpty(row) {
+				if err := fn(lineNum, row); err != nil {
+					return true, err
+				}
+			}
+		}
+	}
+}
+
+// cellValue reads the value of a cell of the given type, whose start element
+// has just been read. Numbers, booleans and dates are returned as stored.
+func (wb *xlsxStreamWorkBook) cellValue(d *xml.Decoder, typ string) (string, error) {
+	var value string
+	for depth := 1; depth > 0; {
+		tok, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "v":
+				var v string
+				if err := d.DecodeElement(&v, &t); err != nil {
+					return "", err
+				}
+				value = strings.Trim(v, " \t\n\r") // as done by xlsxWorkBook
+			case "is":
+				value, err = xlsxText(d)
+				if err != nil {
+					return "", err
+				}
+			default:
+				// Formulas and extensions.
+				if err := d.Skip(); err != nil {
+					return "", err
+				}
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if typ == "s" && value != "" {
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 0 || i >= len(wb.strings) {
+			return "", fmt.Errorf("Invalid shared string index %q.", value)
+		}
+		return wb.strings[i], nil
+	}
+	return value, nil
+}
+
+// maxXlsxColumns is the number of columns of xlsx sheets.
+const maxXlsxColumns = 16384
+
+// xlsxColumn returns the index of the column of a cell reference like "AB12".
+func xlsxColumn(ref string) (int, bool) {
+	col := 0
+	i := 0
+	for ; i < len(ref) && ref[i] >= 'A' && ref[i] <= 'Z' && col < maxXlsxColumns; i++ {
+		col = col*26 + int(ref[i]-'A'+1)
+	}
+	if i == 0 {
+		return 0, false
+	}
+	return col - 1, true
+}
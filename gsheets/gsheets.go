@@ -0,0 +1,157 @@
+// Package gsheets reads xlsforms directly from Google Sheets,
+// using the REST interface of the Sheets API (v4).
+package gsheets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+const defaultBaseURL = "https://sheets.googleapis.com/v4/spreadsheets"
+
+// Client fetches spreadsheets from the Sheets API. The credentials can be
+// an API key, which is enough for spreadsheets shared with anyone having the link,
+// an OAuth2 access token, or an HTTPClient that adds the credentials itself
+// (e.g. the one created by golang.org/x/oauth2).
+type Client struct {
+	APIKey      string
+	AccessToken string
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// BaseURL defaults to the url of the Sheets API.
+	BaseURL string
+}
+
+// Fetch reads the xlsform contained in the spreadsheet with the given id
+// (the long string in the url of the spreadsheet).
+func (c *Client) Fetch(ctx context.Context, spreadsheetId string) (*formats.XlsForm, error) {
+	wb, err := c.FetchWorkBook(ctx, spreadsheetId)
+	if err != nil {
+		return nil, err
+	}
+	return formats.DecXlsform(wb)
+}
+
+// FetchWorkBook reads the survey, choices and settings sheets of the spreadsheet.
+// The workbook can be used with formats.DecXlsform and formats.Translations.
+func (c *Client) FetchWorkBook(ctx context.Context, spreadsheetId string) (formats.WorkBook, error) {
+	var meta struct {
+		Sheets []struct {
+			Properties struct {
+				Title string `json:"title"`
+			} `json:"properties"`
+		} `json:"sheets"`
+	}
+	err := c.get(ctx, url.PathEscape(spreadsheetId), url.Values{"fields": {"sheets.properties.title"}}, &meta)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"majorDimension": {"ROWS"}}
+	for _, s := range meta.Sheets {
+		switch s.Properties.Title {
+		case "survey", "choices", "settings":
+			// The title is quoted so that it is not mistaken for a cell range.
+			query.Add("ranges", "'"+s.Properties.Title+"'")
+		}
+	}
+	if len(query["ranges"]) == 0 {
+		return nil, fmt.Errorf("Spreadsheet %s has no survey, choices or settings sheet.", spreadsheetId)
+	}
+	var values struct {
+		ValueRanges []struct {
+			Range  string     `json:"range"`
+			Values [][]string `json:"values"`
+		} `json:"valueRanges"`
+	}
+	err = c.get(ctx, url.PathEscape(spreadsheetId)+"/values:batchGet", query, &values)
+	if err != nil {
+		return nil, err
+	}
+	wb := make(workBook)
+	for _, vr := range values.ValueRanges {
+		// The range is returned in the form 'survey'!A1:Z100.
+		sheet := vr.Range
+		if i := strings.LastIndexByte(sheet, '!'); i != -1 {
+			sheet = sheet[:i]
+		}
+		sheet = strings.Trim(sheet, "'")
+		rows := padRows(vr.Values)
+		if rows == nil {
+			rows = [][]string{} // the sheet exists, but is empty
+		}
+		wb[sheet] = rows
+	}
+	return wb, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	if c.APIKey != "" {
+		query.Set("key", c.APIKey)
+	}
+	req, err := http.NewRequest("GET", baseURL+"/"+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if c.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.AccessToken)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("Sheets API error (%s): %s", resp.Status, apiErr.Error.Message)
+		}
+		return fmt.Errorf("Sheets API error (%s).", resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// workBook holds the rows of the sheets by title.
+type workBook map[string][][]string
+
+func (wb workBook) Rows(sheetName string) [][]string { return wb[sheetName] }
+
+// padRows makes all the rows as long as the longest one,
+// as the API omits trailing empty cells.
+func padRows(rows [][]string) [][]string {
+	numCols := 0
+	for _, row := range rows {
+		if len(row) > numCols {
+			numCols = len(row)
+		}
+	}
+	for i, row := range rows {
+		if len(row) < numCols {
+			rows[i] = append(row, make([]string, numCols-len(row))...)
+		}
+	}
+	return rows
+}
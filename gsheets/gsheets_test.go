@@ -0,0 +1,48 @@
+package gsheets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": {"message": "The caller does not have permission"}}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/form1":
+			w.Write([]byte(`{"sheets": [{"properties": {"title": "survey"}},
+				{"properties": {"title": "choices"}}, {"properties": {"title": "notes"}}]}`))
+		case "/form1/values:batchGet":
+			ranges := r.URL.Query()["ranges"]
+			if len(ranges) != 2 || ranges[0] != "'survey'" || ranges[1] != "'choices'" {
+				t.Errorf("Unexpected ranges %q", ranges)
+			}
+			w.Write([]byte(`{"valueRanges": [
+				{"range": "survey!A1:Z1000", "values": [["type", "name", "label", "hint"], ["text", "name", "Name"]]},
+				{"range": "choices!A1:Z1000", "values": [["list name", "name", "label"]]}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	c := Client{APIKey: "secret", BaseURL: ts.URL}
+	xls, err := c.Fetch(context.Background(), "form1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xls.Survey) != 1 || xls.Survey[0].Name != "name" || xls.Survey[0].Hint != "" || len(xls.Choices) != 0 {
+		t.Fatalf("Unexpected form: %+v", xls)
+	}
+
+	c.APIKey = "wrong"
+	if _, err := c.Fetch(context.Background(), "form1"); err == nil {
+		t.Fatal("Expected error for wrong api key")
+	}
+}
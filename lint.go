@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// lint implements the "lint" command, which checks xlsforms stored as csv files
+// like -validate, reading the survey one row at a time. It exits with status 1
+// when problems are found.
+func lint(args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `formconv lint checks the structure of xlsforms stored as csv files without
+loading the survey into memory, for huge generated forms. Usage:
+formconv lint form1_survey.csv form2_survey.csv`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	problems := 0
+	for _, surveyName := range fs.Args() {
+		if !strings.HasSuffix(surveyName, csvSurveySuffix) {
+			return fmt.Errorf("%s, lint requires a survey sheet stored as form%s.", surveyName, csvSurveySuffix)
+		}
+		choicesName := strings.TrimSuffix(surveyName, csvSurveySuffix) + "_choices.csv"
+		if _, err := os.Stat(choicesName); err != nil {
+			choicesName = ""
+		}
+		report := func(e formats.SourceError) {
+			problems++
+			fmt.Fprintf(os.Stderr, "%s, sheet %s, line %d, column %s: %s\n", surveyName, e.Sheet, e.LineNum, e.Column, e.Message)
+		}
+		if err := formats.LintCsvForm(surveyName, choicesName, report); err != nil {
+			return fmt.Errorf("%s, %s", surveyName, err)
+		}
+	}
+	if problems > 0 {
+		fmt.Fprintf(os.Stderr, "%d problems found.\n", problems)
+		os.Exit(1)
+	}
+	return nil
+}
@@ -1,71 +1,383 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/gnucoop/formconv/formats"
+	"github.com/gnucoop/formconv/gsheets"
+)
+
+var (
+	opts     formats.ConvertOptions
+	decOpts  formats.DecodeOptions
+	annotate bool
+	freeze   bool
+	split    bool
+	patch    []formats.PatchOperation
+	validate bool
+	unused   bool
 )
 
 func main() {
-	if len(os.Args) <= 1 {
+	if len(os.Args) > 1 && os.Args[1] == "new" {
+		if err := newForm(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ajf2xls" {
+		if err := ajf2xls(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "anonymize" {
+		if err := anonymize(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		if err := lint(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "deps" {
+		if err := deps(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scenarios" {
+		if err := scenarios(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "xlsdiff" {
+		if err := xlsdiff(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		os.Exit(batchConvert(os.Args[2:]))
+	}
+
+	applyFlags := convFlags(flag.CommandLine)
+	printVersion := flag.Bool("version", false, "print version and supported features, then exit")
+	flag.Parse()
+	if *printVersion {
+		fmt.Printf("formconv %s\nfeatures: %s\n", formats.Version(), strings.Join(formats.Features(), " "))
+		return
+	}
+	if err := applyFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if flag.NArg() == 0 {
 		fmt.Fprintln(os.Stderr, `No input files provided.
 formconv converts xlsform files to ajf. Usage:
-formconv form1.xlsx form2.xls`)
+formconv [flags] form1.xlsx form2.xls form3.ods form4_survey.csv gsheets:<spreadsheet id>
+formconv new [-template name] form.xlsx
+formconv ajf2xls form.json
+formconv anonymize [-hash] form.xlsx
+formconv xlsdiff old.xlsx new.xlsx
+formconv deps form.xlsx question_name
+formconv scenarios form.xlsx scenarios.json
+formconv lint form_survey.csv
+formconv convert [flags] -o outdir form1.xlsx form2.xlsx`)
+		flag.PrintDefaults()
 		return
 	}
 
-	for _, fileName := range os.Args[1:] {
-		err := decXlsEncAjf(fileName)
+	for _, fileName := range flag.Args() {
+		err := decXlsEncAjf(fileName, os.Stderr, nil)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 	}
 }
 
-func decXlsEncAjf(xlsName string) error {
-	f, err := os.Open(xlsName)
-	if err != nil {
-		return err
+// convFlags defines the flags controlling the conversion on fs.
+// The returned function must be called after parsing, to validate and apply them.
+func convFlags(fs *flag.FlagSet) func() error {
+	fs.BoolVar(&opts.WrapUngrouped, "wrap-ungrouped", false,
+		"wrap ungrouped questions into slides when the form contains repeats")
+	fs.BoolVar(&opts.NoteAsDescription, "note-as-description", false,
+		"use a note at the start of a group as the group's description")
+	fs.BoolVar(&opts.UnrollNestedRepeats, "unroll-nested-repeats", false,
+		"unroll repeats nested in groups or repeats into repeat_count groups")
+	fs.BoolVar(&opts.NameMapping, "name-mapping", false,
+		"rename the questions to javascript-safe names and include the mapping in the output")
+	fs.BoolVar(&opts.RepeatJoinKeys, "repeat-join-keys", false,
+		"add hidden index and parent key fields to repeating slides")
+	fs.StringVar(&opts.RepeatParentKey, "repeat-parent-key", "",
+		"formula computing the parent key of repetitions, used with -repeat-join-keys")
+	fs.BoolVar(&opts.CollapsibleGroups, "collapsible-groups", false,
+		"convert nested groups with the collapsible appearance into collapsible groups")
+	fs.BoolVar(&opts.Strict, "strict", false,
+		"reject forms whose texts contain markup that can run javascript, for untrusted forms")
+	fs.StringVar(&opts.FixedSeed, "fixed-seed", "",
+		"integer seed used by all the questions with randomized choices, for previews and tests")
+	fs.BoolVar(&opts.EvalConstants, "eval-constants", false,
+		"evaluate at conversion time the calculations depending only on constants")
+	fs.BoolVar(&opts.CheckUnits, "check-units", false,
+		"warn about formulas adding or comparing questions with different units")
+	fs.BoolVar(&opts.SlideRequiredValidation, "slide-required", false,
+		"don't proceed to the next slide until the required questions of the current one are answered")
+	fs.BoolVar(&opts.ChoicesProvenance, "choices-provenance", false,
+		"record in the choices origins the file, sheet and line of each choice")
+	fs.BoolVar(&opts.SkipUnsupportedFields, "skip-unsupported", false,
+		"skip questions of unsupported types with a warning, instead of failing")
+	fs.IntVar(&opts.IdMultiplier, "id-multiplier", 1000,
+		"the children of the node with id x get ids x*multiplier+1, x*multiplier+2...")
+	fs.IntVar(&opts.IdStartOffset, "id-start-offset", 0,
+		"offset added to the ids of the top-level slides")
+	ids := fs.String("ids", "hierarchical",
+		"how the ids of the nodes are assigned: hierarchical, sequential or name-hash")
+	previousAjf := fs.String("previous-ajf", "",
+		"previous version of the converted form (json), whose ids are reused for the questions with the same name")
+	fs.StringVar(&opts.DefaultLanguage, "default-language", "",
+		"default language of the forms whose settings don't specify one")
+	fs.IntVar(&opts.MaxChoicesInline, "max-choices-inline", 0,
+		"show select questions with more choices than this as dropdowns (0 means no limit)")
+	fs.IntVar(&opts.TruncateLabels, "truncate-labels", 0,
+		"shorten the labels longer than this, moving their full text to the hint (0 means no limit)")
+	languages := fs.String("languages", "",
+		"comma-separated list of languages for which translation files are produced (default all)")
+	metadata := fs.String("metadata", "error",
+		"how to handle metadata questions (start, end, deviceid...): error, skip or hidden")
+	notes := fs.String("notes", "html",
+		"how the labels of notes are rendered: html (verbatim), text (escaped), markdown, or sanitized (markdown and safe html)")
+	fs.BoolVar(&opts.MarkdownLabels, "markdown-labels", false,
+		"convert the labels of questions and groups from markdown to html")
+	fs.BoolVar(&decOpts.StrictHeaders, "strict-headers", false,
+		"require the column headers to match exactly, without ignoring case, whitespace and underscores")
+	fs.BoolVar(&unused, "unused-columns", false,
+		"warn about the columns and sheets not used by the converter, which may be misspelled")
+	fs.BoolVar(&annotate, "annotate", false,
+		"on errors or warnings, write a copy of the xlsx file with the problematic rows highlighted")
+	fs.BoolVar(&freeze, "freeze", false,
+		"produce a self-contained ajf file, embedding the translations instead of writing separate files")
+	profile := fs.String("profile", "",
+		`json file with the conversion profile, e.g. {"valid_values": {"required": ["yes", "no"]}}`)
+	fs.BoolVar(&validate, "validate", false,
+		"only check the structure of the forms, reporting all the problems found, without writing output")
+	patchFile := fs.String("patch", "",
+		"json patch (RFC 6902) file applied to the generated ajf, for tweaks not expressible in xlsform")
+	fs.BoolVar(&split, "split", false,
+		"write each top-level group to a separate ajf file, plus a manifest linking them")
+	return func() error {
+		switch *metadata {
+		case "error":
+			opts.Metadata = formats.MetadataError
+		case "skip":
+			opts.Metadata = formats.MetadataSkip
+		case "hidden":
+			opts.Metadata = formats.MetadataHidden
+		default:
+			return fmt.Errorf("Invalid value %q for flag -metadata.", *metadata)
+		}
+		switch *notes {
+		case "html":
+			opts.Notes = formats.NoteHtml
+		case "text":
+			opts.Notes = formats.NoteText
+		case "markdown":
+			opts.Notes = formats.NoteMarkdown
+		case "sanitized":
+			opts.Notes = formats.NoteSanitized
+		default:
+			return fmt.Errorf("Invalid value %q for flag -notes.", *notes)
+		}
+		switch *ids {
+		case "hierarchical":
+			opts.IdAssigner = nil
+		case "sequential":
+			opts.IdAssigner = formats.SequentialIds{Start: opts.IdStartOffset}
+		case "name-hash":
+			opts.IdAssigner = formats.NameHashIds{}
+		default:
+			return fmt.Errorf("Invalid value %q for flag -ids.", *ids)
+		}
+		if *previousAjf != "" {
+			if opts.IdAssigner != nil {
+				return fmt.Errorf("Flags -previous-ajf and -ids %s can't be used together.", *ids)
+			}
+			data, err := ioutil.ReadFile(*previousAjf)
+			if err != nil {
+				return err
+			}
+			var prev formats.AjfForm
+			if err := json.Unmarshal(data, &prev); err != nil {
+				return fmt.Errorf("Error decoding file %s: %s", *previousAjf, err)
+			}
+			opts.IdAssigner = formats.PreviousIds{Previous: &prev}
+		}
+		if opts.IdAssigner != nil {
+			// The other assigners don't use the multiplier,
+			// and SplitForm reassigns hierarchical ids to the split forms.
+			assigner := "-ids " + *ids
+			if *previousAjf != "" {
+				assigner = "-previous-ajf"
+			}
+			multiplier := false
+			fs.Visit(func(f *flag.Flag) { multiplier = multiplier || f.Name == "id-multiplier" })
+			if multiplier {
+				return fmt.Errorf("Flags %s and -id-multiplier can't be used together.", assigner)
+			}
+			if split {
+				return fmt.Errorf("Flags %s and -split can't be used together.", assigner)
+			}
+		}
+		if *profile != "" {
+			if err := loadProfile(*profile); err != nil {
+				return err
+			}
+		}
+		if *languages != "" {
+			opts.Languages = strings.Split(*languages, ",")
+		}
+		if *patchFile != "" {
+			if split {
+				return fmt.Errorf("Flags -patch and -split can't be used together.")
+			}
+			data, err := ioutil.ReadFile(*patchFile)
+			if err != nil {
+				return err
+			}
+			if patch, err = formats.DecJsonPatch(data); err != nil {
+				return fmt.Errorf("Error decoding patch %s: %s", *patchFile, err)
+			}
+		}
+		return nil
 	}
-	defer f.Close()
+}
 
-	stat, err := f.Stat()
-	if err != nil {
-		return err
-	}
-	wb, err := formats.NewWorkBook(f, filepath.Ext(xlsName), stat.Size())
+// csvSurveySuffix identifies xlsforms stored as csv files: the survey sheet
+// is in form_survey.csv, the other sheets in form_choices.csv and form_settings.csv.
+const csvSurveySuffix = "_survey.csv"
+
+// gsheetsPrefix identifies xlsforms read from Google Sheets, as in gsheets:<spreadsheet id>.
+// The credentials are taken from the FORMCONV_GOOGLE_API_KEY or
+// FORMCONV_GOOGLE_ACCESS_TOKEN environment variables.
+const gsheetsPrefix = "gsheets:"
+
+// decXlsEncAjf converts the xlsform xlsName, writing its warnings and the problems
+// found by -validate to log. When writing to outDir, reserve (see outputNames) is called
+// with the name of the output files.
+func decXlsEncAjf(xlsName string, log io.Writer, reserve func(name string) bool) error {
+	wb, err := openWorkBook(xlsName)
 	if err != nil {
 		return fmt.Errorf("Error opening workbook: %s", err)
 	}
-	xls, err := formats.DecXlsform(wb)
+	xls, err := formats.DecXlsformWithOptions(wb, decOpts)
 	if err != nil {
 		return fmt.Errorf("Error decoding file %s: %s", xlsName, err)
 	}
-	ajf, err := formats.Convert(xls)
+	err = formats.LoadExternalChoices(xls, filepath.Dir(xlsName))
 	if err != nil {
 		return fmt.Errorf("%s, %s", xlsName, err)
 	}
+	if unused && !quiet {
+		warnings, err := formats.UnusedColumns(wb)
+		if err != nil {
+			return fmt.Errorf("Error decoding file %s: %s", xlsName, err)
+		}
+		for _, w := range warnings {
+			if w.LineNum == 0 {
+				fmt.Fprintf(log, "%s, warning: %s\n", xlsName, w.Message)
+			} else {
+				fmt.Fprintf(log, "%s, warning: %s\n", xlsName, w)
+			}
+		}
+	}
+	if validate {
+		errs := formats.ValidateXls(xls)
+		for _, e := range errs {
+			fmt.Fprintf(log, "%s, sheet %s, line %d, column %s: %s\n", xlsName, e.Sheet, e.LineNum, e.Column, e.Message)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%s, %d problems found.", xlsName, len(errs))
+		}
+		return nil
+	}
+	ajf, warnings, err := formats.Convert(xls, opts)
 	ext := filepath.Ext(xlsName)
 	name := xlsName[0 : len(xlsName)-len(ext)]
+	if strings.HasSuffix(xlsName, csvSurveySuffix) {
+		name = strings.TrimSuffix(xlsName, csvSurveySuffix)
+	}
+	if strings.HasPrefix(xlsName, gsheetsPrefix) {
+		name, ext = strings.TrimPrefix(xlsName, gsheetsPrefix), ""
+	}
+	if annotate && (err != nil || len(warnings) > 0) {
+		if annErr := annotateXls(wb, name+"_annotated"+ext, err, warnings); annErr != nil {
+			fmt.Fprintf(log, "%s, error annotating workbook: %s\n", xlsName, annErr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s, %s", xlsName, err)
+	}
+	if !quiet {
+		for _, w := range warnings {
+			fmt.Fprintf(log, "%s, warning: %s\n", xlsName, w)
+		}
+	}
+	if outDir != "" {
+		name = filepath.Join(outDir, outputName(filepath.Base(name), ajf.FormId))
+		if reserve != nil && !reserve(name) {
+			return fmt.Errorf("%s, output %s.json already written by another form.", xlsName, name)
+		}
+	}
 	ajfName := name + ".json"
-	err = formats.EncJsonToFile(ajfName, ajf)
+	translations, err := formats.TranslationsWithOptions(wb, opts, decOpts)
+	if err != nil {
+		return fmt.Errorf("Error decoding file %s: %s", xlsName, err)
+	}
+	if freeze {
+		// External choices are already included in the form.
+		ajf.Translations = translations
+		translations = nil
+	}
+	switch {
+	case split:
+		err = encSplitForm(name, ajf, translations)
+	case patch != nil:
+		var patched interface{}
+		patched, err = formats.PatchAjf(ajf, patch)
+		if err != nil {
+			return fmt.Errorf("%s, %s", xlsName, err)
+		}
+		err = formats.EncJsonToFile(ajfName, patched)
+	default:
+		err = formats.EncJsonToFile(ajfName, ajf)
+	}
 	if err != nil {
 		return fmt.Errorf("Error encoding file %s: %s", ajfName, err)
 	}
 
 	// Translation files in case of multiple languages:
-	survey := wb.Rows("survey")
-	langs := formats.ListLanguages(survey)
-	if len(langs) == 0 {
-		return nil
-	}
-	choices := wb.Rows("choices")
-	for lang := range langs {
-		surveyTr := formats.Translation(survey, lang)
-		choicesTr := formats.Translation(choices, lang)
-		tr := formats.MergeMaps(surveyTr, choicesTr)
+	for lang, tr := range translations {
 		err := formats.EncJsonToFile(name+"_"+lang+".json", tr)
 		if err != nil {
 			return err
@@ -73,3 +385,93 @@ func decXlsEncAjf(xlsName string) error {
 	}
 	return nil
 }
+
+func openWorkBook(xlsName string) (formats.WorkBook, error) {
+	if strings.HasPrefix(xlsName, gsheetsPrefix) {
+		c := gsheets.Client{
+			APIKey:      os.Getenv("FORMCONV_GOOGLE_API_KEY"),
+			AccessToken: os.Getenv("FORMCONV_GOOGLE_ACCESS_TOKEN"),
+		}
+		return c.FetchWorkBook(context.Background(), strings.TrimPrefix(xlsName, gsheetsPrefix))
+	}
+	if strings.HasSuffix(xlsName, csvSurveySuffix) {
+		base := strings.TrimSuffix(xlsName, csvSurveySuffix)
+		settings := base + "_settings.csv"
+		if _, err := os.Stat(settings); err != nil {
+			settings = ""
+		}
+		return formats.NewCsvWorkBook(xlsName, base+"_choices.csv", settings)
+	}
+	// The file is read into memory, as xls workbooks read their sheets lazily.
+	data, err := ioutil.ReadFile(xlsName)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(xlsName) == ".xlsx" && !annotate {
+		// Annotating requires the styles of the workbook, which are not read when streaming.
+		return formats.NewStreamingWorkBook(bytes.NewReader(data), int64(len(data)))
+	}
+	return formats.NewWorkBook(bytes.NewReader(data), filepath.Ext(xlsName), int64(len(data)))
+}
+
+// encSplitForm writes each slide of the form to name_<slide>.json,
+// and the manifest linking them to name_manifest.json.
+func encSplitForm(name string, ajf *formats.AjfForm, translations map[string]map[string]string) error {
+	forms, manifest, err := formats.SplitForm(ajf, opts.IdMultiplier)
+	if err != nil {
+		return err
+	}
+	// The files of the slides share the name_<suffix>.json pattern
+	// with the manifest and the translations, which must not be overwritten.
+	owners := map[string]string{"manifest": "the manifest"}
+	for lang := range translations {
+		owners[lang] = fmt.Sprintf("the %s translations", lang)
+	}
+	for _, f := range manifest.Forms {
+		if owner, ok := owners[f.Form]; ok {
+			return fmt.Errorf("Slide %q can't be written to %s_%s.json, the file of %s.", f.Form, name, f.Form, owner)
+		}
+		owners[f.Form] = fmt.Sprintf("slide %q", f.Form)
+	}
+	for i, form := range forms {
+		fileName := name + "_" + manifest.Forms[i].Form + ".json"
+		manifest.Forms[i].File = filepath.Base(fileName)
+		err := formats.EncJsonToFile(fileName, form)
+		if err != nil {
+			return err
+		}
+	}
+	return formats.EncJsonToFile(name+"_manifest.json", manifest)
+}
+
+func annotateXls(wb formats.WorkBook, fileName string, convErr error, warnings []formats.Warning) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	err = formats.AnnotateXlsx(f, wb, formats.Annotations(convErr, warnings))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fileName)
+	}
+	return err
+}
+
+// loadProfile reads the conversion profile, which restricts
+// the values allowed in the survey columns.
+func loadProfile(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var p struct {
+		ValidValues map[string][]string `json:"valid_values"`
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("Error decoding profile %s: %s", fileName, err)
+	}
+	opts.ValidValues = p.ValidValues
+	return nil
+}
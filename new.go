@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// newForm implements the "new" command, which creates a starter xlsform from a template.
+func newForm(args []string) error {
+	fs := flag.NewFlagSet("new", flag.ExitOnError)
+	template := fs.String("template", "survey", "template of the form: "+strings.Join(templateNames(), ", "))
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `formconv new creates a starter xlsform. Usage:
+formconv new [-template name] form.xlsx`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	xls, ok := templates[*template]
+	if !ok {
+		return fmt.Errorf("Unknown template %q, available templates: %s.",
+			*template, strings.Join(templateNames(), ", "))
+	}
+	fileName := fs.Arg(0)
+	if _, err := os.Stat(fileName); err == nil {
+		return fmt.Errorf("File %s already exists.", fileName)
+	}
+	return formats.EncXlsxToFile(fileName, xls)
+}
+
+func templateNames() []string {
+	var names []string
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var yesNo = []formats.ChoicesRow{
+	{ListName: "yes_no", Name: "yes", Label: "Yes"},
+	{ListName: "yes_no", Name: "no", Label: "No"},
+}
+
+var templates = map[string]*formats.XlsForm{
+	"registration": {
+		Survey: []formats.SurveyRow{
+			{Type: "begin group", Name: "personal", Label: "Personal information"},
+			{Type: "text", Name: "first_name", Label: "First name:", Required: "yes"},
+			{Type: "text", Name: "last_name", Label: "Last name:", Required: "yes"},
+			{Type: "date", Name: "birth_date", Label: "Date of birth:"},
+			{Type: "select_one gender", Name: "gender", Label: "Gender:"},
+			{Type: "end group"},
+			{Type: "begin group", Name: "contacts", Label: "Contacts"},
+			{Type: "text", Name: "phone", Label: "Phone number:", Hint: "Include the international prefix"},
+			{Type: "text", Name: "email", Label: "Email:", Constraint: "regex(., '^[^@]+@[^@]+$')",
+				ConstraintMessage: "Invalid email address."},
+			{Type: "end group"},
+		},
+		Choices: []formats.ChoicesRow{
+			{ListName: "gender", Name: "female", Label: "Female"},
+			{ListName: "gender", Name: "male", Label: "Male"},
+			{ListName: "gender", Name: "other", Label: "Other"},
+		},
+		Settings: []formats.SettingsRow{{FormTitle: "Registration", FormId: "registration", Version: "1"}},
+	},
+	"survey": {
+		Survey: []formats.SurveyRow{
+			{Type: "begin group", Name: "respondent", Label: "Respondent"},
+			{Type: "integer", Name: "age", Label: "How old are you?", Required: "yes",
+				Constraint: ". >= 0 and . < 150", ConstraintMessage: "Invalid age."},
+			{Type: "select_one yes_no", Name: "employed", Label: "Are you employed?"},
+			{Type: "text", Name: "job", Label: "What is your job?", Relevant: "${employed} = 'yes'"},
+			{Type: "end group"},
+			{Type: "begin group", Name: "opinions", Label: "Opinions"},
+			{Type: "range", Name: "satisfaction", Label: "How satisfied are you with the service?",
+				Parameters: "start=1 end=5 step=1"},
+			{Type: "text", Name: "comments", Label: "Comments:", Appearance: "multiline"},
+			{Type: "end group"},
+		},
+		Choices:  yesNo,
+		Settings: []formats.SettingsRow{{FormTitle: "Survey", FormId: "survey", Version: "1"}},
+	},
+	"monitoring": {
+		Survey: []formats.SurveyRow{
+			{Type: "begin group", Name: "visit", Label: "Visit"},
+			{Type: "date", Name: "visit_date", Label: "Date of the visit:", Required: "yes"},
+			{Type: "text", Name: "site", Label: "Site:", Required: "yes"},
+			{Type: "integer", Name: "households", Label: "Number of households visited:"},
+			{Type: "end group"},
+			{Type: "begin repeat", Name: "issues", Label: "Issues found"},
+			{Type: "text", Name: "issue", Label: "Description of the issue:"},
+			{Type: "select_one yes_no", Name: "solved", Label: "Has the issue been solved?"},
+			{Type: "end repeat"},
+		},
+		Choices:  yesNo,
+		Settings: []formats.SettingsRow{{FormTitle: "Monitoring", FormId: "monitoring", Version: "1"}},
+	},
+}
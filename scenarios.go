@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// scenarios implements the "scenarios" command, which converts an xlsform and runs it
+// on the answers of scenario files, reporting which questions would be visible and valid.
+func scenarios(args []string) error {
+	fs := flag.NewFlagSet("scenarios", flag.ExitOnError)
+	applyFlags := convFlags(fs)
+	jsonOut := fs.Bool("json", false, "print the results as json")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `formconv scenarios evaluates the relevances and constraints of a form on named sets
+of answers, given as json, reporting which questions would be visible and valid. Usage:
+formconv scenarios [flags] form.xlsx scenarios.json`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := applyFlags(); err != nil {
+		return err
+	}
+	xlsName, scenariosName := fs.Arg(0), fs.Arg(1)
+	wb, err := openWorkBook(xlsName)
+	if err != nil {
+		return fmt.Errorf("Error opening workbook: %s", err)
+	}
+	xls, err := formats.DecXlsformWithOptions(wb, decOpts)
+	if err != nil {
+		return fmt.Errorf("Error decoding file %s: %s", xlsName, err)
+	}
+	if err := formats.LoadExternalChoices(xls, filepath.Dir(xlsName)); err != nil {
+		return fmt.Errorf("%s, %s", xlsName, err)
+	}
+	ajf, _, err := formats.Convert(xls, opts)
+	if err != nil {
+		return fmt.Errorf("%s, %s", xlsName, err)
+	}
+	data, err := ioutil.ReadFile(scenariosName)
+	if err != nil {
+		return err
+	}
+	list, err := formats.DecScenarios(data)
+	if err != nil {
+		return fmt.Errorf("Error decoding file %s: %s", scenariosName, err)
+	}
+
+	results := make([]formats.ScenarioResult, len(list))
+	for i, s := range list {
+		results[i] = formats.RunScenario(ajf, s)
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	for _, res := range results {
+		fmt.Printf("scenario %s:\n", res.Scenario)
+		for _, q := range res.Questions {
+			if len(q.Errors) == 0 {
+				fmt.Printf("  %s: %s\n", q.Name, q.Visibility)
+			} else {
+				fmt.Printf("  %s: %s, invalid: %s\n", q.Name, q.Visibility, strings.Join(q.Errors, " "))
+			}
+		}
+	}
+	return nil
+}
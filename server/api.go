@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// maxUploadSize limits the size of the xlsforms accepted by the api.
+const maxUploadSize = 32 << 20
+
+// uploadTypes maps the media types accepted in the body of api requests
+// to the corresponding file extensions.
+var uploadTypes = map[string]string{
+	"application/vnd.ms-excel": ".xls",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": ".xlsx",
+	"application/vnd.oasis.opendocument.spreadsheet":                    ".ods",
+}
+
+// apiError is the body of the error responses of the api. Sheet and Line
+// are set when the error concerns a specific row of the xlsform.
+type apiError struct {
+	Status    int    `json:"status"`
+	Message   string `json:"message"`
+	Sheet     string `json:"sheet,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Column    string `json:"column,omitempty"`
+	Code      string `json:"code,omitempty"`
+	RequestId string `json:"requestId"`
+}
+
+// convertApi handles POST /convert, which converts an xlsform to ajf.
+// The xlsform is sent as the body of the request, with its media type as Content-Type,
+// or as the "file" field of a multipart form. Both the result and the errors are json.
+// With warnings=true, the result is a formats.ConversionResult, including the warnings.
+func convertApi(w http.ResponseWriter, r *http.Request) {
+	setAllowOrigins(w.Header())
+	switch r.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		jsonError(w, r, http.StatusMethodNotAllowed, "Unsupported method %s, POST an xlsform.", r.Method)
+		return
+	}
+	if !acceptsJson(r.Header.Get("Accept")) {
+		httpError(w, r, http.StatusNotAcceptable, "The response can only be application/json.")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	data, ext, status, err := readUpload(r)
+	if err != nil {
+		jsonError(w, r, status, "%s", err)
+		return
+	}
+	wrapUngrouped := r.FormValue("wrapUngrouped")
+	warnings := r.FormValue("warnings")
+	tag, err := etag(bytes.NewReader(data), "api/convert", ext, wrapUngrouped, warnings)
+	if err != nil {
+		jsonError(w, r, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if checkNotModified(w, r, tag) {
+		return
+	}
+	xls, err := formats.DecXlsFromReader(bytes.NewReader(data), int64(len(data)), ext)
+	if err != nil {
+		jsonError(w, r, http.StatusUnprocessableEntity, "Error decoding xlsform: %s", err)
+		return
+	}
+	opts := formats.ConvertOptions{WrapUngrouped: wrapUngrouped == "true", Strict: true}
+	res, err := formats.ConvertXlsform(xls, opts)
+	if err != nil {
+		convertError(w, r, err)
+		return
+	}
+	for _, warning := range res.Warnings {
+		logJson(map[string]interface{}{
+			"event":     "warning",
+			"requestId": requestId(r),
+			"message":   warning.String(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if warnings == "true" {
+		err = formats.EncResultToWriter(res, w, formats.EncodeOptions{})
+	} else {
+		err = formats.EncAjfToWriter(res.Form, w, formats.EncodeOptions{})
+	}
+	if err != nil {
+		log.Printf("Error writing json response: %s", err)
+	}
+}
+
+// apiCapabilities is the response of GET /capabilities: the capabilities of the converter,
+// the parameters accepted by POST /convert and the media types of the xlsforms.
+type apiCapabilities struct {
+	formats.Capabilities
+	Options    []string `json:"options"`
+	MediaTypes []string `json:"mediaTypes"`
+}
+
+// capabilities handles GET /capabilities, describing what the deployed converter supports.
+func capabilities(w http.ResponseWriter, r *http.Request) {
+	setAllowOrigins(w.Header())
+	switch r.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		jsonError(w, r, http.StatusMethodNotAllowed, "Unsupported method %s.", r.Method)
+		return
+	}
+	c := apiCapabilities{
+		Capabilities: formats.GetCapabilities(),
+		Options:      []string{"wrapUngrouped", "warnings"},
+	}
+	for mediaType := range uploadTypes {
+		c.MediaTypes = append(c.MediaTypes, mediaType)
+	}
+	sort.Strings(c.MediaTypes)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := formats.EncIndentedJson(w, c); err != nil {
+		log.Printf("Error writing json response: %s", err)
+	}
+}
+
+// readUpload reads the xlsform sent with the request, returning its content and
+// extension. In case of error, it also returns the status code of the response.
+func readUpload(r *http.Request) (data []byte, ext string, status int, err error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var body io.Reader = r.Body
+	if mediaType == "multipart/form-data" {
+		f, head, err := r.FormFile("file")
+		if err != nil {
+			return nil, "", http.StatusBadRequest, err
+		}
+		defer f.Close()
+		body, ext = f, strings.ToLower(filepath.Ext(head.Filename))
+	} else {
+		ext = uploadTypes[mediaType]
+	}
+	switch ext {
+	case ".xls", ".xlsx", ".ods":
+	default:
+		return nil, "", http.StatusUnsupportedMediaType, fmt.Errorf(
+			"Unsupported file type, expected an xls, xlsx or ods file.")
+	}
+	data, err = ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", http.StatusBadRequest, err
+	}
+	return data, ext, 0, nil
+}
+
+// acceptsJson reports whether a response of type application/json
+// is acceptable according to the Accept header.
+func acceptsJson(accept string) bool {
+	if accept == "" {
+		return true
+	}
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+// convertError writes the error of a conversion, with the cell that caused it if known.
+func convertError(w http.ResponseWriter, r *http.Request, err error) {
+	e := apiError{Status: http.StatusUnprocessableEntity, Message: err.Error()}
+	if srcErr, ok := err.(formats.SourceError); ok {
+		e.Sheet, e.Line, e.Column = srcErr.Sheet, srcErr.LineNum, srcErr.Column
+		e.Code, e.Message = srcErr.Code, srcErr.Message
+	}
+	writeApiError(w, r, e)
+}
+
+func jsonError(w http.ResponseWriter, r *http.Request, status int, format string, a ...interface{}) {
+	writeApiError(w, r, apiError{Status: status, Message: fmt.Sprintf(format, a...)})
+}
+
+func writeApiError(w http.ResponseWriter, r *http.Request, e apiError) {
+	e.RequestId = requestId(r)
+	logJson(map[string]interface{}{
+		"event":     "error",
+		"requestId": e.RequestId,
+		"status":    e.Status,
+		"message":   e.Message,
+		"line":      e.Line,
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(e.Status)
+	if err := formats.EncIndentedJson(w, map[string]apiError{"error": e}); err != nil {
+		log.Printf("Error writing json response: %s", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// authenticator checks the credentials of the requests. Either verifier can be nil,
+// in which case the corresponding authentication scheme is not accepted.
+type authenticator struct {
+	verifyToken func(token string) bool          // bearer authentication
+	verifyBasic func(user, password string) bool // basic authentication
+}
+
+// authFromEnv configures authentication from the environment:
+// $API_TOKENS is a comma-separated list of accepted bearer tokens,
+// $BASIC_AUTH a comma-separated list of accepted user:password pairs.
+// It returns nil if authentication is not configured.
+func authFromEnv() *authenticator {
+	var a authenticator
+	if tokens := splitList(os.Getenv("API_TOKENS")); len(tokens) > 0 {
+		a.verifyToken = func(token string) bool { return matchAny(tokens, token) }
+	}
+	if pairs := splitList(os.Getenv("BASIC_AUTH")); len(pairs) > 0 {
+		a.verifyBasic = func(user, password string) bool { return matchAny(pairs, user+":"+password) }
+	}
+	if a.verifyToken == nil && a.verifyBasic == nil {
+		return nil
+	}
+	return &a
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			list = append(list, elem)
+		}
+	}
+	return list
+}
+
+// matchAny compares s with the accepted values in constant time.
+func matchAny(accepted []string, s string) bool {
+	match := 0
+	for _, a := range accepted {
+		match |= subtle.ConstantTimeCompare([]byte(a), []byte(s))
+	}
+	return match == 1
+}
+
+// publicPaths don't require authentication.
+var publicPaths = map[string]bool{"/healthz": true, "/readyz": true}
+
+func (a *authenticator) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if a.verifyToken != nil && strings.HasPrefix(auth, "Bearer ") {
+		return a.verifyToken(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if user, password, ok := r.BasicAuth(); ok && a.verifyBasic != nil {
+		return a.verifyBasic(user, password)
+	}
+	return false
+}
+
+// withAuth rejects the requests that are not authorized.
+// CORS preflight requests and publicPaths are always allowed.
+func (a *authenticator) withAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || publicPaths[r.URL.Path] || a.authorized(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if a.verifyBasic != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="formconv"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="formconv"`)
+		}
+		httpError(w, r, http.StatusUnauthorized, "Unauthorized.")
+	})
+}
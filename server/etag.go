@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// etag computes the entity tag of a response from the uploaded file and the
+// parameters that affect the result, including the version of the converter.
+// The file is rewinded after being read.
+func etag(f io.ReadSeeker, params ...string) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	for _, p := range append(params, formats.Version()) {
+		io.WriteString(h, "\x00"+p)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// checkNotModified sets the caching headers of the response and, if the client
+// already has the current version of the result, responds with 304 Not Modified.
+func checkNotModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if t = strings.TrimSpace(t); t == tag || t == "*" || t == "W/"+tag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
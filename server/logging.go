@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// jsonLog writes one json object per line, used for access and diagnostic logs.
+var jsonLog = log.New(os.Stdout, "", 0)
+
+func logJson(fields map[string]interface{}) {
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(fields)
+	if err != nil {
+		log.Printf("Error encoding log line: %s", err)
+		return
+	}
+	jsonLog.Println(string(line))
+}
+
+type ctxKey int
+
+const requestIdKey ctxKey = 0
+
+// requestId returns the id assigned to the request by withRequestLog.
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey).(string)
+	return id
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder records the status code and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	return n, err
+}
+
+// withRequestLog assigns an id to each request, returned in the X-Request-Id header
+// (the id provided by the client in the same header is used, if present),
+// and writes an access log line in json format when the request is served.
+func withRequestLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 64 {
+			id = newRequestId()
+		}
+		w.Header().Set("X-Request-Id", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIdKey, id))
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logJson(map[string]interface{}{
+			"event":      "access",
+			"requestId":  id,
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     rec.status,
+			"size":       rec.size,
+			"durationMs": time.Since(start).Seconds() * 1000,
+			"remote":     r.RemoteAddr,
+		})
+	})
+}
+
+// httpError writes an error response containing the request id, and logs the error.
+func httpError(w http.ResponseWriter, r *http.Request, status int, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	logJson(map[string]interface{}{
+		"event":     "error",
+		"requestId": requestId(r),
+		"status":    status,
+		"message":   msg,
+	})
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n(request id: %s)\n", msg, requestId(r))
+}
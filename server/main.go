@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gnucoop/formconv/formats"
 )
@@ -19,9 +24,73 @@ func main() {
 
 	http.Handle("/", http.FileServer(http.Dir("server/static")))
 	http.HandleFunc("/result.json", convert)
+	http.HandleFunc("/convert", convertApi)
 	http.HandleFunc("/translation.json", translate)
+	http.HandleFunc("/version", versionInfo)
+	http.HandleFunc("/capabilities", capabilities)
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/readyz", readyz)
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	var handler http.Handler = http.DefaultServeMux
+	if auth := authFromEnv(); auth != nil {
+		handler = auth.withAuth(handler)
+	}
+	srv := &http.Server{Addr: ":" + port, Handler: withRequestLog(handler)}
+	done := make(chan struct{})
+	go func() {
+		// Graceful shutdown: stop accepting requests and wait for the pending ones.
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		atomic.StoreInt32(&shuttingDown, 1)
+		// Give the load balancer time to notice that we are not ready anymore.
+		time.Sleep(readinessDrain)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down server: %s", err)
+		}
+		close(done)
+	}()
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+const (
+	readinessDrain  = 5 * time.Second
+	shutdownTimeout = 30 * time.Second
+)
+
+var shuttingDown int32 // accessed atomically
+
+// healthz reports that the server is alive.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "ok\nformconv %s\n", formats.Version())
+}
+
+// readyz reports whether the server is ready to accept requests,
+// which is not the case when it is shutting down.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "shutting down")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func versionInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := formats.EncIndentedJson(w, map[string]interface{}{
+		"version":  formats.Version(),
+		"features": formats.Features(),
+	})
+	if err != nil {
+		log.Printf("Error writing json response: %s", err)
+	}
 }
 
 func setAllowOrigins(h http.Header) { h.Set("Access-Control-Allow-Origin", "*") }
@@ -45,32 +114,44 @@ func convert(w http.ResponseWriter, r *http.Request) {
 func convertPost(w http.ResponseWriter, r *http.Request) {
 	f, head, err := r.FormFile("excelFile")
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Error retrieving POST file: %s", err)
+		httpError(w, r, http.StatusBadRequest, "Error retrieving POST file: %s", err)
 		return
 	}
 	defer f.Close()
 
+	tag, err := etag(f, "convert", head.Filename, r.FormValue("wrapUngrouped"))
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "Error reading POST file: %s", err)
+		return
+	}
+	if checkNotModified(w, r, tag) {
+		return
+	}
 	wb, err := formats.NewWorkBook(f, filepath.Ext(head.Filename), head.Size)
 	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		fmt.Fprintf(w, "Error opening workbook: %s", err)
+		httpError(w, r, http.StatusUnprocessableEntity, "Error opening workbook: %s", err)
 		return
 	}
 	xls, err := formats.DecXlsform(wb)
 	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		fmt.Fprintf(w, "Error decoding xlsform: %s", err)
+		httpError(w, r, http.StatusUnprocessableEntity, "Error decoding xlsform: %s", err)
 		return
 	}
-	ajf, err := formats.Convert(xls)
+	opts := formats.ConvertOptions{WrapUngrouped: r.FormValue("wrapUngrouped") == "true", Strict: true}
+	ajf, warnings, err := formats.Convert(xls, opts)
 	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		fmt.Fprintln(w, err)
+		httpError(w, r, http.StatusUnprocessableEntity, "%s", err)
 		return
 	}
+	for _, warning := range warnings {
+		logJson(map[string]interface{}{
+			"event":     "warning",
+			"requestId": requestId(r),
+			"message":   warning.String(),
+		})
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	err = formats.EncIndentedJson(w, ajf)
+	err = formats.EncAjfToWriter(ajf, w, formats.EncodeOptions{})
 	if err != nil {
 		log.Printf("Error writing json response: %s", err)
 	}
@@ -95,19 +176,25 @@ func translate(w http.ResponseWriter, r *http.Request) {
 func translatePost(w http.ResponseWriter, r *http.Request) {
 	f, head, err := r.FormFile("excelFile")
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Error retrieving POST file: %s", err)
+		httpError(w, r, http.StatusBadRequest, "Error retrieving POST file: %s", err)
 		return
 	}
 	defer f.Close()
 
+	lang := r.FormValue("lang")
+	tag, err := etag(f, "translate", head.Filename, lang)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "Error reading POST file: %s", err)
+		return
+	}
+	if checkNotModified(w, r, tag) {
+		return
+	}
 	wb, err := formats.NewWorkBook(f, filepath.Ext(head.Filename), head.Size)
 	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		fmt.Fprintf(w, "Error opening excel workbook: %s", err)
+		httpError(w, r, http.StatusUnprocessableEntity, "Error opening excel workbook: %s", err)
 		return
 	}
-	lang := r.FormValue("lang")
 	survey := wb.Rows("survey")
 	choices := wb.Rows("choices")
 	surveyTr := formats.Translation(survey, lang)
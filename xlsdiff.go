@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gnucoop/formconv/formats"
+)
+
+// xlsdiff implements the "xlsdiff" command, which prints the differences
+// between two versions of an xlsform. Like diff, it exits with status 1
+// when the forms differ.
+func xlsdiff(args []string) error {
+	fs := flag.NewFlagSet("xlsdiff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `formconv xlsdiff compares the survey, choices and settings of two xlsforms,
+ignoring formatting and column order. Usage:
+formconv xlsdiff old.xlsx new.xlsx`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var forms [2]*formats.XlsForm
+	for i, xlsName := range fs.Args() {
+		wb, err := openWorkBook(xlsName)
+		if err != nil {
+			return fmt.Errorf("Error opening workbook: %s", err)
+		}
+		forms[i], err = formats.DecXlsform(wb)
+		if err != nil {
+			return fmt.Errorf("Error decoding file %s: %s", xlsName, err)
+		}
+	}
+	diffs := formats.DiffXlsForms(forms[0], forms[1])
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}